@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --------------------------
+//         Accounts
+// --------------------------
+
+// Account: somewhere a user's money lives. Its balance starts at
+// OpeningBalance, whose currency is the account's, and moves with the
+// charges posted to it (see ledgerChange); a credit card's balance goes
+// negative as it is spent on. Balance is filled in on responses.
+type Account struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	OpeningBalance Money  `json:"-"`
+	UserID         int    `json:"user_id"`
+	Balance        *Money `json:"-"`
+}
+
+// accountTypes are the kinds of account there are.
+var accountTypes = map[string]bool{"checking": true, "savings": true, "credit_card": true, "cash": true}
+
+// errInvalidAccount: a charge names an account it can't be posted to.
+var errInvalidAccount = errors.New("invalid account")
+
+func (a Account) MarshalJSON() ([]byte, error) {
+	type plain Account
+	out := struct {
+		plain
+		OpeningBalance json.Number  `json:"opening_balance"`
+		Currency       string       `json:"currency"`
+		Balance        *json.Number `json:"balance,omitempty"`
+	}{plain: plain(a), OpeningBalance: a.OpeningBalance.Number(), Currency: a.OpeningBalance.Currency}
+	if a.Balance != nil {
+		n := a.Balance.Number()
+		out.Balance = &n
+	}
+	return json.Marshal(out)
+}
+
+func (a *Account) UnmarshalJSON(data []byte) error {
+	type plain Account
+	aux := struct {
+		*plain
+		OpeningBalance json.Number `json:"opening_balance"`
+		Currency       string      `json:"currency"`
+	}{plain: (*plain)(a)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m, err := parseMoney(aux.OpeningBalance.String(), aux.Currency)
+	if err != nil {
+		return err
+	}
+	a.OpeningBalance = m
+	return nil
+}
+
+// validateAccount trims a's name and checks it and the account type.
+func validateAccount(a *Account) error {
+	a.Name = strings.TrimSpace(a.Name)
+	if a.Name == "" || len(a.Name) > 100 {
+		return fmt.Errorf("account name must be 1 to 100 characters")
+	}
+	a.Type = strings.ToLower(strings.TrimSpace(a.Type))
+	if !accountTypes[a.Type] {
+		return fmt.Errorf("invalid account type %q (want checking, savings, credit_card or cash)", a.Type)
+	}
+	return nil
+}
+
+// checkChargeAccount verifies that the account c is posted to, if any,
+// belongs to c's owner and is in c's currency. It locks the account so its
+// currency can't change underneath the charge.
+func checkChargeAccount(tx Store, c Charge) error {
+	if c.AccountID == nil {
+		return nil
+	}
+	a, err := tx.GetAccount(*c.AccountID)
+	if errors.Is(err, ErrNotFound) || (err == nil && a.UserID != c.UserID) {
+		return fmt.Errorf("%w: no account %d", errInvalidAccount, *c.AccountID)
+	}
+	if err != nil {
+		return err
+	}
+	if a.OpeningBalance.Currency != c.Amount.Currency {
+		return fmt.Errorf("%w: account %d is in %s, not %s", errInvalidAccount, a.ID, a.OpeningBalance.Currency, c.Amount.Currency)
+	}
+	return nil
+}
+
+// ledgerChange is how charge c moves the balance of its account: expenses
+// lower it, income and refunds raise it.
+func ledgerChange(c Charge) Money {
+	if c.Direction == DirectionIncome || c.Direction == DirectionRefund {
+		return c.Amount
+	}
+	return c.Amount.Neg()
+}
+
+// ledgerLine: a charge posted to an account and the balance after it.
+type ledgerLine struct {
+	Charge  Charge
+	Change  Money
+	Balance Money
+}
+
+// accountLedger returns the charges posted to a before to (all of them
+// when nil), oldest first, with the running balance after each, plus the
+// balance after the last.
+func accountLedger(store Store, a Account, to *time.Time) ([]ledgerLine, Money, error) {
+	charges, err := store.ListCharges(&ListFilter{OwnerID: a.UserID, AccountID: a.ID, To: to, Sort: "created_at", Order: "asc"})
+	if err != nil {
+		return nil, Money{}, err
+	}
+	balance := a.OpeningBalance
+	lines := make([]ledgerLine, 0, len(charges))
+	for _, c := range charges {
+		change := ledgerChange(c)
+		if balance, err = balance.Add(change); err != nil {
+			return nil, Money{}, fmt.Errorf("charge %d: %v", c.ID, err)
+		}
+		lines = append(lines, ledgerLine{Charge: c, Change: change, Balance: balance})
+	}
+	return lines, balance, nil
+}
+
+// withBalance fills in a's balance as of to (now, when nil).
+func withBalance(store Store, a Account, to *time.Time) (Account, error) {
+	_, balance, err := accountLedger(store, a, to)
+	if err != nil {
+		return a, err
+	}
+	a.Balance = &balance
+	return a, nil
+}
+
+// GET /api/accounts => the JWT user's accounts (or ?owner=<id>, read access)
+// with their current balances, by name
+func (s *Server) getAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	accounts, err := s.store.ListAccounts(ownerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying accounts: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for i := range accounts {
+		if accounts[i], err = withBalance(s.store, accounts[i], nil); err != nil {
+			http.Error(w, fmt.Sprintf("Error computing balance: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(accounts)
+}
+
+// ownedAccount looks up the account in the request path, reporting
+// ErrNotFound when it isn't ownerID's.
+func (s *Server) ownedAccount(store Store, r *http.Request, ownerID int) (Account, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return Account{}, ErrNotFound
+	}
+	a, err := store.GetAccount(id)
+	if err == nil && a.UserID != ownerID {
+		err = ErrNotFound
+	}
+	return a, err
+}
+
+// GET /api/accounts/{id} => one account of the JWT user (or ?owner=<id>,
+// read access) with its balance at the end of ?date=YYYY-MM-DD (default:
+// now)
+func (s *Server) getAccountHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var to *time.Time
+	if d := r.URL.Query().Get("date"); d != "" {
+		day, err := time.Parse("2006-01-02", d)
+		if err != nil {
+			http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		end := day.AddDate(0, 0, 1)
+		to = &end
+	}
+
+	a, err := s.ownedAccount(s.store, r, ownerID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Account not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		a, err = withBalance(s.store, a, to)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying account: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(a)
+}
+
+// POST /api/accounts => create an account for the JWT user (or ?owner=<id>,
+// write access). Body:
+// { "name": "Everyday", "type": "checking", "currency": "EUR", "opening_balance": 1200 }
+func (s *Server) createAccountHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var a Account
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validateAccount(&a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.ID = 0
+	a.UserID = ownerID
+	a.Balance = nil
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		if err := tx.CreateAccount(&a); err != nil {
+			return err
+		}
+		return audit.record(tx, AuditCreate, "account", a.ID, ownerID, nil, a)
+	})
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, "An account with that name already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating account: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	balance := a.OpeningBalance
+	a.Balance = &balance
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// PUT /api/accounts/{id} => rename an account of the JWT user (or
+// ?owner=<id>, write access), or change its type or opening balance. Its
+// currency can only change while no charges are posted to it.
+func (s *Server) updateAccountHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var a Account
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validateAccount(&a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.UserID = ownerID
+	a.Balance = nil
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, err := s.ownedAccount(tx, r, ownerID)
+		if err != nil {
+			return err
+		}
+		a.ID = before.ID
+		if a.OpeningBalance.Currency != before.OpeningBalance.Currency {
+			posted, err := tx.ListCharges(&ListFilter{OwnerID: ownerID, AccountID: a.ID, Limit: 1})
+			if err != nil {
+				return err
+			}
+			if len(posted) > 0 {
+				return fmt.Errorf("%w: account %d has charges", ErrConflict, a.ID)
+			}
+		}
+		if err := tx.UpdateAccount(a); err != nil {
+			return err
+		}
+		if err := audit.record(tx, AuditUpdate, "account", a.ID, ownerID, before, a); err != nil {
+			return err
+		}
+		a, err = withBalance(tx, a, nil)
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Account not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, "An account with that name already exists, or its currency can't change while it has charges", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating account: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(a)
+}
+
+// DELETE /api/accounts/{id} => delete an account of the JWT user (or
+// ?owner=<id>, write access) that no charges are posted to
+func (s *Server) deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, err := s.ownedAccount(tx, r, ownerID)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteAccount(ownerID, before.ID); err != nil {
+			return err
+		}
+		return audit.record(tx, AuditDelete, "account", before.ID, ownerID, before, nil)
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Account not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, "Move or delete the account's charges first", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting account: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Account deleted successfully", "owner_id": ownerID})
+}
+
+// LedgerEntry: one charge in an account's ledger. Amount is the signed
+// change to the balance and Balance the balance after it.
+type LedgerEntry struct {
+	ChargeID int         `json:"charge_id"`
+	Date     string      `json:"date"`
+	Name     string      `json:"name"`
+	Category string      `json:"category"`
+	Amount   json.Number `json:"amount"`
+	Balance  json.Number `json:"balance"`
+}
+
+// GET /api/accounts/{id}/ledger => the charges posted to an account of the
+// JWT user (or ?owner=<id>, read access), oldest first, each with the
+// balance after it. Optional ?from= and ?to= (YYYY-MM-DD or RFC 3339, to
+// exclusive) narrow the window; opening_balance is the balance at its
+// start.
+func (s *Server) accountLedgerHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var from, to *time.Time
+	for _, p := range []struct {
+		param string
+		dst   **time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := r.URL.Query().Get(p.param); v != "" {
+			t, err := parseDate(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s date %q", p.param, v), http.StatusBadRequest)
+				return
+			}
+			*p.dst = &t
+		}
+	}
+
+	a, err := s.ownedAccount(s.store, r, ownerID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Account not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	var lines []ledgerLine
+	var closing Money
+	if err == nil {
+		lines, closing, err = accountLedger(s.store, a, to)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying ledger: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	opening := a.OpeningBalance
+	entries := []LedgerEntry{}
+	for _, l := range lines {
+		if from != nil {
+			if t, err := parseDate(l.Charge.CreatedAt); err == nil && t.Before(*from) {
+				opening = l.Balance
+				continue
+			}
+		}
+		entries = append(entries, LedgerEntry{
+			ChargeID: l.Charge.ID,
+			Date:     l.Charge.CreatedAt,
+			Name:     l.Charge.Name,
+			Category: l.Charge.Category,
+			Amount:   l.Change.Number(),
+			Balance:  l.Balance.Number(),
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"account":         a,
+		"currency":        a.OpeningBalance.Currency,
+		"opening_balance": opening.Number(),
+		"closing_balance": closing.Number(),
+		"entries":         entries,
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidateAccount(t *testing.T) {
+	tests := []struct {
+		name, typ string
+		wantName  string
+		wantType  string
+		ok        bool
+	}{
+		{" Everyday ", "Checking", "Everyday", "checking", true},
+		{"Rainy day", " savings ", "Rainy day", "savings", true},
+		{"Visa", "CREDIT_CARD", "Visa", "credit_card", true},
+		{"Wallet", "cash", "Wallet", "cash", true},
+		{"Brokerage", "investment", "", "", false},
+		{"Wallet", "", "", "", false},
+		{"  ", "cash", "", "", false},
+		{strings.Repeat("x", 101), "cash", "", "", false},
+	}
+	for _, tc := range tests {
+		a := Account{Name: tc.name, Type: tc.typ}
+		err := validateAccount(&a)
+		if (err == nil) != tc.ok || (tc.ok && (a.Name != tc.wantName || a.Type != tc.wantType)) {
+			t.Fatalf("validateAccount(%q, %q) = %q, %q, %v", tc.name, tc.typ, a.Name, a.Type, err)
+		}
+	}
+}
+
+func TestLedgerChange(t *testing.T) {
+	tests := []struct {
+		direction string
+		want      string
+	}{
+		{DirectionExpense, "-12.50"},
+		{"", "-12.50"},
+		{DirectionIncome, "12.50"},
+		{DirectionRefund, "12.50"},
+	}
+	for _, tc := range tests {
+		c := Charge{Amount: mustMoney("12.50", "EUR"), Direction: tc.direction}
+		if got := ledgerChange(c); got.String() != tc.want || got.Currency != "EUR" {
+			t.Fatalf("ledgerChange of a %q charge = %s %s, want %s", tc.direction, got, got.Currency, tc.want)
+		}
+	}
+}
+
+func TestAccountJSON(t *testing.T) {
+	var a Account
+	if err := json.Unmarshal([]byte(`{"name":"Visa","type":"credit_card","opening_balance":-20.5,"currency":"eur"}`), &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.OpeningBalance != mustMoney("-20.50", "EUR") {
+		t.Fatalf("opening balance = %+v", a.OpeningBalance)
+	}
+	balance := mustMoney("-45", "EUR")
+	a.Balance = &balance
+	data, err := json.Marshal(a)
+	if err != nil || !strings.Contains(string(data), `"opening_balance":-20.50,"currency":"EUR","balance":-45.00`) {
+		t.Fatalf("marshal = %s, %v", data, err)
+	}
+	if err := json.Unmarshal([]byte(`{"name":"Cash","type":"cash","opening_balance":1.5,"currency":"JPY"}`), &a); err == nil {
+		t.Fatalf("an opening balance with too many decimals: want an error")
+	}
+}
+
+func TestAccountStore(t *testing.T) {
+	eachStore(t, testAccounts)
+}
+
+func TestAccountBalances(t *testing.T) {
+	eachStore(t, testAccountBalances)
+}
+
+// testAccountBalances posts charges to an account through the API and checks
+// its balance and ledger.
+func testAccountBalances(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	a := at.a
+
+	var account Account
+	body := map[string]interface{}{"name": "Everyday", "type": "checking", "opening_balance": 100, "currency": "USD"}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/accounts", body, &account); err != nil {
+		t.Fatal(err)
+	}
+	var other Account
+	body["name"] = "Elsewhere"
+	if err := at.b.expectStatus(http.StatusCreated, "POST", "/api/accounts", body, &other); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		charge  map[string]interface{}
+		status  int
+		balance string
+	}{
+		{"an expense", map[string]interface{}{"name": "Rent", "amount": 30, "account_id": account.ID}, http.StatusCreated, "70.00"},
+		{"income", map[string]interface{}{"name": "Salary", "amount": 50, "direction": "income", "account_id": account.ID}, http.StatusCreated, "120.00"},
+		{"a refund", map[string]interface{}{"name": "Returned shoes", "amount": 5, "direction": "refund", "account_id": account.ID}, http.StatusCreated, "125.00"},
+		{"no account", map[string]interface{}{"name": "Coffee", "amount": 3}, http.StatusCreated, "125.00"},
+		{"another currency", map[string]interface{}{"name": "Croissant", "amount": 3, "currency": "EUR", "account_id": account.ID}, http.StatusBadRequest, "125.00"},
+		{"another user's account", map[string]interface{}{"name": "Taxi", "amount": 9, "account_id": other.ID}, http.StatusBadRequest, "125.00"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := a.expectStatus(tc.status, "POST", "/api/charges", tc.charge, nil); err != nil {
+				t.Fatal(err)
+			}
+			var got struct {
+				Balance json.Number `json:"balance"`
+			}
+			if err := a.expectStatus(http.StatusOK, "GET", "/api/accounts/"+strconv.Itoa(account.ID), nil, &got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Balance) != tc.balance {
+				t.Fatalf("balance = %s, want %s", got.Balance, tc.balance)
+			}
+		})
+	}
+
+	var ledger struct {
+		Opening json.Number   `json:"opening_balance"`
+		Closing json.Number   `json:"closing_balance"`
+		Entries []LedgerEntry `json:"entries"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/accounts/"+strconv.Itoa(account.ID)+"/ledger", nil, &ledger); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, e := range ledger.Entries {
+		lines = append(lines, e.Name+" "+string(e.Amount)+" "+string(e.Balance))
+	}
+	if ledger.Opening != "100.00" || ledger.Closing != "125.00" ||
+		strings.Join(lines, ", ") != "Rent -30.00 70.00, Salary 50.00 120.00, Returned shoes 5.00 125.00" {
+		t.Fatalf("ledger = %s to %s: %s", ledger.Opening, ledger.Closing, strings.Join(lines, ", "))
+	}
+	if err := at.b.expectStatus(http.StatusNotFound, "GET", "/api/accounts/"+strconv.Itoa(account.ID)+"/ledger", nil, nil); err != nil {
+		t.Fatalf("another user's ledger: %v", err)
+	}
+	if err := a.expectStatus(http.StatusBadRequest, "GET", "/api/accounts/"+strconv.Itoa(account.ID)+"/ledger?from=soon", nil, nil); err != nil {
+		t.Fatalf("an invalid from date: %v", err)
+	}
+}
+
+func testAccounts(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	checking := Account{Name: "Checking", Type: "checking", OpeningBalance: mustMoney("100", "USD"), UserID: u.ID}
+	if err := s.CreateAccount(&checking); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	dup := Account{Name: "CHECKING", Type: "savings", OpeningBalance: mustMoney("0", "USD"), UserID: u.ID}
+	if err := s.CreateAccount(&dup); !errors.Is(err, ErrConflict) {
+		t.Fatalf("CreateAccount with a taken name = %v, want ErrConflict", err)
+	}
+	cash := Account{Name: "Cash", Type: "cash", OpeningBalance: mustMoney("20", "USD"), UserID: u.ID}
+	if err := s.CreateAccount(&cash); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	for _, c := range []Charge{
+		{Name: "Groceries", Amount: mustMoney("30", "USD"), AccountID: &checking.ID, CreatedAt: "2024-03-02T10:00:00Z"},
+		{Name: "Coffee", Amount: mustMoney("4.50", "USD"), AccountID: &cash.ID, CreatedAt: "2024-03-01T08:00:00Z"},
+		{Name: "Fuel", Amount: mustMoney("45.25", "USD"), AccountID: &checking.ID, CreatedAt: "2024-03-01T18:00:00Z"},
+		{Name: "Unposted", Amount: mustMoney("1", "USD")},
+	} {
+		c.UserID = u.ID
+		if err := s.CreateCharge(&c); err != nil {
+			t.Fatalf("CreateCharge: %v", err)
+		}
+	}
+	missing := 1 << 30
+	if err := s.CreateCharge(&Charge{Name: "Nowhere", Amount: mustMoney("1", "USD"), AccountID: &missing, UserID: u.ID}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("CreateCharge on a missing account = %v, want ErrNotFound", err)
+	}
+
+	lines, balance, err := accountLedger(s, checking, nil)
+	if err != nil {
+		t.Fatalf("accountLedger: %v", err)
+	}
+	if len(lines) != 2 || lines[0].Charge.Name != "Fuel" || lines[0].Balance.String() != "54.75" || balance.String() != "24.75" {
+		t.Fatalf("checking ledger = %+v ending at %s, want Fuel then Groceries ending at 24.75", lines, balance)
+	}
+
+	checking.Name, checking.OpeningBalance = "Everyday", mustMoney("150", "USD")
+	if err := s.UpdateAccount(checking); err != nil {
+		t.Fatalf("UpdateAccount: %v", err)
+	}
+	accounts, err := s.ListAccounts(u.ID)
+	if err != nil || len(accounts) != 2 || accounts[0].Name != "Cash" || accounts[1].OpeningBalance.String() != "150.00" {
+		t.Fatalf("ListAccounts = %+v, %v", accounts, err)
+	}
+
+	if err := s.DeleteAccount(u.ID, cash.ID); !errors.Is(err, ErrConflict) {
+		t.Fatalf("DeleteAccount with charges = %v, want ErrConflict", err)
+	}
+	charges, err := s.ListCharges(&ListFilter{OwnerID: u.ID, AccountID: cash.ID})
+	if err != nil || len(charges) != 1 {
+		t.Fatalf("ListCharges(account) = %d charge(s), %v", len(charges), err)
+	}
+	if err := s.DeleteCharge(u.ID, charges[0].ID); err != nil {
+		t.Fatalf("DeleteCharge: %v", err)
+	}
+	if err := s.DeleteAccount(u.ID, cash.ID); err != nil {
+		t.Fatalf("DeleteAccount: %v", err)
+	}
+}
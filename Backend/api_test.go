@@ -0,0 +1,1244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// --------------------------
+//      HTTP API Tests
+// --------------------------
+
+func TestAPI(t *testing.T) {
+	eachStore(t, testAPI)
+}
+
+// captureNotifier keeps the messages the API sends, for checks to read.
+type captureNotifier struct {
+	mu       sync.Mutex
+	messages map[string][]string // bodies by username
+}
+
+func (n *captureNotifier) Notify(u User, subject, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.messages == nil {
+		n.messages = map[string][]string{}
+	}
+	n.messages[u.Username] = append(n.messages[u.Username], body)
+	return nil
+}
+
+// await returns the nth message sent to username, waiting a while for it
+// since reset tokens are sent after the request is answered. It returns ""
+// if the message doesn't come.
+func (n *captureNotifier) await(username string, nth int) string {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		n.mu.Lock()
+		msgs := n.messages[username]
+		n.mu.Unlock()
+		if len(msgs) >= nth {
+			return msgs[nth-1]
+		}
+	}
+	return ""
+}
+
+// resetToken returns the token in the nth reset message sent to username.
+func (n *captureNotifier) resetToken(username string, nth int) (string, error) {
+	msg := n.await(username, nth)
+	parts := strings.Split(msg, "\n\n")
+	if len(parts) < 2 || parts[1] == "" {
+		return "", fmt.Errorf("no reset token in %q", msg)
+	}
+	return parts[1], nil
+}
+
+// apiClient calls a test server as one user.
+type apiClient struct {
+	base  string
+	token string
+}
+
+// call sends body as JSON and decodes the response into out, returning the
+// status code.
+func (c *apiClient) call(method, path string, body, out interface{}) (int, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, c.base+path, &buf)
+	if err != nil {
+		return 0, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// expectStatus calls the API and fails unless it answers with want.
+func (c *apiClient) expectStatus(want int, method, path string, body, out interface{}) error {
+	got, err := c.call(method, path, body, out)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%s %s: status %d, want %d", method, path, got, want)
+	}
+	return nil
+}
+
+func (c *apiClient) login(username, password string) (string, error) {
+	var resp struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	creds := map[string]string{"username": username, "password": password}
+	if err := c.expectStatus(http.StatusOK, "POST", "/api/login", creds, &resp); err != nil {
+		return "", err
+	}
+	c.token = resp.Token
+	return resp.RefreshToken, nil
+}
+
+var (
+	testPasswordOnce sync.Once
+	testPasswordHash string
+)
+
+// apiTest: a test server on a store, with the users alice and bob logged in
+// on a and b. Its users are deleted and the server closed when the test ends.
+type apiTest struct {
+	t          *testing.T
+	s          Store
+	url        string
+	notes      *captureNotifier
+	alice, bob User
+	a, b       *apiClient
+}
+
+// newAPITest starts a test server on s and logs alice and bob in.
+func newAPITest(t *testing.T, s Store) *apiTest {
+	t.Helper()
+	srv := NewServer(s)
+	at := &apiTest{t: t, s: s, notes: &captureNotifier{}}
+	srv.notifier = at.notes
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+	at.url = ts.URL
+	at.alice, at.a = at.user(RoleUser)
+	at.bob, at.b = at.user(RoleUser)
+	return at
+}
+
+// user creates a user with role, whose password is "pw", and logs them in
+// on the returned client.
+func (at *apiTest) user(role string) (User, *apiClient) {
+	at.t.Helper()
+	testPasswordOnce.Do(func() {
+		testPasswordHash, _ = hashPassword("pw")
+	})
+	u, cleanup := testUser(at.t, at.s, testPasswordHash)
+	at.t.Cleanup(cleanup)
+	if role != u.Permissions {
+		u.Permissions = role
+		if err := at.s.UpdateUser(u); err != nil {
+			at.t.Fatal(err)
+		}
+	}
+	c := at.client()
+	if _, err := c.login(u.Username, "pw"); err != nil {
+		at.t.Fatal(err)
+	}
+	return u, c
+}
+
+// client returns a client that isn't logged in.
+func (at *apiTest) client() *apiClient {
+	return &apiClient{base: at.url}
+}
+
+// testAPI drives the HTTP handlers end to end on top of s.
+func testAPI(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	hash := testPasswordHash
+	alice, bob, a, b := at.alice, at.bob, at.a, at.b
+	if err := at.client().expectStatus(http.StatusUnauthorized, "POST", "/api/login",
+		map[string]string{"username": alice.Username, "password": "wrong"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	budget := map[string]interface{}{"name": "Food", "amount": 100, "currency": "USD", "category": "Food", "period": "monthly"}
+	var created Budget
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/budgets", budget, &created); err != nil {
+		t.Fatal(err)
+	}
+	for _, amount := range []string{"12.50", "7.25"} {
+		charge := map[string]interface{}{"name": "Lunch", "amount": json.Number(amount), "category": "food"}
+		if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", charge, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var page struct {
+		Items      []Charge `json:"items"`
+		NextCursor string   `json:"next_cursor"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/charges?limit=1", nil, &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.NextCursor == "" {
+		t.Fatalf("first page: %d item(s), cursor %q", len(page.Items), page.NextCursor)
+	}
+	cursor := page.NextCursor
+	page.Items, page.NextCursor = nil, ""
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/charges?limit=1&cursor="+cursor, nil, &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.NextCursor != "" {
+		t.Fatalf("last page: %d item(s), cursor %q", len(page.Items), page.NextCursor)
+	}
+
+	// "food" files under the budget's Food category, and a subcategory rolls up
+	groceries := map[string]interface{}{"name": "Market", "amount": 5, "category": "Food/Groceries", "tags": []string{"Weekly"}}
+	var market Charge
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", groceries, &market); err != nil {
+		t.Fatal(err)
+	}
+	var categories []Category
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/categories", nil, &categories); err != nil {
+		t.Fatal(err)
+	}
+	if len(categories) != 2 || categories[1].Path != "Food > Groceries" {
+		t.Fatalf("categories = %+v, want Food and Food > Groceries", categories)
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/charges?category=FOOD", nil, &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 3 {
+		t.Fatalf("charges in Food: %d, want 3", len(page.Items))
+	}
+
+	var totals struct {
+		Categories []struct {
+			Path     string                 `json:"path"`
+			Total    map[string]json.Number `json:"total"`
+			RolledUp map[string]json.Number `json:"rolled_up"`
+		} `json:"categories"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/reports/categories", nil, &totals); err != nil {
+		t.Fatal(err)
+	}
+	if len(totals.Categories) != 2 || totals.Categories[0].Total["USD"] != "19.75" || totals.Categories[0].RolledUp["USD"] != "24.75" {
+		t.Fatalf("category totals = %+v", totals.Categories)
+	}
+
+	// Tag one charge, bulk-tag everything in Food, then query and report by tag
+	if err := a.expectStatus(http.StatusOK, "POST", "/api/charges/"+strconv.Itoa(market.ID)+"/tags",
+		map[string][]string{"tags": {"reimbursable"}}, &market); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(market.Tags, ",") != "reimbursable,weekly" {
+		t.Fatalf("tagged charge has tags %q", market.Tags)
+	}
+	var bulk struct {
+		Matched int `json:"matched"`
+		Changed int `json:"changed"`
+	}
+	if err := a.expectStatus(http.StatusOK, "POST", "/api/charges/tags?category=food",
+		map[string][]string{"add": {"reimbursable"}}, &bulk); err != nil {
+		t.Fatal(err)
+	}
+	if bulk.Matched != 3 || bulk.Changed != 2 {
+		t.Fatalf("bulk tag matched %d and changed %d, want 3 and 2", bulk.Matched, bulk.Changed)
+	}
+	if err := a.expectStatus(http.StatusOK, "DELETE", "/api/charges/"+strconv.Itoa(market.ID)+"/tags/reimbursable", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for query, want := range map[string]int{"tag=reimbursable,weekly": 0, "tag=reimbursable,weekly&tag_mode=any": 3} {
+		if err := a.expectStatus(http.StatusOK, "GET", "/api/charges?"+query, nil, &page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Items) != want {
+			t.Fatalf("charges with %s: %d, want %d", query, len(page.Items), want)
+		}
+	}
+	if err := a.expectStatus(http.StatusBadRequest, "GET", "/api/budgets?tag=weekly", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var tagTotals struct {
+		Tags []struct {
+			Tag   string                 `json:"tag"`
+			Total map[string]json.Number `json:"total"`
+		} `json:"tags"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/reports/tags", nil, &tagTotals); err != nil {
+		t.Fatal(err)
+	}
+	if len(tagTotals.Tags) != 2 || tagTotals.Tags[0].Tag != "reimbursable" || tagTotals.Tags[0].Total["USD"] != "19.75" {
+		t.Fatalf("tag totals = %+v", tagTotals.Tags)
+	}
+
+	// Charges posted to an account show up in its ledger with running balances
+	var account Account
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/accounts",
+		map[string]interface{}{"name": "Wallet", "type": "cash", "currency": "USD", "opening_balance": 50}, &account); err != nil {
+		t.Fatal(err)
+	}
+	for _, amount := range []string{"10", "2.5"} {
+		charge := map[string]interface{}{"name": "Snack", "amount": json.Number(amount), "account_id": account.ID}
+		if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", charge, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	euros := map[string]interface{}{"name": "Croissant", "amount": 3, "currency": "EUR", "account_id": account.ID}
+	if err := a.expectStatus(http.StatusBadRequest, "POST", "/api/charges", euros, nil); err != nil {
+		t.Fatalf("charge in another currency than its account: %v", err)
+	}
+	if err := b.expectStatus(http.StatusNotFound, "GET", "/api/accounts/"+strconv.Itoa(account.ID)+"/ledger", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var ledger struct {
+		Entries []LedgerEntry `json:"entries"`
+		Closing json.Number   `json:"closing_balance"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/accounts/"+strconv.Itoa(account.ID)+"/ledger", nil, &ledger); err != nil {
+		t.Fatal(err)
+	}
+	if len(ledger.Entries) != 2 || ledger.Entries[0].Balance != "40.00" || ledger.Closing != "37.50" {
+		t.Fatalf("ledger = %+v", ledger)
+	}
+	if err := a.expectStatus(http.StatusConflict, "DELETE", "/api/accounts/"+strconv.Itoa(account.ID), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Income and refunds count towards cash flow, not spending
+	negative := map[string]interface{}{"name": "Refund?", "amount": -5}
+	if err := a.expectStatus(http.StatusBadRequest, "POST", "/api/charges", negative, nil); err != nil {
+		t.Fatalf("negative amount: %v", err)
+	}
+	huge := map[string]interface{}{"name": "Everything", "amount": "1000000000000000"}
+	if err := a.expectStatus(http.StatusBadRequest, "POST", "/api/charges", huge, nil); err != nil {
+		t.Fatalf("amount past what the column holds: %v", err)
+	}
+	for _, c := range []map[string]interface{}{
+		{"name": "Salary", "amount": 1000, "direction": "income"},
+		{"name": "Snack refund", "amount": 2.5, "direction": "refund", "account_id": account.ID},
+	} {
+		if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", c, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var cashflow struct {
+		Periods []struct {
+			Income map[string]json.Number `json:"income"`
+		} `json:"periods"`
+		Total struct {
+			Expenses map[string]json.Number `json:"expenses"`
+			Net      map[string]json.Number `json:"net"`
+		} `json:"total"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/reports/cashflow", nil, &cashflow); err != nil {
+		t.Fatal(err)
+	}
+	month := int(time.Now().UTC().Month()) - 1
+	if len(cashflow.Periods) != 12 || cashflow.Periods[month].Income["USD"] != "1000.00" ||
+		cashflow.Total.Expenses["USD"] != "37.25" || cashflow.Total.Net["USD"] != "965.25" {
+		t.Fatalf("cash flow = %+v", cashflow)
+	}
+	var report []BudgetReportLine
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/reports/budget-vs-actual", nil, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 1 || report[0].Spent != "24.75" {
+		t.Fatalf("budget-vs-actual after income = %+v, want 24.75 spent", report)
+	}
+
+	// Transfers move balances without counting as spending or income
+	var savings Account
+	savingsBody := map[string]interface{}{"name": "Savings", "type": "savings", "currency": "USD", "opening_balance": 0}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/accounts", savingsBody, &savings); err != nil {
+		t.Fatal(err)
+	}
+	balanceOf := func(id int) (string, error) {
+		var out struct {
+			Balance json.Number `json:"balance"`
+		}
+		err := a.expectStatus(http.StatusOK, "GET", "/api/accounts/"+strconv.Itoa(id), nil, &out)
+		return out.Balance.String(), err
+	}
+	var transfer Transfer
+	move := map[string]interface{}{"from_account_id": account.ID, "to_account_id": savings.ID, "amount": 40, "currency": "USD"}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/transfers", move, &transfer); err != nil {
+		t.Fatal(err)
+	}
+	if balance, err := balanceOf(savings.ID); err != nil || balance != "40.00" {
+		t.Fatalf("savings balance after transfer = %s, %v; want 40.00", balance, err)
+	}
+	leg := "/api/charges/" + strconv.Itoa(transfer.FromChargeID)
+	if err := a.expectStatus(http.StatusConflict, "DELETE", leg, nil, nil); err != nil {
+		t.Fatalf("deleting a transfer leg: %v", err)
+	}
+	move["amount"] = 50
+	if err := a.expectStatus(http.StatusOK, "PUT", "/api/transfers/"+strconv.Itoa(transfer.ID), move, nil); err != nil {
+		t.Fatal(err)
+	}
+	if balance, err := balanceOf(savings.ID); err != nil || balance != "50.00" {
+		t.Fatalf("savings balance after editing the transfer = %s, %v; want 50.00", balance, err)
+	}
+	var linked []Charge
+	for _, c := range []map[string]interface{}{
+		{"name": "Card payment", "amount": 20, "account_id": account.ID},
+		{"name": "Payment received", "amount": 20, "direction": "refund", "account_id": savings.ID},
+	} {
+		var created Charge
+		if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", c, &created); err != nil {
+			t.Fatal(err)
+		}
+		linked = append(linked, created)
+	}
+	link := map[string]interface{}{"from_charge_id": linked[0].ID, "to_charge_id": linked[1].ID}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/transfers/link", link, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.expectStatus(http.StatusConflict, "POST", "/api/transfers/link", link, nil); err != nil {
+		t.Fatalf("linking twice: %v", err)
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/reports/cashflow", nil, &cashflow); err != nil {
+		t.Fatal(err)
+	}
+	if cashflow.Total.Expenses["USD"] != "37.25" || cashflow.Total.Net["USD"] != "965.25" {
+		t.Fatalf("cash flow with transfers = %+v", cashflow.Total)
+	}
+	if err := a.expectStatus(http.StatusOK, "DELETE", "/api/transfers/"+strconv.Itoa(transfer.ID), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var transfers []Transfer
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/transfers", nil, &transfers); err != nil {
+		t.Fatal(err)
+	}
+	if len(transfers) != 1 || transfers[0].Name != "Card payment" || transfers[0].Amount.String() != "20.00" {
+		t.Fatalf("transfers after deleting one = %+v", transfers)
+	}
+	if balance, err := balanceOf(savings.ID); err != nil || balance != "20.00" {
+		t.Fatalf("savings balance after deleting the transfer = %s, %v; want 20.00", balance, err)
+	}
+
+	// Split charges count each line towards its own category
+	bad := map[string]interface{}{"name": "Supermarket", "amount": 30, "splits": []map[string]interface{}{
+		{"amount": 20, "category": "Food"}, {"amount": 5, "category": "Household"}}}
+	if err := a.expectStatus(http.StatusBadRequest, "POST", "/api/charges", bad, nil); err != nil {
+		t.Fatalf("splits not adding up: %v", err)
+	}
+	var split Charge
+	bad["amount"] = 25
+	bad["category"] = "Food"
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", bad, &split); err != nil {
+		t.Fatal(err)
+	}
+	if split.CategoryID != nil || len(split.Splits) != 2 || split.Splits[1].CategoryID == nil {
+		t.Fatalf("split charge = %+v", split)
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/reports/budget-vs-actual", nil, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 1 || report[0].Spent != "44.75" {
+		t.Fatalf("budget-vs-actual with a split = %+v, want 44.75 spent", report)
+	}
+	splitPath := "/api/charges/" + strconv.Itoa(split.ID)
+	resized := map[string]interface{}{"name": "Supermarket", "amount": 40}
+	if err := a.expectStatus(http.StatusBadRequest, "PUT", splitPath, resized, nil); err != nil {
+		t.Fatalf("resizing a split charge without its lines: %v", err)
+	}
+	resized["splits"] = []map[string]interface{}{{"amount": 10, "category": "Food"}, {"amount": 30, "category": "Household"}}
+	if err := a.expectStatus(http.StatusOK, "PUT", splitPath, resized, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/reports/budget-vs-actual", nil, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 1 || report[0].Spent != "34.75" {
+		t.Fatalf("budget-vs-actual after editing the split = %+v, want 34.75 spent", report)
+	}
+
+	owner := "?owner=" + strconv.Itoa(alice.ID)
+	if err := b.expectStatus(http.StatusForbidden, "GET", "/api/budgets"+owner, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	share := map[string]string{"shareUsername": bob.Username, "access": "read"}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/shares", share, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.expectStatus(http.StatusOK, "GET", "/api/budgets"+owner, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.expectStatus(http.StatusForbidden, "POST", "/api/budgets"+owner, budget, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice's changes are in her audit log, and visible to bob through the share
+	budgetPath := "/api/budgets/" + strconv.Itoa(created.ID)
+	if err := a.expectStatus(http.StatusOK, "PUT", budgetPath, map[string]interface{}{"name": "Food", "amount": 120}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var audit struct {
+		Items []AuditEvent `json:"items"`
+	}
+	auditPath := "/api/audit?entity_type=budget&entity_id=" + strconv.Itoa(created.ID)
+	if err := b.expectStatus(http.StatusOK, "GET", auditPath+"&owner="+strconv.Itoa(alice.ID), nil, &audit); err != nil {
+		t.Fatal(err)
+	}
+	if len(audit.Items) != 2 || audit.Items[0].Action != AuditUpdate || audit.Items[0].ActorID == nil || *audit.Items[0].ActorID != alice.ID {
+		t.Fatalf("budget audit trail = %+v", audit.Items)
+	}
+	if err := b.expectStatus(http.StatusOK, "GET", auditPath, nil, &audit); err != nil {
+		t.Fatal(err)
+	}
+	if len(audit.Items) != 0 {
+		t.Fatalf("bob's own audit log shows %d of alice's events", len(audit.Items))
+	}
+
+	// Rollover: the current period shows what is available, and closed
+	// periods are snapshotted (none yet for a budget created this month)
+	if err := a.expectStatus(http.StatusBadRequest, "PUT", budgetPath, map[string]interface{}{"name": "Food", "amount": 120, "rollover": "sometimes"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	rollover := map[string]interface{}{"name": "Food", "amount": 120, "category": "Food", "period": "monthly", "rollover": "Both", "rollover_cap": 40}
+	if err := a.expectStatus(http.StatusOK, "PUT", budgetPath, rollover, nil); err != nil {
+		t.Fatal(err)
+	}
+	var budgets struct {
+		Items []struct {
+			ID          int         `json:"id"`
+			Rollover    string      `json:"rollover"`
+			RolloverCap json.Number `json:"rollover_cap"`
+			CarriedIn   json.Number `json:"carried_in"`
+			Available   json.Number `json:"available"`
+		} `json:"items"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/budgets", nil, &budgets); err != nil {
+		t.Fatal(err)
+	}
+	if len(budgets.Items) != 1 || budgets.Items[0].Rollover != RolloverBoth || budgets.Items[0].RolloverCap != "40.00" ||
+		budgets.Items[0].CarriedIn != "0.00" || budgets.Items[0].Available != "85.25" {
+		t.Fatalf("budgets with rollover = %+v, want 85.25 available", budgets.Items)
+	}
+	var snapshots []BudgetSnapshot
+	if err := b.expectStatus(http.StatusOK, "GET", budgetPath+"/snapshots"+owner, nil, &snapshots); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 0 {
+		t.Fatalf("snapshots of a budget created this period = %+v", snapshots)
+	}
+	if err := a.expectStatus(http.StatusBadRequest, "POST", budgetPath+"/snapshots/recompute?from=March", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.expectStatus(http.StatusOK, "POST", budgetPath+"/snapshots/recompute", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice and bob share expenses through the share, then settle up
+	dinner := map[string]interface{}{"name": "Dinner", "amount": 30.01, "currency": "EUR", "share_mode": "percent",
+		"participants": []map[string]interface{}{{"user_id": alice.ID, "percent": 60}, {"user_id": bob.ID, "percent": 30}}}
+	if err := a.expectStatus(http.StatusBadRequest, "POST", "/api/charges", dinner, nil); err != nil {
+		t.Fatalf("percents not adding up to 100: %v", err)
+	}
+	dinner["share_mode"] = "equal"
+	var shared struct {
+		Participants []struct {
+			UserID int         `json:"user_id"`
+			Amount json.Number `json:"amount"`
+		} `json:"participants"`
+	}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", dinner, &shared); err != nil {
+		t.Fatal(err)
+	}
+	if len(shared.Participants) != 2 || shared.Participants[0].Amount != "15.01" || shared.Participants[1].Amount != "15.00" {
+		t.Fatalf("dinner participants = %+v, want 15.01 and 15.00", shared.Participants)
+	}
+	taxi := map[string]interface{}{"name": "Taxi", "amount": 10, "currency": "EUR", "share_mode": "exact",
+		"participants": []map[string]interface{}{{"user_id": alice.ID, "amount": 10}}}
+	if err := b.expectStatus(http.StatusCreated, "POST", "/api/charges", taxi, nil); err != nil {
+		t.Fatal(err)
+	}
+	var balances []struct {
+		UserID  int                    `json:"user_id"`
+		Balance map[string]json.Number `json:"balance"`
+	}
+	if err := b.expectStatus(http.StatusOK, "GET", "/api/balances", nil, &balances); err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 1 || balances[0].UserID != alice.ID || balances[0].Balance["EUR"] != "-5.00" {
+		t.Fatalf("bob's balances = %+v, want -5.00 EUR with alice", balances)
+	}
+	var plan struct {
+		Payments []struct {
+			FromUserID int         `json:"from_user_id"`
+			ToUserID   int         `json:"to_user_id"`
+			Amount     json.Number `json:"amount"`
+		} `json:"payments"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/balances/settle-up", nil, &plan); err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Payments) != 1 || plan.Payments[0].FromUserID != bob.ID || plan.Payments[0].ToUserID != alice.ID || plan.Payments[0].Amount != "5.00" {
+		t.Fatalf("settle-up plan = %+v, want bob paying alice 5.00", plan.Payments)
+	}
+	var settled Settlement
+	payAlice := map[string]interface{}{"to_user_id": alice.ID, "currency": "EUR"}
+	if err := b.expectStatus(http.StatusCreated, "POST", "/api/settlements", payAlice, &settled); err != nil {
+		t.Fatal(err)
+	}
+	if settled.Amount.String() != "5.00" {
+		t.Fatalf("settlement = %+v, want 5.00", settled)
+	}
+	if err := b.expectStatus(http.StatusOK, "GET", "/api/balances", nil, &balances); err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 1 || balances[0].Balance["EUR"] != "0.00" {
+		t.Fatalf("bob's balances after settling = %+v, want 0.00", balances)
+	}
+	if err := b.expectStatus(http.StatusBadRequest, "POST", "/api/settlements", payAlice, nil); err != nil {
+		t.Fatalf("settling with nothing owed: %v", err)
+	}
+	settlementPath := "/api/settlements/" + strconv.Itoa(settled.ID)
+	if err := a.expectStatus(http.StatusNotFound, "DELETE", settlementPath, nil, nil); err != nil {
+		t.Fatalf("deleting a settlement paid to alice: %v", err)
+	}
+	if err := b.expectStatus(http.StatusOK, "DELETE", settlementPath, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A joint savings goal: bob contributes through a write share
+	var goal Goal
+	car := map[string]interface{}{"name": "Car", "amount": 1200, "currency": "EUR", "target_date": "2026-07-01"}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/goals", car, &goal); err != nil {
+		t.Fatal(err)
+	}
+	contributionsPath := "/api/goals/" + strconv.Itoa(goal.ID) + "/contributions"
+	saved := map[string]interface{}{"amount": 300, "created_at": "2025-07-01"}
+	if err := a.expectStatus(http.StatusCreated, "POST", contributionsPath, saved, nil); err != nil {
+		t.Fatal(err)
+	}
+	joint := map[string]interface{}{"amount": 600, "created_at": "2025-12-15", "note": "Half of it"}
+	if err := b.expectStatus(http.StatusForbidden, "POST", contributionsPath+owner, joint, nil); err != nil {
+		t.Fatalf("contributing through a read share: %v", err)
+	}
+	share["access"] = "write"
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/shares", share, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.expectStatus(http.StatusCreated, "POST", contributionsPath+owner, joint, nil); err != nil {
+		t.Fatal(err)
+	}
+	var progress struct {
+		Progress struct {
+			Saved           json.Number `json:"saved"`
+			MonthsLeft      int         `json:"months_left"`
+			RequiredMonthly json.Number `json:"required_monthly"`
+			OnTrack         bool        `json:"on_track"`
+			Contributors    []struct {
+				UserID int         `json:"user_id"`
+				Amount json.Number `json:"amount"`
+			} `json:"contributors"`
+		} `json:"progress"`
+	}
+	goalPath := "/api/goals/" + strconv.Itoa(goal.ID)
+	if err := b.expectStatus(http.StatusOK, "GET", goalPath+owner+"&date=2026-01-01", nil, &progress); err != nil {
+		t.Fatal(err)
+	}
+	p := progress.Progress
+	if p.Saved != "900.00" || p.MonthsLeft != 6 || p.RequiredMonthly != "50.00" || !p.OnTrack ||
+		len(p.Contributors) != 2 || p.Contributors[1].UserID != bob.ID || p.Contributors[1].Amount != "600.00" {
+		t.Fatalf("goal progress = %+v", p)
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", goalPath+"?date=2025-12-01", nil, &progress); err != nil {
+		t.Fatal(err)
+	}
+	if p := progress.Progress; p.Saved != "300.00" || p.OnTrack {
+		t.Fatalf("goal progress before bob's contribution = %+v, want 300.00 saved and behind", p)
+	}
+
+	// Envelopes: income in the mode's currency is handed out, never more
+	if err := a.expectStatus(http.StatusConflict, "GET", "/api/envelopes", nil, nil); err != nil {
+		t.Fatalf("envelopes before turning the mode on: %v", err)
+	}
+	if err := a.expectStatus(http.StatusCreated, "PUT", "/api/envelopes/mode", map[string]string{"currency": "gbp"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	salary := map[string]interface{}{"name": "Salary", "amount": 1000, "currency": "GBP", "direction": "income"}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", salary, nil); err != nil {
+		t.Fatal(err)
+	}
+	var rent, fun Envelope
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/envelopes", map[string]string{"name": "Rent", "category": "Housing"}, &rent); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.expectStatus(http.StatusCreated, "POST", "/api/envelopes"+owner, map[string]string{"name": "Fun", "category": "Fun"}, &fun); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.expectStatus(http.StatusConflict, "POST", "/api/envelopes", map[string]string{"name": "Flat", "category": "housing"}, nil); err != nil {
+		t.Fatalf("a second envelope on a category: %v", err)
+	}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/envelopes/moves", map[string]interface{}{"to_envelope_id": rent.ID, "amount": 600}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.expectStatus(http.StatusConflict, "POST", "/api/envelopes/moves", map[string]interface{}{"to_envelope_id": fun.ID, "amount": 400.01}, nil); err != nil {
+		t.Fatalf("assigning more than is left to assign: %v", err)
+	}
+	if err := a.expectStatus(http.StatusConflict, "POST", "/api/envelopes/moves", map[string]interface{}{"from_envelope_id": rent.ID, "to_envelope_id": fun.ID, "amount": 601}, nil); err != nil {
+		t.Fatalf("moving more than an envelope holds: %v", err)
+	}
+	if err := b.expectStatus(http.StatusCreated, "POST", "/api/envelopes/moves"+owner, map[string]interface{}{"from_envelope_id": rent.ID, "to_envelope_id": fun.ID, "amount": 50}, nil); err != nil {
+		t.Fatal(err)
+	}
+	rentCharge := map[string]interface{}{"name": "Rent", "amount": 520, "currency": "GBP", "category": "Housing"}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", rentCharge, nil); err != nil {
+		t.Fatal(err)
+	}
+	var envelopes struct {
+		Income       json.Number `json:"income"`
+		ToBeAssigned json.Number `json:"to_be_assigned"`
+		Envelopes    []struct {
+			Name      string      `json:"name"`
+			Category  string      `json:"category"`
+			Spent     json.Number `json:"spent"`
+			Available json.Number `json:"available"`
+		} `json:"envelopes"`
+	}
+	if err := b.expectStatus(http.StatusOK, "GET", "/api/envelopes"+owner, nil, &envelopes); err != nil {
+		t.Fatal(err)
+	}
+	if envelopes.Income != "1000.00" || envelopes.ToBeAssigned != "400.00" || len(envelopes.Envelopes) != 2 ||
+		envelopes.Envelopes[0].Category != "Housing" || envelopes.Envelopes[0].Spent != "520.00" || envelopes.Envelopes[0].Available != "30.00" ||
+		envelopes.Envelopes[1].Available != "50.00" {
+		t.Fatalf("envelopes this month = %+v", envelopes)
+	}
+	var moves []struct {
+		ActorID *int `json:"actor_id"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/envelopes/moves", nil, &moves); err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != 2 || moves[1].ActorID == nil || *moves[1].ActorID != bob.ID {
+		t.Fatalf("envelope moves = %+v, want alice's then bob's", moves)
+	}
+
+	// Roles: users:* and audit:read are for admins, auditors and support
+	staff := map[string]*apiClient{}
+	for _, role := range []string{RoleAdmin, RoleAuditor, RoleSupport} {
+		u, cleanupStaff := testUser(t, s, hash)
+		defer cleanupStaff()
+		u.Permissions = role
+		if err := s.UpdateUser(u); err != nil {
+			t.Fatal(err)
+		}
+		staff[role] = at.client()
+		if _, err := staff[role].login(u.Username, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.expectStatus(http.StatusForbidden, "GET", "/api/users", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var roleList []Role
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/roles", nil, &roleList); err != nil {
+		t.Fatal(err)
+	}
+	if len(roleList) != len(roles) || roleList[0].Name != RoleAdmin || len(roleList[0].Permissions) == 0 {
+		t.Fatalf("roles = %+v", roleList)
+	}
+	newUser := map[string]string{"username": fmt.Sprintf("check-support-%d", time.Now().UnixNano()), "password": "check-pw1", "permissions": "superuser"}
+	if err := staff[RoleAdmin].expectStatus(http.StatusBadRequest, "POST", "/api/users", newUser, nil); err != nil {
+		t.Fatalf("creating a user with an unknown role: %v", err)
+	}
+	newUser["permissions"] = "Support"
+	var supportUser User
+	if err := staff[RoleAdmin].expectStatus(http.StatusCreated, "POST", "/api/users", newUser, &supportUser); err != nil {
+		t.Fatal(err)
+	}
+	userPath := "/api/users/" + strconv.Itoa(supportUser.ID)
+	if err := staff[RoleAdmin].expectStatus(http.StatusOK, "PUT", userPath, map[string]string{"username": newUser["username"], "password": "check-pw2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetUser(supportUser.ID); err != nil || got.Permissions != RoleSupport {
+		t.Fatalf("user updated without a role = %+v, %v; want it kept as support", got, err)
+	}
+	if err := staff[RoleSupport].expectStatus(http.StatusOK, "GET", "/api/users", nil, nil); err != nil {
+		t.Fatalf("support listing users: %v", err)
+	}
+	if err := staff[RoleSupport].expectStatus(http.StatusForbidden, "DELETE", userPath, nil, nil); err != nil {
+		t.Fatalf("support deleting a user: %v", err)
+	}
+	if err := staff[RoleSupport].expectStatus(http.StatusForbidden, "POST", "/api/budgets", budget, nil); err != nil {
+		t.Fatalf("read-only support creating a budget: %v", err)
+	}
+	if err := staff[RoleAuditor].expectStatus(http.StatusOK, "GET", auditPath, nil, &audit); err != nil {
+		t.Fatal(err)
+	}
+	if len(audit.Items) == 0 {
+		t.Fatalf("the auditor doesn't see alice's budget events")
+	}
+	if err := staff[RoleAdmin].expectStatus(http.StatusOK, "DELETE", userPath, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Login throttling. The suite logs in from loopback throughout, so earlier
+	// runs' failures are forgotten first.
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		if err := s.ClearLoginThrottle(ipLoginKey(ip)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	victim, cleanupVictim := testUser(t, s, hash)
+	defer cleanupVictim()
+	nobody := "nobody-" + victim.Username
+	defer s.ClearLoginThrottle(userLoginKey(nobody))
+	defer s.ClearLoginThrottle(ipLoginKey("192.0.2.1"))
+	var failures []string
+	for _, username := range []string{nobody, victim.Username} {
+		creds, _ := json.Marshal(map[string]string{"username": username, "password": "wrong"})
+		resp, err := http.Post(at.url+"/api/login", "application/json", bytes.NewReader(creds))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("login as %s with a wrong password: status %d, want 401", username, resp.StatusCode)
+		}
+		failures = append(failures, string(msg))
+	}
+	if failures[0] != failures[1] {
+		t.Fatalf("unknown username answered %q, wrong password %q; want the same", failures[0], failures[1])
+	}
+	wrong := map[string]string{"username": victim.Username, "password": "wrong"}
+	for i := 1; i < userLoginLimit.BackoffAfter; i++ {
+		if err := (at.client()).expectStatus(http.StatusUnauthorized, "POST", "/api/login", wrong, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (at.client()).expectStatus(http.StatusTooManyRequests, "POST", "/api/login", wrong, nil); err != nil {
+		t.Fatalf("login right after %d failures: %v", userLoginLimit.BackoffAfter, err)
+	}
+	lockoutPath := "/api/users/" + strconv.Itoa(victim.ID) + "/lockout"
+	var lockout Lockout
+	if err := staff[RoleSupport].expectStatus(http.StatusOK, "GET", lockoutPath, nil, &lockout); err != nil {
+		t.Fatal(err)
+	}
+	if lockout.Failures != userLoginLimit.BackoffAfter || lockout.Locked || lockout.RetryAt == nil {
+		t.Fatalf("lockout while backing off = %+v", lockout)
+	}
+	// The rest of the failures come from elsewhere, so there's no waiting
+	for lockout.Failures < userLoginLimit.LockoutAt {
+		if err := recordLoginFailure(s, victim.Username, "192.0.2.1", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		lockout.Failures++
+	}
+	if err := (at.client()).expectStatus(http.StatusTooManyRequests, "POST", "/api/login",
+		map[string]string{"username": victim.Username, "password": "pw"}, nil); err != nil {
+		t.Fatalf("login while locked out: %v", err)
+	}
+	if err := staff[RoleSupport].expectStatus(http.StatusOK, "GET", lockoutPath, nil, &lockout); err != nil {
+		t.Fatal(err)
+	}
+	if !lockout.Locked {
+		t.Fatalf("lockout after %d failures = %+v, want locked", userLoginLimit.LockoutAt, lockout)
+	}
+	if err := staff[RoleSupport].expectStatus(http.StatusForbidden, "DELETE", lockoutPath, nil, nil); err != nil {
+		t.Fatalf("support unlocking a user: %v", err)
+	}
+	if err := staff[RoleAdmin].expectStatus(http.StatusOK, "DELETE", lockoutPath, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (at.client()).login(victim.Username, "pw"); err != nil {
+		t.Fatalf("login after unlocking: %v", err)
+	}
+	attemptsPath := "/api/login-attempts?username=" + victim.Username
+	if err := a.expectStatus(http.StatusForbidden, "GET", attemptsPath, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var logins struct {
+		Items []LoginAttempt `json:"items"`
+	}
+	if err := staff[RoleAuditor].expectStatus(http.StatusOK, "GET", attemptsPath, nil, &logins); err != nil {
+		t.Fatal(err)
+	}
+	if n := userLoginLimit.BackoffAfter + 3; len(logins.Items) != n || !logins.Items[0].Success ||
+		logins.Items[1].Reason != LoginThrottled || logins.Items[n-1].Reason != LoginInvalidCredentials {
+		t.Fatalf("login attempts = %+v; want %d, newest a success after being throttled", logins.Items, n)
+	}
+
+	// Two-factor authentication: enroll, confirm, log in in two steps, and
+	// an admin requiring it
+	carol, cleanupCarol := testUser(t, s, hash)
+	defer cleanupCarol()
+	c := at.client()
+	if _, err := c.login(carol.Username, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	totpNow := func(secret string, ahead int64) string {
+		key, _ := totpEncoding.DecodeString(secret)
+		return totpCode(key, time.Now().Unix()/totpPeriod+ahead)
+	}
+	if err := c.expectStatus(http.StatusConflict, "POST", "/api/2fa/confirm", map[string]string{"code": "123456"}, nil); err != nil {
+		t.Fatalf("confirming without enrolling: %v", err)
+	}
+	var enrollment TOTPEnrollment
+	if err := c.expectStatus(http.StatusOK, "POST", "/api/2fa/enroll", nil, &enrollment); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/"+totpIssuer+":"+carol.Username+"?") || !strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Fatalf("otpauth URI = %q for secret %q", enrollment.URI, enrollment.Secret)
+	}
+	if err := c.expectStatus(http.StatusUnauthorized, "POST", "/api/2fa/confirm", map[string]string{"code": "abcdef"}, nil); err != nil {
+		t.Fatalf("confirming with a wrong code: %v", err)
+	}
+	firstCode := totpNow(enrollment.Secret, 0)
+	var recovery struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := c.expectStatus(http.StatusOK, "POST", "/api/2fa/confirm", map[string]string{"code": firstCode}, &recovery); err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("confirming returned %d recovery code(s), want %d", len(recovery.RecoveryCodes), recoveryCodeCount)
+	}
+	var step1 struct {
+		Token              string   `json:"token"`
+		ChallengeToken     string   `json:"challenge_token"`
+		EnrollmentRequired bool     `json:"enrollment_required"`
+		RecoveryCodes      []string `json:"recovery_codes"`
+	}
+	carolCreds := map[string]string{"username": carol.Username, "password": "pw"}
+	if err := c.expectStatus(http.StatusOK, "POST", "/api/login", carolCreds, &step1); err != nil {
+		t.Fatal(err)
+	}
+	if step1.Token != "" || step1.ChallengeToken == "" || step1.EnrollmentRequired {
+		t.Fatalf("password step with 2FA on = %+v, want just a challenge", step1)
+	}
+	challenge := step1.ChallengeToken
+	if err := c.expectStatus(http.StatusUnauthorized, "POST", "/api/login/2fa", map[string]string{"challenge_token": challenge, "code": firstCode}, nil); err != nil {
+		t.Fatalf("replaying a code: %v", err)
+	}
+	if err := c.expectStatus(http.StatusOK, "POST", "/api/login/2fa", map[string]string{"challenge_token": challenge, "recovery_code": strings.ToUpper(recovery.RecoveryCodes[0])}, &step1); err != nil {
+		t.Fatal(err)
+	}
+	if step1.Token == "" {
+		t.Fatalf("second step returned no token")
+	}
+	c.token = step1.Token
+	if err := c.expectStatus(http.StatusUnauthorized, "POST", "/api/login/2fa", map[string]string{"challenge_token": challenge, "recovery_code": recovery.RecoveryCodes[1]}, nil); err != nil {
+		t.Fatalf("reusing a challenge: %v", err)
+	}
+	var twoFA TwoFactorStatus
+	if err := c.expectStatus(http.StatusOK, "GET", "/api/2fa", nil, &twoFA); err != nil {
+		t.Fatal(err)
+	}
+	if !twoFA.Enabled || twoFA.RecoveryCodesLeft != recoveryCodeCount-1 {
+		t.Fatalf("2FA status = %+v, want enabled with %d recovery codes", twoFA, recoveryCodeCount-1)
+	}
+	if err := c.expectStatus(http.StatusOK, "DELETE", "/api/2fa", map[string]string{"code": totpNow(enrollment.Secret, 1)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	twoFAPath := "/api/users/" + strconv.Itoa(carol.ID) + "/2fa"
+	if err := staff[RoleSupport].expectStatus(http.StatusForbidden, "PUT", twoFAPath, map[string]bool{"required": true}, nil); err != nil {
+		t.Fatalf("support requiring 2FA: %v", err)
+	}
+	if err := staff[RoleAdmin].expectStatus(http.StatusOK, "PUT", twoFAPath, map[string]bool{"required": true}, &twoFA); err != nil {
+		t.Fatal(err)
+	}
+	if twoFA.Enabled || !twoFA.Required {
+		t.Fatalf("2FA status after requiring it = %+v", twoFA)
+	}
+	step1.ChallengeToken = ""
+	if err := c.expectStatus(http.StatusOK, "POST", "/api/login", carolCreds, &step1); err != nil {
+		t.Fatal(err)
+	}
+	if step1.ChallengeToken == "" || !step1.EnrollmentRequired {
+		t.Fatalf("password step with 2FA required = %+v, want an enrollment challenge", step1)
+	}
+	challenge = step1.ChallengeToken
+	if err := c.expectStatus(http.StatusConflict, "POST", "/api/login/2fa", map[string]string{"challenge_token": challenge, "code": "123456"}, nil); err != nil {
+		t.Fatalf("second step before enrolling: %v", err)
+	}
+	if err := c.expectStatus(http.StatusOK, "POST", "/api/login/2fa/enroll", map[string]string{"challenge_token": challenge}, &enrollment); err != nil {
+		t.Fatal(err)
+	}
+	step1.Token, step1.RecoveryCodes = "", nil
+	if err := c.expectStatus(http.StatusOK, "POST", "/api/login/2fa", map[string]string{"challenge_token": challenge, "code": totpNow(enrollment.Secret, 0)}, &step1); err != nil {
+		t.Fatal(err)
+	}
+	if step1.Token == "" || len(step1.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("enrolling at login = %+v, want a token and recovery codes", step1)
+	}
+	c.token = step1.Token
+	if err := c.expectStatus(http.StatusConflict, "DELETE", "/api/2fa", map[string]string{"code": totpNow(enrollment.Secret, 1)}, nil); err != nil {
+		t.Fatalf("disabling required 2FA: %v", err)
+	}
+	if err := staff[RoleAdmin].expectStatus(http.StatusOK, "DELETE", twoFAPath, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := staff[RoleSupport].expectStatus(http.StatusOK, "GET", twoFAPath, nil, &twoFA); err != nil {
+		t.Fatal(err)
+	}
+	if twoFA.Enabled || twoFA.Pending || !twoFA.Required || twoFA.RecoveryCodesLeft != 0 {
+		t.Fatalf("2FA status after an admin reset = %+v", twoFA)
+	}
+	if err := staff[RoleAuditor].expectStatus(http.StatusOK, "GET", "/api/audit?entity_type=two_factor&entity_id="+strconv.Itoa(carol.ID), nil, &audit); err != nil {
+		t.Fatal(err)
+	}
+	if len(audit.Items) < 5 {
+		t.Fatalf("two-factor audit events = %d, want every change", len(audit.Items))
+	}
+	for _, e := range audit.Items {
+		if strings.Contains(string(e.Before)+string(e.After), "secret") {
+			t.Fatalf("audit event %d has the TOTP secret", e.ID)
+		}
+	}
+
+	// Registration, off unless configured, then open, then by invite
+	defer func(mode string) { registrationMode = mode }(registrationMode)
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		if err := s.ClearLoginThrottle(ipLoginKey(ip)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	anon := at.client()
+	newcomer := map[string]string{"username": fmt.Sprintf(" check-reg-%d ", time.Now().UnixNano()), "password": "short"}
+	registrationMode = RegistrationOff
+	if err := anon.expectStatus(http.StatusForbidden, "POST", "/api/register", newcomer, nil); err != nil {
+		t.Fatalf("registering while it is off: %v", err)
+	}
+	registrationMode = RegistrationOpen
+	if err := anon.expectStatus(http.StatusBadRequest, "POST", "/api/register", newcomer, nil); err != nil {
+		t.Fatalf("registering with a short password: %v", err)
+	}
+	newcomer["password"] = "check-pass-1"
+	var dave User
+	if err := anon.expectStatus(http.StatusCreated, "POST", "/api/register", newcomer, &dave); err != nil {
+		t.Fatal(err)
+	}
+	defer s.DeleteUser(dave.ID)
+	if dave.Username != strings.TrimSpace(newcomer["username"]) || dave.Permissions != RoleUser || dave.Password != "" {
+		t.Fatalf("registered user = %+v", dave)
+	}
+	if err := anon.expectStatus(http.StatusConflict, "POST", "/api/register", newcomer, nil); err != nil {
+		t.Fatalf("registering a taken username: %v", err)
+	}
+	if err := staff[RoleAuditor].expectStatus(http.StatusOK, "GET", "/api/audit?entity_type=user&entity_id="+strconv.Itoa(dave.ID), nil, &audit); err != nil {
+		t.Fatal(err)
+	}
+	if len(audit.Items) != 1 || audit.Items[0].Action != AuditCreate || audit.Items[0].ActorID == nil || *audit.Items[0].ActorID != dave.ID {
+		t.Fatalf("registration audit events = %+v, want one by the new user", audit.Items)
+	}
+
+	registrationMode = RegistrationInvite
+	invitee := map[string]string{"username": fmt.Sprintf("check-inv-%d", time.Now().UnixNano()), "password": "check-pass-1"}
+	if err := anon.expectStatus(http.StatusForbidden, "POST", "/api/register", invitee, nil); err != nil {
+		t.Fatalf("registering without an invite: %v", err)
+	}
+	if err := a.expectStatus(http.StatusForbidden, "POST", "/api/invites", map[string]string{}, nil); err != nil {
+		t.Fatalf("a user creating an invite: %v", err)
+	}
+	var stale, invite Invite
+	if err := staff[RoleAdmin].expectStatus(http.StatusCreated, "POST", "/api/invites", map[string]string{"expires_at": "2000-01-01"}, &stale); err != nil {
+		t.Fatal(err)
+	}
+	defer s.DeleteInvite(stale.ID)
+	if err := staff[RoleAdmin].expectStatus(http.StatusCreated, "POST", "/api/invites", map[string]string{"note": "check"}, &invite); err != nil {
+		t.Fatal(err)
+	}
+	defer s.DeleteInvite(invite.ID)
+	if invite.Code == "" || invite.ExpiresAt != nil {
+		t.Fatalf("created invite = %+v, want a code and no expiry", invite)
+	}
+	invitee["invite_code"] = stale.Code
+	if err := anon.expectStatus(http.StatusForbidden, "POST", "/api/register", invitee, nil); err != nil {
+		t.Fatalf("registering with an expired invite: %v", err)
+	}
+	invitee["invite_code"] = invite.Code
+	var erin User
+	if err := anon.expectStatus(http.StatusCreated, "POST", "/api/register", invitee, &erin); err != nil {
+		t.Fatal(err)
+	}
+	defer s.DeleteUser(erin.ID)
+	invitee["username"] += "-again"
+	if err := anon.expectStatus(http.StatusForbidden, "POST", "/api/register", invitee, nil); err != nil {
+		t.Fatalf("reusing an invite: %v", err)
+	}
+	var invites []Invite
+	if err := staff[RoleSupport].expectStatus(http.StatusOK, "GET", "/api/invites", nil, &invites); err != nil {
+		t.Fatal(err)
+	}
+	if len(invites) < 2 || invites[0].ID != invite.ID || invites[0].Code != "" || invites[0].UsedBy == nil || *invites[0].UsedBy != erin.ID {
+		t.Fatalf("invites = %+v, want the used one first without its code", invites)
+	}
+	invitePath := "/api/invites/" + strconv.Itoa(stale.ID)
+	if err := staff[RoleAdmin].expectStatus(http.StatusOK, "DELETE", invitePath, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := staff[RoleAdmin].expectStatus(http.StatusNotFound, "DELETE", invitePath, nil, nil); err != nil {
+		t.Fatalf("deleting an invite twice: %v", err)
+	}
+
+	// Changing a password needs the current one and ends every session
+	d := at.client()
+	if _, err := d.login(dave.Username, "check-pass-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.expectStatus(http.StatusForbidden, "POST", "/api/me/password",
+		map[string]string{"current_password": "wrong", "new_password": "check-pass-2"}, nil); err != nil {
+		t.Fatalf("changing a password with a wrong current one: %v", err)
+	}
+	if err := d.expectStatus(http.StatusBadRequest, "POST", "/api/me/password",
+		map[string]string{"current_password": "check-pass-1", "new_password": "short"}, nil); err != nil {
+		t.Fatalf("changing to a short password: %v", err)
+	}
+	if err := d.expectStatus(http.StatusOK, "POST", "/api/me/password",
+		map[string]string{"current_password": "check-pass-1", "new_password": "check-pass-2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.expectStatus(http.StatusUnauthorized, "GET", "/api/budgets", nil, nil); err != nil {
+		t.Fatalf("session after changing the password: %v", err)
+	}
+	if _, err := d.login(dave.Username, "check-pass-2"); err != nil {
+		t.Fatalf("login with the changed password: %v", err)
+	}
+
+	// Password reset: tokens go through the notifier, and using one voids
+	// the others
+	forgot := map[string]string{"username": dave.Username}
+	if err := anon.expectStatus(http.StatusAccepted, "POST", "/api/password/forgot", forgot, nil); err != nil {
+		t.Fatal(err)
+	}
+	first, err := at.notes.resetToken(dave.Username, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := anon.expectStatus(http.StatusAccepted, "POST", "/api/password/forgot", forgot, nil); err != nil {
+		t.Fatal(err)
+	}
+	second, err := at.notes.resetToken(dave.Username, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset := map[string]string{"token": first, "new_password": "check-pass-3"}
+	if err := anon.expectStatus(http.StatusOK, "POST", "/api/password/reset", reset, nil); err != nil {
+		t.Fatalf("resetting with the earlier token: %v", err)
+	}
+	if err := anon.expectStatus(http.StatusBadRequest, "POST", "/api/password/reset", reset, nil); err != nil {
+		t.Fatalf("reusing a reset token: %v", err)
+	}
+	reset["token"] = second
+	if err := anon.expectStatus(http.StatusBadRequest, "POST", "/api/password/reset", reset, nil); err != nil {
+		t.Fatalf("resetting with a token voided by another: %v", err)
+	}
+	if err := d.expectStatus(http.StatusUnauthorized, "GET", "/api/budgets", nil, nil); err != nil {
+		t.Fatalf("session after a password reset: %v", err)
+	}
+
+	// Updating a user without a password keeps theirs
+	davePath := "/api/users/" + strconv.Itoa(dave.ID)
+	if err := staff[RoleAdmin].expectStatus(http.StatusBadRequest, "PUT", davePath, map[string]string{"password": "short"}, nil); err != nil {
+		t.Fatalf("updating a user to a short password: %v", err)
+	}
+	dave.Username += "-renamed"
+	if err := staff[RoleAdmin].expectStatus(http.StatusOK, "PUT", davePath, map[string]string{"username": dave.Username}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.login(dave.Username, "check-pass-3"); err != nil {
+		t.Fatalf("login after a rename without a password: %v", err)
+	}
+	if got, err := s.GetUser(dave.ID); err != nil || got.Permissions != RoleUser {
+		t.Fatalf("renamed user = %+v, %v; want the role kept", got, err)
+	}
+
+	// A user who must change their password can do nothing else until they
+	// have, and reset-password puts them back in that state
+	frank, cleanupFrank := testUser(t, s, hash)
+	defer cleanupFrank()
+	frank.MustChangePassword = true
+	if err := s.UpdateUser(frank); err != nil {
+		t.Fatal(err)
+	}
+	f := at.client()
+	var login struct {
+		Token              string `json:"token"`
+		MustChangePassword bool   `json:"must_change_password"`
+	}
+	frankCreds := map[string]string{"username": frank.Username, "password": "pw"}
+	if err := f.expectStatus(http.StatusOK, "POST", "/api/login", frankCreds, &login); err != nil {
+		t.Fatal(err)
+	}
+	if !login.MustChangePassword {
+		t.Fatalf("login of a user who must change their password = %+v", login)
+	}
+	f.token = login.Token
+	if err := f.expectStatus(http.StatusForbidden, "GET", "/api/budgets", nil, nil); err != nil {
+		t.Fatalf("listing budgets before changing the password: %v", err)
+	}
+	if err := f.expectStatus(http.StatusBadRequest, "POST", "/api/me/password",
+		map[string]string{"current_password": "pw", "new_password": "pw"}, nil); err != nil {
+		t.Fatalf("changing to the same password: %v", err)
+	}
+	if err := f.expectStatus(http.StatusOK, "POST", "/api/me/password",
+		map[string]string{"current_password": "pw", "new_password": "check-pass-1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	frankCreds["password"] = "check-pass-1"
+	if err := f.expectStatus(http.StatusOK, "POST", "/api/login", frankCreds, &login); err != nil {
+		t.Fatal(err)
+	}
+	f.token = login.Token
+	if login.MustChangePassword {
+		t.Fatalf("login after changing the password = %+v", login)
+	}
+	if err := f.expectStatus(http.StatusOK, "GET", "/api/budgets", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := runResetPasswordCommand(s, []string{frank.Username}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var oneTime string
+	if _, err := fmt.Sscanf(out.String(), "New password for "+frank.Username+": %s", &oneTime); err != nil {
+		t.Fatalf("reset-password output %q: %v", out.String(), err)
+	}
+	frankCreds["password"] = oneTime
+	if err := f.expectStatus(http.StatusUnauthorized, "GET", "/api/budgets", nil, nil); err != nil {
+		t.Fatalf("session after reset-password: %v", err)
+	}
+	if err := f.expectStatus(http.StatusOK, "POST", "/api/login", frankCreds, &login); err != nil {
+		t.Fatal(err)
+	}
+	if !login.MustChangePassword {
+		t.Fatalf("login with a one-time password = %+v", login)
+	}
+}
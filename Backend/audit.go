@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// --------------------------
+//         Audit Log
+// --------------------------
+
+// AuditEvent: one change to a user, account, budget, charge, share or category,
+// recorded in the same transaction as the change. Before is null when the
+// entity was created and After when it was deleted. OwnerID is whose data
+// changed (for a user, the user themself); ActorID is who changed it, null
+// for the server itself.
+type AuditEvent struct {
+	ID         int             `json:"id"`
+	ActorID    *int            `json:"actor_id"`
+	OwnerID    int             `json:"owner_id"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   int             `json:"entity_id"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	CreatedAt  string          `json:"created_at"`
+	IP         string          `json:"ip,omitempty"`
+	UserAgent  string          `json:"user_agent,omitempty"`
+}
+
+// Audit actions
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// auditEntityTypes are the entity_type values events are recorded with.
+var auditEntityTypes = map[string]bool{"user": true, "account": true, "budget": true, "charge": true, "transfer": true, "settlement": true, "goal": true, "contribution": true, "envelope_mode": true, "envelope": true, "envelope_move": true, "two_factor": true, "share": true, "category": true}
+
+// AuditFilter selects audit events, newest first.
+type AuditFilter struct {
+	OwnerID    int // 0 for every owner
+	ActorID    int
+	EntityType string
+	EntityID   int
+	Action     string
+	From, To   *time.Time
+	BeforeID   int // only events older than this one
+	Limit      int // 0 for no limit
+}
+
+// auditSource: who is making changes and from where, stamped on every event
+// they cause.
+type auditSource struct {
+	ActorID   *int
+	IP        string
+	UserAgent string
+}
+
+// systemAudit is the source of changes the server makes on its own, such
+// as posting recurring charges.
+var systemAudit = auditSource{}
+
+// clientIP is the address of the connection's peer; X-Forwarded-For is
+// client-controlled and ignored.
+func clientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// requestAudit is the source of changes made by actorID through r, from
+// its clientIP.
+func requestAudit(r *http.Request, actorID int) auditSource {
+	return auditSource{ActorID: &actorID, IP: clientIP(r), UserAgent: r.UserAgent()}
+}
+
+// auditUser is what the log keeps of a user: never the password hash.
+type auditUser struct {
+	ID                 int    `json:"id"`
+	Username           string `json:"username"`
+	Permissions        string `json:"permissions"`
+	MustChangePassword bool   `json:"must_change_password"`
+}
+
+// auditSnapshot renders v as it is stored in an event; nil is JSON null.
+func auditSnapshot(v interface{}) (json.RawMessage, error) {
+	switch u := v.(type) {
+	case nil:
+		return json.RawMessage("null"), nil
+	case User:
+		v = auditUser{ID: u.ID, Username: u.Username, Permissions: u.Permissions, MustChangePassword: u.MustChangePassword}
+	}
+	return json.Marshal(v)
+}
+
+// record appends an event for a change to an entity owned by ownerID.
+// before and after are snapshotted as JSON; pass nil for a side that
+// doesn't exist.
+func (src auditSource) record(store Store, action, entityType string, entityID, ownerID int, before, after interface{}) error {
+	e := AuditEvent{
+		ActorID:    src.ActorID,
+		OwnerID:    ownerID,
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		IP:         src.IP,
+		UserAgent:  src.UserAgent,
+	}
+	var err error
+	if e.Before, err = auditSnapshot(before); err != nil {
+		return fmt.Errorf("recording audit event: %v", err)
+	}
+	if e.After, err = auditSnapshot(after); err != nil {
+		return fmt.Errorf("recording audit event: %v", err)
+	}
+	if err := store.RecordAudit(&e); err != nil {
+		return fmt.Errorf("recording audit event: %v", err)
+	}
+	return nil
+}
+
+// parseAuditQuery validates the audit filters in values:
+//
+//	entity_type         one of auditEntityTypes: user, account, budget, charge, transfer,
+//	                    settlement, goal, contribution, envelope_mode, envelope,
+//	                    envelope_move, two_factor, share or category
+//	entity_id, actor_id
+//	action              create, update or delete
+//	from, to            time range (YYYY-MM-DD or RFC 3339; to is exclusive)
+//	limit, cursor       page size and the next_cursor of the previous page
+//
+// Like parseListQuery it sets Limit one past the page size.
+func parseAuditQuery(values url.Values) (*AuditFilter, error) {
+	f := &AuditFilter{}
+
+	if v := values.Get("entity_type"); v != "" {
+		if !auditEntityTypes[v] {
+			return nil, fmt.Errorf("invalid entity_type %q (want user, account, budget, charge, transfer, settlement, goal, contribution, envelope_mode, envelope, envelope_move, two_factor, share or category)", v)
+		}
+		f.EntityType = v
+	}
+	if v := values.Get("action"); v != "" {
+		if v != AuditCreate && v != AuditUpdate && v != AuditDelete {
+			return nil, fmt.Errorf("invalid action %q (want create, update or delete)", v)
+		}
+		f.Action = v
+	}
+	for _, p := range []struct {
+		param string
+		dst   *int
+	}{{"entity_id", &f.EntityID}, {"actor_id", &f.ActorID}, {"cursor", &f.BeforeID}} {
+		if v := values.Get(p.param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid %s %q", p.param, v)
+			}
+			*p.dst = n
+		}
+	}
+	for _, p := range []struct {
+		param string
+		dst   **time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		if v := values.Get(p.param); v != "" {
+			t, err := parseDate(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s date %q", p.param, v)
+			}
+			*p.dst = &t
+		}
+	}
+
+	limit := defaultPageSize
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		limit = n
+	}
+	f.Limit = limit + 1
+	return f, nil
+}
+
+// GET /api/audit => audit events for the JWT user's entities (or ?owner=<id>,
+// read access), newest first. Callers with audit:read (admins and auditors)
+// see every owner's events unless they pass ?owner=. Filterable and
+// paginated; see parseAuditQuery.
+func (s *Server) getAuditHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := parseAuditQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	owner := r.URL.Query().Get("owner")
+	if s.hasPermission(r, PermAuditRead) {
+		if owner != "" {
+			if f.OwnerID, err = strconv.Atoi(owner); err != nil {
+				http.Error(w, "Invalid owner ID", http.StatusBadRequest)
+				return
+			}
+		}
+	} else {
+		_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		f.OwnerID = ownerID
+	}
+
+	events, err := s.store.ListAudit(f)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying audit events: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	next := ""
+	if size := f.Limit - 1; len(events) > size {
+		events = events[:size]
+		next = strconv.Itoa(events[size-1].ID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Page{Items: events, NextCursor: next})
+}
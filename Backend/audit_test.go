@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAuditQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string // an error substring; "" for none
+		check func(f *AuditFilter) bool
+	}{
+		{"", "", func(f *AuditFilter) bool { return *f == AuditFilter{Limit: defaultPageSize + 1} }},
+		{"entity_type=envelope_move&action=delete", "", func(f *AuditFilter) bool {
+			return f.EntityType == "envelope_move" && f.Action == AuditDelete
+		}},
+		{"entity_id=4&actor_id=2&cursor=90&limit=5", "", func(f *AuditFilter) bool {
+			return f.EntityID == 4 && f.ActorID == 2 && f.BeforeID == 90 && f.Limit == 6
+		}},
+		{"from=2024-01-01&to=2024-01-02T12:00:00Z", "", func(f *AuditFilter) bool {
+			return f.From != nil && f.To != nil && f.To.Sub(*f.From).Hours() == 36
+		}},
+		{"entity_type=Budget", "invalid entity_type", nil},
+		{"entity_type=password", "invalid entity_type", nil},
+		{"action=read", "invalid action", nil},
+		{"entity_id=0", "invalid entity_id", nil},
+		{"actor_id=me", "invalid actor_id", nil},
+		{"cursor=-1", "invalid cursor", nil},
+		{"to=tomorrow", "invalid to date", nil},
+		{"limit=" + strconv.Itoa(maxPageSize+1), "limit must be", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			values, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := parseAuditQuery(values)
+			if tc.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.want) {
+					t.Fatalf("parseAuditQuery = %v, want an error about %q", err, tc.want)
+				}
+				return
+			}
+			if err != nil || !tc.check(f) {
+				t.Fatalf("parseAuditQuery = %+v, %v", f, err)
+			}
+		})
+	}
+	// Every entity type recorded anywhere is accepted as a filter
+	for entityType := range auditEntityTypes {
+		if _, err := parseAuditQuery(url.Values{"entity_type": {entityType}}); err != nil {
+			t.Fatalf("entity_type %s: %v", entityType, err)
+		}
+	}
+}
+
+func TestAuditSnapshot(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{nil, "null"},
+		{User{ID: 3, Username: "casey", Password: "$2a$hash", Permissions: "user"},
+			`{"id":3,"username":"casey","permissions":"user","must_change_password":false}`},
+		{map[string]int{"id": 1}, `{"id":1}`},
+	}
+	for _, tc := range tests {
+		got, err := auditSnapshot(tc.v)
+		if err != nil || string(got) != tc.want {
+			t.Fatalf("auditSnapshot(%+v) = %s, %v; want %s", tc.v, got, err, tc.want)
+		}
+	}
+}
+
+func TestAuditStore(t *testing.T) {
+	eachStore(t, testAuditLog)
+}
+
+func TestAuditTrail(t *testing.T) {
+	eachStore(t, testAuditTrail)
+}
+
+// testAuditTrail checks who may read an owner's audit events through the API,
+// and how they are filtered and paged.
+func testAuditTrail(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	a := at.a
+	_, auditor := at.user(RoleAuditor)
+
+	var budget Budget
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/budgets", map[string]interface{}{"name": "Food", "amount": 100}, &budget); err != nil {
+		t.Fatal(err)
+	}
+	budgetPath := "/api/budgets/" + strconv.Itoa(budget.ID)
+	if err := a.expectStatus(http.StatusOK, "PUT", budgetPath, map[string]interface{}{"name": "Food", "amount": 120}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.expectStatus(http.StatusOK, "DELETE", budgetPath, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := "&owner=" + strconv.Itoa(at.alice.ID)
+	entity := "?entity_type=budget&entity_id=" + strconv.Itoa(budget.ID)
+	tests := []struct {
+		name    string
+		c       *apiClient
+		query   string
+		status  int
+		actions string
+	}{
+		{"the owner", a, entity, http.StatusOK, "delete update create"},
+		{"by action", a, entity + "&action=update", http.StatusOK, "update"},
+		{"by actor", a, entity + "&actor_id=" + strconv.Itoa(at.bob.ID), http.StatusOK, ""},
+		{"another user's own log", at.b, entity, http.StatusOK, ""},
+		{"another user without a share", at.b, entity + owner, http.StatusForbidden, ""},
+		{"an auditor", auditor, entity, http.StatusOK, "delete update create"},
+		{"an auditor with owner", auditor, entity + owner, http.StatusOK, "delete update create"},
+		{"a bad filter", a, "?action=read", http.StatusBadRequest, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var page struct {
+				Items []AuditEvent `json:"items"`
+			}
+			if err := tc.c.expectStatus(tc.status, "GET", "/api/audit"+tc.query, nil, &page); err != nil {
+				t.Fatal(err)
+			}
+			var actions []string
+			for _, e := range page.Items {
+				if e.OwnerID != at.alice.ID || e.ActorID == nil || *e.ActorID != at.alice.ID || e.IP == "" {
+					t.Fatalf("event = %+v", e)
+				}
+				actions = append(actions, e.Action)
+			}
+			if got := strings.Join(actions, " "); got != tc.actions {
+				t.Fatalf("actions = %q, want %q", got, tc.actions)
+			}
+		})
+	}
+
+	// Paging one event at a time walks back through the trail
+	var actions []string
+	cursor := ""
+	for len(actions) < 4 {
+		var page Page
+		var items []AuditEvent
+		page.Items = &items
+		if err := a.expectStatus(http.StatusOK, "GET", "/api/audit"+entity+"&limit=1"+cursor, nil, &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range items {
+			actions = append(actions, e.Action)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = "&cursor=" + page.NextCursor
+	}
+	if got := strings.Join(actions, " "); got != "delete update create" {
+		t.Fatalf("paged actions = %q", got)
+	}
+
+	// The update recorded the budget before and after
+	var page struct {
+		Items []AuditEvent `json:"items"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/audit"+entity+"&action=update", nil, &page); err != nil {
+		t.Fatal(err)
+	}
+	var before, after struct {
+		Amount json.Number `json:"amount"`
+	}
+	if len(page.Items) != 1 || json.Unmarshal(page.Items[0].Before, &before) != nil || json.Unmarshal(page.Items[0].After, &after) != nil ||
+		before.Amount != "100.00" || after.Amount != "120.00" {
+		t.Fatalf("update event = %+v", page.Items)
+	}
+}
+
+func testAuditLog(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	src := auditSource{ActorID: &u.ID, IP: "192.0.2.1", UserAgent: "check"}
+	b := Budget{Name: "Audited", Amount: mustMoney("5", "USD"), UserID: u.ID}
+	err := s.Tx(func(tx Store) error {
+		if err := tx.CreateBudget(&b); err != nil {
+			return err
+		}
+		if err := src.record(tx, AuditCreate, "budget", b.ID, u.ID, nil, b); err != nil {
+			return err
+		}
+		before := b
+		b.Amount = mustMoney("7.5", "USD")
+		if err := tx.UpdateBudget(b); err != nil {
+			return err
+		}
+		return src.record(tx, AuditUpdate, "budget", b.ID, u.ID, before, b)
+	})
+	if err != nil {
+		t.Fatalf("Tx: %v", err)
+	}
+	if err := systemAudit.record(s, AuditDelete, "user", u.ID, u.ID, u, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rollback := errors.New("roll back")
+	err = s.Tx(func(tx Store) error {
+		if err := src.record(tx, AuditDelete, "budget", b.ID, u.ID, b, nil); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if err != rollback {
+		t.Fatalf("Tx returned %v, want the callback's error", err)
+	}
+
+	events, err := s.ListAudit(&AuditFilter{OwnerID: u.ID})
+	if err != nil {
+		t.Fatalf("ListAudit: %v", err)
+	}
+	got := ""
+	for _, e := range events {
+		got += e.Action + " " + e.EntityType + ";"
+	}
+	if want := "delete user;update budget;create budget;"; got != want {
+		t.Fatalf("ListAudit = %q, want %q (newest first, rollback discarded)", got, want)
+	}
+
+	update := events[1]
+	if update.ActorID == nil || *update.ActorID != u.ID || update.IP != "192.0.2.1" || update.UserAgent != "check" || update.CreatedAt == "" {
+		t.Fatalf("update event metadata = %+v", update)
+	}
+	var before, after struct {
+		Amount json.Number `json:"amount"`
+	}
+	if err := json.Unmarshal(update.Before, &before); err != nil || before.Amount != "5.00" {
+		t.Fatalf("update before = %s, %v", update.Before, err)
+	}
+	if err := json.Unmarshal(update.After, &after); err != nil || after.Amount != "7.50" {
+		t.Fatalf("update after = %s, %v", update.After, err)
+	}
+	if string(events[2].Before) != "null" || string(events[0].After) != "null" {
+		t.Fatalf("missing snapshots should be null, got %s and %s", events[2].Before, events[0].After)
+	}
+	if events[0].ActorID != nil {
+		t.Fatalf("system event has actor %d", *events[0].ActorID)
+	}
+	if strings.Contains(string(events[0].Before), "secret") || strings.Contains(string(events[0].Before), `"password"`) {
+		t.Fatalf("user snapshot leaks the password: %s", events[0].Before)
+	}
+
+	for _, tc := range []struct {
+		filter AuditFilter
+		want   int
+	}{
+		{AuditFilter{OwnerID: u.ID, EntityType: "budget"}, 2},
+		{AuditFilter{OwnerID: u.ID, EntityType: "budget", EntityID: b.ID, Action: AuditUpdate}, 1},
+		{AuditFilter{OwnerID: u.ID, ActorID: u.ID}, 2},
+		{AuditFilter{OwnerID: u.ID, Limit: 1}, 1},
+		{AuditFilter{OwnerID: u.ID, BeforeID: events[1].ID}, 1},
+		{AuditFilter{OwnerID: u.ID, To: &time.Time{}}, 0},
+	} {
+		if found, err := s.ListAudit(&tc.filter); err != nil || len(found) != tc.want {
+			t.Fatalf("ListAudit(%+v) = %d event(s), %v; want %d", tc.filter, len(found), err, tc.want)
+		}
+	}
+}
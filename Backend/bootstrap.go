@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// --------------------------
+//         Bootstrap
+// --------------------------
+
+// knownDefaultPasswords are tried, along with the username, against every
+// admin and demo user at startup; outside dev mode the server refuses to run
+// if one fits an admin's, and demo users have to change theirs.
+var knownDefaultPasswords = []string{"admin", "password", "changeme", "alice", "bob"}
+
+// demoUsernames are the users --seed-demo creates, whose passwords are their
+// usernames. Older versions created them on every start.
+var demoUsernames = []string{"alice", "bob"}
+
+// bootstrapConfig: how the server sets up its accounts when it starts.
+type bootstrapConfig struct {
+	AdminUsername string // ADMIN_USERNAME, "admin" by default
+	AdminPassword string // ADMIN_PASSWORD; a one-time password is generated without it
+	Dev           bool   // --dev: allow admins with known default passwords
+	SeedDemo      bool   // --seed-demo: create the demo users
+}
+
+// bootstrapConfigFromArgs reads the server's flags and the ADMIN_*
+// environment variables.
+func bootstrapConfigFromArgs(args []string) (bootstrapConfig, error) {
+	cfg := bootstrapConfig{AdminUsername: os.Getenv("ADMIN_USERNAME"), AdminPassword: os.Getenv("ADMIN_PASSWORD")}
+	if cfg.AdminUsername == "" {
+		cfg.AdminUsername = "admin"
+	}
+	fs := flag.NewFlagSet("budget-app", flag.ContinueOnError)
+	fs.BoolVar(&cfg.Dev, "dev", false, "allow admins with known default passwords")
+	fs.BoolVar(&cfg.SeedDemo, "seed-demo", false, "create the alice and bob demo users")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+	return cfg, nil
+}
+
+// hasDefaultPassword reports whether u's password is one of the
+// knownDefaultPasswords or their username.
+func hasDefaultPassword(u User) bool {
+	for _, p := range append([]string{u.Username}, knownDefaultPasswords...) {
+		if checkPasswordHash(p, u.Password) {
+			return true
+		}
+	}
+	return false
+}
+
+// oneTimePassword generates a password for an account that must change it
+// at its first login.
+func oneTimePassword() (string, error) {
+	return randomToken(12)
+}
+
+// bootstrap makes sure store has an admin and refuses admins with known
+// default passwords outside dev mode, where demo users with them must change
+// them at their next login instead. Without an admin it creates one named
+// cfg.AdminUsername, with cfg.AdminPassword or else a one-time password it
+// prints to out. With cfg.SeedDemo it also creates the demo users.
+func bootstrap(store Store, cfg bootstrapConfig, out io.Writer) error {
+	users, err := store.ListUsers()
+	if err != nil {
+		return err
+	}
+	hasAdmin := false
+	for _, u := range users {
+		switch {
+		case u.Permissions == RoleAdmin:
+			hasAdmin = true
+			if !hasDefaultPassword(u) {
+				continue
+			}
+			if !cfg.Dev {
+				return fmt.Errorf("admin %q has a known default password; run \"reset-password %s\" or start with --dev", u.Username, u.Username)
+			}
+			fmt.Fprintf(out, "Warning: admin %q has a known default password (allowed by --dev)\n", u.Username)
+		case isDemoUsername(u.Username) && !u.MustChangePassword && !cfg.Dev && hasDefaultPassword(u):
+			// Same password, which they must now change
+			err := store.Tx(func(tx Store) error {
+				_, err := setPassword(tx, systemAudit, u.ID, u.Password, true)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("error flagging %s: %v", u.Username, err)
+			}
+			fmt.Fprintf(out, "User %q has a known default password and must change it at the next login.\n", u.Username)
+		}
+	}
+	if !hasAdmin {
+		if err := createInitialAdmin(store, cfg, out); err != nil {
+			return err
+		}
+	}
+	if cfg.SeedDemo {
+		return seedDemoUsers(store, cfg, out)
+	}
+	return nil
+}
+
+func isDemoUsername(name string) bool {
+	for _, demo := range demoUsernames {
+		if name == demo {
+			return true
+		}
+	}
+	return false
+}
+
+func createInitialAdmin(store Store, cfg bootstrapConfig, out io.Writer) error {
+	admin := User{Username: cfg.AdminUsername, Permissions: RoleAdmin}
+	password := cfg.AdminPassword
+	if password != "" {
+		if err := validatePassword(password); err != nil && !cfg.Dev {
+			return fmt.Errorf("ADMIN_PASSWORD: %v", err)
+		}
+	} else {
+		var err error
+		if password, err = oneTimePassword(); err != nil {
+			return err
+		}
+		admin.MustChangePassword = true
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("hash admin password: %v", err)
+	}
+	admin.Password = hash
+	if !cfg.Dev && hasDefaultPassword(admin) {
+		return fmt.Errorf("ADMIN_PASSWORD is a known default password; choose another or start with --dev")
+	}
+	if err := insertUser(store, &admin, systemAudit); err != nil {
+		return fmt.Errorf("insert initial admin: %v", err)
+	}
+	if admin.MustChangePassword {
+		fmt.Fprintf(out, "Initial admin created: username=%s password=%s\nThis password is shown only once and must be changed at the first login.\n", admin.Username, password)
+	} else {
+		fmt.Fprintf(out, "Initial admin created: username=%s with the password in ADMIN_PASSWORD\n", admin.Username)
+	}
+	return nil
+}
+
+// seedDemoUsers creates the demoUsernames, whose passwords are their
+// usernames, unless they exist. Outside dev mode they must change their
+// passwords at their first login.
+func seedDemoUsers(store Store, cfg bootstrapConfig, out io.Writer) error {
+	for _, name := range demoUsernames {
+		_, err := store.GetUserByUsername(name)
+		if err == nil {
+			fmt.Fprintf(out, "Demo user '%s' already exists, skipping creation.\n", name)
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("error checking for %s: %v", name, err)
+		}
+
+		hashedPass, err := hashPassword(name)
+		if err != nil {
+			return fmt.Errorf("error hashing %s's password: %v", name, err)
+		}
+		u := User{Username: name, Password: hashedPass, Permissions: RoleUser, MustChangePassword: !cfg.Dev}
+		if err := insertUser(store, &u, systemAudit); err != nil {
+			return fmt.Errorf("error inserting %s: %v", name, err)
+		}
+		fmt.Fprintf(out, "Demo user created: username=%s / password=%s (permissions=user)\n", name, name)
+		if u.MustChangePassword {
+			fmt.Fprintf(out, "Without --dev, %s must change this password at the first login.\n", name)
+		}
+	}
+	return nil
+}
+
+// runResetPasswordCommand implements "reset-password <username>": the user
+// gets a one-time password, printed to out, that they must change at their
+// next login. Their sessions end and a lockout of their username is lifted.
+func runResetPasswordCommand(store Store, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: reset-password <username>")
+	}
+	u, err := store.GetUserByUsername(args[0])
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("no user named %q", args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	password, err := oneTimePassword()
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	err = store.Tx(func(tx Store) error {
+		if _, err := setPassword(tx, systemAudit, u.ID, hash, true); err != nil {
+			return err
+		}
+		return tx.ClearLoginThrottle(userLoginKey(u.Username))
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "New password for %s: %s\nIt must be changed at the next login.\n", u.Username, password)
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBootstrapConfigFromArgs(t *testing.T) {
+	tests := []struct {
+		args               []string
+		username, password string
+		want               bootstrapConfig
+		ok                 bool
+	}{
+		{nil, "", "", bootstrapConfig{AdminUsername: "admin"}, true},
+		{[]string{"--dev"}, "root", "", bootstrapConfig{AdminUsername: "root", Dev: true}, true},
+		{[]string{"-seed-demo", "--dev"}, "", "s3cret-pw", bootstrapConfig{AdminUsername: "admin", AdminPassword: "s3cret-pw", Dev: true, SeedDemo: true}, true},
+		{[]string{"--dev=false"}, "", "", bootstrapConfig{AdminUsername: "admin"}, true},
+		{[]string{"--verbose"}, "", "", bootstrapConfig{}, false},
+		{[]string{"serve"}, "", "", bootstrapConfig{}, false},
+	}
+	for _, tc := range tests {
+		t.Setenv("ADMIN_USERNAME", tc.username)
+		t.Setenv("ADMIN_PASSWORD", tc.password)
+		cfg, err := bootstrapConfigFromArgs(tc.args)
+		if (err == nil) != tc.ok || (tc.ok && cfg != tc.want) {
+			t.Fatalf("bootstrapConfigFromArgs(%q) = %+v, %v; want %+v", tc.args, cfg, err, tc.want)
+		}
+	}
+}
+
+func TestHasDefaultPassword(t *testing.T) {
+	tests := []struct {
+		username, password string
+		want               bool
+	}{
+		{"root", "changeme", true},
+		{"root", "admin", true},
+		{"carol", "carol", true},
+		{"carol", "Carol", false},
+		{"carol", "correct-horse", false},
+	}
+	for _, tc := range tests {
+		hash, err := hashPassword(tc.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hasDefaultPassword(User{Username: tc.username, Password: hash}); got != tc.want {
+			t.Fatalf("hasDefaultPassword(%s with %q) = %v, want %v", tc.username, tc.password, got, tc.want)
+		}
+	}
+}
+
+func TestRunResetPasswordCommand(t *testing.T) {
+	s := newMemoryStore()
+	u := User{Username: "carol", Password: "hash", Permissions: RoleUser}
+	if err := s.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{nil, false},
+		{[]string{"carol", "dave"}, false},
+		{[]string{"dave"}, false},
+		{[]string{"carol"}, true},
+	}
+	for _, tc := range tests {
+		var out bytes.Buffer
+		err := runResetPasswordCommand(s, tc.args, &out)
+		if (err == nil) != tc.ok {
+			t.Fatalf("reset-password %q = %v, want ok %v", tc.args, err, tc.ok)
+		}
+		if !tc.ok {
+			continue
+		}
+		password := strings.TrimPrefix(strings.SplitN(out.String(), "\n", 2)[0], "New password for carol: ")
+		got, err := s.GetUser(u.ID)
+		if err != nil || !got.MustChangePassword || !checkPasswordHash(password, got.Password) {
+			t.Fatalf("after reset-password %q printed %q: %+v, %v", tc.args, out.String(), got, err)
+		}
+	}
+}
+
+// TestBootstrap runs against fresh in-memory stores only, since bootstrap
+// only creates an admin in a store without one.
+func TestBootstrap(t *testing.T) {
+	var out bytes.Buffer
+	s := newMemoryStore()
+	if err := bootstrap(s, bootstrapConfig{AdminUsername: "root"}, &out); err != nil {
+		t.Fatalf("bootstrap of an empty store: %v", err)
+	}
+	admin, err := s.GetUserByUsername("root")
+	if err != nil || admin.Permissions != RoleAdmin || !admin.MustChangePassword {
+		t.Fatalf("initial admin = %+v, %v; want an admin who must change their password", admin, err)
+	}
+	var password string
+	if _, err := fmt.Sscanf(out.String(), "Initial admin created: username=root password=%s", &password); err != nil ||
+		!checkPasswordHash(password, admin.Password) {
+		t.Fatalf("bootstrap output %q doesn't have the admin's password", out.String())
+	}
+	if users, err := s.ListUsers(); err != nil || len(users) != 1 {
+		t.Fatalf("users without --seed-demo = %+v, %v; want only the admin", users, err)
+	}
+	out.Reset()
+	if err := bootstrap(s, bootstrapConfig{AdminUsername: "root", SeedDemo: true}, &out); err != nil {
+		t.Fatalf("bootstrap with an admin: %v", err)
+	}
+	if strings.Contains(out.String(), "Initial admin") {
+		t.Fatalf("bootstrap created a second admin: %q", out.String())
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if u, err := s.GetUserByUsername(name); err != nil || u.Permissions != RoleUser {
+			t.Fatalf("demo user %s = %+v, %v", name, u, err)
+		}
+	}
+
+	// Known default admin passwords only pass in dev mode
+	cfg := bootstrapConfig{AdminUsername: "admin", AdminPassword: "changeme"}
+	if err := bootstrap(newMemoryStore(), cfg, io.Discard); err == nil {
+		t.Fatalf("bootstrap with a default ADMIN_PASSWORD: want an error")
+	}
+	cfg.Dev = true
+	dev := newMemoryStore()
+	if err := bootstrap(dev, cfg, io.Discard); err != nil {
+		t.Fatalf("bootstrap with a default ADMIN_PASSWORD in dev mode: %v", err)
+	}
+	if admin, err := dev.GetUserByUsername("admin"); err != nil || admin.MustChangePassword || !checkPasswordHash("changeme", admin.Password) {
+		t.Fatalf("admin from ADMIN_PASSWORD = %+v, %v", admin, err)
+	}
+	cfg.Dev = false
+	if err := bootstrap(dev, cfg, io.Discard); err == nil || !strings.Contains(err.Error(), "known default password") {
+		t.Fatalf("starting with an admin/changeme account: got %v, want a refusal", err)
+	}
+	if err := runResetPasswordCommand(dev, []string{"admin"}, io.Discard); err != nil {
+		t.Fatalf("reset-password: %v", err)
+	}
+	if err := bootstrap(dev, cfg, io.Discard); err != nil {
+		t.Fatalf("starting after reset-password: %v", err)
+	}
+}
+
+// TestBootstrapDemoUsers checks that demo users with their default passwords
+// have to change them, unless the server runs with --dev.
+func TestBootstrapDemoUsers(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        bootstrapConfig
+		legacy     bool // the demo users exist from before
+		mustChange bool
+	}{
+		{"seeded", bootstrapConfig{SeedDemo: true}, false, true},
+		{"seeded in dev mode", bootstrapConfig{SeedDemo: true, Dev: true}, false, false},
+		{"legacy", bootstrapConfig{}, true, true},
+		{"legacy in dev mode", bootstrapConfig{Dev: true}, true, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newMemoryStore()
+			tc.cfg.AdminUsername, tc.cfg.AdminPassword = "root", "root-password"
+			if tc.legacy {
+				for _, name := range demoUsernames {
+					hash, err := hashPassword(name)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := s.CreateUser(&User{Username: name, Password: hash, Permissions: RoleUser}); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := bootstrap(s, tc.cfg, io.Discard); err != nil {
+				t.Fatalf("bootstrap: %v", err)
+			}
+			for _, name := range demoUsernames {
+				u, err := s.GetUserByUsername(name)
+				if err != nil || u.MustChangePassword != tc.mustChange || !checkPasswordHash(name, u.Password) {
+					t.Fatalf("demo user %s = %+v, %v; want must_change_password %v", name, u, err, tc.mustChange)
+				}
+			}
+		})
+	}
+
+	// A demo user who changed their password is left alone
+	s := newMemoryStore()
+	hash, err := hashPassword("a-better-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateUser(&User{Username: "alice", Password: hash, Permissions: RoleUser}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bootstrap(s, bootstrapConfig{AdminUsername: "root", AdminPassword: "root-password"}, io.Discard); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	if u, err := s.GetUserByUsername("alice"); err != nil || u.MustChangePassword {
+		t.Fatalf("alice with a password of their own = %+v, %v", u, err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --------------------------
+//     Income + Cash Flow
+// --------------------------
+
+// Charge directions. Amounts are never negative; the direction says which
+// way the money went. A refund is money back from earlier spending, so it
+// counts against expenses rather than as income.
+const (
+	DirectionExpense = "expense"
+	DirectionIncome  = "income"
+	DirectionRefund  = "refund"
+)
+
+// validateDirection normalizes c's direction, defaulting to an expense,
+// and rejects negative amounts.
+func validateDirection(c *Charge) error {
+	c.Direction = strings.ToLower(strings.TrimSpace(c.Direction))
+	switch c.Direction {
+	case "":
+		c.Direction = DirectionExpense
+	case DirectionExpense, DirectionIncome, DirectionRefund:
+	default:
+		return fmt.Errorf("invalid direction %q (want expense, income or refund)", c.Direction)
+	}
+	if c.Amount.Minor < 0 {
+		return fmt.Errorf("amount must not be negative; record money coming in with direction income or refund")
+	}
+	return nil
+}
+
+// spendingOf is what c adds to spending: its amount for an expense, less
+// its amount for a refund. Income isn't spending, and neither are the legs
+// of a transfer, so ok is false for them.
+func spendingOf(c Charge) (m Money, ok bool) {
+	if c.TransferID != nil {
+		return Money{}, false
+	}
+	switch c.Direction {
+	case DirectionIncome:
+		return Money{}, false
+	case DirectionRefund:
+		return c.Amount.Neg(), true
+	}
+	return c.Amount, true
+}
+
+// CashflowPeriod: what came in and went out in one period, per currency.
+// Net is income plus refunds less expenses.
+type CashflowPeriod struct {
+	PeriodStart string      `json:"period_start"`
+	PeriodEnd   string      `json:"period_end"`
+	Income      MoneyTotals `json:"income"`
+	Expenses    MoneyTotals `json:"expenses"`
+	Refunds     MoneyTotals `json:"refunds"`
+	Net         MoneyTotals `json:"net"`
+}
+
+func newCashflowPeriod(start, end time.Time) *CashflowPeriod {
+	return &CashflowPeriod{
+		PeriodStart: start.Format(time.RFC3339),
+		PeriodEnd:   end.Format(time.RFC3339),
+		Income:      MoneyTotals{},
+		Expenses:    MoneyTotals{},
+		Refunds:     MoneyTotals{},
+		Net:         MoneyTotals{},
+	}
+}
+
+// add counts charge c towards the period. Transfers only move money between
+// the owner's accounts, so their legs are left out.
+func (p *CashflowPeriod) add(c Charge) error {
+	if c.TransferID != nil {
+		return nil
+	}
+	kind, net := p.Expenses, c.Amount.Neg()
+	switch c.Direction {
+	case DirectionIncome:
+		kind, net = p.Income, c.Amount
+	case DirectionRefund:
+		kind, net = p.Refunds, c.Amount
+	}
+	if err := kind.Add(c.Amount); err != nil {
+		return err
+	}
+	return p.Net.Add(net)
+}
+
+// maxCashflowPeriods caps how many periods one cash flow report spans.
+const maxCashflowPeriods = 1000
+
+// GET /api/reports/cashflow => income, expenses, refunds and net cash flow
+// of the JWT user (or ?owner=<id>, read access) per ?interval= (daily,
+// weekly, monthly (default), quarterly or yearly) between ?from= and ?to=
+// (YYYY-MM-DD or RFC 3339, to exclusive; default the current year), plus
+// the totals over the whole window. Periods are calendar periods, the first
+// and last cut to the window.
+func (s *Server) cashflowHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	from, to, err := reportWindow(r, "yearly")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	interval := strings.ToLower(r.URL.Query().Get("interval"))
+	switch interval {
+	case "":
+		interval = "monthly"
+	case "daily", "weekly", "monthly", "quarterly", "yearly":
+	default:
+		http.Error(w, "interval must be daily, weekly, monthly, quarterly or yearly", http.StatusBadRequest)
+		return
+	}
+
+	var periods []*CashflowPeriod
+	var ends []time.Time
+	for start := from; start.Before(to); {
+		if len(periods) == maxCashflowPeriods {
+			http.Error(w, fmt.Sprintf("The report would span more than %d periods; use a longer interval", maxCashflowPeriods), http.StatusBadRequest)
+			return
+		}
+		_, end, _ := periodWindow(interval, start)
+		if end.After(to) {
+			end = to
+		}
+		periods = append(periods, newCashflowPeriod(start, end))
+		ends = append(ends, end)
+		start = end
+	}
+
+	charges, err := s.store.ListCharges(&ListFilter{OwnerID: ownerID, From: &from, To: &to, Sort: "created_at", Order: "asc"})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying charges: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	total := newCashflowPeriod(from, to)
+	i := 0
+	for _, c := range charges {
+		t, err := parseDate(c.CreatedAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Charge %d: invalid created_at %q", c.ID, c.CreatedAt), http.StatusInternalServerError)
+			return
+		}
+		for i < len(ends)-1 && !t.Before(ends[i]) {
+			i++
+		}
+		if err = periods[i].add(c); err == nil {
+			err = total.add(c)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error totaling charges: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":     from.Format(time.RFC3339),
+		"to":       to.Format(time.RFC3339),
+		"interval": interval,
+		"periods":  periods,
+		"total":    total,
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestValidateDirection(t *testing.T) {
+	tests := []struct {
+		direction, amount string
+		want              string
+		ok                bool
+	}{
+		{"", "5", DirectionExpense, true},
+		{" Income ", "5", DirectionIncome, true},
+		{"REFUND", "0", DirectionRefund, true},
+		{"expense", "5", DirectionExpense, true},
+		{"transfer", "5", "", false},
+		{"", "-5", "", false},
+		{"income", "-0.01", "", false},
+	}
+	for _, tc := range tests {
+		c := Charge{Direction: tc.direction, Amount: mustMoney(tc.amount, "USD")}
+		err := validateDirection(&c)
+		if (err == nil) != tc.ok || (tc.ok && c.Direction != tc.want) {
+			t.Fatalf("validateDirection(%q, %s) = %q, %v; want %q, ok %v", tc.direction, tc.amount, c.Direction, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestSpendingOf(t *testing.T) {
+	transferID := 1
+	tests := []struct {
+		name   string
+		charge Charge
+		want   string
+		ok     bool
+	}{
+		{"an expense", Charge{Direction: DirectionExpense}, "12.50", true},
+		{"a refund", Charge{Direction: DirectionRefund}, "-12.50", true},
+		{"income", Charge{Direction: DirectionIncome}, "", false},
+		{"a transfer leg", Charge{Direction: DirectionExpense, TransferID: &transferID}, "", false},
+	}
+	for _, tc := range tests {
+		tc.charge.Amount = mustMoney("12.50", "USD")
+		got, ok := spendingOf(tc.charge)
+		if ok != tc.ok || (ok && got.String() != tc.want) {
+			t.Fatalf("spendingOf(%s) = %s, %v; want %s, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestCashflowPeriodAdd(t *testing.T) {
+	transferID := 1
+	p := &CashflowPeriod{Income: MoneyTotals{}, Expenses: MoneyTotals{}, Refunds: MoneyTotals{}, Net: MoneyTotals{}}
+	for _, c := range []Charge{
+		{Direction: DirectionIncome, Amount: mustMoney("1000", "USD")},
+		{Direction: DirectionExpense, Amount: mustMoney("250", "USD")},
+		{Direction: DirectionRefund, Amount: mustMoney("20", "USD")},
+		{Direction: DirectionExpense, Amount: mustMoney("8", "EUR")},
+		{Direction: DirectionExpense, Amount: mustMoney("500", "USD"), TransferID: &transferID},
+	} {
+		p.add(c)
+	}
+	data, err := json.Marshal(p)
+	want := `{"period_start":"","period_end":"","income":{"USD":1000.00},"expenses":{"EUR":8.00,"USD":250.00},"refunds":{"USD":20.00},"net":{"EUR":-8.00,"USD":770.00}}`
+	if err != nil || string(data) != want {
+		t.Fatalf("period = %s, %v; want %s", data, err, want)
+	}
+}
+
+func TestDirectionStore(t *testing.T) {
+	eachStore(t, testDirections)
+}
+
+func TestCashflowReport(t *testing.T) {
+	eachStore(t, testCashflowReport)
+}
+
+// testCashflowReport checks the cash flow report's periods over charges on
+// known dates.
+func testCashflowReport(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	for _, c := range []Charge{
+		{Name: "Salary", Amount: mustMoney("1000", "USD"), Direction: DirectionIncome, CreatedAt: "2024-01-31T09:00:00Z"},
+		{Name: "Rent", Amount: mustMoney("600", "USD"), Direction: DirectionExpense, CreatedAt: "2024-02-01T09:00:00Z"},
+		{Name: "Refund", Amount: mustMoney("50", "USD"), Direction: DirectionRefund, CreatedAt: "2024-03-15T09:00:00Z"},
+		{Name: "Too late", Amount: mustMoney("99", "USD"), Direction: DirectionExpense, CreatedAt: "2024-04-01T00:00:00Z"},
+	} {
+		c.UserID = at.alice.ID
+		c.Category = "Misc"
+		if err := s.CreateCharge(&c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type period struct {
+		Start string                 `json:"period_start"`
+		Net   map[string]json.Number `json:"net"`
+	}
+	tests := []struct {
+		query  string
+		status int
+		nets   []string // net USD per period, "" for none
+		total  string
+	}{
+		{"interval=monthly", http.StatusOK, []string{"1000.00", "-600.00", "50.00"}, "450.00"},
+		{"", http.StatusOK, []string{"1000.00", "-600.00", "50.00"}, "450.00"},
+		{"interval=quarterly", http.StatusOK, []string{"450.00"}, "450.00"},
+		{"interval=yearly", http.StatusOK, []string{"450.00"}, "450.00"},
+		{"interval=daily", http.StatusOK, nil, "450.00"},
+		{"interval=hourly", http.StatusBadRequest, nil, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			var report struct {
+				Periods []period `json:"periods"`
+				Total   period   `json:"total"`
+			}
+			path := "/api/reports/cashflow?from=2024-01-01&to=2024-04-01&" + tc.query
+			if err := at.a.expectStatus(tc.status, "GET", path, nil, &report); err != nil {
+				t.Fatal(err)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			if tc.nets != nil {
+				if len(report.Periods) != len(tc.nets) {
+					t.Fatalf("%d periods, want %d", len(report.Periods), len(tc.nets))
+				}
+				for i, p := range report.Periods {
+					if string(p.Net["USD"]) != tc.nets[i] {
+						t.Fatalf("period %d from %s: net %s, want %s", i, p.Start, p.Net["USD"], tc.nets[i])
+					}
+				}
+			} else if len(report.Periods) != 91 {
+				t.Fatalf("%d daily periods, want 91", len(report.Periods))
+			}
+			if string(report.Total.Net["USD"]) != tc.total {
+				t.Fatalf("total net = %s, want %s", report.Total.Net["USD"], tc.total)
+			}
+		})
+	}
+
+	if err := at.a.expectStatus(http.StatusBadRequest, "GET", "/api/reports/cashflow?from=2024-04-01&to=2024-01-01", nil, nil); err != nil {
+		t.Fatalf("from after to: %v", err)
+	}
+	if err := at.a.expectStatus(http.StatusBadRequest, "GET", "/api/reports/cashflow?from=2000-01-01&to=2024-01-01&interval=daily", nil, nil); err != nil {
+		t.Fatalf("too many periods: %v", err)
+	}
+	if err := at.b.expectStatus(http.StatusForbidden, "GET", "/api/reports/cashflow?owner="+strconv.Itoa(at.alice.ID), nil, nil); err != nil {
+		t.Fatalf("another user's report: %v", err)
+	}
+}
+
+func testDirections(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	account := Account{Name: "Checking", Type: "checking", OpeningBalance: mustMoney("0", "USD"), UserID: u.ID}
+	if err := s.CreateAccount(&account); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	created := map[string]*Charge{}
+	for _, c := range []Charge{
+		{Name: "Salary", Direction: DirectionIncome, Amount: mustMoney("2000", "USD")},
+		{Name: "Shoes", Amount: mustMoney("80", "USD")},
+		{Name: "Shoes returned", Direction: DirectionRefund, Amount: mustMoney("30", "USD")},
+	} {
+		c := c
+		c.UserID, c.AccountID, c.CreatedAt = u.ID, &account.ID, "2024-05-01T12:00:00Z"
+		if err := s.CreateCharge(&c); err != nil {
+			t.Fatalf("CreateCharge: %v", err)
+		}
+		created[c.Name] = &c
+	}
+	if got, err := s.GetCharge(created["Shoes"].ID); err != nil || got.Direction != DirectionExpense {
+		t.Fatalf("charge stored without a direction has %q, %v; want expense", got.Direction, err)
+	}
+
+	income, err := s.ListCharges(&ListFilter{OwnerID: u.ID, Direction: DirectionIncome})
+	if err != nil || len(income) != 1 || income[0].Name != "Salary" {
+		t.Fatalf("ListCharges(direction=income) = %+v, %v", income, err)
+	}
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	spent, err := sumChargesByCurrency(s, u.ID, nil, start, start.AddDate(0, 1, 0))
+	if err != nil || spent["USD"].String() != "50.00" {
+		t.Fatalf("spending = %v, %v; want 50.00 (shoes less the refund)", spent, err)
+	}
+	if _, balance, err := accountLedger(s, account, nil); err != nil || balance.String() != "1950.00" {
+		t.Fatalf("account balance = %s, %v; want 1950.00", balance, err)
+	}
+
+	refund := *created["Shoes returned"]
+	refund.Direction = DirectionExpense
+	if err := s.UpdateCharge(refund); err != nil {
+		t.Fatalf("UpdateCharge: %v", err)
+	}
+	if got, err := s.GetCharge(refund.ID); err != nil || got.Direction != DirectionExpense {
+		t.Fatalf("updated direction = %q, %v", got.Direction, err)
+	}
+}
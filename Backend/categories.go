@@ -0,0 +1,525 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --------------------------
+//        Categories
+// --------------------------
+
+// Category: one of a user's categories. ParentID nests it under another of
+// the same user's categories, e.g. Food > Groceries. Path is the full name
+// from the root, filled in on responses.
+type Category struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentID *int   `json:"parent_id"`
+	UserID   int    `json:"user_id"`
+	Path     string `json:"path,omitempty"`
+}
+
+// categoryPathSep joins the names along a category's path. Paths sent by
+// clients may also use "/".
+const categoryPathSep = " > "
+
+var categoryPathSplit = regexp.MustCompile(`\s*[/>]\s*`)
+
+// defaultCategories are seeded for every new user.
+var defaultCategories = []string{
+	"Housing", "Housing > Rent", "Housing > Utilities",
+	"Food", "Food > Groceries", "Food > Dining Out",
+	"Transportation", "Health", "Entertainment", "Shopping", "Travel",
+	"Miscellaneous",
+}
+
+// errInvalidCategory: a budget or charge names a category it can't use.
+var errInvalidCategory = errors.New("invalid category")
+
+// splitCategoryPath splits "Food > Groceries" or "Food/Groceries" into its names.
+func splitCategoryPath(path string) []string {
+	var names []string
+	for _, name := range categoryPathSplit.Split(strings.TrimSpace(path), -1) {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// validateCategoryName rejects names that are empty, too long or would
+// read as a path.
+func validateCategoryName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return "", fmt.Errorf("category name is required")
+	case len(name) > 100:
+		return "", fmt.Errorf("category name is longer than 100 characters")
+	case strings.ContainsAny(name, "/>"):
+		return "", fmt.Errorf("category name can't contain / or >")
+	}
+	return name, nil
+}
+
+// categoryTree indexes one user's categories for path and subtree lookups.
+type categoryTree struct {
+	ownerID  int
+	byID     map[int]Category
+	children map[int][]int // parent ID (0 for roots) => child IDs
+}
+
+func loadCategoryTree(store Store, ownerID int) (*categoryTree, error) {
+	categories, err := store.ListCategories(ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("loading categories: %v", err)
+	}
+	t := &categoryTree{ownerID: ownerID, byID: map[int]Category{}, children: map[int][]int{}}
+	for _, c := range categories {
+		t.add(c)
+	}
+	return t, nil
+}
+
+func (t *categoryTree) add(c Category) {
+	t.byID[c.ID] = c
+	parent := 0
+	if c.ParentID != nil {
+		parent = *c.ParentID
+	}
+	t.children[parent] = append(t.children[parent], c.ID)
+}
+
+// path returns the names from the root down to category id.
+func (t *categoryTree) path(id int) string {
+	var names []string
+	for seen := 0; seen <= len(t.byID); seen++ {
+		c, ok := t.byID[id]
+		if !ok {
+			break
+		}
+		names = append([]string{c.Name}, names...)
+		if c.ParentID == nil {
+			break
+		}
+		id = *c.ParentID
+	}
+	return strings.Join(names, categoryPathSep)
+}
+
+// subtree returns id and the IDs of all its descendants.
+func (t *categoryTree) subtree(id int) []int {
+	ids := []int{id}
+	for i := 0; i < len(ids); i++ {
+		ids = append(ids, t.children[ids[i]]...)
+	}
+	return ids
+}
+
+// child finds the category called name (case-insensitively) under parent,
+// 0 for the roots.
+func (t *categoryTree) child(parent int, name string) (Category, bool) {
+	for _, id := range t.children[parent] {
+		if c := t.byID[id]; strings.EqualFold(c.Name, name) {
+			return c, true
+		}
+	}
+	return Category{}, false
+}
+
+// withPaths returns every category with its Path set, ordered by path.
+func (t *categoryTree) withPaths() []Category {
+	categories := make([]Category, 0, len(t.byID))
+	for id, c := range t.byID {
+		c.Path = t.path(id)
+		categories = append(categories, c)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return strings.ToLower(categories[i].Path) < strings.ToLower(categories[j].Path)
+	})
+	return categories
+}
+
+// matching returns the IDs of the categories whose name or path is one of
+// names (case-insensitively), with their descendants.
+func (t *categoryTree) matching(names []string) []int {
+	ids := []int{}
+	for id, c := range t.byID {
+		path := strings.Join(splitCategoryPath(t.path(id)), "/")
+		for _, name := range names {
+			if strings.EqualFold(c.Name, name) || strings.EqualFold(path, strings.Join(splitCategoryPath(name), "/")) {
+				ids = append(ids, t.subtree(id)...)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// resolve works out the category a budget or charge is filed under:
+// categoryID when given, which must be one of the owner's, otherwise the
+// path in name, creating any levels that don't exist yet. It returns the
+// category ID (nil for uncategorized) and the path stored alongside it.
+func (t *categoryTree) resolve(tx Store, categoryID *int, name string, src auditSource) (*int, string, error) {
+	if categoryID != nil {
+		if _, ok := t.byID[*categoryID]; !ok {
+			return nil, "", fmt.Errorf("%w: no category %d", errInvalidCategory, *categoryID)
+		}
+		id := *categoryID
+		return &id, t.path(id), nil
+	}
+
+	names := splitCategoryPath(name)
+	if len(names) == 0 {
+		return nil, "", nil
+	}
+	parent := 0
+	for _, n := range names {
+		n, err := validateCategoryName(n)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", errInvalidCategory, err)
+		}
+		c, ok := t.child(parent, n)
+		if !ok {
+			c = Category{Name: n, UserID: t.ownerID}
+			if parent != 0 {
+				p := parent
+				c.ParentID = &p
+			}
+			if err := tx.CreateCategory(&c); err != nil {
+				return nil, "", fmt.Errorf("creating category %q: %v", n, err)
+			}
+			if err := src.record(tx, AuditCreate, "category", c.ID, t.ownerID, nil, c); err != nil {
+				return nil, "", err
+			}
+			t.add(c)
+		}
+		parent = c.ID
+	}
+	return &parent, t.path(parent), nil
+}
+
+// seedCategories gives a new user the default categories.
+func seedCategories(tx Store, userID int) error {
+	t := &categoryTree{ownerID: userID, byID: map[int]Category{}, children: map[int][]int{}}
+	for _, path := range defaultCategories {
+		if _, _, err := t.resolve(tx, nil, path, systemAudit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandCategoryFilter turns the category names and IDs a list was filtered
+// on into f.CategoryIDs, including every subcategory, so filtering on Food
+// also finds Food > Groceries.
+func expandCategoryFilter(store Store, f *ListFilter) error {
+	if len(f.Categories) == 0 && f.CategoryIDs == nil {
+		return nil
+	}
+	t, err := loadCategoryTree(store, f.OwnerID)
+	if err != nil {
+		return err
+	}
+	ids := t.matching(f.Categories)
+	for _, id := range f.CategoryIDs {
+		if _, ok := t.byID[id]; ok {
+			ids = append(ids, t.subtree(id)...)
+		}
+	}
+	f.CategoryIDs = ids
+	return nil
+}
+
+// GET /api/categories => the JWT user's categories (or ?owner=<id>, read
+// access) with their full paths, ordered by path
+func (s *Server) getCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	t, err := loadCategoryTree(s.store, ownerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying categories: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(t.withPaths())
+}
+
+// POST /api/categories => create a category for the JWT user (or ?owner=<id>,
+// write access). Body: { "name": "Groceries", "parent_id": 3 }
+func (s *Server) createCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var c Category
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if c.Name, err = validateCategoryName(c.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.ID = 0
+	c.UserID = ownerID
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		t, err := loadCategoryTree(tx, ownerID)
+		if err != nil {
+			return err
+		}
+		if c.ParentID != nil {
+			if _, ok := t.byID[*c.ParentID]; !ok {
+				return fmt.Errorf("%w: no parent category %d", errInvalidCategory, *c.ParentID)
+			}
+		}
+		if err := tx.CreateCategory(&c); err != nil {
+			return err
+		}
+		t.add(c)
+		c.Path = t.path(c.ID)
+		return audit.record(tx, AuditCreate, "category", c.ID, ownerID, nil, c)
+	})
+	if errors.Is(err, errInvalidCategory) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, "A category with that name already exists there", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating category: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// PUT /api/categories/{id} => rename a category or move it under another
+// parent (null for the top level). Budgets and charges filed under it or
+// its subcategories follow. Accepts ?owner=<id> with write access.
+func (s *Server) updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	vars := mux.Vars(r)
+	categoryID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	var c Category
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if c.Name, err = validateCategoryName(c.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.ID = categoryID
+	c.UserID = ownerID
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		t, err := loadCategoryTree(tx, ownerID)
+		if err != nil {
+			return err
+		}
+		before, ok := t.byID[categoryID]
+		if !ok {
+			return ErrNotFound
+		}
+		if c.ParentID != nil {
+			if _, ok := t.byID[*c.ParentID]; !ok {
+				return fmt.Errorf("%w: no parent category %d", errInvalidCategory, *c.ParentID)
+			}
+			for _, id := range t.subtree(categoryID) {
+				if id == *c.ParentID {
+					return fmt.Errorf("%w: a category can't be moved under itself", errInvalidCategory)
+				}
+			}
+		}
+		before.Path = t.path(categoryID)
+		if err := tx.UpdateCategory(c); err != nil {
+			return err
+		}
+		if t, err = loadCategoryTree(tx, ownerID); err != nil {
+			return err
+		}
+		c.Path = t.path(categoryID)
+		return audit.record(tx, AuditUpdate, "category", categoryID, ownerID, before, c)
+	})
+	if errors.Is(err, errInvalidCategory) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Category not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, "A category with that name already exists there", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating category: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(c)
+}
+
+// DELETE /api/categories/{id} => delete a category without subcategories.
+// Budgets and charges filed under it become uncategorized. Accepts
+// ?owner=<id> with write access.
+func (s *Server) deleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	vars := mux.Vars(r)
+	categoryID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, err := tx.GetCategory(categoryID)
+		if err == nil && before.UserID != ownerID {
+			err = ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteCategory(ownerID, categoryID); err != nil {
+			return err
+		}
+		return audit.record(tx, AuditDelete, "category", categoryID, ownerID, before, nil)
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Category not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, "Delete or move the category's subcategories first", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting category: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Category deleted successfully", "owner_id": ownerID})
+}
+
+// CategoryTotal: what was charged to one category in a window, on its own
+// and rolled up with all its subcategories.
+type CategoryTotal struct {
+	Category
+	Total    MoneyTotals `json:"total"`
+	RolledUp MoneyTotals `json:"rolled_up"`
+}
+
+// GET /api/reports/categories => spending per category of the JWT user
+// (or ?owner=<id>, read access) between ?from= and ?to= (YYYY-MM-DD or
+// RFC 3339, to exclusive; default the current month), each also rolled up
+// over its subcategories. Refunds count against spending and income isn't
+// counted; split charges count per line. Uncategorized charges are
+// totalled separately.
+func (s *Server) categoryTotalsHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	from, to, err := reportWindow(r, "monthly")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := loadCategoryTree(s.store, ownerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	charges, err := s.store.ListCharges(&ListFilter{OwnerID: ownerID, From: &from, To: &to})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying charges: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	own := map[int]MoneyTotals{}
+	uncategorized := MoneyTotals{}
+	for _, c := range charges {
+		for _, line := range spendingLines(c) {
+			totals := uncategorized
+			if line.CategoryID != nil {
+				if own[*line.CategoryID] == nil {
+					own[*line.CategoryID] = MoneyTotals{}
+				}
+				totals = own[*line.CategoryID]
+			}
+			if err := totals.Add(line.Amount); err != nil {
+				http.Error(w, fmt.Sprintf("Error totaling charges: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	lines := []CategoryTotal{}
+	for _, c := range t.withPaths() {
+		line := CategoryTotal{Category: c, Total: MoneyTotals{}, RolledUp: MoneyTotals{}}
+		for code, m := range own[c.ID] {
+			line.Total[code] = m
+		}
+		for _, id := range t.subtree(c.ID) {
+			for _, m := range own[id] {
+				if err := line.RolledUp.Add(m); err != nil {
+					http.Error(w, fmt.Sprintf("Error totaling charges: %v", err), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":          from.Format(time.RFC3339),
+		"to":            to.Format(time.RFC3339),
+		"categories":    lines,
+		"uncategorized": uncategorized,
+	})
+}
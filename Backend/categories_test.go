@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSplitCategoryPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"Food", []string{"Food"}},
+		{"Food > Groceries", []string{"Food", "Groceries"}},
+		{" Food/Groceries / Organic ", []string{"Food", "Groceries", "Organic"}},
+		{"Food >> Groceries", []string{"Food", "Groceries"}},
+		{"/Food/", []string{"Food"}},
+		{"", nil},
+	}
+	for _, tc := range tests {
+		if got := splitCategoryPath(tc.path); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("splitCategoryPath(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestValidateCategoryName(t *testing.T) {
+	tests := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"Groceries", "Groceries", true},
+		{"  Dining Out ", "Dining Out", true},
+		{strings.Repeat("x", 100), strings.Repeat("x", 100), true},
+		{strings.Repeat("x", 101), "", false},
+		{"   ", "", false},
+		{"Food/Groceries", "", false},
+		{"Food > Groceries", "", false},
+	}
+	for _, tc := range tests {
+		if got, err := validateCategoryName(tc.name); got != tc.want || (err == nil) != tc.ok {
+			t.Fatalf("validateCategoryName(%q) = %q, %v; want %q, ok %v", tc.name, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestCategoryTree(t *testing.T) {
+	id := func(n int) *int { return &n }
+	tree := &categoryTree{byID: map[int]Category{}, children: map[int][]int{}}
+	for _, c := range []Category{
+		{ID: 1, Name: "Food"},
+		{ID: 2, Name: "Groceries", ParentID: id(1)},
+		{ID: 3, Name: "Organic", ParentID: id(2)},
+		{ID: 4, Name: "Travel"},
+		{ID: 5, Name: "Groceries", ParentID: id(4)},
+	} {
+		tree.add(c)
+	}
+
+	if got := tree.path(3); got != "Food > Groceries > Organic" {
+		t.Fatalf("path(3) = %q", got)
+	}
+	if c, ok := tree.child(1, "GROCERIES"); !ok || c.ID != 2 {
+		t.Fatalf("child(1, GROCERIES) = %+v, %v", c, ok)
+	}
+	if _, ok := tree.child(0, "Groceries"); ok {
+		t.Fatalf("child(0, Groceries) found a subcategory at the top level")
+	}
+
+	tests := []struct {
+		names []string
+		want  []int
+	}{
+		{[]string{"food"}, []int{1, 2, 3}},
+		{[]string{"Groceries"}, []int{2, 3, 5}},
+		{[]string{"food/groceries"}, []int{2, 3}},
+		{[]string{"Travel > Groceries", "organic"}, []int{3, 5}},
+		{[]string{"Food/Organic"}, []int{}},
+		{[]string{"Rent"}, []int{}},
+	}
+	for _, tc := range tests {
+		got := tree.matching(tc.names)
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("matching(%q) = %v, want %v", tc.names, got, tc.want)
+		}
+	}
+
+	var paths []string
+	for _, c := range tree.withPaths() {
+		paths = append(paths, c.Path)
+	}
+	if got := strings.Join(paths, ", "); got != "Food, Food > Groceries, Food > Groceries > Organic, Travel, Travel > Groceries" {
+		t.Fatalf("withPaths = %s", got)
+	}
+}
+
+func TestCategoryStore(t *testing.T) {
+	eachStore(t, testCategories)
+}
+
+func TestCategoryAPI(t *testing.T) {
+	eachStore(t, testCategoryAPI)
+}
+
+// testCategoryAPI creates, moves and deletes categories through the API.
+func testCategoryAPI(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	a := at.a
+
+	var food Category
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/categories", map[string]string{"name": "Food"}, &food); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		body   map[string]interface{}
+		status int
+		path   string
+	}{
+		{"a subcategory", map[string]interface{}{"name": "Groceries", "parent_id": food.ID}, http.StatusCreated, "Food > Groceries"},
+		{"a duplicate", map[string]interface{}{"name": "food"}, http.StatusConflict, ""},
+		{"a name with a slash", map[string]interface{}{"name": "Food/Snacks"}, http.StatusBadRequest, ""},
+		{"no name", map[string]interface{}{"name": " "}, http.StatusBadRequest, ""},
+		{"an unknown parent", map[string]interface{}{"name": "Snacks", "parent_id": food.ID + 1000}, http.StatusBadRequest, ""},
+		{"a top-level category", map[string]interface{}{"name": "Travel"}, http.StatusCreated, "Travel"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var c Category
+			if err := a.expectStatus(tc.status, "POST", "/api/categories", tc.body, &c); err != nil {
+				t.Fatal(err)
+			}
+			if tc.path != "" && c.Path != tc.path {
+				t.Fatalf("path = %q, want %q", c.Path, tc.path)
+			}
+		})
+	}
+
+	// A charge filed under a new path creates its missing levels
+	charge := map[string]interface{}{"name": "Apples", "amount": 3, "category": "food/groceries/Organic"}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", charge, nil); err != nil {
+		t.Fatal(err)
+	}
+	var categories []Category
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/categories", nil, &categories); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, c := range categories {
+		paths = append(paths, c.Path)
+	}
+	if got := strings.Join(paths, ", "); got != "Food, Food > Groceries, Food > Groceries > Organic, Travel" {
+		t.Fatalf("categories = %s", got)
+	}
+	if err := a.expectStatus(http.StatusConflict, "DELETE", "/api/categories/"+strconv.Itoa(food.ID), nil, nil); err != nil {
+		t.Fatalf("deleting a category with subcategories: %v", err)
+	}
+	if err := at.b.expectStatus(http.StatusNotFound, "DELETE", "/api/categories/"+strconv.Itoa(categories[3].ID), nil, nil); err != nil {
+		t.Fatalf("deleting another user's category: %v", err)
+	}
+	if err := a.expectStatus(http.StatusOK, "DELETE", "/api/categories/"+strconv.Itoa(categories[3].ID), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testCategories(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+	other, cleanupOther := testUser(t, s, "secret")
+	defer cleanupOther()
+
+	food := Category{Name: "Food", UserID: u.ID}
+	if err := s.CreateCategory(&food); err != nil {
+		t.Fatalf("CreateCategory: %v", err)
+	}
+	if err := s.CreateCategory(&Category{Name: "FOOD", UserID: u.ID}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("duplicate sibling name: got %v, want ErrConflict", err)
+	}
+	if err := s.CreateCategory(&Category{Name: "Food", UserID: other.ID}); err != nil {
+		t.Fatalf("another user's Food: %v", err)
+	}
+	groceries := Category{Name: "Groceries", ParentID: &food.ID, UserID: u.ID}
+	if err := s.CreateCategory(&groceries); err != nil {
+		t.Fatalf("CreateCategory(child): %v", err)
+	}
+	if err := s.CreateCategory(&Category{Name: "Food", ParentID: &groceries.ID, UserID: u.ID}); err != nil {
+		t.Fatalf("same name under another parent: %v", err)
+	}
+
+	c := Charge{Name: "Market", Amount: mustMoney("20", "USD"), Category: "Food > Groceries", CategoryID: &groceries.ID, UserID: u.ID}
+	if err := s.CreateCharge(&c); err != nil {
+		t.Fatalf("CreateCharge: %v", err)
+	}
+	missing := -1
+	if err := s.CreateCharge(&Charge{Name: "x", Amount: mustMoney("1", "USD"), CategoryID: &missing, UserID: u.ID}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("charge in a missing category: got %v, want ErrNotFound", err)
+	}
+
+	food.Name = "Food & Drink"
+	if err := s.UpdateCategory(food); err != nil {
+		t.Fatalf("UpdateCategory: %v", err)
+	}
+	if got, _ := s.GetCharge(c.ID); got.Category != "Food & Drink > Groceries" {
+		t.Fatalf("renaming a parent left the charge filed as %q", got.Category)
+	}
+	stolen := food
+	stolen.UserID = other.ID
+	if err := s.UpdateCategory(stolen); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("updating another user's category: got %v, want ErrNotFound", err)
+	}
+
+	if err := s.DeleteCategory(u.ID, food.ID); !errors.Is(err, ErrConflict) {
+		t.Fatalf("deleting a category with children: got %v, want ErrConflict", err)
+	}
+	categories, err := s.ListCategories(u.ID)
+	if err != nil || len(categories) != 3 {
+		t.Fatalf("ListCategories = %+v, %v", categories, err)
+	}
+	for _, cat := range categories {
+		if cat.ParentID != nil && *cat.ParentID == groceries.ID {
+			if err := s.DeleteCategory(u.ID, cat.ID); err != nil {
+				t.Fatalf("DeleteCategory(leaf): %v", err)
+			}
+		}
+	}
+	if err := s.DeleteCategory(u.ID, groceries.ID); err != nil {
+		t.Fatalf("DeleteCategory: %v", err)
+	}
+	if got, _ := s.GetCharge(c.ID); got.CategoryID != nil || got.Category != "" {
+		t.Fatalf("charge in a deleted category = %q (%v), want uncategorized", got.Category, got.CategoryID)
+	}
+}
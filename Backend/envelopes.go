@@ -0,0 +1,804 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --------------------------
+//    Envelope Budgeting
+// --------------------------
+
+// EnvelopeMode: a user's zero-based envelope budgeting settings. Income in
+// Currency from StartMonth (YYYY-MM) on flows into a "to be assigned" pool,
+// which the user hands out to envelopes month by month. Budgets work as
+// before alongside it.
+type EnvelopeMode struct {
+	UserID     int    `json:"user_id"`
+	Currency   string `json:"currency"`
+	StartMonth string `json:"start_month"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// Envelope: money set aside for one category. Charges filed under the
+// category or its subcategories draw it down, unless a subcategory has an
+// envelope of its own. Category is filled in on responses from CategoryID,
+// which is nil once the category is deleted.
+type Envelope struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Category   string `json:"category"`
+	CategoryID *int   `json:"category_id"`
+	UserID     int    `json:"user_id"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// EnvelopeMove: money moved in a month (YYYY-MM) from the pool to an
+// envelope (FromEnvelopeID nil), between envelopes, or from an envelope
+// back to the pool (ToEnvelopeID nil). Moves are the history of what was
+// assigned and are never changed; deleting an envelope leaves the pool in
+// its place. ActorID is who made the move, nil once that user is deleted.
+// Its amount is in the mode's currency, so only "amount" is sent.
+type EnvelopeMove struct {
+	ID             int    `json:"id"`
+	UserID         int    `json:"user_id"`
+	Month          string `json:"month"`
+	FromEnvelopeID *int   `json:"from_envelope_id"`
+	ToEnvelopeID   *int   `json:"to_envelope_id"`
+	Amount         Money  `json:"-"`
+	Note           string `json:"note"`
+	ActorID        *int   `json:"actor_id"`
+	CreatedAt      string `json:"created_at"`
+
+	sent json.Number // amount as sent, until the handler reads it
+}
+
+var (
+	// errEnvelopeModeOff: the owner hasn't turned envelope budgeting on.
+	errEnvelopeModeOff = errors.New("envelope mode is off")
+	// errInvalidEnvelope: an envelope or move that can't be stored as sent.
+	errInvalidEnvelope = errors.New("invalid envelope")
+	// errInsufficientFunds: a move of more than is available to move.
+	errInsufficientFunds = errors.New("insufficient funds")
+)
+
+func (m EnvelopeMove) MarshalJSON() ([]byte, error) {
+	type plain EnvelopeMove
+	return json.Marshal(struct {
+		plain
+		moneyFields
+	}{plain(m), newMoneyFields(m.Amount)})
+}
+
+func (m *EnvelopeMove) UnmarshalJSON(data []byte) error {
+	type plain EnvelopeMove
+	aux := struct {
+		*plain
+		Amount json.Number `json:"amount"`
+	}{plain: (*plain)(m)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m.sent = aux.Amount
+	return nil
+}
+
+// EnvelopeMonth: where a user's envelope money stands at the end of a
+// month. Income and Assigned are the month's: what came in, and what went
+// from the pool into envelopes, net. ToBeAssigned is the income up to the
+// end of the month less everything assigned, in any month, that hasn't
+// been given back. Unbudgeted is the month's spending no envelope draws.
+// It is only ever sent, never read.
+type EnvelopeMonth struct {
+	Month        string            `json:"-"`
+	Currency     string            `json:"-"`
+	Income       Money             `json:"-"`
+	Assigned     Money             `json:"-"`
+	ToBeAssigned Money             `json:"-"`
+	Unbudgeted   Money             `json:"-"`
+	Envelopes    []EnvelopeBalance `json:"-"`
+}
+
+func (m EnvelopeMonth) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Month        string            `json:"month"`
+		Currency     string            `json:"currency"`
+		Income       json.Number       `json:"income"`
+		Assigned     json.Number       `json:"assigned"`
+		ToBeAssigned json.Number       `json:"to_be_assigned"`
+		Unbudgeted   json.Number       `json:"unbudgeted"`
+		Envelopes    []EnvelopeBalance `json:"envelopes"`
+	}{m.Month, m.Currency, m.Income.Number(), m.Assigned.Number(), m.ToBeAssigned.Number(), m.Unbudgeted.Number(), m.Envelopes})
+}
+
+// EnvelopeBalance: one envelope in an EnvelopeMonth. Assigned is what was
+// moved into it in the month, net, and Spent what it was drawn down by.
+// Available carries over from month to month: everything moved into it up
+// to the end of the month less everything it was drawn down by.
+type EnvelopeBalance struct {
+	Envelope
+	Assigned  Money `json:"-"`
+	Spent     Money `json:"-"`
+	Available Money `json:"-"`
+}
+
+func (b EnvelopeBalance) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Envelope
+		Assigned  json.Number `json:"assigned"`
+		Spent     json.Number `json:"spent"`
+		Available json.Number `json:"available"`
+	}{b.Envelope, b.Assigned.Number(), b.Spent.Number(), b.Available.Number()})
+}
+
+// parseMonth parses a YYYY-MM month into the time it starts.
+func parseMonth(s string) (time.Time, error) {
+	m, err := time.Parse("2006-01", strings.TrimSpace(s))
+	if err != nil {
+		return m, fmt.Errorf("invalid month %q, expected YYYY-MM", s)
+	}
+	return m, nil
+}
+
+// thisMonth is the start of the current month.
+func thisMonth() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// envelopeMode looks up ownerID's envelope settings, reporting
+// errEnvelopeModeOff while they have none.
+func envelopeMode(store Store, ownerID int) (EnvelopeMode, error) {
+	mode, err := store.GetEnvelopeMode(ownerID)
+	if errors.Is(err, ErrNotFound) {
+		err = errEnvelopeModeOff
+	}
+	return mode, err
+}
+
+// checkEnvelopeMonth verifies that month is one the mode covers.
+func checkEnvelopeMonth(mode EnvelopeMode, month time.Time) error {
+	start, err := parseMonth(mode.StartMonth)
+	if err != nil {
+		return err
+	}
+	if month.Before(start) {
+		return fmt.Errorf("%w: envelope budgeting starts in %s", errInvalidEnvelope, mode.StartMonth)
+	}
+	return nil
+}
+
+// drawingEnvelope returns the index in byCategory of the envelope that
+// category id is drawn from: the category's own or its nearest ancestor's.
+func drawingEnvelope(tree *categoryTree, byCategory map[int]int, id *int) (int, bool) {
+	for seen := 0; id != nil && seen <= len(tree.byID); seen++ {
+		if i, ok := byCategory[*id]; ok {
+			return i, true
+		}
+		c, ok := tree.byID[*id]
+		if !ok {
+			break
+		}
+		id = c.ParentID
+	}
+	return 0, false
+}
+
+// envelopeMonth works out the mode owner's envelope money in month from
+// their income, moves and spending in the mode's currency since the mode's
+// start month.
+func envelopeMonth(store Store, tree *categoryTree, mode EnvelopeMode, month time.Time) (EnvelopeMonth, error) {
+	zero := Money{Currency: mode.Currency}
+	m := EnvelopeMonth{Month: month.Format("2006-01"), Currency: mode.Currency,
+		Income: zero, Assigned: zero, ToBeAssigned: zero, Unbudgeted: zero, Envelopes: []EnvelopeBalance{}}
+	start, err := parseMonth(mode.StartMonth)
+	if err != nil {
+		return m, err
+	}
+
+	envelopes, err := store.ListEnvelopes(mode.UserID)
+	if err != nil {
+		return m, err
+	}
+	byID, byCategory := map[int]int{}, map[int]int{}
+	for i, e := range envelopes {
+		if e.CategoryID != nil {
+			e.Category = tree.path(*e.CategoryID)
+			byCategory[*e.CategoryID] = i
+		}
+		byID[e.ID] = i
+		m.Envelopes = append(m.Envelopes, EnvelopeBalance{Envelope: e, Assigned: zero, Spent: zero, Available: zero})
+	}
+	envelope := func(id *int) *EnvelopeBalance {
+		if id == nil {
+			return nil
+		}
+		if i, ok := byID[*id]; ok {
+			return &m.Envelopes[i]
+		}
+		return nil
+	}
+
+	moves, err := store.ListEnvelopeMoves(mode.UserID)
+	if err != nil {
+		return m, err
+	}
+	assigned := zero
+	for _, mv := range moves {
+		if mv.Amount.Currency != mode.Currency {
+			continue
+		}
+		at, err := parseMonth(mv.Month)
+		if err != nil {
+			return m, fmt.Errorf("move %d: %v", mv.ID, err)
+		}
+		inMonth := at.Equal(month)
+		from, to := envelope(mv.FromEnvelopeID), envelope(mv.ToEnvelopeID)
+		switch {
+		case from == nil && to != nil:
+			assigned.Minor += mv.Amount.Minor
+			if inMonth {
+				m.Assigned.Minor += mv.Amount.Minor
+			}
+		case from != nil && to == nil:
+			assigned.Minor -= mv.Amount.Minor
+			if inMonth {
+				m.Assigned.Minor -= mv.Amount.Minor
+			}
+		}
+		if at.After(month) {
+			continue
+		}
+		if to != nil {
+			to.Available.Minor += mv.Amount.Minor
+			if inMonth {
+				to.Assigned.Minor += mv.Amount.Minor
+			}
+		}
+		if from != nil {
+			from.Available.Minor -= mv.Amount.Minor
+			if inMonth {
+				from.Assigned.Minor -= mv.Amount.Minor
+			}
+		}
+	}
+
+	end := month.AddDate(0, 1, 0)
+	charges, err := store.ListCharges(&ListFilter{OwnerID: mode.UserID, From: &start, To: &end})
+	if err != nil {
+		return m, err
+	}
+	income := zero
+	for _, c := range charges {
+		at, err := time.Parse(time.RFC3339Nano, c.CreatedAt)
+		inMonth := err == nil && !at.Before(month)
+		if c.Direction == DirectionIncome && c.TransferID == nil {
+			if c.Amount.Currency == mode.Currency {
+				income.Minor += c.Amount.Minor
+				if inMonth {
+					m.Income.Minor += c.Amount.Minor
+				}
+			}
+			continue
+		}
+		for _, line := range spendingLines(c) {
+			if line.Amount.Currency != mode.Currency {
+				continue
+			}
+			i, ok := drawingEnvelope(tree, byCategory, line.CategoryID)
+			switch {
+			case ok:
+				m.Envelopes[i].Available.Minor -= line.Amount.Minor
+				if inMonth {
+					m.Envelopes[i].Spent.Minor += line.Amount.Minor
+				}
+			case inMonth:
+				m.Unbudgeted.Minor += line.Amount.Minor
+			}
+		}
+	}
+	m.ToBeAssigned.Minor = income.Minor - assigned.Minor
+	return m, nil
+}
+
+// ownedEnvelope looks up the envelope in the request path, reporting
+// ErrNotFound when it isn't ownerID's.
+func ownedEnvelope(store Store, r *http.Request, ownerID int) (Envelope, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return Envelope{}, ErrNotFound
+	}
+	e, err := store.GetEnvelope(id)
+	if err == nil && e.UserID != ownerID {
+		err = ErrNotFound
+	}
+	return e, err
+}
+
+// resolveEnvelope validates e's name and files it under the category it
+// names, creating the category when it is missing.
+func resolveEnvelope(tx Store, e *Envelope, src auditSource) error {
+	e.Name = strings.TrimSpace(e.Name)
+	if e.Name == "" || len(e.Name) > 100 {
+		return fmt.Errorf("%w: name must be 1 to 100 characters", errInvalidEnvelope)
+	}
+	t, err := loadCategoryTree(tx, e.UserID)
+	if err != nil {
+		return err
+	}
+	if e.CategoryID, e.Category, err = t.resolve(tx, e.CategoryID, e.Category, src); err != nil {
+		return err
+	}
+	if e.CategoryID == nil {
+		return fmt.Errorf("%w: an envelope needs a category", errInvalidEnvelope)
+	}
+	return nil
+}
+
+// writeEnvelopeError answers the errors envelope handlers share, reporting
+// whether err was one of them.
+func writeEnvelopeError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, errEnvelopeModeOff):
+		http.Error(w, "Envelope mode is off; turn it on with PUT /api/envelopes/mode", http.StatusConflict)
+	case errors.Is(err, errInvalidEnvelope), errors.Is(err, errInvalidCategory):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errInsufficientFunds):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		return false
+	}
+	return true
+}
+
+// GET /api/envelopes/mode => the envelope settings of the JWT user (or
+// ?owner=<id>, read access); 404 while envelope mode is off
+func (s *Server) getEnvelopeModeHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	mode, err := s.store.GetEnvelopeMode(ownerID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Envelope mode is off", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying envelope mode: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(mode)
+}
+
+// PUT /api/envelopes/mode => turn envelope budgeting on for the JWT user
+// (or ?owner=<id>, write access), or change its settings. The currency
+// defaults to DEFAULT_CURRENCY and the start month to this one; neither
+// can change once money has been moved. Body:
+// { "currency": "EUR", "start_month": "2026-10" }
+func (s *Server) putEnvelopeModeHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var mode EnvelopeMode
+	if err := json.NewDecoder(r.Body).Decode(&mode); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if mode.Currency, err = normalizeCurrency(mode.Currency); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start := thisMonth()
+	if mode.StartMonth != "" {
+		if start, err = parseMonth(mode.StartMonth); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	mode.StartMonth = start.Format("2006-01")
+	mode.UserID = ownerID
+	mode.CreatedAt = ""
+
+	created := false
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, err := tx.GetEnvelopeMode(ownerID)
+		if errors.Is(err, ErrNotFound) {
+			if err := tx.PutEnvelopeMode(&mode); err != nil {
+				return err
+			}
+			created = true
+			return audit.record(tx, AuditCreate, "envelope_mode", ownerID, ownerID, nil, mode)
+		}
+		if err != nil {
+			return err
+		}
+		if mode.Currency != before.Currency || mode.StartMonth != before.StartMonth {
+			moves, err := tx.ListEnvelopeMoves(ownerID)
+			if err != nil {
+				return err
+			}
+			if len(moves) > 0 {
+				return ErrConflict
+			}
+		}
+		if err := tx.PutEnvelopeMode(&mode); err != nil {
+			return err
+		}
+		return audit.record(tx, AuditUpdate, "envelope_mode", ownerID, ownerID, before, mode)
+	})
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, "The envelope currency and start month can't change once money has been moved", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error saving envelope mode: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(mode)
+}
+
+// DELETE /api/envelopes/mode => turn envelope budgeting off for the JWT
+// user (or ?owner=<id>, write access). Envelopes and moves are kept for
+// when it is turned back on.
+func (s *Server) deleteEnvelopeModeHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, err := tx.GetEnvelopeMode(ownerID)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteEnvelopeMode(ownerID); err != nil {
+			return err
+		}
+		return audit.record(tx, AuditDelete, "envelope_mode", ownerID, ownerID, before, nil)
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Envelope mode is off", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error turning envelope mode off: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Envelope mode turned off", "owner_id": ownerID})
+}
+
+// GET /api/envelopes => the envelopes of the JWT user (or ?owner=<id>, read
+// access) in ?month=YYYY-MM (default: this month), with the month's income,
+// what was assigned, what is left to be assigned and each envelope's
+// assigned, spent and available amounts
+func (s *Server) getEnvelopesHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	month := thisMonth()
+	if v := r.URL.Query().Get("month"); v != "" {
+		if month, err = parseMonth(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var m EnvelopeMonth
+	err = s.store.Tx(func(tx Store) error {
+		mode, err := envelopeMode(tx, ownerID)
+		if err != nil {
+			return err
+		}
+		if err := checkEnvelopeMonth(mode, month); err != nil {
+			return err
+		}
+		tree, err := loadCategoryTree(tx, ownerID)
+		if err != nil {
+			return err
+		}
+		m, err = envelopeMonth(tx, tree, mode, month)
+		return err
+	})
+	if writeEnvelopeError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying envelopes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(m)
+}
+
+// POST /api/envelopes => create an envelope for the JWT user (or
+// ?owner=<id>, write access), drawn down by the charges of a category.
+// Sending a category path creates the category when it is missing.
+// Body: { "name": "Groceries", "category": "Food/Groceries" }
+func (s *Server) createEnvelopeHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var e Envelope
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	e.ID = 0
+	e.UserID = ownerID
+	e.CreatedAt = ""
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		if _, err := envelopeMode(tx, ownerID); err != nil {
+			return err
+		}
+		if err := resolveEnvelope(tx, &e, audit); err != nil {
+			return err
+		}
+		if err := tx.CreateEnvelope(&e); err != nil {
+			return err
+		}
+		return audit.record(tx, AuditCreate, "envelope", e.ID, ownerID, nil, e)
+	})
+	if writeEnvelopeError(w, err) {
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, fmt.Sprintf("Category %q already has an envelope", e.Category), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating envelope: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(e)
+}
+
+// PUT /api/envelopes/{id} => rename an envelope of the JWT user (or
+// ?owner=<id>, write access) or change its category
+func (s *Server) updateEnvelopeHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var e Envelope
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	e.UserID = ownerID
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, err := ownedEnvelope(tx, r, ownerID)
+		if err != nil {
+			return err
+		}
+		e.ID, e.CreatedAt = before.ID, before.CreatedAt
+		if err := resolveEnvelope(tx, &e, audit); err != nil {
+			return err
+		}
+		if err := tx.UpdateEnvelope(e); err != nil {
+			return err
+		}
+		return audit.record(tx, AuditUpdate, "envelope", e.ID, ownerID, before, e)
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Envelope not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if writeEnvelopeError(w, err) {
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, fmt.Sprintf("Category %q already has an envelope", e.Category), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating envelope: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(e)
+}
+
+// DELETE /api/envelopes/{id} => delete an envelope of the JWT user (or
+// ?owner=<id>, write access). What it held goes back to the pool: its
+// moves are kept with the pool in its place.
+func (s *Server) deleteEnvelopeHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, err := ownedEnvelope(tx, r, ownerID)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteEnvelope(ownerID, before.ID); err != nil {
+			return err
+		}
+		return audit.record(tx, AuditDelete, "envelope", before.ID, ownerID, before, nil)
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Envelope not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting envelope: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Envelope deleted successfully", "owner_id": ownerID})
+}
+
+// GET /api/envelopes/moves => the money moves of the JWT user (or
+// ?owner=<id>, read access), oldest first; ?month=YYYY-MM keeps one month's
+func (s *Server) getEnvelopeMovesHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	month := r.URL.Query().Get("month")
+	if month != "" {
+		m, err := parseMonth(month)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		month = m.Format("2006-01")
+	}
+
+	moves, err := s.store.ListEnvelopeMoves(ownerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying moves: %v", err), http.StatusInternalServerError)
+		return
+	}
+	kept := moves[:0]
+	for _, mv := range moves {
+		if month == "" || mv.Month == month {
+			kept = append(kept, mv)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(kept)
+}
+
+// POST /api/envelopes/moves => move money in a month for the JWT user (or
+// ?owner=<id>, write access): assign it from the pool to an envelope (no
+// from_envelope_id), move it between envelopes, or give it back to the pool
+// (no to_envelope_id). Refused with 409 when the pool or the envelope it
+// comes from hasn't that much available in the month. The caller is
+// recorded as the actor. Body:
+// { "month": "2026-10", "to_envelope_id": 3, "amount": 250, "note": "Groceries" }
+func (s *Server) createEnvelopeMoveHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var mv EnvelopeMove
+	if err := json.NewDecoder(r.Body).Decode(&mv); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	month := thisMonth()
+	if mv.Month != "" {
+		if month, err = parseMonth(mv.Month); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	mv.ID = 0
+	mv.UserID = ownerID
+	mv.Month = month.Format("2006-01")
+	mv.ActorID = &callerID
+	mv.CreatedAt = ""
+	mv.Note = strings.TrimSpace(mv.Note)
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		// Locking the settings keeps concurrent moves from spending the same money
+		mode, err := envelopeMode(tx, ownerID)
+		if err != nil {
+			return err
+		}
+		if err := checkEnvelopeMonth(mode, month); err != nil {
+			return err
+		}
+		if mv.Amount, err = parseMoney(mv.sent.String(), mode.Currency); err != nil || mv.Amount.Minor <= 0 {
+			return fmt.Errorf("%w: amount must be a positive %s amount", errInvalidEnvelope, mode.Currency)
+		}
+		switch {
+		case mv.FromEnvelopeID == nil && mv.ToEnvelopeID == nil:
+			return fmt.Errorf("%w: a move needs from_envelope_id, to_envelope_id or both", errInvalidEnvelope)
+		case mv.FromEnvelopeID != nil && mv.ToEnvelopeID != nil && *mv.FromEnvelopeID == *mv.ToEnvelopeID:
+			return fmt.Errorf("%w: can't move money from an envelope to itself", errInvalidEnvelope)
+		}
+		for _, id := range []*int{mv.FromEnvelopeID, mv.ToEnvelopeID} {
+			if id == nil {
+				continue
+			}
+			e, err := tx.GetEnvelope(*id)
+			if errors.Is(err, ErrNotFound) || (err == nil && e.UserID != ownerID) {
+				return fmt.Errorf("%w: no envelope %d", errInvalidEnvelope, *id)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		tree, err := loadCategoryTree(tx, ownerID)
+		if err != nil {
+			return err
+		}
+		m, err := envelopeMonth(tx, tree, mode, month)
+		if err != nil {
+			return err
+		}
+		available, from := m.ToBeAssigned, "to be assigned"
+		if mv.FromEnvelopeID != nil {
+			for _, e := range m.Envelopes {
+				if e.ID == *mv.FromEnvelopeID {
+					available, from = e.Available, "in envelope "+strconv.Quote(e.Name)
+				}
+			}
+		}
+		if mv.Amount.Minor > available.Minor {
+			return fmt.Errorf("%w: only %s %s is available %s in %s", errInsufficientFunds, available, available.Currency, from, mv.Month)
+		}
+
+		if err := tx.CreateEnvelopeMove(&mv); err != nil {
+			return err
+		}
+		return audit.record(tx, AuditCreate, "envelope_move", mv.ID, ownerID, nil, mv)
+	})
+	if writeEnvelopeError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error moving money: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(mv)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseMonth(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"2026-10", "2026-10-01", true},
+		{" 2026-01 ", "2026-01-01", true},
+		{"2026-13", "", false},
+		{"2026-10-01", "", false},
+		{"Oct 2026", "", false},
+		{"", "", false},
+	}
+	for _, tc := range tests {
+		got, err := parseMonth(tc.in)
+		if (err == nil) != tc.ok || (tc.ok && got.Format("2006-01-02") != tc.want) {
+			t.Fatalf("parseMonth(%q) = %v, %v; want %s", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestCheckEnvelopeMonth(t *testing.T) {
+	tests := []struct {
+		start, month string
+		ok           bool
+	}{
+		{"2026-09", "2026-09", true},
+		{"2026-09", "2027-01", true},
+		{"2026-09", "2026-08", false},
+		{"September", "2026-09", false},
+	}
+	for _, tc := range tests {
+		month, _ := parseMonth(tc.month)
+		if err := checkEnvelopeMonth(EnvelopeMode{StartMonth: tc.start}, month); (err == nil) != tc.ok {
+			t.Fatalf("checkEnvelopeMonth(%s, %s) = %v, want ok %v", tc.start, tc.month, err, tc.ok)
+		}
+	}
+}
+
+func TestDrawingEnvelope(t *testing.T) {
+	id := func(n int) *int { return &n }
+	tree := &categoryTree{byID: map[int]Category{}, children: map[int][]int{}}
+	for _, c := range []Category{
+		{ID: 1, Name: "Food"},
+		{ID: 2, Name: "Groceries", ParentID: id(1)},
+		{ID: 3, Name: "Organic", ParentID: id(2)},
+		{ID: 4, Name: "Restaurants", ParentID: id(1)},
+		{ID: 5, Name: "Travel"},
+	} {
+		tree.add(c)
+	}
+	// Envelope 0 is on Food and envelope 1 on Groceries
+	byCategory := map[int]int{1: 0, 2: 1}
+
+	tests := []struct {
+		category *int
+		want     int
+		ok       bool
+	}{
+		{id(1), 0, true},
+		{id(2), 1, true},
+		{id(3), 1, true},
+		{id(4), 0, true},
+		{id(5), 0, false},
+		{id(99), 0, false},
+		{nil, 0, false},
+	}
+	for _, tc := range tests {
+		got, ok := drawingEnvelope(tree, byCategory, tc.category)
+		if ok != tc.ok || got != tc.want {
+			t.Fatalf("drawingEnvelope(%v) = %d, %v; want %d, %v", tc.category, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestEnvelopeStore(t *testing.T) {
+	eachStore(t, testEnvelopes)
+}
+
+func TestEnvelopeMovesAPI(t *testing.T) {
+	eachStore(t, testEnvelopeMoves)
+}
+
+// testEnvelopeMoves assigns, moves and gives back envelope money through
+// the API.
+func testEnvelopeMoves(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	a := at.a
+	if err := a.expectStatus(http.StatusCreated, "PUT", "/api/envelopes/mode", map[string]string{"currency": "EUR"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	salary := map[string]interface{}{"name": "Salary", "amount": 100, "currency": "EUR", "direction": "income"}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", salary, nil); err != nil {
+		t.Fatal(err)
+	}
+	var food, rent Envelope
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/envelopes", map[string]string{"name": "Food", "category": "Food"}, &food); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/envelopes", map[string]string{"name": "Rent", "category": "Housing"}, &rent); err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := rent.ID + 1000
+	earlier := time.Now().UTC().AddDate(0, -1, 0).Format("2006-01")
+	tests := []struct {
+		name     string
+		from, to *int
+		amount   interface{}
+		month    string
+		status   int
+	}{
+		{"neither envelope", nil, nil, 10, "", http.StatusBadRequest},
+		{"to itself", &food.ID, &food.ID, 10, "", http.StatusBadRequest},
+		{"no amount", nil, &food.ID, 0, "", http.StatusBadRequest},
+		{"a negative amount", nil, &food.ID, -10, "", http.StatusBadRequest},
+		{"too precise", nil, &food.ID, 0.001, "", http.StatusBadRequest},
+		{"an unknown envelope", nil, &unknown, 10, "", http.StatusBadRequest},
+		{"an invalid month", nil, &food.ID, 10, "October", http.StatusBadRequest},
+		{"before the start month", nil, &food.ID, 10, earlier, http.StatusBadRequest},
+		{"more than is left to assign", nil, &food.ID, 100.01, "", http.StatusConflict},
+		{"an assignment", nil, &food.ID, 60, "", http.StatusCreated},
+		{"more than the envelope holds", &food.ID, &rent.ID, 61, "", http.StatusConflict},
+		{"between envelopes", &food.ID, &rent.ID, 20, "", http.StatusCreated},
+		{"back to the pool", &food.ID, nil, 40, "", http.StatusCreated},
+		{"more than is back in the pool", nil, &rent.ID, 80.01, "", http.StatusConflict},
+	}
+	for _, tc := range tests {
+		body := map[string]interface{}{"from_envelope_id": tc.from, "to_envelope_id": tc.to, "amount": tc.amount}
+		if tc.month != "" {
+			body["month"] = tc.month
+		}
+		if err := a.expectStatus(tc.status, "POST", "/api/envelopes/moves", body, nil); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+	}
+
+	var month struct {
+		Assigned     json.Number `json:"assigned"`
+		ToBeAssigned json.Number `json:"to_be_assigned"`
+		Envelopes    []struct {
+			Name      string      `json:"name"`
+			Assigned  json.Number `json:"assigned"`
+			Available json.Number `json:"available"`
+		} `json:"envelopes"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/envelopes", nil, &month); err != nil {
+		t.Fatal(err)
+	}
+	if month.Assigned != "20.00" || month.ToBeAssigned != "80.00" || len(month.Envelopes) != 2 ||
+		month.Envelopes[0].Assigned != "0.00" || month.Envelopes[0].Available != "0.00" ||
+		month.Envelopes[1].Assigned != "20.00" || month.Envelopes[1].Available != "20.00" {
+		t.Fatalf("envelopes after the moves = %+v", month)
+	}
+}
+
+func testEnvelopes(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	if _, err := s.GetEnvelopeMode(u.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetEnvelopeMode before turning it on: got %v, want ErrNotFound", err)
+	}
+	mode := EnvelopeMode{UserID: u.ID, Currency: "EUR", StartMonth: "2026-09"}
+	if err := s.PutEnvelopeMode(&mode); err != nil || mode.CreatedAt == "" {
+		t.Fatalf("PutEnvelopeMode = %+v, %v", mode, err)
+	}
+	if got, err := s.GetEnvelopeMode(u.ID); err != nil || got != mode {
+		t.Fatalf("GetEnvelopeMode = %+v, %v; want %+v", got, err, mode)
+	}
+
+	food := Category{Name: "Food", UserID: u.ID}
+	if err := s.CreateCategory(&food); err != nil {
+		t.Fatalf("CreateCategory: %v", err)
+	}
+	groceries := Category{Name: "Groceries", ParentID: &food.ID, UserID: u.ID}
+	if err := s.CreateCategory(&groceries); err != nil {
+		t.Fatalf("CreateCategory: %v", err)
+	}
+	eating := Envelope{Name: "Eating", CategoryID: &food.ID, UserID: u.ID}
+	market := Envelope{Name: "Market", CategoryID: &groceries.ID, UserID: u.ID}
+	for _, e := range []*Envelope{&eating, &market} {
+		if err := s.CreateEnvelope(e); err != nil || e.ID == 0 || e.CreatedAt == "" {
+			t.Fatalf("CreateEnvelope = %+v, %v", e, err)
+		}
+	}
+	if err := s.CreateEnvelope(&Envelope{Name: "More food", CategoryID: &food.ID, UserID: u.ID}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("a second envelope on a category: got %v, want ErrConflict", err)
+	}
+	eating.Name = "Eating out"
+	if err := s.UpdateEnvelope(eating); err != nil {
+		t.Fatalf("UpdateEnvelope: %v", err)
+	}
+	if got, err := s.GetEnvelope(eating.ID); err != nil || got.Name != "Eating out" || got.CategoryID == nil || *got.CategoryID != food.ID {
+		t.Fatalf("GetEnvelope after update = %+v, %v", got, err)
+	}
+
+	for _, m := range []EnvelopeMove{
+		{Month: "2026-10", ToEnvelopeID: &eating.ID, Amount: mustMoney("100", "EUR")},
+		{Month: "2026-10", FromEnvelopeID: &eating.ID, ToEnvelopeID: &market.ID, Amount: mustMoney("30", "EUR")},
+		{Month: "2026-09", ToEnvelopeID: &eating.ID, Amount: mustMoney("50", "EUR"), Note: "Start"},
+	} {
+		m.UserID, m.ActorID = u.ID, &u.ID
+		if err := s.CreateEnvelopeMove(&m); err != nil || m.ID == 0 || m.CreatedAt == "" {
+			t.Fatalf("CreateEnvelopeMove = %+v, %v", m, err)
+		}
+	}
+	moves, err := s.ListEnvelopeMoves(u.ID)
+	if err != nil || len(moves) != 3 || moves[0].Note != "Start" || moves[2].FromEnvelopeID == nil || moves[2].Amount.String() != "30.00" {
+		t.Fatalf("ListEnvelopeMoves = %+v, %v; want September first", moves, err)
+	}
+
+	// Income fills the pool; the groceries envelope draws its own category
+	// and the food one the rest of Food
+	for _, c := range []Charge{
+		{Name: "Salary", Direction: DirectionIncome, Amount: mustMoney("500", "EUR")},
+		{Name: "Market", Amount: mustMoney("20", "EUR"), CategoryID: &groceries.ID},
+		{Name: "Lunch", Amount: mustMoney("15", "EUR"), CategoryID: &food.ID},
+		{Name: "Socks", Amount: mustMoney("7", "EUR")},
+	} {
+		c.UserID, c.CreatedAt = u.ID, "2026-10-02T12:00:00Z"
+		if err := s.CreateCharge(&c); err != nil {
+			t.Fatalf("CreateCharge: %v", err)
+		}
+	}
+	tree, err := loadCategoryTree(s, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	october := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	m, err := envelopeMonth(s, tree, mode, october)
+	if err != nil {
+		t.Fatalf("envelopeMonth: %v", err)
+	}
+	if m.Income.String() != "500.00" || m.Assigned.String() != "100.00" || m.ToBeAssigned.String() != "350.00" || m.Unbudgeted.String() != "7.00" ||
+		len(m.Envelopes) != 2 || m.Envelopes[0].Available.String() != "105.00" || m.Envelopes[0].Spent.String() != "15.00" ||
+		m.Envelopes[1].Assigned.String() != "30.00" || m.Envelopes[1].Available.String() != "10.00" {
+		t.Fatalf("October = %+v", m)
+	}
+
+	// Deleting an envelope gives back what it held; deleting its category
+	// leaves an envelope on none
+	if err := s.DeleteEnvelope(u.ID, eating.ID); err != nil {
+		t.Fatalf("DeleteEnvelope: %v", err)
+	}
+	if m, err = envelopeMonth(s, tree, mode, october); err != nil || m.ToBeAssigned.String() != "470.00" || len(m.Envelopes) != 1 {
+		t.Fatalf("October after deleting an envelope = %+v, %v; want 470.00 to be assigned", m, err)
+	}
+	if err := s.DeleteCategory(u.ID, groceries.ID); err != nil {
+		t.Fatalf("DeleteCategory: %v", err)
+	}
+	if got, err := s.GetEnvelope(market.ID); err != nil || got.CategoryID != nil {
+		t.Fatalf("envelope of a deleted category = %+v, %v", got, err)
+	}
+
+	if err := s.DeleteEnvelopeMode(u.ID); err != nil {
+		t.Fatalf("DeleteEnvelopeMode: %v", err)
+	}
+	if _, err := s.GetEnvelopeMode(u.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetEnvelopeMode after turning it off: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --------------------------
+//       Savings Goals
+// --------------------------
+
+// Goal: money a user is saving up for, e.g. 5000 for a car by June. Target
+// is sent as "amount" and "currency"; TargetDate is a YYYY-MM-DD day.
+// AccountID optionally names the account the savings are kept in, in the
+// goal's currency. Progress is filled in on responses. Goals are shared
+// like everything else: a grantee with write access contributes to a
+// joint goal through ?owner=.
+type Goal struct {
+	ID         int           `json:"id"`
+	Name       string        `json:"name"`
+	Target     Money         `json:"-"`
+	TargetDate string        `json:"target_date"`
+	AccountID  *int          `json:"account_id"`
+	UserID     int           `json:"user_id"`
+	CreatedAt  string        `json:"created_at"`
+	Progress   *GoalProgress `json:"progress,omitempty"`
+}
+
+func (g Goal) MarshalJSON() ([]byte, error) {
+	type plain Goal
+	return json.Marshal(struct {
+		plain
+		moneyFields
+	}{plain(g), newMoneyFields(g.Target)})
+}
+
+func (g *Goal) UnmarshalJSON(data []byte) error {
+	type plain Goal
+	aux := struct {
+		*plain
+		moneyFields
+	}{plain: (*plain)(g)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m, err := aux.money()
+	if err != nil {
+		return err
+	}
+	g.Target = m
+	return nil
+}
+
+// Contribution: money put towards a goal, or taken back out when
+// negative. UserID is who recorded it, nil once that user is deleted. Its
+// amount is in the goal's currency, so only "amount" is sent.
+type Contribution struct {
+	ID        int    `json:"id"`
+	GoalID    int    `json:"goal_id"`
+	UserID    *int   `json:"user_id"`
+	Amount    Money  `json:"-"`
+	Note      string `json:"note"`
+	CreatedAt string `json:"created_at"`
+
+	sent json.Number // amount as sent, until the handler reads it
+}
+
+// errInvalidContribution: a contribution without a usable amount.
+var errInvalidContribution = errors.New("invalid contribution")
+
+func (c Contribution) MarshalJSON() ([]byte, error) {
+	type plain Contribution
+	return json.Marshal(struct {
+		plain
+		moneyFields
+	}{plain(c), newMoneyFields(c.Amount)})
+}
+
+func (c *Contribution) UnmarshalJSON(data []byte) error {
+	type plain Contribution
+	aux := struct {
+		*plain
+		Amount json.Number `json:"amount"`
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	c.sent = aux.Amount
+	return nil
+}
+
+// validateGoal trims g's name and checks it, the target and the target date.
+func validateGoal(g *Goal) error {
+	g.Name = strings.TrimSpace(g.Name)
+	if g.Name == "" || len(g.Name) > 100 {
+		return fmt.Errorf("goal name must be 1 to 100 characters")
+	}
+	if g.Target.Minor <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+	if _, err := time.Parse("2006-01-02", g.TargetDate); err != nil {
+		return fmt.Errorf("invalid target_date %q, expected YYYY-MM-DD", g.TargetDate)
+	}
+	return nil
+}
+
+// checkGoalAccount verifies that the account g is linked to, if any,
+// belongs to g's owner and is in g's currency.
+func checkGoalAccount(tx Store, g Goal) error {
+	if g.AccountID == nil {
+		return nil
+	}
+	a, err := tx.GetAccount(*g.AccountID)
+	if errors.Is(err, ErrNotFound) || (err == nil && a.UserID != g.UserID) {
+		return fmt.Errorf("%w: no account %d", errInvalidAccount, *g.AccountID)
+	}
+	if err != nil {
+		return err
+	}
+	if a.OpeningBalance.Currency != g.Target.Currency {
+		return fmt.Errorf("%w: account %d is in %s, not %s", errInvalidAccount, a.ID, a.OpeningBalance.Currency, g.Target.Currency)
+	}
+	return nil
+}
+
+// GoalProgress: how far a goal has come as of a day. MonthsLeft counts
+// part of a month as a whole one, and RequiredMonthly is what each of them
+// needs to reach the target. MonthlyRate is what was saved per month since
+// the goal started; ProjectedDate is when the goal is reached at that
+// rate, nil when it never will be. It is only ever sent, never read.
+type GoalProgress struct {
+	Saved           Money       `json:"-"`
+	Remaining       Money       `json:"-"`
+	Percent         float64     `json:"-"`
+	MonthsLeft      int         `json:"-"`
+	RequiredMonthly Money       `json:"-"`
+	MonthlyRate     Money       `json:"-"`
+	ProjectedDate   *string     `json:"-"`
+	OnTrack         bool        `json:"-"`
+	Reached         bool        `json:"-"`
+	Contributors    MoneyByUser `json:"-"`
+	AccountBalance  *Money      `json:"-"`
+}
+
+// MoneyByUser: amounts per user ID, encoded as [{"user_id": 1, "amount": 10}].
+type MoneyByUser map[int]Money
+
+func (m MoneyByUser) MarshalJSON() ([]byte, error) {
+	type entry struct {
+		UserID int         `json:"user_id"`
+		Amount json.Number `json:"amount"`
+	}
+	out := make([]entry, 0, len(m))
+	for id, amount := range m {
+		out = append(out, entry{id, amount.Number()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UserID < out[j].UserID })
+	return json.Marshal(out)
+}
+
+func (p GoalProgress) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Saved           json.Number  `json:"saved"`
+		Remaining       json.Number  `json:"remaining"`
+		Percent         float64      `json:"percent"`
+		MonthsLeft      int          `json:"months_left"`
+		RequiredMonthly json.Number  `json:"required_monthly"`
+		MonthlyRate     json.Number  `json:"monthly_rate"`
+		ProjectedDate   *string      `json:"projected_date"`
+		OnTrack         bool         `json:"on_track"`
+		Reached         bool         `json:"reached"`
+		Contributors    MoneyByUser  `json:"contributors"`
+		AccountBalance  *json.Number `json:"account_balance,omitempty"`
+	}{
+		Saved: p.Saved.Number(), Remaining: p.Remaining.Number(), Percent: p.Percent, MonthsLeft: p.MonthsLeft,
+		RequiredMonthly: p.RequiredMonthly.Number(), MonthlyRate: p.MonthlyRate.Number(), ProjectedDate: p.ProjectedDate,
+		OnTrack: p.OnTrack, Reached: p.Reached, Contributors: p.Contributors,
+	}
+	if p.AccountBalance != nil {
+		n := p.AccountBalance.Number()
+		out.AccountBalance = &n
+	}
+	return json.Marshal(out)
+}
+
+// daysPerMonth is the average length of a month, for rates and projections.
+const daysPerMonth = 365.25 / 12
+
+// monthsUntil counts the months from day to target, a part of a month as
+// a whole one; 0 once target has come.
+func monthsUntil(day, target time.Time) int {
+	if !target.After(day) {
+		return 0
+	}
+	months := (target.Year()-day.Year())*12 + int(target.Month()-day.Month())
+	if day.AddDate(0, months, 0).Before(target) {
+		months++
+	}
+	return months
+}
+
+// goalProgress works out g's progress at the end of day from its
+// contributions up to then.
+func goalProgress(g Goal, contributions []Contribution, day time.Time) (GoalProgress, error) {
+	cur := g.Target.Currency
+	p := GoalProgress{Saved: Money{Currency: cur}, Contributors: MoneyByUser{}}
+	start, err := time.Parse(time.RFC3339Nano, g.CreatedAt)
+	if err != nil {
+		start = day
+	}
+	for _, c := range contributions {
+		at, atErr := time.Parse(time.RFC3339Nano, c.CreatedAt)
+		if atErr == nil && !at.Before(day.AddDate(0, 0, 1)) {
+			continue
+		}
+		if p.Saved, err = p.Saved.Add(c.Amount); err != nil {
+			return p, fmt.Errorf("contribution %d: %v", c.ID, err)
+		}
+		if c.UserID != nil {
+			sum := p.Contributors[*c.UserID]
+			sum.Currency, sum.Minor = cur, sum.Minor+c.Amount.Minor
+			p.Contributors[*c.UserID] = sum
+		}
+		if atErr == nil && at.Before(start) {
+			start = at
+		}
+	}
+
+	remaining, err := g.Target.Sub(p.Saved)
+	if err != nil {
+		return p, err
+	}
+	if remaining.Minor < 0 {
+		remaining.Minor = 0
+	}
+	p.Remaining, p.Reached = remaining, remaining.Minor == 0
+	if p.Percent, err = p.Saved.PercentOf(g.Target); err != nil {
+		return p, err
+	}
+
+	target, err := time.Parse("2006-01-02", g.TargetDate)
+	if err != nil {
+		return p, fmt.Errorf("goal %d: invalid target date %q", g.ID, g.TargetDate)
+	}
+	p.MonthsLeft = monthsUntil(day, target)
+	p.RequiredMonthly = remaining
+	if p.MonthsLeft > 1 {
+		months := int64(p.MonthsLeft)
+		p.RequiredMonthly.Minor = (remaining.Minor + months - 1) / months
+	}
+
+	elapsed := math.Max(day.Sub(start).Hours()/24/daysPerMonth, 1)
+	p.MonthlyRate = Money{Currency: cur}
+	if p.Saved.Minor > 0 {
+		p.MonthlyRate.Minor = int64(float64(p.Saved.Minor) / elapsed)
+	}
+	switch {
+	case p.Reached:
+		p.OnTrack = true
+	case p.MonthlyRate.Minor > 0:
+		months := float64(remaining.Minor) / float64(p.MonthlyRate.Minor)
+		projected := day.AddDate(0, 0, int(math.Ceil(months*daysPerMonth)))
+		d := projected.Format("2006-01-02")
+		p.ProjectedDate = &d
+		p.OnTrack = !projected.After(target)
+	}
+	return p, nil
+}
+
+// withProgress fills in g's progress on day, including the balance of its
+// account if it has one.
+func withProgress(store Store, g Goal, day time.Time) (Goal, error) {
+	contributions, err := store.ListContributions(g.ID)
+	if err != nil {
+		return g, err
+	}
+	p, err := goalProgress(g, contributions, day)
+	if err != nil {
+		return g, err
+	}
+	if g.AccountID != nil {
+		a, err := store.GetAccount(*g.AccountID)
+		if err != nil {
+			return g, err
+		}
+		if a, err = withBalance(store, a, nil); err != nil {
+			return g, err
+		}
+		p.AccountBalance = a.Balance
+	}
+	g.Progress = &p
+	return g, nil
+}
+
+// progressDay reads the ?date=YYYY-MM-DD progress is worked out on,
+// today by default.
+func progressDay(r *http.Request) (time.Time, error) {
+	d := r.URL.Query().Get("date")
+	if d == "" {
+		now := time.Now().UTC()
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), nil
+	}
+	day, err := time.Parse("2006-01-02", d)
+	if err != nil {
+		return day, fmt.Errorf("Invalid date, expected YYYY-MM-DD")
+	}
+	return day, nil
+}
+
+// ownedGoal looks up the goal in the request path, reporting ErrNotFound
+// when it isn't ownerID's.
+func ownedGoal(store Store, r *http.Request, ownerID int) (Goal, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return Goal{}, ErrNotFound
+	}
+	g, err := store.GetGoal(id)
+	if err == nil && g.UserID != ownerID {
+		err = ErrNotFound
+	}
+	return g, err
+}
+
+// GET /api/goals => the JWT user's savings goals (or ?owner=<id>, read
+// access) by target date, with their progress on ?date=YYYY-MM-DD (default:
+// today)
+func (s *Server) getGoalsHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	day, err := progressDay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	goals, err := s.store.ListGoals(ownerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying goals: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for i := range goals {
+		if goals[i], err = withProgress(s.store, goals[i], day); err != nil {
+			http.Error(w, fmt.Sprintf("Error computing progress: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(goals)
+}
+
+// GET /api/goals/{id} => one goal of the JWT user (or ?owner=<id>, read
+// access) with its progress on ?date=YYYY-MM-DD (default: today)
+func (s *Server) getGoalHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	day, err := progressDay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	g, err := ownedGoal(s.store, r, ownerID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Goal not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		g, err = withProgress(s.store, g, day)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying goal: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(g)
+}
+
+// POST /api/goals => create a savings goal for the JWT user (or
+// ?owner=<id>, write access). Body:
+// { "name": "Car", "amount": 5000, "currency": "EUR", "target_date": "2027-06-30", "account_id": 2 }
+func (s *Server) createGoalHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var g Goal
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validateGoal(&g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.ID = 0
+	g.UserID = ownerID
+	g.CreatedAt = ""
+	g.Progress = nil
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		if err := checkGoalAccount(tx, g); err != nil {
+			return err
+		}
+		if err := tx.CreateGoal(&g); err != nil {
+			return fmt.Errorf("Error creating goal: %v", err)
+		}
+		if err := audit.record(tx, AuditCreate, "goal", g.ID, ownerID, nil, g); err != nil {
+			return err
+		}
+		day, _ := progressDay(r)
+		g, err = withProgress(tx, g, day)
+		return err
+	})
+	if errors.Is(err, errInvalidAccount) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(g)
+}
+
+// PUT /api/goals/{id} => change the name, target, target date or account
+// of a goal of the JWT user (or ?owner=<id>, write access). Its currency
+// can only change while it has no contributions.
+func (s *Server) updateGoalHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var g Goal
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validateGoal(&g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.UserID = ownerID
+	g.Progress = nil
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, err := ownedGoal(tx, r, ownerID)
+		if err != nil {
+			return err
+		}
+		g.ID, g.CreatedAt = before.ID, before.CreatedAt
+		if g.Target.Currency != before.Target.Currency {
+			contributions, err := tx.ListContributions(g.ID)
+			if err != nil {
+				return err
+			}
+			if len(contributions) > 0 {
+				return fmt.Errorf("%w: goal %d has contributions", ErrConflict, g.ID)
+			}
+		}
+		if err := checkGoalAccount(tx, g); err != nil {
+			return err
+		}
+		if err := tx.UpdateGoal(g); err != nil {
+			return err
+		}
+		if err := audit.record(tx, AuditUpdate, "goal", g.ID, ownerID, before, g); err != nil {
+			return err
+		}
+		day, _ := progressDay(r)
+		g, err = withProgress(tx, g, day)
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Goal not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errInvalidAccount) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, "A goal's currency can't change while it has contributions", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating goal: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(g)
+}
+
+// DELETE /api/goals/{id} => delete a goal of the JWT user (or ?owner=<id>,
+// write access) with its contributions
+func (s *Server) deleteGoalHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, err := ownedGoal(tx, r, ownerID)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteGoal(ownerID, before.ID); err != nil {
+			return err
+		}
+		return audit.record(tx, AuditDelete, "goal", before.ID, ownerID, before, nil)
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Goal not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting goal: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Goal deleted successfully", "owner_id": ownerID})
+}
+
+// GET /api/goals/{id}/contributions => the contributions to a goal of the
+// JWT user (or ?owner=<id>, read access), oldest first
+func (s *Server) getContributionsHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	g, err := ownedGoal(s.store, r, ownerID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Goal not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	var contributions []Contribution
+	if err == nil {
+		contributions, err = s.store.ListContributions(g.ID)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying contributions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(contributions)
+}
+
+// POST /api/goals/{id}/contributions => record money put towards a goal of
+// the JWT user (or ?owner=<id>, write access), in the goal's currency;
+// a negative amount takes money back out. The caller is recorded as the
+// contributor. Body: { "amount": 250, "note": "March", "created_at": "2027-03-01" }
+func (s *Server) createContributionHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var c Contribution
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if c.CreatedAt != "" {
+		at, err := parseDate(c.CreatedAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid created_at %q", c.CreatedAt), http.StatusBadRequest)
+			return
+		}
+		c.CreatedAt = at.UTC().Format(time.RFC3339Nano)
+	}
+	c.ID = 0
+	c.UserID = &callerID
+	c.Note = strings.TrimSpace(c.Note)
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		g, err := ownedGoal(tx, r, ownerID)
+		if err != nil {
+			return err
+		}
+		c.GoalID = g.ID
+		if c.Amount, err = parseMoney(c.sent.String(), g.Target.Currency); err != nil || c.Amount.Minor == 0 {
+			return fmt.Errorf("%w: amount must be a non-zero %s amount", errInvalidContribution, g.Target.Currency)
+		}
+		if err := tx.CreateContribution(&c); err != nil {
+			return fmt.Errorf("Error recording contribution: %v", err)
+		}
+		return audit.record(tx, AuditCreate, "contribution", c.ID, ownerID, nil, c)
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Goal not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errInvalidContribution) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// DELETE /api/goals/{id}/contributions/{contributionID} => delete a
+// contribution to a goal of the JWT user (or ?owner=<id>, write access)
+func (s *Server) deleteContributionHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["contributionID"])
+	if err != nil {
+		http.Error(w, "Invalid contribution ID", http.StatusBadRequest)
+		return
+	}
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		g, err := ownedGoal(tx, r, ownerID)
+		if err != nil {
+			return err
+		}
+		contributions, err := tx.ListContributions(g.ID)
+		if err != nil {
+			return err
+		}
+		for _, before := range contributions {
+			if before.ID == id {
+				if err := tx.DeleteContribution(g.ID, id); err != nil {
+					return err
+				}
+				return audit.record(tx, AuditDelete, "contribution", id, ownerID, before, nil)
+			}
+		}
+		return ErrNotFound
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Contribution not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting contribution: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Contribution deleted successfully", "owner_id": ownerID})
+}
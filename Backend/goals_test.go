@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonthsUntil(t *testing.T) {
+	tests := []struct {
+		day, target string
+		want        int
+	}{
+		{"2024-01-15", "2024-01-15", 0},
+		{"2024-01-15", "2024-01-10", 0},
+		{"2024-01-15", "2024-01-16", 1},
+		{"2024-01-15", "2024-02-15", 1},
+		{"2024-01-15", "2024-02-16", 2},
+		{"2024-01-31", "2024-02-29", 1},
+		{"2023-12-20", "2025-01-01", 13},
+		{"2025-04-01", "2025-07-01", 3},
+	}
+	for _, tc := range tests {
+		day, _ := time.Parse("2006-01-02", tc.day)
+		target, _ := time.Parse("2006-01-02", tc.target)
+		if got := monthsUntil(day, target); got != tc.want {
+			t.Fatalf("monthsUntil(%s, %s) = %d, want %d", tc.day, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestValidateGoal(t *testing.T) {
+	tests := []struct {
+		name, amount, date string
+		want               string
+		ok                 bool
+	}{
+		{" Car ", "5000", "2027-06-30", "Car", true},
+		{"", "5000", "2027-06-30", "", false},
+		{strings.Repeat("x", 101), "5000", "2027-06-30", "", false},
+		{"Car", "0", "2027-06-30", "", false},
+		{"Car", "-5", "2027-06-30", "", false},
+		{"Car", "5000", "2027-06-30T00:00:00Z", "", false},
+		{"Car", "5000", "", "", false},
+	}
+	for _, tc := range tests {
+		g := Goal{Name: tc.name, Target: mustMoney(tc.amount, "EUR"), TargetDate: tc.date}
+		err := validateGoal(&g)
+		if (err == nil) != tc.ok || (tc.ok && g.Name != tc.want) {
+			t.Fatalf("validateGoal(%q, %s, %q) = %q, %v", tc.name, tc.amount, tc.date, g.Name, err)
+		}
+	}
+}
+
+func TestGoalProgress(t *testing.T) {
+	one, two := 1, 2
+	g := Goal{ID: 1, Target: mustMoney("1200", "EUR"), TargetDate: "2025-07-01", CreatedAt: "2025-01-01T00:00:00Z"}
+	contributions := []Contribution{
+		{ID: 1, UserID: &one, Amount: mustMoney("300", "EUR"), CreatedAt: "2025-01-01T10:00:00Z"},
+		{ID: 2, UserID: &two, Amount: mustMoney("300", "EUR"), CreatedAt: "2025-02-15T10:00:00Z"},
+		{ID: 3, UserID: &one, Amount: mustMoney("-100", "EUR"), CreatedAt: "2025-03-01T10:00:00Z"},
+		{ID: 4, UserID: nil, Amount: mustMoney("700", "EUR"), CreatedAt: "2025-06-01T10:00:00Z"},
+	}
+	tests := []struct {
+		day  string
+		want string
+	}{
+		{"2025-01-10", `{"saved":300.00,"remaining":900.00,"percent":25,"months_left":6,"required_monthly":150.00,"monthly_rate":300.00,"projected_date":"2025-04-12","on_track":true,"reached":false,"contributors":[{"user_id":1,"amount":300.00}]}`},
+		{"2025-04-01", `{"saved":500.00,"remaining":700.00,"percent":41.67,"months_left":3,"required_monthly":233.34,"monthly_rate":169.09,"projected_date":"2025-08-06","on_track":false,"reached":false,"contributors":[{"user_id":1,"amount":200.00},{"user_id":2,"amount":300.00}]}`},
+		{"2025-06-01", `{"saved":1200.00,"remaining":0.00,"percent":100,"months_left":1,"required_monthly":0.00,"monthly_rate":241.88,"projected_date":null,"on_track":true,"reached":true,"contributors":[{"user_id":1,"amount":200.00},{"user_id":2,"amount":300.00}]}`},
+	}
+	for _, tc := range tests {
+		day, _ := time.Parse("2006-01-02", tc.day)
+		p, err := goalProgress(g, contributions, day)
+		if err != nil {
+			t.Fatalf("goalProgress on %s: %v", tc.day, err)
+		}
+		if data, _ := json.Marshal(p); string(data) != tc.want {
+			t.Fatalf("progress on %s = %s\nwant %s", tc.day, data, tc.want)
+		}
+	}
+
+	mixed := append(contributions[:1:1], Contribution{ID: 5, Amount: mustMoney("1", "USD")})
+	if _, err := goalProgress(g, mixed, time.Now()); err == nil {
+		t.Fatalf("goalProgress with a contribution in another currency: want an error")
+	}
+}
+
+func TestGoalStore(t *testing.T) {
+	eachStore(t, testGoals)
+}
+
+func TestGoalAPI(t *testing.T) {
+	eachStore(t, testGoalAPI)
+}
+
+// testGoalAPI creates a goal and contributes to it through the API.
+func testGoalAPI(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	a := at.a
+	var usd Account
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/accounts", map[string]interface{}{"name": "Savings", "type": "savings", "currency": "USD"}, &usd); err != nil {
+		t.Fatal(err)
+	}
+
+	goals := []struct {
+		name   string
+		body   map[string]interface{}
+		status int
+	}{
+		{"an account in another currency", map[string]interface{}{"name": "Car", "amount": 1200, "currency": "EUR", "target_date": "2030-07-01", "account_id": usd.ID}, http.StatusBadRequest},
+		{"no target date", map[string]interface{}{"name": "Car", "amount": 1200, "currency": "EUR"}, http.StatusBadRequest},
+		{"no amount", map[string]interface{}{"name": "Car", "currency": "EUR", "target_date": "2030-07-01"}, http.StatusBadRequest},
+		{"a goal", map[string]interface{}{"name": "Car", "amount": 1200, "currency": "EUR", "target_date": "2030-07-01"}, http.StatusCreated},
+	}
+	var goal Goal
+	for _, tc := range goals {
+		if err := a.expectStatus(tc.status, "POST", "/api/goals", tc.body, &goal); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+	}
+
+	contributionsPath := "/api/goals/" + strconv.Itoa(goal.ID) + "/contributions"
+	contributions := []struct {
+		name   string
+		c      *apiClient
+		body   map[string]interface{}
+		status int
+		saved  string
+	}{
+		{"a contribution", a, map[string]interface{}{"amount": 300, "created_at": "2025-07-01"}, http.StatusCreated, "300.00"},
+		{"a withdrawal", a, map[string]interface{}{"amount": -50, "note": "Oops"}, http.StatusCreated, "250.00"},
+		{"zero", a, map[string]interface{}{"amount": 0}, http.StatusBadRequest, "250.00"},
+		{"too precise", a, map[string]interface{}{"amount": 0.001}, http.StatusBadRequest, "250.00"},
+		{"a bad date", a, map[string]interface{}{"amount": 5, "created_at": "July"}, http.StatusBadRequest, "250.00"},
+		{"another user's goal", at.b, map[string]interface{}{"amount": 5}, http.StatusNotFound, "250.00"},
+	}
+	for _, tc := range contributions {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.c.expectStatus(tc.status, "POST", contributionsPath, tc.body, nil); err != nil {
+				t.Fatal(err)
+			}
+			var got struct {
+				Progress struct {
+					Saved json.Number `json:"saved"`
+				} `json:"progress"`
+			}
+			if err := a.expectStatus(http.StatusOK, "GET", "/api/goals/"+strconv.Itoa(goal.ID), nil, &got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Progress.Saved) != tc.saved {
+				t.Fatalf("saved = %s, want %s", got.Progress.Saved, tc.saved)
+			}
+		})
+	}
+
+	// Progress on a day before the withdrawal leaves it out
+	var before struct {
+		Progress struct {
+			Saved json.Number `json:"saved"`
+		} `json:"progress"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/goals/"+strconv.Itoa(goal.ID)+"?date=2025-07-02", nil, &before); err != nil {
+		t.Fatal(err)
+	}
+	if before.Progress.Saved != "300.00" {
+		t.Fatalf("saved on 2025-07-02 = %s, want 300.00", before.Progress.Saved)
+	}
+	if err := a.expectStatus(http.StatusBadRequest, "GET", "/api/goals/"+strconv.Itoa(goal.ID)+"?date=July", nil, nil); err != nil {
+		t.Fatalf("an invalid date: %v", err)
+	}
+}
+
+func testGoals(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	a := Account{Name: "Savings", Type: "savings", OpeningBalance: mustMoney("0", "EUR"), UserID: u.ID}
+	if err := s.CreateAccount(&a); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	car := Goal{Name: "Car", Target: mustMoney("5000", "EUR"), TargetDate: "2027-06-30", AccountID: &a.ID, UserID: u.ID}
+	holiday := Goal{Name: "Holiday", Target: mustMoney("1500", "EUR"), TargetDate: "2027-03-31", UserID: u.ID}
+	for _, g := range []*Goal{&car, &holiday} {
+		if err := s.CreateGoal(g); err != nil || g.ID == 0 || g.CreatedAt == "" {
+			t.Fatalf("CreateGoal = %+v, %v", g, err)
+		}
+	}
+	goals, err := s.ListGoals(u.ID)
+	if err != nil || len(goals) != 2 || goals[0].ID != holiday.ID || goals[1].AccountID == nil || *goals[1].AccountID != a.ID {
+		t.Fatalf("ListGoals = %+v, %v; want Holiday then Car", goals, err)
+	}
+
+	car.Name, car.Target, car.TargetDate = "New car", mustMoney("6000", "EUR"), "2027-12-31"
+	if err := s.UpdateGoal(car); err != nil {
+		t.Fatalf("UpdateGoal: %v", err)
+	}
+	if got, err := s.GetGoal(car.ID); err != nil || got.Name != "New car" || got.Target.String() != "6000.00" || got.TargetDate != "2027-12-31" {
+		t.Fatalf("GetGoal after update = %+v, %v", got, err)
+	}
+	other := car
+	other.UserID = u.ID + 1
+	if err := s.UpdateGoal(other); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("UpdateGoal for another owner: got %v, want ErrNotFound", err)
+	}
+
+	for _, c := range []Contribution{
+		{GoalID: car.ID, UserID: &u.ID, Amount: mustMoney("300", "EUR"), CreatedAt: "2026-02-01T00:00:00Z"},
+		{GoalID: car.ID, UserID: &u.ID, Amount: mustMoney("200", "EUR"), Note: "Bonus", CreatedAt: "2026-01-01T00:00:00Z"},
+		{GoalID: holiday.ID, Amount: mustMoney("50", "EUR")},
+	} {
+		if err := s.CreateContribution(&c); err != nil || c.ID == 0 || c.CreatedAt == "" {
+			t.Fatalf("CreateContribution = %+v, %v", c, err)
+		}
+	}
+	contributions, err := s.ListContributions(car.ID)
+	if err != nil || len(contributions) != 2 || contributions[0].Note != "Bonus" || contributions[1].Amount.String() != "300.00" {
+		t.Fatalf("ListContributions = %+v, %v; want oldest first", contributions, err)
+	}
+	if err := s.DeleteContribution(holiday.ID, contributions[0].ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("DeleteContribution under another goal: got %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteContribution(car.ID, contributions[0].ID); err != nil {
+		t.Fatalf("DeleteContribution: %v", err)
+	}
+
+	// Deleting the account unlinks the goal; deleting a goal its contributions
+	if err := s.DeleteAccount(u.ID, a.ID); err != nil {
+		t.Fatalf("DeleteAccount: %v", err)
+	}
+	if got, err := s.GetGoal(car.ID); err != nil || got.AccountID != nil {
+		t.Fatalf("goal after deleting its account = %+v, %v", got, err)
+	}
+	if err := s.DeleteGoal(u.ID, car.ID); err != nil {
+		t.Fatalf("DeleteGoal: %v", err)
+	}
+	if _, err := s.GetGoal(car.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetGoal after delete: got %v, want ErrNotFound", err)
+	}
+	if left, err := s.ListContributions(car.ID); err != nil || len(left) != 0 {
+		t.Fatalf("contributions of a deleted goal = %+v, %v", left, err)
+	}
+}
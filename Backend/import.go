@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// --------------------------
+//       CSV Import
+// --------------------------
+
+// maxImportSize caps the size of an uploaded CSV file.
+const maxImportSize = 10 << 20
+
+// ImportMapping: how the columns of a bank's CSV export map onto a Charge.
+// Columns are given by header name, or by 0-based index when the file has
+// no header row.
+type ImportMapping struct {
+	Date            string `json:"date"`
+	Description     string `json:"description"`
+	Amount          string `json:"amount"`
+	Debit           string `json:"debit"`
+	Credit          string `json:"credit"`
+	Category        string `json:"category"`
+	DefaultCategory string `json:"default_category"`
+	Currency        string `json:"currency"`
+	DefaultCurrency string `json:"default_currency"`
+	// Sign says which amounts are spending:
+	//   "expense_positive" (default) - amount > 0 is a charge
+	//   "expense_negative"           - amount < 0 is a charge (typical bank export)
+	//   "debit_credit"               - separate debit and credit columns
+	Sign string `json:"sign"`
+	// Credits says what money coming in becomes: skipped ("skip", the
+	// default), or charges with direction "income" or "refund"
+	Credits    string `json:"credits"`
+	DateFormat string `json:"date_format"`
+	NoHeader   bool   `json:"no_header"`
+	Delimiter  string `json:"delimiter"`
+}
+
+// ImportRow: one parsed CSV line and what happened to it
+type ImportRow struct {
+	Line        int      `json:"line"`
+	Charge      *Charge  `json:"charge,omitempty"`
+	Errors      []string `json:"errors,omitempty"`
+	Skipped     string   `json:"skipped,omitempty"`
+	Duplicate   bool     `json:"duplicate"`
+	DuplicateOf *int     `json:"duplicate_of,omitempty"`
+	Imported    bool     `json:"imported"`
+}
+
+// ImportResult: the response of POST /api/charges/import
+type ImportResult struct {
+	Mode       string      `json:"mode"`
+	Rows       []ImportRow `json:"rows"`
+	Valid      int         `json:"valid"`
+	Invalid    int         `json:"invalid"`
+	Skipped    int         `json:"skipped"`
+	Duplicates int         `json:"duplicates"`
+	Imported   int         `json:"imported"`
+}
+
+// goDateLayout turns formats such as "MM/DD/YYYY" into Go layouts. Go
+// layouts ("01/02/2006") pass through unchanged.
+func goDateLayout(format string) string {
+	if format == "" {
+		return "2006-01-02"
+	}
+	r := strings.NewReplacer("YYYY", "2006", "YY", "06", "MM", "01", "DD", "02", "yyyy", "2006", "yy", "06", "dd", "02")
+	return r.Replace(format)
+}
+
+// parseImportAmount parses amounts like "1,234.56", "$12.00", "-5" or "(5.00)".
+func parseImportAmount(s, currency string) (Money, error) {
+	s = strings.TrimSpace(s)
+	negative := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		negative = true
+		s = s[1 : len(s)-1]
+	}
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9', r == '.', r == '-', r == '+':
+			return r
+		}
+		return -1
+	}, s)
+	if s == "" {
+		return Money{}, fmt.Errorf("empty amount")
+	}
+	v, err := parseMoney(s, currency)
+	if err != nil {
+		return Money{}, err
+	}
+	if negative {
+		v = v.Neg()
+	}
+	return v, nil
+}
+
+// columnIndex resolves a mapped column against the header row.
+func columnIndex(header []string, col string) (int, error) {
+	if col == "" {
+		return -1, nil
+	}
+	for i, h := range header {
+		if strings.EqualFold(strings.TrimSpace(h), strings.TrimSpace(col)) {
+			return i, nil
+		}
+	}
+	if i, err := strconv.Atoi(col); err == nil && i >= 0 {
+		return i, nil
+	}
+	return -1, fmt.Errorf("column %q not found", col)
+}
+
+// parseImport reads the CSV into rows using mapping. Rows that are not
+// spending under the sign convention are returned as skipped unless the
+// mapping imports credits.
+func parseImport(file io.Reader, m ImportMapping, ownerID int) ([]ImportRow, error) {
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if m.Delimiter != "" {
+		if len([]rune(m.Delimiter)) != 1 {
+			return nil, fmt.Errorf("delimiter must be a single character")
+		}
+		reader.Comma = []rune(m.Delimiter)[0]
+	}
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("CSV file is empty")
+	}
+
+	var header []string
+	firstLine := 1
+	if !m.NoHeader {
+		header = records[0]
+		records = records[1:]
+		firstLine = 2
+	}
+
+	sign := m.Sign
+	if sign == "" {
+		sign = "expense_positive"
+	}
+	if sign != "expense_positive" && sign != "expense_negative" && sign != "debit_credit" {
+		return nil, fmt.Errorf("sign must be expense_positive, expense_negative or debit_credit")
+	}
+	credits := m.Credits
+	if credits == "" {
+		credits = "skip"
+	}
+	if credits != "skip" && credits != DirectionIncome && credits != DirectionRefund {
+		return nil, fmt.Errorf("credits must be skip, income or refund")
+	}
+
+	cols := map[string]int{}
+	required := []string{"date", "description"}
+	if sign == "debit_credit" {
+		required = append(required, "debit")
+	} else {
+		required = append(required, "amount")
+	}
+	for name, col := range map[string]string{
+		"date": m.Date, "description": m.Description, "amount": m.Amount,
+		"debit": m.Debit, "credit": m.Credit, "category": m.Category,
+		"currency": m.Currency,
+	} {
+		i, err := columnIndex(header, col)
+		if err != nil {
+			return nil, fmt.Errorf("mapping %s: %v", name, err)
+		}
+		cols[name] = i
+	}
+	for _, name := range required {
+		if cols[name] < 0 {
+			return nil, fmt.Errorf("mapping for %s is required", name)
+		}
+	}
+
+	layout := goDateLayout(m.DateFormat)
+	field := func(rec []string, name string) string {
+		i := cols[name]
+		if i < 0 || i >= len(rec) {
+			return ""
+		}
+		return strings.TrimSpace(rec[i])
+	}
+
+	rows := make([]ImportRow, 0, len(records))
+	for n, rec := range records {
+		row := ImportRow{Line: firstLine + n}
+		c := &Charge{UserID: ownerID, Direction: DirectionExpense}
+
+		date, err := time.Parse(layout, field(rec, "date"))
+		if err != nil {
+			row.Errors = append(row.Errors, fmt.Sprintf("invalid date %q for format %q", field(rec, "date"), layout))
+		} else {
+			c.CreatedAt = date.Format(time.RFC3339)
+		}
+
+		c.Name = field(rec, "description")
+		if c.Name == "" {
+			row.Errors = append(row.Errors, "missing description")
+		} else if utf8.RuneCountInString(c.Name) > 100 {
+			c.Name = string([]rune(c.Name)[:100])
+		}
+
+		c.Category = field(rec, "category")
+		if c.Category == "" {
+			c.Category = m.DefaultCategory
+		}
+		if c.Category == "" {
+			c.Category = "Miscellaneous"
+		}
+		for _, name := range splitCategoryPath(c.Category) {
+			if _, err := validateCategoryName(name); err != nil {
+				row.Errors = append(row.Errors, err.Error())
+			}
+		}
+
+		currency := field(rec, "currency")
+		if currency == "" {
+			currency = m.DefaultCurrency
+		}
+		if _, err := normalizeCurrency(currency); err != nil {
+			row.Errors = append(row.Errors, err.Error())
+			currency = ""
+		}
+
+		switch sign {
+		case "debit_credit":
+			if debit := field(rec, "debit"); debit != "" {
+				v, err := parseImportAmount(debit, currency)
+				if err != nil {
+					row.Errors = append(row.Errors, err.Error())
+				}
+				c.Amount = v.Abs()
+			} else if credit := field(rec, "credit"); credit != "" {
+				if credits == "skip" {
+					row.Skipped = "credit, not a charge"
+					break
+				}
+				v, err := parseImportAmount(credit, currency)
+				if err != nil {
+					row.Errors = append(row.Errors, err.Error())
+				}
+				c.Amount, c.Direction = v.Abs(), credits
+			} else {
+				row.Errors = append(row.Errors, "no debit or credit amount")
+			}
+		default:
+			v, err := parseImportAmount(field(rec, "amount"), currency)
+			if err != nil {
+				row.Errors = append(row.Errors, err.Error())
+				break
+			}
+			if sign == "expense_negative" {
+				v = v.Neg()
+			}
+			switch {
+			case v.Minor < 0 && credits != "skip":
+				v, c.Direction = v.Neg(), credits
+			case v.Minor <= 0:
+				row.Skipped = "not a charge under the sign convention"
+			}
+			c.Amount = v
+		}
+
+		row.Charge = c
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// duplicateKey identifies charges that are probably the same transaction.
+func duplicateKey(date string, amount Money, name string) string {
+	if len(date) >= 10 {
+		date = date[:10]
+	}
+	return fmt.Sprintf("%s|%s %s|%s", date, amount, amount.Currency, strings.ToLower(strings.TrimSpace(name)))
+}
+
+// flagDuplicates marks rows matching an existing charge of the owner, or an
+// earlier row of the same file, by date, amount and name.
+func flagDuplicates(store Store, rows []ImportRow, ownerID int) error {
+	var from, to time.Time
+	for _, row := range rows {
+		if len(row.Errors) > 0 || row.Skipped != "" {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339, row.Charge.CreatedAt)
+		if from.IsZero() || t.Before(from) {
+			from = t
+		}
+		if t.After(to) {
+			to = t
+		}
+	}
+	if from.IsZero() {
+		return nil
+	}
+
+	existing := map[string]int{}
+	to = to.AddDate(0, 0, 1)
+	charges, err := store.ListCharges(&ListFilter{OwnerID: ownerID, From: &from, To: &to})
+	if err != nil {
+		return fmt.Errorf("querying existing charges: %v", err)
+	}
+	for _, c := range charges {
+		createdAt, err := time.Parse(time.RFC3339Nano, c.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("charge %d: %v", c.ID, err)
+		}
+		existing[duplicateKey(createdAt.UTC().Format("2006-01-02"), c.Amount, c.Name)] = c.ID
+	}
+
+	seen := map[string]bool{}
+	for i := range rows {
+		row := &rows[i]
+		if len(row.Errors) > 0 || row.Skipped != "" {
+			continue
+		}
+		key := duplicateKey(row.Charge.CreatedAt, row.Charge.Amount, row.Charge.Name)
+		if id, ok := existing[key]; ok {
+			row.Duplicate = true
+			row.DuplicateOf = &id
+		} else if seen[key] {
+			row.Duplicate = true
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// POST /api/charges/import => import charges from a bank CSV export.
+// Multipart form fields:
+//   - file:    the CSV file
+//   - mapping: ImportMapping as JSON
+//   - mode:    "dry-run" (default) returns the parsed rows without saving;
+//     "commit" inserts them in one transaction
+//   - include_duplicates: "true" to also insert rows flagged as duplicates
+//
+// Commit is refused while any row has validation errors. Accepts ?owner=<id>
+// with write access.
+func (s *Server) importChargesHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(maxImportSize); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid multipart upload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	mode := r.FormValue("mode")
+	if mode == "" {
+		mode = "dry-run"
+	}
+	if mode != "dry-run" && mode != "commit" {
+		http.Error(w, "mode must be dry-run or commit", http.StatusBadRequest)
+		return
+	}
+	includeDuplicates := r.FormValue("include_duplicates") == "true"
+
+	var mapping ImportMapping
+	if err := json.Unmarshal([]byte(r.FormValue("mapping")), &mapping); err != nil {
+		http.Error(w, "Invalid mapping: expected a JSON object", http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing CSV file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	rows, err := parseImport(file, mapping, ownerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := flagDuplicates(s.store, rows, ownerID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := ImportResult{Mode: mode, Rows: rows}
+	for _, row := range rows {
+		switch {
+		case len(row.Errors) > 0:
+			result.Invalid++
+		case row.Skipped != "":
+			result.Skipped++
+		default:
+			result.Valid++
+			if row.Duplicate {
+				result.Duplicates++
+			}
+		}
+	}
+
+	if mode == "commit" {
+		if result.Invalid > 0 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+		if err := commitImport(s.store, rows, includeDuplicates, requestAudit(r, callerID)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, row := range rows {
+			if row.Imported {
+				result.Imported++
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// commitImport inserts the importable rows in a single transaction, filling
+// in their IDs and marking them imported. Each charge is audited as src's.
+func commitImport(store Store, rows []ImportRow, includeDuplicates bool, src auditSource) error {
+	imported := map[int]bool{}
+	err := store.Tx(func(tx Store) error {
+		var t *categoryTree
+		for i := range rows {
+			row := &rows[i]
+			if len(row.Errors) > 0 || row.Skipped != "" || (row.Duplicate && !includeDuplicates) {
+				continue
+			}
+			// Every row has the same owner; new category paths are created once
+			c := row.Charge
+			var err error
+			if t == nil {
+				if t, err = loadCategoryTree(tx, c.UserID); err != nil {
+					return err
+				}
+			}
+			if c.CategoryID, c.Category, err = t.resolve(tx, nil, c.Category, src); err != nil {
+				return fmt.Errorf("filing line %d: %v", row.Line, err)
+			}
+			if err := tx.CreateCharge(row.Charge); err != nil {
+				return fmt.Errorf("inserting line %d: %v", row.Line, err)
+			}
+			if err := src.record(tx, AuditCreate, "charge", row.Charge.ID, row.Charge.UserID, nil, row.Charge); err != nil {
+				return err
+			}
+			imported[i] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Only a committed import marks rows imported
+	for i := range imported {
+		rows[i].Imported = true
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParseImportDescription(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		want        string
+	}{
+		{"short", "Coffee", "Coffee"},
+		{"100 characters", strings.Repeat("a", 100), strings.Repeat("a", 100)},
+		{"long", strings.Repeat("a", 150), strings.Repeat("a", 100)},
+		{"multibyte within the limit", strings.Repeat("é", 100), strings.Repeat("é", 100)},
+		{"long multibyte", strings.Repeat("日本", 60), strings.Repeat("日本", 50)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			csv := "date,description,amount\n2024-05-01," + tc.description + ",12.50\n"
+			m := ImportMapping{Date: "date", Description: "description", Amount: "amount", DateFormat: "YYYY-MM-DD", DefaultCurrency: "USD"}
+			rows, err := parseImport(strings.NewReader(csv), m, 1)
+			if err != nil {
+				t.Fatalf("parseImport: %v", err)
+			}
+			if len(rows) != 1 || rows[0].Charge == nil || len(rows[0].Errors) != 0 {
+				t.Fatalf("rows = %+v", rows)
+			}
+			got := rows[0].Charge.Name
+			if got != tc.want || !utf8.ValidString(got) {
+				t.Fatalf("name = %q (%d runes), want %q", got, utf8.RuneCountInString(got), tc.want)
+			}
+		})
+	}
+}
+
+func TestGoDateLayout(t *testing.T) {
+	tests := []struct{ format, layout string }{
+		{"", "2006-01-02"},
+		{"YYYY-MM-DD", "2006-01-02"},
+		{"MM/DD/YYYY", "01/02/2006"},
+		{"dd.MM.yy", "02.01.06"},
+		{"02/01/2006", "02/01/2006"},
+	}
+	for _, tc := range tests {
+		if got := goDateLayout(tc.format); got != tc.layout {
+			t.Fatalf("goDateLayout(%q) = %q, want %q", tc.format, got, tc.layout)
+		}
+	}
+}
+
+func TestParseImportAmount(t *testing.T) {
+	tests := []struct {
+		in, currency, want string
+		ok                 bool
+	}{
+		{"12.50", "USD", "12.50", true},
+		{"$1,234.56", "USD", "1234.56", true},
+		{"-5", "EUR", "-5.00", true},
+		{"+5", "EUR", "5.00", true},
+		{"(5.00)", "USD", "-5.00", true},
+		{" 1 200 ", "JPY", "1200", true},
+		{"1.234", "USD", "", false},
+		{"", "USD", "", false},
+		{"n/a", "USD", "", false},
+	}
+	for _, tc := range tests {
+		got, err := parseImportAmount(tc.in, tc.currency)
+		if (err == nil) != tc.ok || (tc.ok && (got.String() != tc.want || got.Currency != tc.currency)) {
+			t.Fatalf("parseImportAmount(%q, %s) = %s %s, %v; want %s, ok %v", tc.in, tc.currency, got, got.Currency, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestParseImportSign(t *testing.T) {
+	tests := []struct {
+		name      string
+		sign      string
+		credits   string
+		amount    string // the amount, or debit;credit for debit_credit
+		want      string
+		direction string
+		skipped   bool
+	}{
+		{"expense positive: a charge", "", "", "12.50", "12.50", DirectionExpense, false},
+		{"expense positive: a credit", "expense_positive", "", "-12.50", "-12.50", DirectionExpense, true},
+		{"expense positive: zero", "expense_positive", "", "0", "0.00", DirectionExpense, true},
+		{"expense negative: a charge", "expense_negative", "", "-12.50", "12.50", DirectionExpense, false},
+		{"expense negative: a credit", "expense_negative", "", "12.50", "-12.50", DirectionExpense, true},
+		{"expense negative: income", "expense_negative", "income", "2000", "2000.00", DirectionIncome, false},
+		{"expense positive: a refund", "expense_positive", "refund", "(9.99)", "9.99", DirectionRefund, false},
+		{"debit", "debit_credit", "", "12.50;", "12.50", DirectionExpense, false},
+		{"credit skipped", "debit_credit", "", ";12.50", "", DirectionExpense, true},
+		{"credit as income", "debit_credit", "income", ";-12.50", "12.50", DirectionIncome, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := ImportMapping{Date: "0", Description: "1", Sign: tc.sign, Credits: tc.credits, NoHeader: true, Delimiter: ";"}
+			if tc.sign == "debit_credit" {
+				m.Debit, m.Credit = "2", "3"
+			} else {
+				m.Amount = "2"
+			}
+			rows, err := parseImport(strings.NewReader("2024-05-01;Row;"+tc.amount+"\n"), m, 1)
+			if err != nil {
+				t.Fatalf("parseImport: %v", err)
+			}
+			if len(rows) != 1 || len(rows[0].Errors) != 0 || rows[0].Line != 1 {
+				t.Fatalf("rows = %+v", rows)
+			}
+			row := rows[0]
+			if (row.Skipped != "") != tc.skipped || row.Charge.Direction != tc.direction {
+				t.Fatalf("skipped %q, direction %q; want skipped %v, direction %q", row.Skipped, row.Charge.Direction, tc.skipped, tc.direction)
+			}
+			if tc.want != "" && row.Charge.Amount.String() != tc.want {
+				t.Fatalf("amount = %s, want %s", row.Charge.Amount, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseImportMapping(t *testing.T) {
+	tests := []struct {
+		name string
+		m    ImportMapping
+		want string
+	}{
+		{"no amount column", ImportMapping{Date: "date", Description: "description"}, "mapping for amount is required"},
+		{"no debit column", ImportMapping{Date: "date", Description: "description", Amount: "amount", Sign: "debit_credit"}, "mapping for debit is required"},
+		{"unknown column", ImportMapping{Date: "date", Description: "memo", Amount: "amount"}, `column "memo" not found`},
+		{"unknown sign", ImportMapping{Date: "date", Description: "description", Amount: "amount", Sign: "both"}, "sign must be"},
+		{"unknown credits", ImportMapping{Date: "date", Description: "description", Amount: "amount", Credits: "transfer"}, "credits must be"},
+		{"long delimiter", ImportMapping{Date: "date", Description: "description", Amount: "amount", Delimiter: ";;"}, "delimiter"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseImport(strings.NewReader("date,description,amount\n2024-05-01,Coffee,3\n"), tc.m, 1)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("parseImport = %v, want an error about %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------
+//  Filtering + Pagination
+// --------------------------
+
+// Page size limits for list endpoints.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 500
+)
+
+// Page: the envelope list endpoints respond with. NextCursor is empty on
+// the last page.
+type Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// sortField: a column a list can be ordered by, and the SQL type used to
+// compare a cursor value against it.
+type sortField struct {
+	Expr string
+	Type string
+}
+
+// listSpec describes what a list endpoint can filter and sort on.
+type listSpec struct {
+	Sortable     map[string]sortField
+	DefaultSort  string
+	DefaultOrder string
+	DateColumn   string // "" when the table has no date to filter on
+	Tagged       bool   // rows carry tags to filter on
+	Accounts     bool   // rows can be filtered by account
+	Directed     bool   // rows have a direction to filter on
+	Split        bool   // rows may be split into lines with categories of their own
+}
+
+// field returns the sort field named by f, the ID when f.Sort is empty.
+func (spec listSpec) field(f *ListFilter) sortField {
+	if s, ok := spec.Sortable[f.Sort]; ok {
+		return s
+	}
+	return spec.Sortable["id"]
+}
+
+var chargeListSpec = listSpec{
+	Sortable: map[string]sortField{
+		"id":         {"id", "integer"},
+		"created_at": {"created_at", "timestamptz"},
+		"amount":     {"amount", "numeric"},
+		"name":       {"name", "text"},
+		"category":   {"category", "text"},
+	},
+	DefaultSort:  "created_at",
+	DefaultOrder: "desc",
+	DateColumn:   "created_at",
+	Tagged:       true,
+	Accounts:     true,
+	Directed:     true,
+	Split:        true,
+}
+
+var budgetListSpec = listSpec{
+	Sortable: map[string]sortField{
+		"id":       {"id", "integer"},
+		"amount":   {"amount", "numeric"},
+		"name":     {"name", "text"},
+		"category": {"COALESCE(category, '')", "text"},
+		"period":   {"COALESCE(period, '')", "text"},
+	},
+	DefaultSort:  "id",
+	DefaultOrder: "asc",
+}
+
+// listCursor is what an opaque cursor decodes to: the sort key and ID of
+// the last row returned, plus the sort and filters it belongs to.
+type listCursor struct {
+	Sort    string `json:"s"`
+	Order   string `json:"o"`
+	Filters string `json:"f"`
+	Value   string `json:"v"`
+	ID      int    `json:"id"`
+}
+
+// ListFilter selects, orders and pages a list of one owner's budgets or
+// charges. Stores must return at most Limit rows (all of them when Limit
+// is 0) ordered by Sort then ID, starting after the After cursor.
+type ListFilter struct {
+	OwnerID     int
+	From, To    *time.Time // created_at range, To exclusive
+	Categories  []string   // names or paths; expandCategoryFilter turns them into CategoryIDs
+	CategoryIDs []int      // nil matches any category
+	Tags        []string   // normalized; rows must carry all of them, or any with AnyTag
+	AnyTag      bool
+	AccountID   int    // 0 for any account or none
+	Direction   string // expense, income or refund; "" for any
+	Currency    string
+	MinAmount   *Money
+	MaxAmount   *Money
+	Query       string // name substring, case-insensitive
+	Sort        string
+	Order       string // asc or desc
+	Limit       int
+	After       *listCursor
+
+	filters string
+}
+
+// parseListQuery validates the list parameters in values for ownerID:
+//
+//	from, to            created_at range (YYYY-MM-DD or RFC 3339; to is exclusive)
+//	category            one or more names or paths, repeated or comma separated,
+//	                    case-insensitive; subcategories are included
+//	category_id         one or more category IDs, likewise
+//	tag                 one or more tags, likewise
+//	tag_mode            all (the default: rows carry every tag) or any
+//	account_id          the account charges were posted to
+//	direction           expense, income or refund
+//	min_amount, max_amount
+//	                    amount bounds in currency, which they require
+//	currency
+//	q                   name substring, case-insensitive
+//	sort, order         a sortable field, asc or desc
+//	limit, cursor       page size and the next_cursor of the previous page
+//
+// Limit is set one past the page size so the handler can tell whether
+// another page exists.
+func parseListQuery(values url.Values, spec listSpec, ownerID int) (*ListFilter, error) {
+	f := &ListFilter{OwnerID: ownerID}
+
+	if spec.DateColumn != "" {
+		for _, p := range []struct {
+			param string
+			dst   **time.Time
+		}{{"from", &f.From}, {"to", &f.To}} {
+			if v := values.Get(p.param); v != "" {
+				t, err := parseDate(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s date %q", p.param, v)
+				}
+				*p.dst = &t
+			}
+		}
+	} else if values.Get("from") != "" || values.Get("to") != "" {
+		return nil, fmt.Errorf("from/to are not supported here")
+	}
+
+	for _, v := range values["category"] {
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				f.Categories = append(f.Categories, strings.ToLower(c))
+			}
+		}
+	}
+	for _, v := range values["category_id"] {
+		for _, c := range strings.Split(v, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(c))
+			if err != nil {
+				return nil, fmt.Errorf("invalid category_id %q", c)
+			}
+			f.CategoryIDs = append(f.CategoryIDs, id)
+		}
+	}
+
+	var tags []string
+	for _, v := range values["tag"] {
+		tags = append(tags, strings.Split(v, ",")...)
+	}
+	mode := values.Get("tag_mode")
+	if !spec.Tagged && (len(tags) > 0 || mode != "") {
+		return nil, fmt.Errorf("tag filters are not supported here")
+	}
+	if len(tags) > 0 {
+		var err error
+		if f.Tags, err = normalizeTags(tags); err != nil {
+			return nil, err
+		}
+	}
+	switch mode {
+	case "", "all":
+	case "any":
+		f.AnyTag = true
+	default:
+		return nil, fmt.Errorf("tag_mode must be all or any")
+	}
+
+	if v := values.Get("account_id"); v != "" {
+		if !spec.Accounts {
+			return nil, fmt.Errorf("account_id is not supported here")
+		}
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 1 {
+			return nil, fmt.Errorf("invalid account_id %q", v)
+		}
+		f.AccountID = id
+	}
+
+	if v := strings.ToLower(values.Get("direction")); v != "" {
+		if !spec.Directed {
+			return nil, fmt.Errorf("direction is not supported here")
+		}
+		if v != DirectionExpense && v != DirectionIncome && v != DirectionRefund {
+			return nil, fmt.Errorf("invalid direction %q (want expense, income or refund)", v)
+		}
+		f.Direction = v
+	}
+
+	currency := values.Get("currency")
+	if currency != "" {
+		code, err := normalizeCurrency(currency)
+		if err != nil {
+			return nil, err
+		}
+		f.Currency = code
+	}
+	for _, p := range []struct {
+		param string
+		dst   **Money
+	}{{"min_amount", &f.MinAmount}, {"max_amount", &f.MaxAmount}} {
+		if v := values.Get(p.param); v != "" {
+			// Amounts in other currencies aren't comparable
+			if currency == "" {
+				return nil, fmt.Errorf("%s needs a currency", p.param)
+			}
+			m, err := parseMoney(v, currency)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", p.param, err)
+			}
+			*p.dst = &m
+		}
+	}
+
+	f.Query = strings.TrimSpace(values.Get("q"))
+
+	f.Sort = values.Get("sort")
+	if f.Sort == "" {
+		f.Sort = spec.DefaultSort
+	}
+	if _, ok := spec.Sortable[f.Sort]; !ok {
+		var names []string
+		for name := range spec.Sortable {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("invalid sort field %q (want one of %s)", f.Sort, strings.Join(names, ", "))
+	}
+	f.Order = strings.ToLower(values.Get("order"))
+	if f.Order == "" {
+		f.Order = spec.DefaultOrder
+	}
+	if f.Order != "asc" && f.Order != "desc" {
+		return nil, fmt.Errorf("order must be asc or desc")
+	}
+
+	limit := defaultPageSize
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		limit = n
+	}
+	f.Limit = limit + 1
+
+	f.filters = filterFingerprint(values)
+	if v := values.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil || c.Sort != f.Sort || c.Order != f.Order || c.Filters != f.filters {
+			return nil, fmt.Errorf("invalid cursor for this query")
+		}
+		f.After = c
+	}
+	return f, nil
+}
+
+// filterFingerprint identifies the filters of a query so a cursor can't be
+// replayed against different ones.
+func filterFingerprint(values url.Values) string {
+	filtered := url.Values{}
+	for k, v := range values {
+		switch k {
+		case "cursor", "limit":
+			continue
+		}
+		filtered[k] = v
+	}
+	sum := sha256.Sum256([]byte(filtered.Encode()))
+	return hex.EncodeToString(sum[:8])
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c listCursor
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// page trims the rows a store returned for f to the requested page size
+// and returns how many to keep plus the cursor for the next page, given
+// the sort key and ID of the row at index i.
+func (f *ListFilter) page(rowCount int, key func(i int) (string, int)) (int, string) {
+	size := f.Limit - 1
+	if rowCount <= size {
+		return rowCount, ""
+	}
+	value, id := key(size - 1)
+	raw, _ := json.Marshal(listCursor{Sort: f.Sort, Order: f.Order, Filters: f.filters, Value: value, ID: id})
+	return size, base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// sortKey renders b's value of a sortable field the way cursors carry it.
+func (b Budget) sortKey(field string) string {
+	switch field {
+	case "amount":
+		return b.Amount.String()
+	case "name":
+		return b.Name
+	case "category":
+		return b.Category
+	case "period":
+		return b.Period
+	}
+	return strconv.Itoa(b.ID)
+}
+
+// sortKey renders c's value of a sortable field the way cursors carry it.
+func (c Charge) sortKey(field string) string {
+	switch field {
+	case "created_at":
+		return c.CreatedAt
+	case "amount":
+		return c.Amount.String()
+	case "name":
+		return c.Name
+	case "category":
+		return c.Category
+	}
+	return strconv.Itoa(c.ID)
+}
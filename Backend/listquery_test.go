@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseListQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		spec  listSpec
+		want  string // an error substring; "" for none
+		check func(f *ListFilter) bool
+	}{
+		{"", chargeListSpec, "", func(f *ListFilter) bool {
+			return f.Sort == "created_at" && f.Order == "desc" && f.Limit == defaultPageSize+1 && f.After == nil
+		}},
+		{"", budgetListSpec, "", func(f *ListFilter) bool { return f.Sort == "id" && f.Order == "asc" }},
+		{"sort=amount&order=ASC&limit=10", chargeListSpec, "", func(f *ListFilter) bool {
+			return f.Sort == "amount" && f.Order == "asc" && f.Limit == 11
+		}},
+		{"from=2024-01-01&to=2024-02-01T00:00:00Z", chargeListSpec, "", func(f *ListFilter) bool {
+			return f.From != nil && f.To != nil && f.To.Sub(*f.From).Hours() == 31*24
+		}},
+		{"category=Food,%20Travel/Trains&category=rent&category_id=3,4", chargeListSpec, "", func(f *ListFilter) bool {
+			return strings.Join(f.Categories, "|") == "food|travel/trains|rent" && len(f.CategoryIDs) == 2 && f.CategoryIDs[1] == 4
+		}},
+		{"tag=Work,trip&tag_mode=any", chargeListSpec, "", func(f *ListFilter) bool { return len(f.Tags) == 2 && f.AnyTag }},
+		{"account_id=7&direction=Income", chargeListSpec, "", func(f *ListFilter) bool {
+			return f.AccountID == 7 && f.Direction == DirectionIncome
+		}},
+		{"currency=jpy&min_amount=100&max_amount=2000&q=%20Lunch%20", chargeListSpec, "", func(f *ListFilter) bool {
+			return f.Currency == "JPY" && f.MinAmount.Minor == 100 && f.MaxAmount.String() == "2000" && f.Query == "Lunch"
+		}},
+		{"from=yesterday", chargeListSpec, "invalid from date", nil},
+		{"from=2024-01-01", budgetListSpec, "not supported", nil},
+		{"tag=work", budgetListSpec, "not supported", nil},
+		{"account_id=1", budgetListSpec, "not supported", nil},
+		{"direction=income", budgetListSpec, "not supported", nil},
+		{"category_id=food", chargeListSpec, "invalid category_id", nil},
+		{"tag_mode=some", chargeListSpec, "tag_mode", nil},
+		{"account_id=0", chargeListSpec, "invalid account_id", nil},
+		{"direction=transfer", chargeListSpec, "invalid direction", nil},
+		{"currency=XYZ", chargeListSpec, "unknown currency", nil},
+		{"currency=JPY&min_amount=1.5", chargeListSpec, "invalid min_amount", nil},
+		{"max_amount=500", chargeListSpec, "max_amount needs a currency", nil},
+		{"sort=period", chargeListSpec, "invalid sort field", nil},
+		{"order=up", chargeListSpec, "order must be", nil},
+		{"limit=0", chargeListSpec, "limit must be", nil},
+		{"limit=" + strconv.Itoa(maxPageSize+1), chargeListSpec, "limit must be", nil},
+		{"cursor=not-a-cursor", chargeListSpec, "invalid cursor", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			values, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := parseListQuery(values, tc.spec, 1)
+			if tc.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.want) {
+					t.Fatalf("parseListQuery = %v, want an error about %q", err, tc.want)
+				}
+				return
+			}
+			if err != nil || f.OwnerID != 1 || !tc.check(f) {
+				t.Fatalf("parseListQuery = %+v, %v", f, err)
+			}
+		})
+	}
+}
+
+func TestListCursor(t *testing.T) {
+	first, err := parseListQuery(url.Values{"sort": {"name"}, "q": {"lunch"}, "limit": {"2"}}, chargeListSpec, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep, cursor := first.page(3, func(i int) (string, int) { return "Lunch " + strconv.Itoa(i), 40 + i })
+	if keep != 2 || cursor == "" {
+		t.Fatalf("page of 3 rows = %d, %q; want 2 and a cursor", keep, cursor)
+	}
+	if keep, next := first.page(2, nil); keep != 2 || next != "" {
+		t.Fatalf("last page = %d, %q; want 2 and no cursor", keep, next)
+	}
+
+	tampered := []byte(cursor)
+	tampered[len(tampered)/2] ^= 1
+	tests := []struct {
+		name  string
+		query url.Values
+		ok    bool
+	}{
+		{"same query", url.Values{"sort": {"name"}, "q": {"lunch"}}, true},
+		{"another page size", url.Values{"sort": {"name"}, "q": {"lunch"}, "limit": {"50"}}, true},
+		{"another filter", url.Values{"sort": {"name"}, "q": {"dinner"}}, false},
+		{"an added filter", url.Values{"sort": {"name"}, "q": {"lunch"}, "currency": {"USD"}}, false},
+		{"another sort", url.Values{"sort": {"amount"}, "q": {"lunch"}}, false},
+		{"another order", url.Values{"sort": {"name"}, "q": {"lunch"}, "order": {"asc"}}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.query.Set("cursor", cursor)
+			f, err := parseListQuery(tc.query, chargeListSpec, 1)
+			if (err == nil) != tc.ok {
+				t.Fatalf("parseListQuery = %v, want ok %v", err, tc.ok)
+			}
+			if tc.ok && (f.After == nil || f.After.Value != "Lunch 1" || f.After.ID != 41) {
+				t.Fatalf("cursor decoded to %+v, want the second row", f.After)
+			}
+		})
+	}
+	if c, err := decodeCursor(string(tampered)); err == nil && c.Filters == first.filters && c.ID == 41 && c.Value == "Lunch 1" {
+		t.Fatalf("a tampered cursor decoded unchanged")
+	}
+	if _, err := decodeCursor(base64.RawURLEncoding.EncodeToString([]byte("{"))); err == nil {
+		t.Fatalf("decodeCursor of broken JSON: want an error")
+	}
+}
+
+func TestChargeListStore(t *testing.T) {
+	eachStore(t, testChargeLists)
+}
+
+func TestChargePages(t *testing.T) {
+	eachStore(t, testChargePages)
+}
+
+// testChargePages walks every page of the charge list in each sort order and
+// checks that every charge comes back exactly once, in order.
+func testChargePages(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	a := at.a
+	for i, c := range []map[string]interface{}{
+		{"name": "Apples", "amount": 3},
+		{"name": "Bread", "amount": 3},
+		{"name": "Cheese", "amount": 7.5},
+		{"name": "Dates", "amount": 1},
+		{"name": "Eggs", "amount": 3},
+	} {
+		c["category"] = "Food"
+		if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", c, nil); err != nil {
+			t.Fatalf("charge %d: %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "Eggs Dates Cheese Bread Apples"},
+		{"sort=created_at&order=asc", "Apples Bread Cheese Dates Eggs"},
+		{"sort=name", "Eggs Dates Cheese Bread Apples"},
+		{"sort=name&order=asc", "Apples Bread Cheese Dates Eggs"},
+		// Equal amounts are ordered by ID, in the same direction
+		{"sort=amount&order=asc", "Dates Apples Bread Eggs Cheese"},
+		{"sort=amount&min_amount=2&currency=usd", "Cheese Eggs Bread Apples"},
+		{"sort=category&q=e", "Eggs Dates Cheese Bread Apples"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			var names []string
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > 5 {
+					t.Fatalf("more pages than charges")
+				}
+				path := "/api/charges?limit=2&" + tc.query
+				if cursor != "" {
+					path += "&cursor=" + url.QueryEscape(cursor)
+				}
+				var page struct {
+					Items      []Charge `json:"items"`
+					NextCursor string   `json:"next_cursor"`
+				}
+				if err := a.expectStatus(http.StatusOK, "GET", path, nil, &page); err != nil {
+					t.Fatal(err)
+				}
+				if len(page.Items) > 2 {
+					t.Fatalf("page of %d charges, want at most 2", len(page.Items))
+				}
+				for _, c := range page.Items {
+					names = append(names, c.Name)
+				}
+				if cursor = page.NextCursor; cursor == "" {
+					break
+				}
+			}
+			if got := strings.Join(names, " "); got != tc.want {
+				t.Fatalf("charges = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func testChargeLists(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	food := Category{Name: "Food", UserID: u.ID}
+	housing := Category{Name: "Housing", UserID: u.ID}
+	for _, c := range []*Category{&food, &housing} {
+		if err := s.CreateCategory(c); err != nil {
+			t.Fatalf("CreateCategory: %v", err)
+		}
+	}
+	dining := Category{Name: "Dining", ParentID: &food.ID, UserID: u.ID}
+	if err := s.CreateCategory(&dining); err != nil {
+		t.Fatalf("CreateCategory: %v", err)
+	}
+
+	for _, c := range []Charge{
+		{Name: "Coffee", Amount: mustMoney("3.50", "USD"), Category: "Food", CategoryID: &food.ID, CreatedAt: "2024-01-05T08:00:00Z"},
+		{Name: "Rent", Amount: mustMoney("1200", "USD"), Category: "Housing", CategoryID: &housing.ID, CreatedAt: "2024-01-01T00:00:00Z"},
+		{Name: "Dinner 50%", Amount: mustMoney("42.00", "USD"), Category: "Food > Dining", CategoryID: &dining.ID, CreatedAt: "2024-01-20T19:30:00Z"},
+		{Name: "Train", Amount: mustMoney("1500", "JPY"), CreatedAt: "2024-02-02T09:00:00Z"},
+	} {
+		c.UserID = u.ID
+		if err := s.CreateCharge(&c); err != nil {
+			t.Fatalf("CreateCharge: %v", err)
+		}
+		got, err := s.GetCharge(c.ID)
+		if err != nil || got.Name != c.Name || got.Amount != c.Amount {
+			t.Fatalf("GetCharge(%d) = %+v, %v", c.ID, got, err)
+		}
+	}
+
+	names := func(f *ListFilter) (string, error) {
+		f.OwnerID = u.ID
+		charges, err := s.ListCharges(f)
+		if err != nil {
+			return "", err
+		}
+		out := ""
+		for _, c := range charges {
+			out += c.Name + ";"
+		}
+		return out, nil
+	}
+	from := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	min := mustMoney("10", "USD")
+	cases := []struct {
+		filter ListFilter
+		want   string
+	}{
+		{ListFilter{Sort: "created_at", Order: "desc"}, "Train;Dinner 50%;Coffee;Rent;"},
+		{ListFilter{Sort: "amount", Order: "asc", Currency: "USD"}, "Coffee;Dinner 50%;Rent;"},
+		{ListFilter{Sort: "name", Order: "asc", CategoryIDs: []int{food.ID, dining.ID}}, "Coffee;Dinner 50%;"},
+		{ListFilter{Sort: "name", Order: "asc", CategoryIDs: []int{}}, ""},
+		{ListFilter{Sort: "created_at", Order: "asc", From: &from, To: &to}, "Coffee;Dinner 50%;"},
+		{ListFilter{Sort: "id", Order: "asc", MinAmount: &min, Currency: "USD"}, "Rent;Dinner 50%;"},
+		{ListFilter{Sort: "id", Order: "asc", Query: "50%"}, "Dinner 50%;"},
+		{ListFilter{Sort: "id", Order: "asc", Query: "COFF"}, "Coffee;"},
+		{ListFilter{Sort: "created_at", Order: "desc", Limit: 2}, "Train;Dinner 50%;"},
+		{ListFilter{Sort: "created_at", Order: "desc", Limit: 2,
+			After: &listCursor{Value: "2024-01-20T19:30:00Z"}}, "Coffee;Rent;"},
+	}
+	for _, tc := range cases {
+		f := tc.filter
+		if tc.filter.After != nil {
+			// The cursor needs the ID of the row it continues after
+			all, _ := s.ListCharges(&ListFilter{OwnerID: u.ID, Query: "Dinner"})
+			if len(all) != 1 {
+				t.Fatalf("expected one Dinner charge, got %d", len(all))
+			}
+			f.After = &listCursor{Value: all[0].sortKey("created_at"), ID: all[0].ID}
+		}
+		got, err := names(&f)
+		if err != nil {
+			t.Fatalf("ListCharges(%+v): %v", tc.filter, err)
+		}
+		if got != tc.want {
+			t.Fatalf("ListCharges(sort=%s %s) = %q, want %q", tc.filter.Sort, tc.filter.Order, got, tc.want)
+		}
+	}
+}
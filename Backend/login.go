@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --------------------------
+//   Login Throttling
+// --------------------------
+
+// loginLimit: how many failed logins in a row a username or an IP address
+// gets before it is slowed down and then locked out.
+type loginLimit struct {
+	BackoffAfter int // failures before each further attempt has to wait
+	LockoutAt    int // failures that lock logins out for loginLockoutDuration
+}
+
+// Throttling settings, overridable with LOGIN_BACKOFF_AFTER,
+// LOGIN_LOCKOUT_THRESHOLD, LOGIN_IP_BACKOFF_AFTER, LOGIN_IP_LOCKOUT_THRESHOLD,
+// LOGIN_BACKOFF_BASE, LOGIN_BACKOFF_MAX and LOGIN_LOCKOUT_DURATION. An IP
+// address gets more room than a username since many users can share one.
+var (
+	userLoginLimit       = loginLimit{BackoffAfter: 3, LockoutAt: 5}
+	ipLoginLimit         = loginLimit{BackoffAfter: 10, LockoutAt: 50}
+	loginBackoffBase     = time.Second
+	loginBackoffMax      = time.Minute
+	loginLockoutDuration = 15 * time.Minute
+)
+
+// Why a login attempt failed
+const (
+	LoginInvalidCredentials = "invalid_credentials"
+	LoginThrottled          = "throttled"
+	LoginChallenged         = "two_factor_challenge" // the password was right; waiting for the second factor
+	LoginInvalidCode        = "invalid_code"
+)
+
+// invalidCredentials is all a client learns about a failed login, whether
+// the username doesn't exist or the password is wrong.
+const invalidCredentials = "Invalid username or password"
+
+// LoginThrottle: the failed logins of a "user:<username>" or "ip:<address>"
+// key since its last successful login or unlock. Password reset requests
+// are counted the same way under "reset-user:" and "reset-ip:" keys.
+type LoginThrottle struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+}
+
+// LoginAttempt: one POST /api/login, recorded whether or not it succeeded.
+type LoginAttempt struct {
+	ID        int    `json:"id"`
+	Username  string `json:"username"`
+	UserID    *int   `json:"user_id"` // nil when no user has the username
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Success   bool   `json:"success"`
+	Reason    string `json:"reason,omitempty"` // why it failed
+	CreatedAt string `json:"created_at"`
+}
+
+// LoginAttemptFilter narrows ListLoginAttempts; zero fields don't filter.
+type LoginAttemptFilter struct {
+	Username string
+	UserID   int
+	IP       string
+	BeforeID int // only attempts with a smaller ID (pagination cursor)
+	Limit    int // 0 for no limit
+}
+
+func userLoginKey(username string) string { return "user:" + username }
+func ipLoginKey(ip string) string         { return "ip:" + ip }
+
+// retryAt returns when the key may try again under limit: right away below
+// BackoffAfter failures, then after a wait that doubles with every failure
+// up to loginBackoffMax, and loginLockoutDuration after the last failure
+// once there have been LockoutAt.
+func (t LoginThrottle) retryAt(limit loginLimit) time.Time {
+	if t.Failures >= limit.LockoutAt {
+		return t.LastFailure.Add(loginLockoutDuration)
+	}
+	if t.Failures < limit.BackoffAfter {
+		return time.Time{}
+	}
+	wait := loginBackoffMax
+	if n := t.Failures - limit.BackoffAfter; n < 32 {
+		if d := loginBackoffBase << uint(n); d < wait {
+			wait = d
+		}
+	}
+	return t.LastFailure.Add(wait)
+}
+
+// locked reports whether the key is locked out under limit.
+func (t LoginThrottle) locked(limit loginLimit, now time.Time) bool {
+	return t.Failures >= limit.LockoutAt && now.Before(t.retryAt(limit))
+}
+
+// loginThrottle returns the throttle of key, with no failures if it has none.
+func loginThrottle(store Store, key string) (LoginThrottle, error) {
+	t, err := store.GetLoginThrottle(key)
+	if errors.Is(err, ErrNotFound) {
+		return LoginThrottle{Key: key}, nil
+	}
+	return t, err
+}
+
+// throttleKey: a LoginThrottle key and the limit it is held to.
+type throttleKey struct {
+	key   string
+	limit loginLimit
+}
+
+// loginKeys returns the keys a login of username from ip counts against.
+func loginKeys(username, ip string) []throttleKey {
+	return []throttleKey{{userLoginKey(username), userLoginLimit}, {ipLoginKey(ip), ipLoginLimit}}
+}
+
+// throttleRetryAt returns when keys next allow an attempt, the latest of
+// what each of them allows.
+func throttleRetryAt(store Store, keys []throttleKey) (time.Time, error) {
+	var at time.Time
+	for _, k := range keys {
+		t, err := loginThrottle(store, k.key)
+		if err != nil {
+			return at, err
+		}
+		if r := t.retryAt(k.limit); r.After(at) {
+			at = r
+		}
+	}
+	return at, nil
+}
+
+// lockThrottleRetryAt locks keys for the rest of tx and returns when they
+// next allow an attempt. Checking an attempt and counting its failure in
+// the same tx keeps concurrent attempts from all getting through before
+// any failure counts.
+func lockThrottleRetryAt(tx Store, keys []throttleKey) (time.Time, error) {
+	for _, k := range keys {
+		if err := tx.LockLoginThrottle(k.key); err != nil {
+			return time.Time{}, fmt.Errorf("locking login throttle: %v", err)
+		}
+	}
+	return throttleRetryAt(tx, keys)
+}
+
+// recordThrottleFailure counts a failure against keys. Failures older than
+// the lockout no longer count.
+func recordThrottleFailure(store Store, keys []throttleKey, now time.Time) error {
+	since := now.Add(-loginLockoutDuration)
+	for _, k := range keys {
+		if _, err := store.RecordLoginFailure(k.key, now, since); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loginRetryAt returns when username may next try to log in from ip.
+func loginRetryAt(store Store, username, ip string) (time.Time, error) {
+	return throttleRetryAt(store, loginKeys(username, ip))
+}
+
+// lockLoginRetryAt locks the throttles of username and ip for the rest of
+// tx and returns when username may next try to log in from ip.
+func lockLoginRetryAt(tx Store, username, ip string) (time.Time, error) {
+	return lockThrottleRetryAt(tx, loginKeys(username, ip))
+}
+
+// recordLoginFailure counts a failed login against username and ip.
+func recordLoginFailure(store Store, username, ip string, now time.Time) error {
+	return recordThrottleFailure(store, loginKeys(username, ip), now)
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// checkMissingUserPassword spends as long on the password of a username
+// nobody has as checkPasswordHash does on a real one, so response times
+// don't tell the two apart.
+func checkMissingUserPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword("no such user")
+	})
+	checkPasswordHash(password, dummyHash)
+}
+
+// throttledError: logins of a username or IP have to wait until retryAt.
+type throttledError struct {
+	retryAt time.Time
+}
+
+func (e *throttledError) Error() string { return "too many failed login attempts" }
+
+// writeThrottled answers a login attempt that has to wait until retryAt.
+func writeThrottled(w http.ResponseWriter, retryAt time.Time) {
+	writeRetryLater(w, retryAt, "Too many failed login attempts, try again later")
+}
+
+// writeRetryLater answers a 429 with msg, telling the client to wait until
+// retryAt.
+func writeRetryLater(w http.ResponseWriter, retryAt time.Time, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(retryAt).Seconds()))))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// finishLogin records a successful login, forgetting the failures of its
+// username, and issues the user's token pair.
+func finishLogin(tx Store, attempt *LoginAttempt) (tokenPair, error) {
+	attempt.Success, attempt.Reason = true, ""
+	if err := tx.ClearLoginThrottle(userLoginKey(attempt.Username)); err != nil {
+		return tokenPair{}, err
+	}
+	if err := tx.RecordLoginAttempt(attempt); err != nil {
+		return tokenPair{}, err
+	}
+	return issueTokenPair(tx, *attempt.UserID)
+}
+
+// loginResponse is what a successful login answers.
+func loginResponse(pair tokenPair, u User) map[string]interface{} {
+	return map[string]interface{}{
+		"message":              "login successful",
+		"token":                pair.Token,
+		"refresh_token":        pair.RefreshToken,
+		"expires_in":           pair.ExpiresIn,
+		"permissions":          u.Permissions,
+		"must_change_password": u.MustChangePassword,
+	}
+}
+
+// POST /api/login => a token pair for { "username", "password" }. Unknown
+// usernames and wrong passwords get the same 401; too many failures for the
+// username or the client's IP get a 429 with Retry-After until the backoff
+// or lockout (see loginLimit) passes. Every attempt is recorded. The
+// password is checked and a failure counted with the throttles locked, so
+// concurrent guesses can't all slip in under the limits.
+//
+// Users with two-factor authentication (or required to have it) get a
+// "challenge_token" instead, to send with a code to POST /api/login/2fa;
+// "enrollment_required" says they have to enroll first.
+func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	var creds User
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	attempt := LoginAttempt{Username: creds.Username, IP: ip, UserAgent: r.UserAgent()}
+
+	var dbUser User
+	var pair tokenPair
+	var challenge string
+	var retryAt time.Time
+	passwordOK, enroll := false, false
+	err := s.store.Tx(func(tx Store) error {
+		var err error
+		if retryAt, err = lockLoginRetryAt(tx, creds.Username, ip); err != nil {
+			return err
+		}
+		now := time.Now()
+		if now.Before(retryAt) {
+			attempt.Reason = LoginThrottled
+			return tx.RecordLoginAttempt(&attempt)
+		}
+
+		dbUser, err = tx.GetUserByUsername(creds.Username)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			checkMissingUserPassword(creds.Password)
+		case err != nil:
+			return fmt.Errorf("looking up user: %v", err)
+		default:
+			attempt.UserID = &dbUser.ID
+			passwordOK = checkPasswordHash(creds.Password, dbUser.Password)
+		}
+		if !passwordOK {
+			attempt.Reason = LoginInvalidCredentials
+			if err := recordLoginFailure(tx, creds.Username, ip, now); err != nil {
+				return err
+			}
+			return tx.RecordLoginAttempt(&attempt)
+		}
+		t, err := twoFactor(tx, dbUser.ID)
+		if err != nil {
+			return err
+		}
+		if t.enabled() || t.Required {
+			// The username's failures stand until the second factor checks out
+			attempt.Reason = LoginChallenged
+			enroll = !t.enabled()
+			if challenge, err = issueLoginChallenge(tx, dbUser.ID); err != nil {
+				return err
+			}
+			return tx.RecordLoginAttempt(&attempt)
+		}
+		pair, err = finishLogin(tx, &attempt)
+		return err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error logging in: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if attempt.Reason == LoginThrottled {
+		writeThrottled(w, retryAt)
+		return
+	}
+	if !passwordOK {
+		http.Error(w, invalidCredentials, http.StatusUnauthorized)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if challenge != "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":             "two-factor authentication required",
+			"two_factor_required": true,
+			"challenge_token":     challenge,
+			"expires_in":          int(loginChallengeTTL.Seconds()),
+			"enrollment_required": enroll,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(loginResponse(pair, dbUser))
+}
+
+// Lockout: a user's failed logins as GET /api/users/{id}/lockout shows them.
+type Lockout struct {
+	UserID      int        `json:"user_id"`
+	Username    string     `json:"username"`
+	Failures    int        `json:"failures"`
+	LastFailure *time.Time `json:"last_failure"`
+	Locked      bool       `json:"locked"`
+	RetryAt     *time.Time `json:"retry_at"` // when the user may next try, while they have to wait
+}
+
+// userOfPath returns the user the {id} in the path names.
+func (s *Server) userOfPath(r *http.Request) (User, int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return User{}, http.StatusBadRequest, errors.New("Invalid user ID")
+	}
+	u, err := s.store.GetUser(id)
+	if errors.Is(err, ErrNotFound) {
+		return u, http.StatusNotFound, errors.New("User not found")
+	}
+	if err != nil {
+		return u, http.StatusInternalServerError, fmt.Errorf("Error fetching user: %v", err)
+	}
+	return u, http.StatusOK, nil
+}
+
+// GET /api/users/{id}/lockout => the user's recent failed logins and
+// whether they are locked out (users:read). Only the username counts here;
+// an IP address can be throttled on its own.
+func (s *Server) getLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	u, status, err := s.userOfPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	t, err := loginThrottle(s.store, userLoginKey(u.Username))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching lockout: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	lockout := Lockout{UserID: u.ID, Username: u.Username, Failures: t.Failures, Locked: t.locked(userLoginLimit, now)}
+	if t.Failures > 0 {
+		lockout.LastFailure = &t.LastFailure
+	}
+	if at := t.retryAt(userLoginLimit); now.Before(at) {
+		lockout.RetryAt = &at
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lockout)
+}
+
+// DELETE /api/users/{id}/lockout => unlock the user, forgetting their failed
+// logins (users:write)
+func (s *Server) deleteLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	u, status, err := s.userOfPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if err := s.store.ClearLoginThrottle(userLoginKey(u.Username)); err != nil {
+		http.Error(w, fmt.Sprintf("Error unlocking user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "User unlocked"})
+}
+
+// parseLoginAttemptQuery validates the filters of GET /api/login-attempts:
+// username, user_id, ip, and limit and cursor like parseAuditQuery's.
+func parseLoginAttemptQuery(values url.Values) (*LoginAttemptFilter, error) {
+	f := &LoginAttemptFilter{Username: values.Get("username"), IP: values.Get("ip")}
+	for _, p := range []struct {
+		param string
+		dst   *int
+	}{{"user_id", &f.UserID}, {"cursor", &f.BeforeID}} {
+		if v := values.Get(p.param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid %s %q", p.param, v)
+			}
+			*p.dst = n
+		}
+	}
+
+	limit := defaultPageSize
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		limit = n
+	}
+	f.Limit = limit + 1
+	return f, nil
+}
+
+// GET /api/login-attempts => recorded logins, newest first (audit:read).
+// Filterable and paginated; see parseLoginAttemptQuery.
+func (s *Server) getLoginAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := parseLoginAttemptQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	attempts, err := s.store.ListLoginAttempts(f)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying login attempts: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	next := ""
+	if size := f.Limit - 1; len(attempts) > size {
+		attempts = attempts[:size]
+		next = strconv.Itoa(attempts[size-1].ID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Page{Items: attempts, NextCursor: next})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleRetryAt(t *testing.T) {
+	last := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		limit    loginLimit
+		failures int
+		wait     time.Duration // -1 for right away
+	}{
+		{userLoginLimit, 0, -1},
+		{userLoginLimit, 2, -1},
+		{userLoginLimit, 3, time.Second},
+		{userLoginLimit, 4, 2 * time.Second},
+		{userLoginLimit, 5, loginLockoutDuration},
+		{userLoginLimit, 9, loginLockoutDuration},
+		{ipLoginLimit, 12, 4 * time.Second},
+		{ipLoginLimit, 16, loginBackoffMax},
+		{ipLoginLimit, 49, loginBackoffMax},
+		{ipLoginLimit, 50, loginLockoutDuration},
+	}
+	for _, tc := range tests {
+		th := LoginThrottle{Failures: tc.failures, LastFailure: last}
+		want := time.Time{}
+		if tc.wait >= 0 {
+			want = last.Add(tc.wait)
+		}
+		if got := th.retryAt(tc.limit); !got.Equal(want) {
+			t.Fatalf("retryAt(%+v) after %d failures = %v, want %v", tc.limit, tc.failures, got, want)
+		}
+	}
+}
+
+func TestLoginThrottleLocked(t *testing.T) {
+	last := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		failures int
+		now      time.Time
+		want     bool
+	}{
+		{4, last, false},
+		{5, last, true},
+		{5, last.Add(loginLockoutDuration - time.Second), true},
+		{5, last.Add(loginLockoutDuration), false},
+		{8, last.Add(time.Minute), true},
+	}
+	for _, tc := range tests {
+		th := LoginThrottle{Failures: tc.failures, LastFailure: last}
+		if got := th.locked(userLoginLimit, tc.now); got != tc.want {
+			t.Fatalf("locked after %d failures at %v = %v, want %v", tc.failures, tc.now, got, tc.want)
+		}
+	}
+}
+
+func TestParseLoginAttemptQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  LoginAttemptFilter
+		ok    bool
+	}{
+		{"", LoginAttemptFilter{Limit: defaultPageSize + 1}, true},
+		{"username=alice&ip=192.0.2.1&user_id=7&cursor=40&limit=5", LoginAttemptFilter{Username: "alice", IP: "192.0.2.1", UserID: 7, BeforeID: 40, Limit: 6}, true},
+		{"user_id=0", LoginAttemptFilter{}, false},
+		{"user_id=alice", LoginAttemptFilter{}, false},
+		{"cursor=-1", LoginAttemptFilter{}, false},
+		{"limit=0", LoginAttemptFilter{}, false},
+		{"limit=" + strconv.Itoa(maxPageSize+1), LoginAttemptFilter{}, false},
+	}
+	for _, tc := range tests {
+		values, _ := url.ParseQuery(tc.query)
+		f, err := parseLoginAttemptQuery(values)
+		if (err == nil) != tc.ok || (tc.ok && *f != tc.want) {
+			t.Fatalf("parseLoginAttemptQuery(%q) = %+v, %v; want %+v", tc.query, f, err, tc.want)
+		}
+	}
+}
+
+func TestLoginThrottleStore(t *testing.T) {
+	eachStore(t, testLoginThrottling)
+}
+
+func TestConcurrentLoginFailures(t *testing.T) {
+	eachStore(t, testConcurrentLoginFailures)
+}
+
+// testConcurrentLoginFailures checks that wrong passwords sent at once are
+// throttled like ones sent one after another: only the first BackoffAfter
+// get a password check, the rest have to wait.
+func testConcurrentLoginFailures(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	u := at.alice
+	defer s.ClearLoginThrottle(userLoginKey(u.Username))
+	defer s.ClearLoginThrottle(ipLoginKey("127.0.0.1"))
+
+	attempts := userLoginLimit.LockoutAt * 2
+	statuses := make([]int, attempts)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := at.client()
+			statuses[i], _ = c.call("POST", "/api/login", map[string]string{"username": u.Username, "password": "wrong"}, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	counts := map[int]int{}
+	for _, status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusUnauthorized] != userLoginLimit.BackoffAfter || counts[http.StatusTooManyRequests] != attempts-userLoginLimit.BackoffAfter {
+		t.Fatalf("%d concurrent wrong passwords got statuses %v; want %d 401s, the rest 429s",
+			attempts, counts, userLoginLimit.BackoffAfter)
+	}
+	if th, err := s.GetLoginThrottle(userLoginKey(u.Username)); err != nil || th.Failures != userLoginLimit.BackoffAfter {
+		t.Fatalf("throttle = %+v, %v; want %d failures", th, err, userLoginLimit.BackoffAfter)
+	}
+}
+
+func testLoginThrottling(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	key, stale := userLoginKey(u.Username), ipLoginKey("check-"+u.Username)
+	defer s.ClearLoginThrottle(key)
+	if _, err := s.GetLoginThrottle(key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetLoginThrottle before any failure: got %v, want ErrNotFound", err)
+	}
+	now := time.Now().Truncate(time.Second)
+	if _, err := s.RecordLoginFailure(stale, now.Add(-2*time.Hour), now.Add(-3*time.Hour)); err != nil {
+		t.Fatalf("RecordLoginFailure: %v", err)
+	}
+	for want := 1; want <= 2; want++ {
+		th, err := s.RecordLoginFailure(key, now, now.Add(-time.Hour))
+		if err != nil || th.Failures != want || !th.LastFailure.Equal(now) {
+			t.Fatalf("RecordLoginFailure = %+v, %v; want failure %d", th, err, want)
+		}
+	}
+	if th, err := s.GetLoginThrottle(key); err != nil || th.Key != key || th.Failures != 2 || !th.LastFailure.Equal(now) {
+		t.Fatalf("GetLoginThrottle = %+v, %v; want 2 failures", th, err)
+	}
+	if _, err := s.GetLoginThrottle(stale); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stale throttle: got %v, want ErrNotFound", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.ClearLoginThrottle(key); err != nil {
+			t.Fatalf("ClearLoginThrottle: %v", err)
+		}
+	}
+	if _, err := s.GetLoginThrottle(key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetLoginThrottle after clearing: got %v, want ErrNotFound", err)
+	}
+
+	attempts := []LoginAttempt{
+		{Username: u.Username, IP: "192.0.2.1", Reason: LoginInvalidCredentials},
+		{Username: u.Username, UserID: &u.ID, IP: "192.0.2.2", UserAgent: "check", Success: true},
+	}
+	for i := range attempts {
+		if err := s.RecordLoginAttempt(&attempts[i]); err != nil || attempts[i].ID == 0 || attempts[i].CreatedAt == "" {
+			t.Fatalf("RecordLoginAttempt = %+v, %v", attempts[i], err)
+		}
+	}
+	got, err := s.ListLoginAttempts(&LoginAttemptFilter{Username: u.Username})
+	if err != nil || len(got) != 2 || got[0].ID != attempts[1].ID || !got[0].Success || got[0].UserID == nil ||
+		got[1].UserID != nil || got[1].Reason != LoginInvalidCredentials {
+		t.Fatalf("ListLoginAttempts = %+v, %v; want the success then the failure", got, err)
+	}
+	for _, tc := range []struct {
+		filter LoginAttemptFilter
+		want   int
+	}{
+		{LoginAttemptFilter{UserID: u.ID}, 1},
+		{LoginAttemptFilter{Username: u.Username, IP: "192.0.2.1"}, 1},
+		{LoginAttemptFilter{Username: u.Username, Limit: 1}, 1},
+		{LoginAttemptFilter{Username: u.Username, BeforeID: attempts[1].ID}, 1},
+	} {
+		if found, err := s.ListLoginAttempts(&tc.filter); err != nil || len(found) != tc.want {
+			t.Fatalf("ListLoginAttempts(%+v) = %d attempt(s), %v; want %d", tc.filter, len(found), err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS shares;
+DROP TABLE IF EXISTS charges;
+DROP TABLE IF EXISTS budgets;
+DROP TABLE IF EXISTS users;
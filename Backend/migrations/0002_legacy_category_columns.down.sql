@@ -0,0 +1,2 @@
+-- Nothing to undo: the renamed columns are the ones the API has always used.
+SELECT 1;
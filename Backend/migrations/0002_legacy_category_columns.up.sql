@@ -0,0 +1,21 @@
+-- Databases created by the old Test Tools/setup_db.py script used
+-- budgets.description and charges.charge_type where the API expects
+-- category. Rename them in place when present.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_name = 'budgets' AND column_name = 'description')
+       AND NOT EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_name = 'budgets' AND column_name = 'category') THEN
+        ALTER TABLE budgets RENAME COLUMN description TO category;
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_name = 'charges' AND column_name = 'charge_type')
+       AND NOT EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_name = 'charges' AND column_name = 'category') THEN
+        ALTER TABLE charges RENAME COLUMN charge_type TO category;
+        ALTER TABLE charges ALTER COLUMN category TYPE TEXT;
+    END IF;
+END
+$$;
@@ -0,0 +1,2 @@
+ALTER TABLE shares DROP CONSTRAINT IF EXISTS shares_owner_grantee_key;
+ALTER TABLE shares DROP CONSTRAINT IF EXISTS shares_access_check;
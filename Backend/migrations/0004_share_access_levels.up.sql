@@ -0,0 +1,21 @@
+-- Fold the free-text access strings into the read/write/admin levels,
+-- mapping anything unrecognised to the least privileged one.
+UPDATE shares SET access = CASE LOWER(TRIM(access))
+    WHEN 'admin' THEN 'admin'
+    WHEN 'write' THEN 'write'
+    WHEN 'edit' THEN 'write'
+    WHEN 'read-write' THEN 'write'
+    ELSE 'read'
+END;
+
+-- Keep only the most privileged share per owner/grantee pair.
+DELETE FROM shares s
+USING shares t
+WHERE s.user_id = t.user_id
+  AND s.user_share_id = t.user_share_id
+  AND s.id <> t.id
+  AND (CASE s.access WHEN 'admin' THEN 3 WHEN 'write' THEN 2 ELSE 1 END, s.id)
+    < (CASE t.access WHEN 'admin' THEN 3 WHEN 'write' THEN 2 ELSE 1 END, t.id);
+
+ALTER TABLE shares ADD CONSTRAINT shares_access_check CHECK (access IN ('read', 'write', 'admin'));
+ALTER TABLE shares ADD CONSTRAINT shares_owner_grantee_key UNIQUE (user_id, user_share_id);
@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS charges_recurrence_next_idx;
+ALTER TABLE charges DROP CONSTRAINT IF EXISTS charges_template_occurrence_key;
+ALTER TABLE charges
+    DROP COLUMN IF EXISTS occurrence_date,
+    DROP COLUMN IF EXISTS template_id,
+    DROP COLUMN IF EXISTS recurrence_next,
+    DROP COLUMN IF EXISTS recurrence_seq,
+    DROP COLUMN IF EXISTS recurrence_end,
+    DROP COLUMN IF EXISTS recurrence_day,
+    DROP COLUMN IF EXISTS recurring;
@@ -0,0 +1,16 @@
+-- A charge with recurring = true is a template: it is the first occurrence
+-- and the worker posts the following ones, per its periodical frequency, as
+-- new charges pointing back at it through template_id.
+ALTER TABLE charges
+    ADD COLUMN recurring BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN recurrence_day SMALLINT,
+    ADD COLUMN recurrence_end DATE,
+    ADD COLUMN recurrence_seq INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN recurrence_next TIMESTAMPTZ,
+    ADD COLUMN template_id INTEGER REFERENCES charges(id) ON DELETE SET NULL,
+    ADD COLUMN occurrence_date DATE;
+
+-- Posting the same occurrence twice (restarts, several replicas) is a no-op.
+ALTER TABLE charges ADD CONSTRAINT charges_template_occurrence_key UNIQUE (template_id, occurrence_date);
+
+CREATE INDEX charges_recurrence_next_idx ON charges (recurrence_next) WHERE recurring;
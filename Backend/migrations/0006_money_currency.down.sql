@@ -0,0 +1,7 @@
+ALTER TABLE charges
+    DROP COLUMN IF EXISTS currency,
+    ALTER COLUMN amount TYPE NUMERIC(10,2);
+
+ALTER TABLE budgets
+    DROP COLUMN IF EXISTS currency,
+    ALTER COLUMN amount TYPE NUMERIC(10,2);
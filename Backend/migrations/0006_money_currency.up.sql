@@ -0,0 +1,10 @@
+-- Amounts are exact decimals wide enough for any realistic budget, with
+-- room for currencies that use three minor unit digits. Existing rows
+-- predate currencies and are taken to be USD.
+ALTER TABLE budgets
+    ALTER COLUMN amount TYPE NUMERIC(19,4),
+    ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD' CHECK (currency ~ '^[A-Z]{3}$');
+
+ALTER TABLE charges
+    ALTER COLUMN amount TYPE NUMERIC(19,4),
+    ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD' CHECK (currency ~ '^[A-Z]{3}$');
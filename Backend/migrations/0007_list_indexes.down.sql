@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS budgets_user_amount_idx;
+DROP INDEX IF EXISTS charges_user_category_idx;
+DROP INDEX IF EXISTS charges_user_amount_idx;
+DROP INDEX IF EXISTS charges_user_created_idx;
@@ -0,0 +1,5 @@
+-- Indexes backing the filtered, keyset-paginated list endpoints.
+CREATE INDEX IF NOT EXISTS charges_user_created_idx ON charges (user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS charges_user_amount_idx ON charges (user_id, amount, id);
+CREATE INDEX IF NOT EXISTS charges_user_category_idx ON charges (user_id, LOWER(TRIM(category)));
+CREATE INDEX IF NOT EXISTS budgets_user_amount_idx ON budgets (user_id, amount, id);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS charges_user_category_id_idx;
+CREATE INDEX IF NOT EXISTS charges_user_category_idx ON charges (user_id, LOWER(TRIM(category)));
+
+ALTER TABLE charges DROP COLUMN IF EXISTS category_id;
+ALTER TABLE budgets DROP COLUMN IF EXISTS category_id;
+DROP TABLE IF EXISTS categories;
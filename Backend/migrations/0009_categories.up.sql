@@ -0,0 +1,76 @@
+-- Categories become rows of a per-user tree (Food > Groceries) that budgets
+-- and charges reference by ID. The category text column is kept as the
+-- category's full path, maintained by the application, for display and
+-- sorting.
+CREATE TABLE IF NOT EXISTS categories (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    parent_id INTEGER REFERENCES categories(id) ON DELETE RESTRICT
+);
+
+-- Sibling names are unique regardless of case.
+CREATE UNIQUE INDEX IF NOT EXISTS categories_sibling_name_key
+    ON categories (user_id, COALESCE(parent_id, 0), LOWER(name));
+CREATE INDEX IF NOT EXISTS categories_parent_idx ON categories (parent_id);
+
+ALTER TABLE budgets ADD COLUMN category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL;
+ALTER TABLE charges ADD COLUMN category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL;
+
+-- Fold the existing free-text categories into rows: case and spacing
+-- variants share one category, and "Food/Groceries" or "Food > Groceries"
+-- become a parent and a child.
+DO $$
+DECLARE
+    r RECORD;
+    part TEXT;
+    parent INTEGER;
+    cur INTEGER;
+BEGIN
+    FOR r IN
+        SELECT DISTINCT user_id, category AS path
+        FROM (SELECT user_id, category FROM budgets
+              UNION ALL
+              SELECT user_id, category FROM charges) c
+        WHERE TRIM(COALESCE(category, '')) <> ''
+        ORDER BY user_id, path
+    LOOP
+        parent := NULL;
+        FOREACH part IN ARRAY regexp_split_to_array(TRIM(r.path), '\s*[/>]\s*') LOOP
+            CONTINUE WHEN part = '';
+            part := LEFT(part, 100);
+            SELECT id INTO cur FROM categories
+            WHERE user_id = r.user_id
+              AND parent_id IS NOT DISTINCT FROM parent
+              AND LOWER(name) = LOWER(part);
+            IF cur IS NULL THEN
+                INSERT INTO categories (user_id, name, parent_id)
+                VALUES (r.user_id, part, parent)
+                RETURNING id INTO cur;
+            END IF;
+            parent := cur;
+        END LOOP;
+
+        UPDATE budgets SET category_id = parent WHERE user_id = r.user_id AND category = r.path;
+        UPDATE charges SET category_id = parent WHERE user_id = r.user_id AND category = r.path;
+    END LOOP;
+END
+$$;
+
+-- Rewrite the text of every categorised row as its category's path.
+WITH RECURSIVE paths AS (
+    SELECT id, name::text AS path FROM categories WHERE parent_id IS NULL
+    UNION ALL
+    SELECT c.id, p.path || ' > ' || c.name FROM categories c JOIN paths p ON c.parent_id = p.id
+)
+UPDATE budgets b SET category = paths.path FROM paths WHERE b.category_id = paths.id;
+
+WITH RECURSIVE paths AS (
+    SELECT id, name::text AS path FROM categories WHERE parent_id IS NULL
+    UNION ALL
+    SELECT c.id, p.path || ' > ' || c.name FROM categories c JOIN paths p ON c.parent_id = p.id
+)
+UPDATE charges ch SET category = paths.path FROM paths WHERE ch.category_id = paths.id;
+
+DROP INDEX IF EXISTS charges_user_category_idx;
+CREATE INDEX IF NOT EXISTS charges_user_category_id_idx ON charges (user_id, category_id);
@@ -0,0 +1,7 @@
+-- 0009 made parent_id ON DELETE RESTRICT, which is checked row by row, so
+-- deleting a user couldn't cascade through nested categories. NO ACTION is
+-- checked at the end of the statement instead; DeleteCategory refuses to
+-- delete parents itself.
+ALTER TABLE categories DROP CONSTRAINT IF EXISTS categories_parent_id_fkey;
+ALTER TABLE categories ADD CONSTRAINT categories_parent_id_fkey
+    FOREIGN KEY (parent_id) REFERENCES categories(id);
@@ -0,0 +1,16 @@
+-- Free-form labels on charges (vacation-2026, reimbursable, ...), many to
+-- many. Tag names are stored lower-cased and unique per user.
+CREATE TABLE IF NOT EXISTS tags (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(50) NOT NULL,
+    UNIQUE (user_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS charge_tags (
+    charge_id INTEGER NOT NULL REFERENCES charges(id) ON DELETE CASCADE,
+    tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+    PRIMARY KEY (charge_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS charge_tags_tag_idx ON charge_tags (tag_id, charge_id);
@@ -0,0 +1,2 @@
+ALTER TABLE charges DROP COLUMN IF EXISTS account_id;
+DROP TABLE IF EXISTS accounts;
@@ -0,0 +1,18 @@
+-- Where money lives: checking, savings, credit card and cash accounts.
+-- A charge may be posted against one of its owner's accounts; the
+-- account's balance is its opening balance less what was posted to it.
+CREATE TABLE IF NOT EXISTS accounts (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    type VARCHAR(20) NOT NULL CHECK (type IN ('checking', 'savings', 'credit_card', 'cash')),
+    currency CHAR(3) NOT NULL CHECK (currency ~ '^[A-Z]{3}$'),
+    opening_balance NUMERIC(19,4) NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS accounts_user_name_key ON accounts (user_id, LOWER(name));
+
+-- Accounts with charges posted to them can't be deleted (checked at the end
+-- of the statement, so deleting a user still cascades)
+ALTER TABLE charges ADD COLUMN account_id INTEGER REFERENCES accounts(id);
+CREATE INDEX IF NOT EXISTS charges_account_idx ON charges (account_id, created_at, id);
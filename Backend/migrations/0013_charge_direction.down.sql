@@ -0,0 +1,3 @@
+ALTER TABLE charges DROP CONSTRAINT IF EXISTS charges_amount_nonnegative;
+UPDATE charges SET amount = -amount WHERE direction IN ('income', 'refund');
+ALTER TABLE charges DROP COLUMN IF EXISTS direction;
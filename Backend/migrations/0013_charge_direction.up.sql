@@ -0,0 +1,10 @@
+-- Charges record money going out (expense) as well as coming in (income,
+-- or a refund of earlier spending). Amounts are never negative; the
+-- direction says which way the money went. Negative amounts recorded
+-- before this were refunds in all but name.
+ALTER TABLE charges ADD COLUMN direction VARCHAR(10) NOT NULL DEFAULT 'expense'
+    CHECK (direction IN ('expense', 'income', 'refund'));
+
+UPDATE charges SET direction = 'refund', amount = -amount WHERE amount < 0;
+
+ALTER TABLE charges ADD CONSTRAINT charges_amount_nonnegative CHECK (amount >= 0);
@@ -0,0 +1,12 @@
+-- Money moved between two of a user's accounts: the expense leaving one
+-- and the income arriving in the other, linked so that neither counts as
+-- spending or income. Deleting either leg (or the user) deletes the link.
+CREATE TABLE IF NOT EXISTS transfers (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    from_charge_id INTEGER NOT NULL UNIQUE REFERENCES charges(id) ON DELETE CASCADE,
+    to_charge_id INTEGER NOT NULL UNIQUE REFERENCES charges(id) ON DELETE CASCADE,
+    CHECK (from_charge_id <> to_charge_id)
+);
+
+CREATE INDEX IF NOT EXISTS transfers_user_idx ON transfers (user_id, id);
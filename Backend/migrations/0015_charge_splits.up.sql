@@ -0,0 +1,16 @@
+-- A charge split across categories, e.g. one supermarket receipt covering
+-- groceries, household supplies and a gift. The lines are in the charge's
+-- currency and add up to its amount, which the application checks. Like
+-- charges, the category text is the category's full path.
+CREATE TABLE IF NOT EXISTS charge_splits (
+    id SERIAL PRIMARY KEY,
+    charge_id INTEGER NOT NULL REFERENCES charges(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    amount NUMERIC(19,4) NOT NULL CHECK (amount > 0),
+    category TEXT NOT NULL DEFAULT '',
+    category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+    note TEXT NOT NULL DEFAULT '',
+    UNIQUE (charge_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS charge_splits_category_idx ON charge_splits (category_id, charge_id);
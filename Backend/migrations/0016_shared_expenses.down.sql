@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS settlements;
+DROP TABLE IF EXISTS charge_participants;
+ALTER TABLE charges DROP COLUMN IF EXISTS share_mode;
@@ -0,0 +1,33 @@
+-- Shared expenses: a charge its owner paid for several users who share
+-- with each other. share_mode says how it is divided; each participant's
+-- amount is what they owe of it, worked out by the application and adding
+-- up to the charge's amount. percent is only kept in percent mode.
+ALTER TABLE charges ADD COLUMN IF NOT EXISTS share_mode TEXT
+    CHECK (share_mode IN ('equal', 'percent', 'exact'));
+
+CREATE TABLE IF NOT EXISTS charge_participants (
+    charge_id INTEGER NOT NULL REFERENCES charges(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    percent NUMERIC(5,2),
+    amount NUMERIC(19,4) NOT NULL CHECK (amount >= 0),
+    PRIMARY KEY (charge_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS charge_participants_user_idx ON charge_participants (user_id);
+
+-- Money one user paid another to settle what they owed through shared
+-- expenses.
+CREATE TABLE IF NOT EXISTS settlements (
+    id SERIAL PRIMARY KEY,
+    from_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    to_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    currency CHAR(3) NOT NULL CHECK (currency ~ '^[A-Z]{3}$'),
+    amount NUMERIC(19,4) NOT NULL CHECK (amount > 0),
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK (from_user_id <> to_user_id)
+);
+
+CREATE INDEX IF NOT EXISTS settlements_from_idx ON settlements (from_user_id, created_at);
+CREATE INDEX IF NOT EXISTS settlements_to_idx ON settlements (to_user_id, created_at);
@@ -0,0 +1,30 @@
+-- Savings goals: a target amount to save by a target date, optionally kept
+-- in one of the owner's accounts (in the goal's currency, which the
+-- application checks). Contributions are in the goal's currency; negative
+-- ones take money back out.
+CREATE TABLE IF NOT EXISTS goals (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    currency CHAR(3) NOT NULL CHECK (currency ~ '^[A-Z]{3}$'),
+    target_amount NUMERIC(19,4) NOT NULL CHECK (target_amount > 0),
+    target_date DATE NOT NULL,
+    account_id INTEGER REFERENCES accounts(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS goals_user_idx ON goals (user_id, target_date, id);
+
+-- user_id is who recorded the contribution, which for a joint goal may be
+-- a user the owner shares it with
+CREATE TABLE IF NOT EXISTS goal_contributions (
+    id SERIAL PRIMARY KEY,
+    goal_id INTEGER NOT NULL REFERENCES goals(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    amount NUMERIC(19,4) NOT NULL CHECK (amount <> 0),
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS goal_contributions_goal_idx ON goal_contributions (goal_id, created_at, id);
+CREATE INDEX IF NOT EXISTS goal_contributions_user_idx ON goal_contributions (user_id);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS budget_snapshots;
+ALTER TABLE budgets
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS rollover_cap,
+    DROP COLUMN IF EXISTS rollover;
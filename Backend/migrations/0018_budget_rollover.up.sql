@@ -0,0 +1,24 @@
+-- Budget rollover: what each period of a budget carries into the next,
+-- at most rollover_cap either way. Periods are counted from the one a
+-- budget was created in; existing budgets start now.
+ALTER TABLE budgets
+    ADD COLUMN IF NOT EXISTS rollover TEXT NOT NULL DEFAULT 'none'
+        CHECK (rollover IN ('none', 'surplus', 'deficit', 'both')),
+    ADD COLUMN IF NOT EXISTS rollover_cap NUMERIC(19,4) CHECK (rollover_cap > 0),
+    ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+-- One row per closed period of a budget, as computed when it closed, so
+-- that editing old charges doesn't change history until it is recomputed
+CREATE TABLE IF NOT EXISTS budget_snapshots (
+    budget_id INTEGER NOT NULL REFERENCES budgets(id) ON DELETE CASCADE,
+    period_start TIMESTAMPTZ NOT NULL,
+    period_end TIMESTAMPTZ NOT NULL,
+    currency CHAR(3) NOT NULL CHECK (currency ~ '^[A-Z]{3}$'),
+    allocated NUMERIC(19,4) NOT NULL,
+    carried_in NUMERIC(19,4) NOT NULL,
+    spent NUMERIC(19,4) NOT NULL,
+    carried_out NUMERIC(19,4) NOT NULL,
+    rollover TEXT NOT NULL,
+    computed_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (budget_id, period_start)
+);
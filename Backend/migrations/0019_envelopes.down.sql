@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS envelope_moves;
+DROP TABLE IF EXISTS envelopes;
+DROP TABLE IF EXISTS envelope_modes;
@@ -0,0 +1,39 @@
+-- Envelope budgeting: a user with a row in envelope_modes hands out the
+-- income in its currency from start_month on (always the 1st) to
+-- envelopes, each drawn down by the charges of one category.
+CREATE TABLE IF NOT EXISTS envelope_modes (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    currency CHAR(3) NOT NULL CHECK (currency ~ '^[A-Z]{3}$'),
+    start_month DATE NOT NULL CHECK (EXTRACT(DAY FROM start_month) = 1),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS envelopes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, category_id)
+);
+
+-- Money moved in a month: from the pool (from_envelope_id NULL) to an
+-- envelope, between envelopes, or back to the pool (to_envelope_id NULL).
+-- Deleting an envelope puts the pool in its place. actor_id is who moved it.
+CREATE TABLE IF NOT EXISTS envelope_moves (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    month DATE NOT NULL CHECK (EXTRACT(DAY FROM month) = 1),
+    from_envelope_id INTEGER REFERENCES envelopes(id) ON DELETE SET NULL,
+    to_envelope_id INTEGER REFERENCES envelopes(id) ON DELETE SET NULL,
+    currency CHAR(3) NOT NULL CHECK (currency ~ '^[A-Z]{3}$'),
+    amount NUMERIC(19,4) NOT NULL CHECK (amount > 0),
+    note TEXT NOT NULL DEFAULT '',
+    actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS envelope_moves_user_idx ON envelope_moves (user_id, month, id);
+CREATE INDEX IF NOT EXISTS envelope_moves_from_idx ON envelope_moves (from_envelope_id);
+CREATE INDEX IF NOT EXISTS envelope_moves_to_idx ON envelope_moves (to_envelope_id);
+CREATE INDEX IF NOT EXISTS envelope_moves_actor_idx ON envelope_moves (actor_id);
@@ -0,0 +1,7 @@
+-- users.permissions names the user's role; the roles and what they grant
+-- are defined in rbac.go. Anything that isn't a role used to mean an
+-- ordinary user.
+UPDATE users SET permissions = LOWER(TRIM(permissions));
+UPDATE users SET permissions = 'user' WHERE permissions NOT IN ('admin', 'user', 'auditor', 'support');
+
+ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (permissions IN ('admin', 'user', 'auditor', 'support'));
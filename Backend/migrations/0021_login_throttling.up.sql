@@ -0,0 +1,26 @@
+-- Failed logins per "user:<username>" and "ip:<address>" key, the state
+-- loginHandler backs off and locks out on. Rows are deleted on successful
+-- login, admin unlock, or once their last failure is old enough not to
+-- count any more.
+CREATE TABLE login_throttles (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX login_throttles_last_failure_idx ON login_throttles (last_failure_at);
+
+-- Append-only log of login attempts. Like audit_events it has no foreign
+-- keys, so attempts outlive the users they name; user_id is NULL for
+-- usernames that don't exist.
+CREATE TABLE login_attempts (
+    id SERIAL PRIMARY KEY,
+    username TEXT NOT NULL,
+    user_id INT,
+    ip VARCHAR(64) NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    success BOOLEAN NOT NULL,
+    reason VARCHAR(32) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX login_attempts_username_idx ON login_attempts (username, id);
+CREATE INDEX login_attempts_ip_idx ON login_attempts (ip, id);
@@ -0,0 +1,32 @@
+-- TOTP (RFC 6238) two-factor authentication. A row exists once a user
+-- starts enrolling or an admin requires 2FA of them; secret is '' while
+-- they have none and confirmed_at NULL until a first code is verified.
+-- last_step is the latest 30-second step a code was used for, so each code
+-- works once.
+CREATE TABLE two_factor (
+    user_id INTEGER PRIMARY KEY,
+    required BOOLEAN NOT NULL DEFAULT FALSE,
+    secret TEXT NOT NULL DEFAULT '',
+    confirmed_at TIMESTAMPTZ,
+    last_step BIGINT NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- One-time recovery codes, stored as SHA-256 hex digests and deleted when used.
+CREATE TABLE recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    UNIQUE (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Challenges handed out by the password step of a two-factor login, stored
+-- as SHA-256 hex digests and exchanged once for a token pair.
+CREATE TABLE login_challenges (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
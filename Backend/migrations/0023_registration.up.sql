@@ -0,0 +1,24 @@
+-- Single-use invite codes admins hand out while REGISTRATION=invite, stored
+-- as SHA-256 hex digests. Like audit_events they have no foreign keys, so
+-- invites outlive the users who created and used them.
+CREATE TABLE invites (
+    id SERIAL PRIMARY KEY,
+    code_hash CHAR(64) UNIQUE NOT NULL,
+    note TEXT NOT NULL DEFAULT '',
+    created_by INT,
+    expires_at TIMESTAMPTZ,
+    used_by INT,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Password reset tokens, stored as SHA-256 hex digests. Using one deletes
+-- all of the user's.
+CREATE TABLE password_resets (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX password_resets_user_id_idx ON password_resets (user_id);
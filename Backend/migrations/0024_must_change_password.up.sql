@@ -0,0 +1,3 @@
+-- Set on accounts whose password was handed to them, like the generated
+-- initial admin's: the API refuses everything but changing it until they do.
+ALTER TABLE users ADD COLUMN must_change_password BOOLEAN NOT NULL DEFAULT FALSE;
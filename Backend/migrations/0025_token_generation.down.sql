@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tokens_revoked_at TIMESTAMPTZ;
+UPDATE users SET tokens_revoked_at = CURRENT_TIMESTAMP WHERE token_generation > 0;
+ALTER TABLE users DROP COLUMN IF EXISTS token_generation;
@@ -0,0 +1,9 @@
+-- Access tokens carry the generation they were issued in and are rejected
+-- once the user's generation has moved on. Unlike tokens_revoked_at, whose
+-- comparison with iat only had second precision, this doesn't reject tokens
+-- issued in the same second as a revocation.
+ALTER TABLE users ADD COLUMN token_generation INTEGER NOT NULL DEFAULT 0;
+-- Tokens issued before this carry no generation, which reads as 0: keep
+-- them revoked for users who had revoked theirs.
+UPDATE users SET token_generation = 1 WHERE tokens_revoked_at IS NOT NULL;
+ALTER TABLE users DROP COLUMN tokens_revoked_at;
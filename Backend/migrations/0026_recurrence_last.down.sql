@@ -0,0 +1 @@
+ALTER TABLE charges DROP COLUMN IF EXISTS recurrence_last;
@@ -0,0 +1,5 @@
+-- When the latest occurrence was posted, kept on the template so deleting
+-- that charge doesn't let a rescheduled template post it again.
+ALTER TABLE charges ADD COLUMN recurrence_last TIMESTAMPTZ;
+UPDATE charges t SET recurrence_last = (SELECT MAX(created_at) FROM charges c WHERE c.template_id = t.id)
+WHERE recurring;
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatalf("no migrations embedded")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("migration %d is version %d; versions must run 1, 2, 3, ... without gaps", i, m.Version)
+		}
+		if m.Name == "" || strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			t.Fatalf("migration %04d_%s has an empty name, up or down", m.Version, m.Name)
+		}
+	}
+}
+
+func TestRunMigrateCommandArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "usage"},
+		{[]string{"up", "two"}, "invalid step count"},
+		{[]string{"down", "0"}, "invalid step count"},
+		{[]string{"sideways"}, "unknown migrate command"},
+	}
+	for _, tc := range tests {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			// Bad arguments are refused before the database is touched
+			err := runMigrateCommand(nil, tc.args, nil)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("runMigrateCommand(%q) = %v, want an error about %q", tc.args, err, tc.want)
+			}
+		})
+	}
+}
+
+// TestMigrationRoundTrip reverts every migration of the PostgreSQL test
+// database and applies them again, so every down file runs.
+func TestMigrationRoundTrip(t *testing.T) {
+	testPostgres(t)
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := migrateDown(pgDB, len(migrations)); err != nil || n != len(migrations) {
+		t.Fatalf("migrateDown = %d, %v; want all %d reverted", n, err, len(migrations))
+	}
+	if n, err := migrateUp(pgDB, 0); err != nil || n != len(migrations) {
+		t.Fatalf("migrateUp = %d, %v; want all %d applied", n, err, len(migrations))
+	}
+	if n, err := migrateUp(pgDB, 0); err != nil || n != 0 {
+		t.Fatalf("migrateUp with nothing pending = %d, %v", n, err)
+	}
+}
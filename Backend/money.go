@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// --------------------------
+//          Money
+// --------------------------
+
+// Money: an exact amount of money as an integer count of the currency's
+// minor units (cents for USD/EUR, yen for JPY) plus its ISO 4217 code.
+// Arithmetic between different currencies is an error, never a silent sum.
+type Money struct {
+	Minor    int64
+	Currency string
+}
+
+// errMixedCurrency is returned when amounts in different currencies meet.
+var errMixedCurrency = errors.New("cannot combine amounts in different currencies")
+
+// errMoneyRange is returned for amounts, and sums of them, too large for
+// the NUMERIC(19,4) columns that hold them.
+var errMoneyRange = errors.New("amount out of range")
+
+// maxMoneyWholeDigits: digits NUMERIC(19,4) keeps before the decimal point.
+const maxMoneyWholeDigits = 15
+
+// maxMinor returns the largest amount of currency, in minor units, that
+// its columns hold: 15 nines before the decimal point and as many after
+// as the currency has minor digits.
+func maxMinor(currency string) int64 {
+	max := int64(1)
+	for i := 0; i < maxMoneyWholeDigits+currencyExponent(currency); i++ {
+		max *= 10
+	}
+	return max - 1
+}
+
+// defaultCurrency applies to budgets and charges sent without a currency,
+// overridable with DEFAULT_CURRENCY.
+var defaultCurrency = "USD"
+
+// isoCurrencies lists the active ISO 4217 codes we accept.
+var isoCurrencies = map[string]bool{}
+
+func init() {
+	for _, code := range strings.Fields(`
+		AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND
+		BOB BRL BSD BTN BWP BYN BZD CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF
+		DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD
+		HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW
+		KWD KYD KZT LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR
+		MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN
+		PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN
+		SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX USD UYU UZS VES
+		VND VUV WST XAF XCD XOF XPF YER ZAR ZMW ZWL`) {
+		isoCurrencies[code] = true
+	}
+
+	if c := os.Getenv("DEFAULT_CURRENCY"); c != "" {
+		code, err := normalizeCurrency(c)
+		if err != nil {
+			panic(fmt.Sprintf("DEFAULT_CURRENCY: %v", err))
+		}
+		defaultCurrency = code
+	}
+}
+
+// currencyExponent is the number of minor unit digits of an ISO 4217 currency.
+func currencyExponent(code string) int {
+	switch code {
+	case "BIF", "CLP", "DJF", "GNF", "ISK", "JPY", "KMF", "KRW", "PYG",
+		"RWF", "UGX", "VND", "VUV", "XAF", "XOF", "XPF":
+		return 0
+	case "BHD", "IQD", "JOD", "KWD", "LYD", "OMR", "TND":
+		return 3
+	}
+	return 2
+}
+
+// normalizeCurrency upper-cases and validates a currency code; "" means
+// the default currency.
+func normalizeCurrency(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return defaultCurrency, nil
+	}
+	if !isoCurrencies[code] {
+		return "", fmt.Errorf("unknown currency %q", code)
+	}
+	return code, nil
+}
+
+// parseMoney parses a decimal string such as "-1234.50" exactly. Digits past
+// the currency's minor unit must be zero, and the amount must be within
+// maxMinor either way.
+func parseMoney(s, currency string) (Money, error) {
+	currency, err := normalizeCurrency(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	exp := currencyExponent(currency)
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Money{Currency: currency}, nil
+	}
+	negative := false
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	if strings.ContainsAny(whole+frac, "eE+-") {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	if trimmed := strings.TrimRight(frac, "0"); len(trimmed) > exp {
+		return Money{}, fmt.Errorf("%s amounts have at most %d decimal places", currency, exp)
+	}
+	for len(frac) < exp {
+		frac += "0"
+	}
+	frac = frac[:exp]
+	if whole == "" {
+		whole = "0"
+	}
+
+	minor, err := strconv.ParseInt(whole+frac, 10, 64)
+	if errors.Is(err, strconv.ErrRange) || (err == nil && minor > maxMinor(currency)) {
+		return Money{}, fmt.Errorf("%w: %s amounts are at most %s", errMoneyRange, currency, Money{Minor: maxMinor(currency), Currency: currency})
+	}
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	if negative {
+		minor = -minor
+	}
+	return Money{Minor: minor, Currency: currency}, nil
+}
+
+// String formats m as a plain decimal, e.g. "1234.50".
+func (m Money) String() string {
+	exp := currencyExponent(m.Currency)
+	minor := m.Minor
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	digits := strconv.FormatInt(minor, 10)
+	if exp == 0 {
+		return sign + digits
+	}
+	for len(digits) <= exp {
+		digits = "0" + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// Number returns m as a JSON number with exactly the currency's decimals.
+func (m Money) Number() json.Number {
+	return json.Number(m.String())
+}
+
+// Add returns m + o, or errMixedCurrency, or errMoneyRange if the sum is
+// past maxMinor either way.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", errMixedCurrency, m.Currency, o.Currency)
+	}
+	sum := Money{Minor: m.Minor + o.Minor, Currency: m.Currency}
+	wrapped := (o.Minor > 0 && sum.Minor < m.Minor) || (o.Minor < 0 && sum.Minor > m.Minor)
+	if max := maxMinor(m.Currency); wrapped || sum.Minor > max || sum.Minor < -max {
+		return Money{}, fmt.Errorf("%w: %s + %s", errMoneyRange, m, o)
+	}
+	return sum, nil
+}
+
+// Sub returns m - o, or errMixedCurrency or errMoneyRange like Add.
+func (m Money) Sub(o Money) (Money, error) {
+	return m.Add(o.Neg())
+}
+
+// Neg returns -m.
+func (m Money) Neg() Money {
+	return Money{Minor: -m.Minor, Currency: m.Currency}
+}
+
+// Abs returns |m|.
+func (m Money) Abs() Money {
+	if m.Minor < 0 {
+		return m.Neg()
+	}
+	return m
+}
+
+// PercentOf returns m as a percentage of total, to two decimals.
+func (m Money) PercentOf(total Money) (float64, error) {
+	if m.Currency != total.Currency {
+		return 0, fmt.Errorf("%w: %s and %s", errMixedCurrency, m.Currency, total.Currency)
+	}
+	if total.Minor == 0 {
+		return 0, nil
+	}
+	return math.Round(float64(m.Minor)/float64(total.Minor)*10000) / 100, nil
+}
+
+// Value stores m in a NUMERIC column as an exact decimal string. The
+// currency lives in its own column.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan reads a NUMERIC column. The currency column must be scanned into
+// m.Currency first (list it before the amount in the SELECT) so the
+// decimal can be converted to minor units.
+func (m *Money) Scan(src interface{}) error {
+	if m.Currency == "" {
+		return fmt.Errorf("money: scan the currency column before the amount")
+	}
+	var s string
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case nil:
+		s = ""
+	default:
+		return fmt.Errorf("money: cannot scan %T", src)
+	}
+	parsed, err := parseMoney(s, m.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// MoneyTotals: sums kept per currency so different currencies are never added
+type MoneyTotals map[string]Money
+
+// Add accumulates m into its currency's total, or returns errMoneyRange
+// and leaves the total alone if it would grow past maxMinor.
+func (t MoneyTotals) Add(m Money) error {
+	sum, ok := t[m.Currency]
+	if !ok {
+		sum = Money{Currency: m.Currency}
+	}
+	sum, err := sum.Add(m)
+	if err != nil {
+		return err
+	}
+	t[m.Currency] = sum
+	return nil
+}
+
+// MarshalJSON encodes totals as {"EUR": 12.50, "USD": 3.00}.
+func (t MoneyTotals) MarshalJSON() ([]byte, error) {
+	out := make(map[string]json.Number, len(t))
+	for code, m := range t {
+		out[code] = m.Number()
+	}
+	return json.Marshal(out)
+}
+
+// moneyFields is how Budget and Charge carry an amount over JSON: a plain
+// decimal "amount" next to a "currency" code.
+type moneyFields struct {
+	Amount   json.Number `json:"amount"`
+	Currency string      `json:"currency"`
+}
+
+func newMoneyFields(m Money) moneyFields {
+	return moneyFields{Amount: m.Number(), Currency: m.Currency}
+}
+
+func (f moneyFields) money() (Money, error) {
+	return parseMoney(f.Amount.String(), f.Currency)
+}
+
+func (b Budget) MarshalJSON() ([]byte, error) {
+	type plain Budget
+	return json.Marshal(struct {
+		plain
+		moneyFields
+		rolloverFields
+	}{plain(b), newMoneyFields(b.Amount), newRolloverFields(b)})
+}
+
+func (b *Budget) UnmarshalJSON(data []byte) error {
+	type plain Budget
+	aux := struct {
+		*plain
+		moneyFields
+		rolloverFields
+	}{plain: (*plain)(b)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m, err := aux.money()
+	if err != nil {
+		return err
+	}
+	b.Amount = m
+	b.RolloverCap = nil
+	if aux.rolloverFields.RolloverCap != nil {
+		limit, err := parseMoney(aux.rolloverFields.RolloverCap.String(), m.Currency)
+		if err != nil {
+			return err
+		}
+		b.RolloverCap = &limit
+	}
+	return nil
+}
+
+func (c Charge) MarshalJSON() ([]byte, error) {
+	type plain Charge
+	return json.Marshal(struct {
+		plain
+		moneyFields
+	}{plain(c), newMoneyFields(c.Amount)})
+}
+
+func (c *Charge) UnmarshalJSON(data []byte) error {
+	type plain Charge
+	aux := struct {
+		*plain
+		moneyFields
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m, err := aux.money()
+	if err != nil {
+		return err
+	}
+	c.Amount = m
+	return nil
+}
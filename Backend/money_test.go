@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in, currency string
+		minor        int64
+		code         string
+		ok           bool
+	}{
+		{"12.50", "USD", 1250, "USD", true},
+		{"12.5", "usd", 1250, "USD", true},
+		{"-1234.05", "EUR", -123405, "EUR", true},
+		{"+3", "EUR", 300, "EUR", true},
+		{".75", "EUR", 75, "EUR", true},
+		{"5.", "EUR", 500, "EUR", true},
+		{"  7 ", "EUR", 700, "EUR", true},
+		{"", "EUR", 0, "EUR", true},
+		{"12.500", "USD", 1250, "USD", true}, // trailing zeros past the minor unit
+		{"1500", "JPY", 1500, "JPY", true},
+		{"1.5", "JPY", 0, "", false},
+		{"1.0005", "KWD", 0, "", false},
+		{"1.005", "KWD", 1005, "KWD", true},
+		{"12.345", "USD", 0, "", false},
+		{"1e3", "USD", 0, "", false},
+		{"--5", "USD", 0, "", false},
+		{".", "USD", 0, "", false},
+		{"12,50", "USD", 0, "", false},
+		{"99999999999999999999", "USD", 0, "", false},
+		{"999999999999999.99", "USD", 99999999999999999, "USD", true},
+		{"-999999999999999.99", "USD", -99999999999999999, "USD", true},
+		{"1000000000000000", "USD", 0, "", false}, // more than NUMERIC(19,4) holds
+		{"-1000000000000000", "JPY", 0, "", false},
+		{"999999999999999.999", "KWD", 999999999999999999, "KWD", true},
+		{"5", "XYZ", 0, "", false},
+	}
+	for _, tc := range tests {
+		got, err := parseMoney(tc.in, tc.currency)
+		if (err == nil) != tc.ok || (tc.ok && got != (Money{Minor: tc.minor, Currency: tc.code})) {
+			t.Fatalf("parseMoney(%q, %q) = %+v, %v; want %d %s, ok %v", tc.in, tc.currency, got, err, tc.minor, tc.code, tc.ok)
+		}
+	}
+	if got, err := parseMoney("1", ""); err != nil || got.Currency != defaultCurrency {
+		t.Fatalf("parseMoney without a currency = %+v, %v; want %s", got, err, defaultCurrency)
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{Money{0, "USD"}, "0.00"},
+		{Money{5, "USD"}, "0.05"},
+		{Money{-5, "USD"}, "-0.05"},
+		{Money{123456, "EUR"}, "1234.56"},
+		{Money{-1500, "JPY"}, "-1500"},
+		{Money{1005, "KWD"}, "1.005"},
+	}
+	for _, tc := range tests {
+		if got := tc.m.String(); got != tc.want {
+			t.Fatalf("%+v.String() = %q, want %q", tc.m, got, tc.want)
+		}
+		// String round-trips through parseMoney
+		if back, err := parseMoney(tc.want, tc.m.Currency); err != nil || back != tc.m {
+			t.Fatalf("parseMoney(%q) = %+v, %v; want %+v", tc.want, back, err, tc.m)
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	usd := func(minor int64) Money { return Money{minor, "USD"} }
+	tests := []struct {
+		name string
+		op   func(a, b Money) (Money, error)
+		a, b Money
+		want Money
+		err  error
+	}{
+		{"add", Money.Add, usd(1250), usd(-250), usd(1000), nil},
+		{"sub", Money.Sub, usd(1250), usd(2000), usd(-750), nil},
+		{"add mixed", Money.Add, usd(100), Money{100, "EUR"}, Money{}, errMixedCurrency},
+		{"sub mixed", Money.Sub, usd(100), Money{100, "JPY"}, Money{}, errMixedCurrency},
+		{"add up to the max", Money.Add, usd(maxMinor("USD") - 1), usd(1), usd(maxMinor("USD")), nil},
+		{"add past the max", Money.Add, usd(maxMinor("USD")), usd(1), Money{}, errMoneyRange},
+		{"sub past the min", Money.Sub, usd(-maxMinor("USD")), usd(1), Money{}, errMoneyRange},
+		{"add wrapping around", Money.Add, usd(math.MaxInt64), usd(1), Money{}, errMoneyRange},
+	}
+	for _, tc := range tests {
+		got, err := tc.op(tc.a, tc.b)
+		if !errors.Is(err, tc.err) || (tc.err == nil && err != nil) || got != tc.want {
+			t.Fatalf("%s(%+v, %+v) = %+v, %v", tc.name, tc.a, tc.b, got, err)
+		}
+	}
+	if got := usd(-300).Abs(); got != usd(300) {
+		t.Fatalf("Abs = %+v", got)
+	}
+	if got := usd(300).Neg(); got != usd(-300) {
+		t.Fatalf("Neg = %+v", got)
+	}
+}
+
+func TestMoneyPercentOf(t *testing.T) {
+	tests := []struct {
+		m, total Money
+		want     float64
+		ok       bool
+	}{
+		{Money{2475, "USD"}, Money{10000, "USD"}, 24.75, true},
+		{Money{4000, "USD"}, Money{3000, "USD"}, 133.33, true},
+		{Money{1, "USD"}, Money{3, "USD"}, 33.33, true},
+		{Money{500, "USD"}, Money{0, "USD"}, 0, true},
+		{Money{500, "USD"}, Money{500, "EUR"}, 0, false},
+	}
+	for _, tc := range tests {
+		got, err := tc.m.PercentOf(tc.total)
+		if got != tc.want || (err == nil) != tc.ok {
+			t.Fatalf("%s PercentOf %s = %v, %v; want %v", tc.m, tc.total, got, err, tc.want)
+		}
+	}
+}
+
+func TestNormalizeCurrency(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"usd", "USD", true},
+		{" eur ", "EUR", true},
+		{"", defaultCurrency, true},
+		{"XYZ", "", false},
+		{"dollars", "", false},
+	}
+	for _, tc := range tests {
+		if got, err := normalizeCurrency(tc.in); got != tc.want || (err == nil) != tc.ok {
+			t.Fatalf("normalizeCurrency(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestMoneyScan(t *testing.T) {
+	tests := []struct {
+		src  interface{}
+		want Money
+		ok   bool
+	}{
+		{[]byte("12.50"), Money{1250, "EUR"}, true},
+		{"12.500", Money{1250, "EUR"}, true},
+		{int64(7), Money{700, "EUR"}, true},
+		{nil, Money{0, "EUR"}, true},
+		{12.5, Money{}, false},
+	}
+	for _, tc := range tests {
+		m := Money{Currency: "EUR"}
+		if err := m.Scan(tc.src); (err == nil) != tc.ok || (tc.ok && m != tc.want) {
+			t.Fatalf("Scan(%v) = %+v, %v; want %+v", tc.src, m, err, tc.want)
+		}
+	}
+	var m Money
+	if err := m.Scan("1"); err == nil {
+		t.Fatalf("Scan without the currency scanned first: want an error")
+	}
+}
+
+func TestMoneyTotals(t *testing.T) {
+	totals := MoneyTotals{}
+	for _, m := range []Money{{1250, "USD"}, {300, "EUR"}, {-250, "USD"}} {
+		if err := totals.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := totals.Add(Money{maxMinor("USD"), "USD"}); !errors.Is(err, errMoneyRange) {
+		t.Fatalf("adding past the max = %v, want errMoneyRange", err)
+	}
+	data, err := json.Marshal(totals)
+	if err != nil || string(data) != `{"EUR":3.00,"USD":10.00}` {
+		t.Fatalf("totals = %s, %v", data, err)
+	}
+}
+
+func TestChargeJSON(t *testing.T) {
+	tests := []struct {
+		body   string
+		amount string
+		ok     bool
+	}{
+		{`{"name":"Coffee","amount":3.5,"currency":"eur"}`, "3.50 EUR", true},
+		{`{"name":"Coffee","amount":"3.50","currency":"JPY"}`, "", false},
+		{`{"name":"Coffee","amount":350,"currency":"JPY"}`, "350 JPY", true},
+		{`{"name":"Coffee","amount":0.001}`, "", false},
+	}
+	for _, tc := range tests {
+		var c Charge
+		err := json.Unmarshal([]byte(tc.body), &c)
+		if (err == nil) != tc.ok || (tc.ok && c.Amount.String()+" "+c.Amount.Currency != tc.amount) {
+			t.Fatalf("unmarshal %s = %s %s, %v; want %s", tc.body, c.Amount, c.Amount.Currency, err, tc.amount)
+		}
+		if !tc.ok {
+			continue
+		}
+		var back struct {
+			Amount   json.Number `json:"amount"`
+			Currency string      `json:"currency"`
+		}
+		data, _ := json.Marshal(c)
+		if err := json.Unmarshal(data, &back); err != nil || string(back.Amount)+" "+back.Currency != tc.amount {
+			t.Fatalf("marshal = %s, %v", data, err)
+		}
+	}
+}
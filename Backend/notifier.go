@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// --------------------------
+//       Notifications
+// --------------------------
+
+// Notifier delivers messages to users, such as password reset tokens. The
+// server picks one with NOTIFIER: "file" appends messages to NOTIFIER_FILE,
+// meant for running locally. Anything that can reach users, like email, can
+// implement it. Without one, password resets are turned off, since nothing
+// else would keep the tokens out of the wrong hands.
+type Notifier interface {
+	Notify(u User, subject, body string) error
+}
+
+// fileNotifier appends messages to a file, one JSON object per line.
+type fileNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (n *fileNotifier) Notify(u User, subject, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("opening %s: %v", n.path, err)
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(map[string]interface{}{
+		"time":     time.Now().UTC().Format(time.RFC3339),
+		"user_id":  u.ID,
+		"username": u.Username,
+		"subject":  subject,
+		"body":     body,
+	})
+}
+
+// notifierFromEnv returns the Notifier NOTIFIER names, or nil if it is unset.
+func notifierFromEnv() Notifier {
+	switch name := os.Getenv("NOTIFIER"); name {
+	case "":
+		return nil
+	case "file":
+		path := os.Getenv("NOTIFIER_FILE")
+		if path == "" {
+			path = "notifications.jsonl"
+		}
+		return &fileNotifier{path: path}
+	default:
+		log.Fatalf("NOTIFIER must be file or unset: %q", name)
+		return nil
+	}
+}
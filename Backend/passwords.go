@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// --------------------------
+//   Password Change + Reset
+// --------------------------
+
+// passwordMinLength is overridable with PASSWORD_MIN_LENGTH. bcrypt only
+// looks at the first 72 bytes of a password, so longer ones are refused
+// rather than silently cut short.
+var passwordMinLength = 8
+
+const passwordMaxBytes = 72
+
+// Password reset settings, overridable with PASSWORD_RESET_TTL and
+// PASSWORD_RESET_URL. The token is appended to the URL, if there is one, to
+// make a link to the frontend's reset page.
+var (
+	passwordResetTTL = time.Hour
+	passwordResetURL = ""
+)
+
+// How many reset requests a username or an IP address may make before
+// further ones have to wait; every request counts, whether or not the
+// username exists. The waits and lockout are the login ones.
+var (
+	userResetLimit = loginLimit{BackoffAfter: 3, LockoutAt: 5}
+	ipResetLimit   = loginLimit{BackoffAfter: 10, LockoutAt: 50}
+)
+
+// resetsDisabled answers reset requests on a server without a Notifier.
+const resetsDisabled = "Password reset is not enabled on this server"
+
+var (
+	errInvalidResetToken = errors.New("invalid or expired reset token")
+	errSamePassword      = errors.New("the new password is the current one")
+)
+
+// PasswordReset: a password reset token. Only its hash is kept.
+type PasswordReset struct {
+	ID        int
+	UserID    int
+	Hash      string
+	ExpiresAt time.Time
+}
+
+// validatePassword checks a password being set against the rules above.
+func validatePassword(password string) error {
+	if utf8.RuneCountInString(password) < passwordMinLength {
+		return fmt.Errorf("password must be at least %d characters", passwordMinLength)
+	}
+	if len(password) > passwordMaxBytes {
+		return fmt.Errorf("password must be at most %d bytes", passwordMaxBytes)
+	}
+	return nil
+}
+
+// setPassword gives the user a new password hash, which they must change
+// at their next login if mustChange, and ends all their sessions, returning
+// the user as they were.
+func setPassword(tx Store, audit auditSource, userID int, hash string, mustChange bool) (User, error) {
+	before, err := tx.GetUser(userID)
+	if err != nil {
+		return before, err
+	}
+	after := before
+	after.Password = hash
+	after.MustChangePassword = mustChange
+	if err := tx.UpdateUser(after); err != nil {
+		return before, err
+	}
+	if err := tx.RevokeUserTokens(userID); err != nil {
+		return before, err
+	}
+	return before, audit.record(tx, AuditUpdate, "user", userID, userID, before, after)
+}
+
+// POST /api/me/password => change the JWT user's password, given
+// { "current_password", "new_password" }. A wrong current password counts
+// as a failed login, checked and counted with the login throttles locked.
+// Every session of the user ends, this one included.
+// This is all users who must change their password can do until they have.
+func (s *Server) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	me := callerOf(r)
+	var body struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(body.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(body.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+	ip := clientIP(r)
+	wrong := false
+	err = s.store.Tx(func(tx Store) error {
+		retryAt, err := lockLoginRetryAt(tx, me.Username, ip)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if now.Before(retryAt) {
+			return &throttledError{retryAt}
+		}
+		u, err := tx.GetUser(me.ID)
+		if err != nil {
+			return err
+		}
+		if !checkPasswordHash(body.CurrentPassword, u.Password) {
+			wrong = true
+			return recordLoginFailure(tx, me.Username, ip, now)
+		}
+		if checkPasswordHash(body.NewPassword, u.Password) {
+			return errSamePassword
+		}
+		_, err = setPassword(tx, requestAudit(r, me.ID), me.ID, hash, false)
+		return err
+	})
+	var throttled *throttledError
+	switch {
+	case errors.As(err, &throttled):
+		writeThrottled(w, throttled.retryAt)
+		return
+	case errors.Is(err, errSamePassword):
+		http.Error(w, "The new password must differ from the current one", http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Error changing password: %v", err), http.StatusInternalServerError)
+		return
+	case wrong:
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password changed; log in again"})
+}
+
+func userResetKey(username string) string { return "reset-user:" + username }
+func ipResetKey(ip string) string         { return "reset-ip:" + ip }
+
+// resetKeys returns the keys a reset request for username from ip counts
+// against.
+func resetKeys(username, ip string) []throttleKey {
+	return []throttleKey{{userResetKey(username), userResetLimit}, {ipResetKey(ip), ipResetLimit}}
+}
+
+// POST /api/password/forgot => { "username" }: send the user a reset token
+// through the server's Notifier. Tokens sent before stay good until one is
+// used or they expire, so nobody can cancel a reset by asking for another.
+// Requests are throttled per username and IP like logins are. The answer is
+// the same 202, given before the username is even looked up, whether or
+// not it exists. Without a Notifier, resets are turned off.
+func (s *Server) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if s.notifier == nil {
+		http.Error(w, resetsDisabled, http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Username == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	keys := resetKeys(body.Username, clientIP(r))
+	err := s.store.Tx(func(tx Store) error {
+		retryAt, err := lockThrottleRetryAt(tx, keys)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if now.Before(retryAt) {
+			return &throttledError{retryAt}
+		}
+		return recordThrottleFailure(tx, keys, now)
+	})
+	var throttled *throttledError
+	if errors.As(err, &throttled) {
+		writeRetryLater(w, throttled.retryAt, "Too many password reset requests, try again later")
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error requesting a password reset: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Whether the user exists only shows in what happens after answering
+	go s.sendPasswordReset(body.Username)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists, a reset token has been sent"})
+}
+
+// sendPasswordReset sends the user named username a new reset token, if
+// there is such a user. Nobody is waiting on it, so failures are logged.
+func (s *Server) sendPasswordReset(username string) {
+	u, err := s.store.GetUserByUsername(username)
+	if errors.Is(err, ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up user for a password reset: %v\n", err)
+		return
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		log.Printf("Error creating reset token for user %d: %v\n", u.ID, err)
+		return
+	}
+	err = s.store.CreatePasswordReset(&PasswordReset{
+		UserID:    u.ID,
+		Hash:      hashToken(token),
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+	})
+	if err != nil {
+		log.Printf("Error creating reset token for user %d: %v\n", u.ID, err)
+		return
+	}
+	msg := fmt.Sprintf("Someone asked to reset your password. Within %s, send this token with a new password to POST /api/password/reset:\n\n%s\n\nIf it wasn't you, ignore this message.",
+		passwordResetTTL, token)
+	if passwordResetURL != "" {
+		msg = fmt.Sprintf("Someone asked to reset your password. Within %s, choose a new one at:\n\n%s%s\n\nIf it wasn't you, ignore this message.",
+			passwordResetTTL, passwordResetURL, token)
+	}
+	if err := s.notifier.Notify(u, "Reset your password", msg); err != nil {
+		log.Printf("Error sending password reset to user %d: %v\n", u.ID, err)
+	}
+}
+
+// POST /api/password/reset => { "token", "new_password" }: set the password
+// of the user a reset token was sent to. A token expires after
+// PASSWORD_RESET_TTL; using one voids the others the user was sent, ends
+// every session of the user and lifts a lockout of their username.
+func (s *Server) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if s.notifier == nil {
+		http.Error(w, resetsDisabled, http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(body.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(body.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+	err = s.store.Tx(func(tx Store) error {
+		pr, err := tx.GetPasswordReset(hashToken(body.Token))
+		if errors.Is(err, ErrNotFound) || (err == nil && time.Now().After(pr.ExpiresAt)) {
+			return errInvalidResetToken
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.DeletePasswordResets(pr.UserID); err != nil {
+			return err
+		}
+		u, err := setPassword(tx, auditSource{ActorID: &pr.UserID, IP: clientIP(r), UserAgent: r.UserAgent()}, pr.UserID, hash, false)
+		if err != nil {
+			return err
+		}
+		if err := tx.ClearLoginThrottle(userLoginKey(u.Username)); err != nil {
+			return err
+		}
+		return tx.ClearLoginThrottle(userResetKey(u.Username))
+	})
+	if errors.Is(err, errInvalidResetToken) {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error resetting password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset; log in with the new one"})
+}
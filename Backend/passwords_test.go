@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		password string
+		ok       bool
+	}{
+		{"", false},
+		{"seven-7", false},
+		{"eight-88", true},
+		{"ünïcödé", false},
+		{"ünïcödé!", true},
+		{strings.Repeat("x", passwordMaxBytes), true},
+		{strings.Repeat("x", passwordMaxBytes+1), false},
+		{strings.Repeat("é", passwordMaxBytes/2), true},
+		{strings.Repeat("é", passwordMaxBytes/2+1), false},
+	}
+	for _, tc := range tests {
+		if err := validatePassword(tc.password); (err == nil) != tc.ok {
+			t.Fatalf("validatePassword(%q) = %v, want ok %v", tc.password, err, tc.ok)
+		}
+	}
+}
+
+func TestPasswordResetStore(t *testing.T) {
+	eachStore(t, testPasswordResets)
+}
+
+func TestChangePasswordAPI(t *testing.T) {
+	eachStore(t, testChangePassword)
+}
+
+// testChangePassword checks what POST /api/me/password refuses before it
+// changes anything, then that a reset token works once and not once expired.
+func testChangePassword(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	u := at.alice
+	defer s.ClearLoginThrottle(userLoginKey(u.Username))
+	defer s.ClearLoginThrottle(ipLoginKey("127.0.0.1"))
+
+	tests := []struct {
+		name    string
+		current string
+		next    string
+		status  int
+	}{
+		{"a short password", "pw", "short", http.StatusBadRequest},
+		{"a long password", "pw", strings.Repeat("x", passwordMaxBytes+1), http.StatusBadRequest},
+		{"a wrong current password", "wrong", "changed-pw1", http.StatusForbidden},
+		{"a change", "pw", "changed-pw1", http.StatusOK},
+		{"the same password", "changed-pw1", "changed-pw1", http.StatusBadRequest},
+	}
+	c := at.a
+	for _, tc := range tests {
+		body := map[string]string{"current_password": tc.current, "new_password": tc.next}
+		if err := c.expectStatus(tc.status, "POST", "/api/me/password", body, nil); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if tc.status == http.StatusOK {
+			c = at.client()
+			if _, err := c.login(u.Username, tc.next); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	expired := "expired-" + u.Username
+	if err := s.CreatePasswordReset(&PasswordReset{UserID: u.ID, Hash: hashToken(expired), ExpiresAt: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	anon := at.client()
+	if err := anon.expectStatus(http.StatusAccepted, "POST", "/api/password/forgot", map[string]string{"username": u.Username}, nil); err != nil {
+		t.Fatal(err)
+	}
+	token, err := at.notes.resetToken(u.Username, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resets := []struct {
+		name     string
+		token    string
+		password string
+		status   int
+	}{
+		{"no token", "", "reset-pw-1", http.StatusBadRequest},
+		{"an unknown token", "nope", "reset-pw-1", http.StatusBadRequest},
+		{"an expired token", expired, "reset-pw-1", http.StatusBadRequest},
+		{"a short password", token, "short", http.StatusBadRequest},
+		{"a reset", token, "reset-pw-1", http.StatusOK},
+		{"a used token", token, "reset-pw-2", http.StatusBadRequest},
+	}
+	for _, tc := range resets {
+		body := map[string]string{"token": tc.token, "new_password": tc.password}
+		if err := anon.expectStatus(tc.status, "POST", "/api/password/reset", body, nil); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+	}
+	if _, err := at.client().login(u.Username, "reset-pw-1"); err != nil {
+		t.Fatalf("login after the reset: %v", err)
+	}
+}
+
+func TestLoginAfterPasswordChange(t *testing.T) {
+	eachStore(t, testLoginAfterPasswordChange)
+}
+
+// testLoginAfterPasswordChange checks that changing or resetting a password
+// ends the sessions the user had, and that logging in with the new password
+// works straight away.
+func testLoginAfterPasswordChange(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	u := at.alice
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T, c *apiClient, from, to string)
+	}{
+		{"change", func(t *testing.T, c *apiClient, from, to string) {
+			body := map[string]string{"current_password": from, "new_password": to}
+			if err := c.expectStatus(http.StatusOK, "POST", "/api/me/password", body, nil); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"reset", func(t *testing.T, c *apiClient, from, to string) {
+			anon := &apiClient{base: c.base}
+			if err := anon.expectStatus(http.StatusAccepted, "POST", "/api/password/forgot", map[string]string{"username": u.Username}, nil); err != nil {
+				t.Fatal(err)
+			}
+			token, err := at.notes.resetToken(u.Username, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := map[string]string{"token": token, "new_password": to}
+			if err := anon.expectStatus(http.StatusOK, "POST", "/api/password/reset", body, nil); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	password := "pw"
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			old := at.client()
+			if _, err := old.login(u.Username, password); err != nil {
+				t.Fatal(err)
+			}
+			next := password + "-" + tc.name
+			tc.change(t, old, password, next)
+			password = next
+			if err := old.expectStatus(http.StatusUnauthorized, "GET", "/api/budgets", nil, nil); err != nil {
+				t.Fatalf("session from before the %s: %v", tc.name, err)
+			}
+			again := at.client()
+			if _, err := again.login(u.Username, password); err != nil {
+				t.Fatalf("login right after the %s: %v", tc.name, err)
+			}
+			if err := again.expectStatus(http.StatusOK, "GET", "/api/budgets", nil, nil); err != nil {
+				t.Fatalf("session right after the %s: %v", tc.name, err)
+			}
+		})
+	}
+}
+
+func TestForgotPasswordAPI(t *testing.T) {
+	eachStore(t, testForgotPassword)
+}
+
+// testForgotPassword checks that reset requests are throttled per username
+// and per IP whether or not the username exists, that nothing is sent for
+// an unknown username, and that resets are off without a notifier.
+func testForgotPassword(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	anon := at.client()
+	unknown := "nobody-" + at.alice.Username
+	defer s.ClearLoginThrottle(userResetKey(unknown))
+	defer s.ClearLoginThrottle(userResetKey(at.alice.Username))
+	defer s.ClearLoginThrottle(ipResetKey("127.0.0.1"))
+
+	for _, username := range []string{unknown, at.alice.Username} {
+		forgot := map[string]string{"username": username}
+		for i := 0; i < userResetLimit.BackoffAfter; i++ {
+			if err := anon.expectStatus(http.StatusAccepted, "POST", "/api/password/forgot", forgot, nil); err != nil {
+				t.Fatalf("request %d for %s: %v", i+1, username, err)
+			}
+		}
+		if err := anon.expectStatus(http.StatusTooManyRequests, "POST", "/api/password/forgot", forgot, nil); err != nil {
+			t.Fatalf("request over the limit for %s: %v", username, err)
+		}
+	}
+	if _, err := at.notes.resetToken(at.alice.Username, userResetLimit.BackoffAfter); err != nil {
+		t.Fatal(err)
+	}
+	at.notes.mu.Lock()
+	sent := at.notes.messages[unknown]
+	at.notes.mu.Unlock()
+	if len(sent) > 0 {
+		t.Fatalf("a reset message was sent for an unknown username: %q", sent)
+	}
+
+	// Other usernames still get through until the IP's own limit
+	if err := s.ClearLoginThrottle(ipResetKey("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= ipResetLimit.BackoffAfter; i++ {
+		want := http.StatusAccepted
+		if i == ipResetLimit.BackoffAfter {
+			want = http.StatusTooManyRequests
+		}
+		forgot := map[string]string{"username": fmt.Sprintf("%s-%d", unknown, i)}
+		defer s.ClearLoginThrottle(userResetKey(forgot["username"]))
+		if err := anon.expectStatus(want, "POST", "/api/password/forgot", forgot, nil); err != nil {
+			t.Fatalf("request %d from one IP: %v", i+1, err)
+		}
+	}
+
+	ts := httptest.NewServer(NewServer(s).Handler())
+	defer ts.Close()
+	off := &apiClient{base: ts.URL}
+	if err := off.expectStatus(http.StatusNotFound, "POST", "/api/password/forgot", map[string]string{"username": at.alice.Username}, nil); err != nil {
+		t.Fatalf("forgot password without a notifier: %v", err)
+	}
+	if err := off.expectStatus(http.StatusNotFound, "POST", "/api/password/reset", map[string]string{"token": "x", "new_password": "reset-pw-1"}, nil); err != nil {
+		t.Fatalf("reset password without a notifier: %v", err)
+	}
+}
+
+func TestConcurrentPasswordChangeFailures(t *testing.T) {
+	eachStore(t, testConcurrentPasswordChangeFailures)
+}
+
+// testConcurrentPasswordChangeFailures checks that wrong current passwords
+// sent at once are throttled like wrong logins are.
+func testConcurrentPasswordChangeFailures(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	u, c := at.alice, at.a
+	defer s.ClearLoginThrottle(userLoginKey(u.Username))
+	defer s.ClearLoginThrottle(ipLoginKey("127.0.0.1"))
+
+	attempts := userLoginLimit.LockoutAt * 2
+	statuses := make([]int, attempts)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := map[string]string{"current_password": "wrong", "new_password": "new-password"}
+			statuses[i], _ = c.call("POST", "/api/me/password", body, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	counts := map[int]int{}
+	for _, status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusForbidden] != userLoginLimit.BackoffAfter || counts[http.StatusTooManyRequests] != attempts-userLoginLimit.BackoffAfter {
+		t.Fatalf("%d concurrent wrong passwords got statuses %v; want %d 403s, the rest 429s",
+			attempts, counts, userLoginLimit.BackoffAfter)
+	}
+}
+
+func testPasswordResets(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	if err := s.CreatePasswordReset(&PasswordReset{UserID: -1, Hash: hashToken("nobody"), ExpiresAt: time.Now()}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("CreatePasswordReset for a missing user: got %v, want ErrNotFound", err)
+	}
+	expired := PasswordReset{UserID: u.ID, Hash: hashToken("expired-" + u.Username), ExpiresAt: time.Now().Add(-time.Minute)}
+	pr := PasswordReset{UserID: u.ID, Hash: hashToken("reset-" + u.Username), ExpiresAt: time.Now().Add(time.Minute)}
+	for _, r := range []*PasswordReset{&expired, &pr} {
+		if err := s.CreatePasswordReset(r); err != nil {
+			t.Fatalf("CreatePasswordReset: %v", err)
+		}
+	}
+	if _, err := s.GetPasswordReset(expired.Hash); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expired password reset: got %v, want it forgotten", err)
+	}
+	if got, err := s.GetPasswordReset(pr.Hash); err != nil || got.ID != pr.ID || got.UserID != u.ID || !got.ExpiresAt.After(time.Now()) {
+		t.Fatalf("GetPasswordReset = %+v, %v", got, err)
+	}
+	if err := s.DeletePasswordResets(u.ID); err != nil {
+		t.Fatalf("DeletePasswordResets: %v", err)
+	}
+	if _, err := s.GetPasswordReset(pr.Hash); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleted password reset: got %v, want ErrNotFound", err)
+	}
+
+	// Deleting the user deletes their tokens
+	if err := s.CreatePasswordReset(&pr); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if _, err := s.GetPasswordReset(pr.Hash); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("password reset of a deleted user: got %v, want ErrNotFound", err)
+	}
+}
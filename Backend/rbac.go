@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// --------------------------
+//    Roles + Permissions
+// --------------------------
+
+// Permission: something a role allows, named resource:action.
+type Permission string
+
+const (
+	// The caller's own budgets, charges, accounts, ... and what others
+	// share with them (shares decide how far that goes)
+	PermDataRead  Permission = "data:read"
+	PermDataWrite Permission = "data:write"
+	// Every user account
+	PermUsersRead   Permission = "users:read"
+	PermUsersWrite  Permission = "users:write" // create users and change them, roles included
+	PermUsersDelete Permission = "users:delete"
+	// Every user's audit events, not just those of data the caller can read
+	PermAuditRead Permission = "audit:read"
+	PermRolesRead Permission = "roles:read"
+)
+
+// Roles. A user's role is named by User.Permissions.
+const (
+	RoleAdmin   = "admin"
+	RoleUser    = "user"
+	RoleAuditor = "auditor"
+	RoleSupport = "support"
+)
+
+// Role: a named set of permissions.
+type Role struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// roles are the defined roles, as GET /api/roles lists them. The users
+// table checks role names too (migration 0020).
+var roles = []Role{
+	{RoleAdmin, "Manages users and sees every user's audit log", []Permission{
+		PermDataRead, PermDataWrite, PermUsersRead, PermUsersWrite, PermUsersDelete, PermAuditRead, PermRolesRead}},
+	{RoleUser, "Keeps their own budget", []Permission{PermDataRead, PermDataWrite, PermRolesRead}},
+	{RoleAuditor, "Reads every user's audit log", []Permission{PermDataRead, PermUsersRead, PermAuditRead, PermRolesRead}},
+	{RoleSupport, "Read-only support: looks user accounts up", []Permission{PermDataRead, PermUsersRead, PermRolesRead}},
+}
+
+// findRole looks a role up by name.
+func findRole(name string) (Role, bool) {
+	for _, role := range roles {
+		if role.Name == name {
+			return role, true
+		}
+	}
+	return Role{}, false
+}
+
+// allows reports whether the role has permission p.
+func (role Role) allows(p Permission) bool {
+	for _, have := range role.Permissions {
+		if have == p {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRole normalizes a role name and checks that the role is defined.
+func validateRole(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if _, ok := findRole(name); !ok {
+		names := make([]string, len(roles))
+		for i, role := range roles {
+			names[i] = role.Name
+		}
+		return "", fmt.Errorf("invalid role %q (want %s)", name, strings.Join(names, ", "))
+	}
+	return name, nil
+}
+
+// errLastAdmin: a change would leave no user with RoleAdmin.
+var errLastAdmin = fmt.Errorf("%w: the last admin can't be demoted or deleted", ErrConflict)
+
+// keepAdmin returns errLastAdmin if userID is the only admin. Run in a
+// transaction, ListUsers locks the users, so two admins can't demote each
+// other at the same time.
+func keepAdmin(tx Store, userID int) error {
+	users, err := tx.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.ID != userID && u.Permissions == RoleAdmin {
+			return nil
+		}
+	}
+	return errLastAdmin
+}
+
+// contextKey keys the values authorize passes on to handlers.
+type contextKey int
+
+const callerKey contextKey = iota
+
+// authorize wraps h so that it only runs for callers whose role has all of
+// perms: 401 without a valid access token, 403 without the permissions or
+// while the caller must change their password. The caller is passed on in
+// the request context, where getUserIDFromToken and hasPermission find it.
+func (s *Server) authorize(h http.HandlerFunc, perms ...Permission) http.HandlerFunc {
+	return s.authorizeCaller(h, false, perms)
+}
+
+// authorizePasswordChange is authorize for the route changing the caller's
+// own password, which callers who must change theirs can still use.
+func (s *Server) authorizePasswordChange(h http.HandlerFunc) http.HandlerFunc {
+	return s.authorizeCaller(h, true, nil)
+}
+
+func (s *Server) authorizeCaller(h http.HandlerFunc, passwordChange bool, perms []Permission) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := s.parseAccessToken(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		caller, err := s.store.GetUser(t.UserID)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if caller.MustChangePassword && !passwordChange {
+			http.Error(w, "Forbidden - change your password first (POST /api/me/password)", http.StatusForbidden)
+			return
+		}
+		role, _ := findRole(caller.Permissions)
+		for _, p := range perms {
+			if !role.allows(p) {
+				http.Error(w, fmt.Sprintf("Forbidden - requires permission %s", p), http.StatusForbidden)
+				return
+			}
+		}
+		caller.Password = ""
+		h(w, r.WithContext(context.WithValue(r.Context(), callerKey, caller)))
+	}
+}
+
+// callerOf returns the caller of a request authorize let through.
+func callerOf(r *http.Request) User {
+	caller, _ := r.Context().Value(callerKey).(User)
+	return caller
+}
+
+// hasPermission reports whether the caller of a request authorize let
+// through has permission p.
+func (s *Server) hasPermission(r *http.Request, p Permission) bool {
+	caller, ok := r.Context().Value(callerKey).(User)
+	if !ok {
+		return false
+	}
+	role, _ := findRole(caller.Permissions)
+	return role.allows(p)
+}
+
+// GET /api/roles => the defined roles and the permissions each grants
+func (s *Server) getRolesHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(roles)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestValidateRole(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"admin", RoleAdmin, true},
+		{" Auditor ", RoleAuditor, true},
+		{"SUPPORT", RoleSupport, true},
+		{"user", RoleUser, true},
+		{"", "", false},
+		{"superuser", "", false},
+		{"admin,user", "", false},
+	}
+	for _, tc := range tests {
+		got, err := validateRole(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Fatalf("validateRole(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	perms := []Permission{PermDataRead, PermDataWrite, PermUsersRead, PermUsersWrite, PermUsersDelete, PermAuditRead, PermRolesRead}
+	tests := []struct {
+		role string
+		want []Permission
+	}{
+		{RoleAdmin, perms},
+		{RoleUser, []Permission{PermDataRead, PermDataWrite, PermRolesRead}},
+		{RoleAuditor, []Permission{PermDataRead, PermUsersRead, PermAuditRead, PermRolesRead}},
+		{RoleSupport, []Permission{PermDataRead, PermUsersRead, PermRolesRead}},
+		{"superuser", nil},
+	}
+	for _, tc := range tests {
+		role, _ := findRole(tc.role)
+		want := map[Permission]bool{}
+		for _, p := range tc.want {
+			want[p] = true
+		}
+		for _, p := range perms {
+			if got := role.allows(p); got != want[p] {
+				t.Fatalf("%s allows %s = %v, want %v", tc.role, p, got, want[p])
+			}
+		}
+	}
+}
+
+func TestRoleAccessAPI(t *testing.T) {
+	eachStore(t, testRoleAccess)
+}
+
+// testRoleAccess checks which routes each role gets through to.
+func testRoleAccess(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	clients := map[string]*apiClient{RoleUser: at.a}
+	for _, role := range []string{RoleAdmin, RoleAuditor, RoleSupport} {
+		_, clients[role] = at.user(role)
+	}
+	missing := "/api/users/" + strconv.Itoa(at.bob.ID+1000)
+	budget := map[string]interface{}{"name": "Food", "amount": 100, "period": "monthly"}
+
+	tests := []struct {
+		method, path string
+		body         interface{}
+		status       map[string]int // by role; unlisted roles get 403
+	}{
+		{"GET", "/api/roles", nil, map[string]int{RoleAdmin: 200, RoleUser: 200, RoleAuditor: 200, RoleSupport: 200}},
+		{"GET", "/api/budgets", nil, map[string]int{RoleAdmin: 200, RoleUser: 200, RoleAuditor: 200, RoleSupport: 200}},
+		{"POST", "/api/budgets", budget, map[string]int{RoleAdmin: 201, RoleUser: 201}},
+		{"GET", "/api/users", nil, map[string]int{RoleAdmin: 200, RoleAuditor: 200, RoleSupport: 200}},
+		{"PUT", missing, map[string]string{"username": "nobody"}, map[string]int{RoleAdmin: 404}},
+		{"DELETE", missing, nil, map[string]int{RoleAdmin: 404}},
+		{"GET", "/api/login-attempts", nil, map[string]int{RoleAdmin: 200, RoleAuditor: 200}},
+	}
+	for _, tc := range tests {
+		for _, role := range []string{RoleAdmin, RoleUser, RoleAuditor, RoleSupport} {
+			want, ok := tc.status[role]
+			if !ok {
+				want = http.StatusForbidden
+			}
+			if err := clients[role].expectStatus(want, tc.method, tc.path, tc.body, nil); err != nil {
+				t.Fatalf("%s %s as %s: %v", tc.method, tc.path, role, err)
+			}
+		}
+		if err := at.client().expectStatus(http.StatusUnauthorized, tc.method, tc.path, tc.body, nil); err != nil {
+			t.Fatalf("%s %s without logging in: %v", tc.method, tc.path, err)
+		}
+	}
+
+	// A user who must change their password only gets to change it
+	u, c := at.user(RoleAdmin)
+	u.MustChangePassword = true
+	if err := s.UpdateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.expectStatus(http.StatusForbidden, "GET", "/api/roles", nil, nil); err != nil {
+		t.Fatalf("before changing the password: %v", err)
+	}
+	if err := c.expectStatus(http.StatusOK, "POST", "/api/me/password", map[string]string{"current_password": "pw", "new_password": "changed-pw1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLastAdminAPI(t *testing.T) {
+	eachStore(t, testLastAdmin)
+}
+
+// testLastAdmin checks that the API can't be left without an admin.
+func testLastAdmin(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	admin, c := at.user(RoleAdmin)
+	other, _ := at.user(RoleAdmin)
+	otherPath := "/api/users/" + strconv.Itoa(other.ID)
+	adminPath := "/api/users/" + strconv.Itoa(admin.ID)
+
+	// Another admin is left, so these go through
+	if err := c.expectStatus(http.StatusOK, "PUT", otherPath, map[string]string{"permissions": RoleUser}, nil); err != nil {
+		t.Fatalf("demoting another admin: %v", err)
+	}
+	if err := c.expectStatus(http.StatusOK, "PUT", otherPath, map[string]string{"permissions": RoleAdmin}, nil); err != nil {
+		t.Fatalf("promoting them again: %v", err)
+	}
+	if err := c.expectStatus(http.StatusOK, "DELETE", otherPath, nil, nil); err != nil {
+		t.Fatalf("deleting another admin: %v", err)
+	}
+
+	// A shared database may hold admins of its own
+	users, err := s.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range users {
+		if u.ID != admin.ID && u.Permissions == RoleAdmin {
+			t.Skipf("the database has another admin, %q", u.Username)
+		}
+	}
+	if err := c.expectStatus(http.StatusConflict, "PUT", adminPath, map[string]string{"permissions": RoleUser}, nil); err != nil {
+		t.Fatalf("demoting the last admin: %v", err)
+	}
+	if err := c.expectStatus(http.StatusConflict, "DELETE", adminPath, nil, nil); err != nil {
+		t.Fatalf("deleting the last admin: %v", err)
+	}
+	// Changing anything else about them is fine
+	if err := c.expectStatus(http.StatusOK, "PUT", adminPath, map[string]string{"permissions": RoleAdmin}, nil); err != nil {
+		t.Fatalf("updating the last admin: %v", err)
+	}
+	if u, err := s.GetUser(admin.ID); err != nil || u.Permissions != RoleAdmin {
+		t.Fatalf("last admin = %+v, %v", u, err)
+	}
+}
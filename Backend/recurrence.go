@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------
+//     Recurring Charges
+// --------------------------
+
+// recurrenceInterval is how often the worker looks for due occurrences,
+// overridable with RECURRENCE_INTERVAL.
+var recurrenceInterval = 5 * time.Minute
+
+// recurrenceBatch caps how many templates one worker transaction locks.
+const recurrenceBatch = 100
+
+// recurrenceRule: when a recurring charge template posts. Occurrence 0 is the
+// template itself; occurrence n is computed from the anchor rather than from
+// occurrence n-1 so that monthly charges on the 31st don't drift to the 28th.
+type recurrenceRule struct {
+	Frequency string     // daily, weekly, biweekly, monthly or yearly
+	Anchor    time.Time  // created_at of the template
+	Day       int        // monthly/yearly day of month; 0 = anchor's day, -1 = last day
+	End       *time.Time // last date an occurrence may post on, inclusive
+}
+
+// normalizeFrequency validates a Charge.Periodical value for recurrence.
+func normalizeFrequency(s string) (string, bool) {
+	switch f := strings.ToLower(strings.TrimSpace(s)); f {
+	case "daily", "weekly", "biweekly", "monthly", "yearly":
+		return f, true
+	case "annually":
+		return "yearly", true
+	case "fortnightly", "bi-weekly":
+		return "biweekly", true
+	}
+	return "", false
+}
+
+// onDay returns day (clamped to the month's length, -1 meaning the last day)
+// of the given month, at clock's time of day. month may overflow into later years.
+func onDay(year int, month time.Month, day int, clock time.Time) time.Time {
+	first := time.Date(year, month, 1, clock.Hour(), clock.Minute(), clock.Second(), 0, time.UTC)
+	last := first.AddDate(0, 1, -1).Day()
+	if day == -1 || day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// occurrence returns when the nth occurrence posts.
+func (rr recurrenceRule) occurrence(n int) time.Time {
+	a := rr.Anchor.UTC()
+	day := rr.Day
+	if day == 0 {
+		day = a.Day()
+	}
+	switch rr.Frequency {
+	case "daily":
+		return a.AddDate(0, 0, n)
+	case "weekly":
+		return a.AddDate(0, 0, 7*n)
+	case "biweekly":
+		return a.AddDate(0, 0, 14*n)
+	case "monthly":
+		return onDay(a.Year(), a.Month()+time.Month(n), day, a)
+	default: // yearly
+		return onDay(a.Year()+n, a.Month(), day, a)
+	}
+}
+
+// ended reports whether t falls after the rule's end date.
+func (rr recurrenceRule) ended(t time.Time) bool {
+	return rr.End != nil && !t.Before(rr.End.AddDate(0, 0, 1))
+}
+
+// nextSeq returns the first occurrence number >= 1 posting after t.
+func (rr recurrenceRule) nextSeq(t time.Time) int {
+	n := 1
+	for !rr.occurrence(n).After(t) {
+		n++
+	}
+	return n
+}
+
+// validateRecurrence checks and normalizes the recurrence fields of a charge
+// about to be stored. Non-recurring charges have them cleared.
+func validateRecurrence(c *Charge) error {
+	if !c.Recurring {
+		c.RecurrenceDay = nil
+		c.RecurrenceEnd = nil
+		return nil
+	}
+	freq, ok := normalizeFrequency(c.Periodical)
+	if !ok {
+		return fmt.Errorf("recurring charges need periodical set to daily, weekly, biweekly, monthly or yearly")
+	}
+	c.Periodical = freq
+
+	if c.RecurrenceDay != nil {
+		d := *c.RecurrenceDay
+		if freq != "monthly" && freq != "yearly" {
+			return fmt.Errorf("recurrence_day only applies to monthly and yearly charges")
+		}
+		if d != -1 && (d < 1 || d > 31) {
+			return fmt.Errorf("recurrence_day must be 1-31, or -1 for the last day of the month")
+		}
+	}
+	if c.RecurrenceEnd != nil {
+		end, err := parseDate(*c.RecurrenceEnd)
+		if err != nil {
+			return fmt.Errorf("invalid recurrence_end: %v", err)
+		}
+		s := end.Format("2006-01-02")
+		c.RecurrenceEnd = &s
+	}
+	return nil
+}
+
+// parseDate accepts YYYY-MM-DD or an RFC 3339 timestamp.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// ruleOf returns the recurrence rule of a charge, and whether it recurs.
+func ruleOf(c Charge) (recurrenceRule, bool) {
+	var rr recurrenceRule
+	rr.Frequency, _ = normalizeFrequency(c.Periodical)
+	rr.Anchor, _ = time.Parse(time.RFC3339Nano, c.CreatedAt)
+	if c.RecurrenceDay != nil {
+		rr.Day = *c.RecurrenceDay
+	}
+	if c.RecurrenceEnd != nil {
+		if end, err := parseDate(*c.RecurrenceEnd); err == nil {
+			rr.End = &end
+		}
+	}
+	return rr, c.Recurring && rr.Frequency != ""
+}
+
+// scheduleRecurrence works out the next occurrence of a charge after it is
+// created or edited: the first one after everything already posted, deleted
+// occurrences included.
+func scheduleRecurrence(store Store, chargeID int) error {
+	c, err := store.GetCharge(chargeID)
+	if err != nil {
+		return fmt.Errorf("loading recurrence: %v", err)
+	}
+	rr, recurring := ruleOf(c)
+	if !recurring {
+		return store.SetRecurrence(chargeID, 0, nil)
+	}
+
+	lastPosted := rr.Anchor
+	latest, err := store.LastOccurrence(chargeID)
+	if err != nil {
+		return fmt.Errorf("finding last occurrence: %v", err)
+	}
+	if latest != nil && latest.After(lastPosted) {
+		lastPosted = *latest
+	}
+
+	seq := rr.nextSeq(lastPosted)
+	var next *time.Time
+	if t := rr.occurrence(seq); !rr.ended(t) {
+		next = &t
+	}
+	return store.SetRecurrence(chargeID, seq, next)
+}
+
+// materializeDueCharges posts every occurrence due by now and returns how many
+// charges it created. Templates are locked with SKIP LOCKED and each posting
+// is keyed on (template_id, occurrence_date), so replicas running this
+// concurrently, or a restart half way through, never double-post.
+func materializeDueCharges(store Store, now time.Time) (int, error) {
+	posted := 0
+	for {
+		n, more, err := materializeBatch(store, now)
+		posted += n
+		if err != nil || !more {
+			return posted, err
+		}
+	}
+}
+
+func materializeBatch(store Store, now time.Time) (int, bool, error) {
+	posted := 0
+	more := false
+	err := store.Tx(func(tx Store) error {
+		due, err := tx.DueTemplates(now, recurrenceBatch)
+		if err != nil {
+			return fmt.Errorf("selecting due templates: %v", err)
+		}
+		more = len(due) == recurrenceBatch
+
+		for _, t := range due {
+			rule, _ := ruleOf(t.Charge)
+			seq := t.Seq
+			for {
+				at := rule.occurrence(seq)
+				if at.After(now) || rule.ended(at) {
+					break
+				}
+				templateID := t.ID
+				c := Charge{
+					Name:         t.Name,
+					Amount:       t.Amount,
+					Category:     t.Category,
+					CategoryID:   t.CategoryID,
+					Tags:         t.Tags,
+					Splits:       t.Splits,
+					ShareMode:    t.ShareMode,
+					Participants: t.Participants,
+					AccountID:    t.AccountID,
+					Direction:    t.Direction,
+					Periodical:   t.Periodical,
+					UserID:       t.UserID,
+					CreatedAt:    at.Format(time.RFC3339),
+					TemplateID:   &templateID,
+				}
+				ok, err := tx.PostOccurrence(&c, at.Format("2006-01-02"))
+				if err != nil {
+					return fmt.Errorf("posting occurrence of charge %d: %v", t.ID, err)
+				}
+				if ok {
+					posted++
+					if err := systemAudit.record(tx, AuditCreate, "charge", c.ID, c.UserID, nil, c); err != nil {
+						return err
+					}
+				}
+				seq++
+			}
+
+			var next *time.Time
+			if at := rule.occurrence(seq); !rule.ended(at) {
+				next = &at
+			}
+			if err := tx.SetRecurrence(t.ID, seq, next); err != nil {
+				return fmt.Errorf("advancing charge %d: %v", t.ID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return posted, more, nil
+}
+
+// runRecurrenceWorker posts due recurring charges every recurrenceInterval
+// for the life of the server.
+func (s *Server) runRecurrenceWorker() {
+	for {
+		n, err := materializeDueCharges(s.store, time.Now())
+		if err != nil {
+			log.Printf("Recurring charges: %v\n", err)
+		} else if n > 0 {
+			log.Printf("Recurring charges: posted %d charge(s)\n", n)
+		}
+		time.Sleep(recurrenceInterval)
+	}
+}
+
+// UpcomingCharge: a future occurrence of a recurring charge
+type UpcomingCharge struct {
+	TemplateID int         `json:"template_id"`
+	Name       string      `json:"name"`
+	Amount     json.Number `json:"amount"`
+	Currency   string      `json:"currency"`
+	Direction  string      `json:"direction"`
+	Category   string      `json:"category"`
+	Periodical string      `json:"periodical"`
+	UserID     int         `json:"user_id"`
+	DueAt      string      `json:"due_at"`
+}
+
+// GET /api/charges/upcoming => occurrences of the JWT user's recurring charges
+// that will post in the next ?days=N days (default 30, at most 366), by date.
+// Accepts ?owner=<id> with read access.
+func (s *Server) getUpcomingChargesHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > 366 {
+			http.Error(w, "days must be between 1 and 366", http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now()
+	until := now.AddDate(0, 0, days)
+
+	templates, err := s.store.ListRecurringTemplates(ownerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying recurring charges: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	upcoming := []UpcomingCharge{}
+	for _, t := range templates {
+		rule, _ := ruleOf(t.Charge)
+		for seq := t.Seq; ; seq++ {
+			at := rule.occurrence(seq)
+			if at.After(until) || rule.ended(at) {
+				break
+			}
+			// Due but not yet posted by the worker still counts as upcoming
+			upcoming = append(upcoming, UpcomingCharge{
+				TemplateID: t.ID,
+				Name:       t.Name,
+				Amount:     t.Amount.Number(),
+				Currency:   t.Amount.Currency,
+				Direction:  t.Direction,
+				Category:   t.Category,
+				Periodical: t.Periodical,
+				UserID:     t.UserID,
+				DueAt:      at.Format(time.RFC3339),
+			})
+		}
+	}
+
+	sort.SliceStable(upcoming, func(i, j int) bool { return upcoming[i].DueAt < upcoming[j].DueAt })
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(upcoming)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeFrequency(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"daily", "daily", true},
+		{" Weekly ", "weekly", true},
+		{"biweekly", "biweekly", true},
+		{"bi-weekly", "biweekly", true},
+		{"fortnightly", "biweekly", true},
+		{"MONTHLY", "monthly", true},
+		{"yearly", "yearly", true},
+		{"annually", "yearly", true},
+		{"quarterly", "", false},
+		{"one-time", "", false},
+		{"", "", false},
+	}
+	for _, tc := range tests {
+		if got, ok := normalizeFrequency(tc.in); got != tc.want || ok != tc.ok {
+			t.Fatalf("normalizeFrequency(%q) = %q, %v; want %q, %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestRecurrenceOccurrence(t *testing.T) {
+	tests := []struct {
+		freq   string
+		anchor string
+		day    int
+		n      int
+		want   string
+	}{
+		{"daily", "2024-02-28T09:30:00Z", 0, 2, "2024-03-01T09:30:00Z"},
+		{"weekly", "2024-01-01T09:30:00Z", 0, 3, "2024-01-22T09:30:00Z"},
+		{"biweekly", "2024-12-25T00:00:00Z", 0, 1, "2025-01-08T00:00:00Z"},
+		// The 31st clamps to short months without drifting
+		{"monthly", "2024-01-31T12:00:00Z", 0, 1, "2024-02-29T12:00:00Z"},
+		{"monthly", "2024-01-31T12:00:00Z", 0, 2, "2024-03-31T12:00:00Z"},
+		{"monthly", "2024-11-15T12:00:00Z", 0, 3, "2025-02-15T12:00:00Z"},
+		{"monthly", "2024-01-10T08:00:00Z", -1, 1, "2024-02-29T08:00:00Z"},
+		{"monthly", "2024-01-10T08:00:00Z", 30, 1, "2024-02-29T08:00:00Z"},
+		{"yearly", "2024-02-29T00:00:00Z", 0, 1, "2025-02-28T00:00:00Z"},
+		{"yearly", "2024-02-29T00:00:00Z", 0, 4, "2028-02-29T00:00:00Z"},
+		{"monthly", "2024-03-05T10:00:00+02:00", 0, 0, "2024-03-05T08:00:00Z"},
+	}
+	for _, tc := range tests {
+		anchor, err := time.Parse(time.RFC3339, tc.anchor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := recurrenceRule{Frequency: tc.freq, Anchor: anchor, Day: tc.day}
+		if got := rr.occurrence(tc.n).Format(time.RFC3339); got != tc.want {
+			t.Fatalf("%s from %s (day %d): occurrence(%d) = %s, want %s", tc.freq, tc.anchor, tc.day, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestRecurrenceNextSeq(t *testing.T) {
+	anchor := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)
+	rr := recurrenceRule{Frequency: "monthly", Anchor: anchor, End: &end}
+	tests := []struct {
+		after string
+		seq   int
+	}{
+		{"2024-01-31T12:00:00Z", 1},
+		{"2024-02-29T11:59:59Z", 1},
+		{"2024-02-29T12:00:00Z", 2},
+		{"2024-04-01T00:00:00Z", 3},
+	}
+	for _, tc := range tests {
+		after, _ := time.Parse(time.RFC3339, tc.after)
+		if got := rr.nextSeq(after); got != tc.seq {
+			t.Fatalf("nextSeq(%s) = %d, want %d", tc.after, got, tc.seq)
+		}
+	}
+	// The end date is inclusive
+	if rr.ended(rr.occurrence(2)) || !rr.ended(rr.occurrence(3)) {
+		t.Fatalf("ended: occurrence 2 (%s) should post and 3 (%s) not, with end %s",
+			rr.occurrence(2), rr.occurrence(3), end.Format("2006-01-02"))
+	}
+}
+
+func TestValidateRecurrence(t *testing.T) {
+	day := func(d int) *int { return &d }
+	date := func(s string) *string { return &s }
+	tests := []struct {
+		name    string
+		charge  Charge
+		ok      bool
+		freq    string
+		endDate string
+	}{
+		{"not recurring clears the rule", Charge{Periodical: "monthly", RecurrenceDay: day(5), RecurrenceEnd: date("2024-01-01")}, true, "monthly", ""},
+		{"normalizes the frequency", Charge{Recurring: true, Periodical: "Annually"}, true, "yearly", ""},
+		{"unknown frequency", Charge{Recurring: true, Periodical: "quarterly"}, false, "", ""},
+		{"day of month", Charge{Recurring: true, Periodical: "monthly", RecurrenceDay: day(31)}, true, "monthly", ""},
+		{"last day of month", Charge{Recurring: true, Periodical: "yearly", RecurrenceDay: day(-1)}, true, "yearly", ""},
+		{"day out of range", Charge{Recurring: true, Periodical: "monthly", RecurrenceDay: day(32)}, false, "", ""},
+		{"day zero", Charge{Recurring: true, Periodical: "monthly", RecurrenceDay: day(0)}, false, "", ""},
+		{"day on a weekly charge", Charge{Recurring: true, Periodical: "weekly", RecurrenceDay: day(3)}, false, "", ""},
+		{"end as a timestamp", Charge{Recurring: true, Periodical: "daily", RecurrenceEnd: date("2024-06-30T18:00:00Z")}, true, "daily", "2024-06-30"},
+		{"invalid end", Charge{Recurring: true, Periodical: "daily", RecurrenceEnd: date("June")}, false, "", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := tc.charge
+			err := validateRecurrence(&c)
+			if (err == nil) != tc.ok {
+				t.Fatalf("validateRecurrence = %v, want ok %v", err, tc.ok)
+			}
+			if !tc.ok {
+				return
+			}
+			if c.Periodical != tc.freq {
+				t.Fatalf("periodical = %q, want %q", c.Periodical, tc.freq)
+			}
+			if !c.Recurring && (c.RecurrenceDay != nil || c.RecurrenceEnd != nil) {
+				t.Fatalf("a non-recurring charge kept its rule: %+v", c)
+			}
+			if tc.endDate != "" && (c.RecurrenceEnd == nil || *c.RecurrenceEnd != tc.endDate) {
+				t.Fatalf("recurrence_end = %v, want %s", c.RecurrenceEnd, tc.endDate)
+			}
+		})
+	}
+}
+
+func TestRecurringChargeStore(t *testing.T) {
+	eachStore(t, testRecurringCharges)
+}
+
+func testRecurringCharges(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	end := "2024-04-30"
+	template := Charge{
+		Name:          "Gym",
+		Amount:        mustMoney("30", "USD"),
+		Category:      "Health",
+		Periodical:    "monthly",
+		UserID:        u.ID,
+		CreatedAt:     "2024-01-31T12:00:00Z",
+		Recurring:     true,
+		RecurrenceEnd: &end,
+	}
+	if err := s.CreateCharge(&template); err != nil {
+		t.Fatalf("CreateCharge: %v", err)
+	}
+	if err := scheduleRecurrence(s, template.ID); err != nil {
+		t.Fatalf("scheduleRecurrence: %v", err)
+	}
+	templates, err := s.ListRecurringTemplates(u.ID)
+	if err != nil || len(templates) != 1 || templates[0].Seq != 1 {
+		t.Fatalf("ListRecurringTemplates = %+v, %v", templates, err)
+	}
+
+	// Other checks' templates may be due too, so count only this user's charges
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := materializeDueCharges(s, now); err != nil {
+		t.Fatalf("materializeDueCharges: %v", err)
+	}
+	if _, err := materializeDueCharges(s, now); err != nil {
+		t.Fatalf("materializeDueCharges again: %v", err)
+	}
+	charges, err := s.ListCharges(&ListFilter{OwnerID: u.ID, Sort: "created_at"})
+	if err != nil {
+		t.Fatalf("ListCharges: %v", err)
+	}
+	got := ""
+	for _, c := range charges {
+		t, _ := time.Parse(time.RFC3339Nano, c.CreatedAt)
+		got += t.UTC().Format("2006-01-02") + ";"
+	}
+	if want := "2024-01-31;2024-02-29;2024-03-31;2024-04-30;"; got != want {
+		t.Fatalf("posted occurrences %q, want %q", got, want)
+	}
+
+	last, err := s.LastOccurrence(template.ID)
+	if err != nil || last == nil || !last.Equal(time.Date(2024, 4, 30, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("LastOccurrence = %v, %v", last, err)
+	}
+	if templates, _ := s.ListRecurringTemplates(u.ID); len(templates) != 0 {
+		t.Fatalf("an ended template is still scheduled")
+	}
+
+	// Deleting the latest occurrence and editing the template doesn't bring
+	// it back
+	if err := s.DeleteCharge(u.ID, charges[len(charges)-1].ID); err != nil {
+		t.Fatalf("DeleteCharge: %v", err)
+	}
+	template.Amount = mustMoney("35", "USD")
+	if err := s.UpdateCharge(template); err != nil {
+		t.Fatalf("UpdateCharge: %v", err)
+	}
+	if err := scheduleRecurrence(s, template.ID); err != nil {
+		t.Fatalf("scheduleRecurrence after edit: %v", err)
+	}
+	if templates, _ := s.ListRecurringTemplates(u.ID); len(templates) != 0 {
+		t.Fatalf("the deleted occurrence is scheduled again: %+v", templates)
+	}
+	if _, err := materializeDueCharges(s, now); err != nil {
+		t.Fatalf("materializeDueCharges after edit: %v", err)
+	}
+	if charges, _ := s.ListCharges(&ListFilter{OwnerID: u.ID}); len(charges) != 3 {
+		t.Fatalf("%d charges after deleting one and editing the template, want 3", len(charges))
+	}
+}
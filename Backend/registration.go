@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --------------------------
+//   Registration + Invites
+// --------------------------
+
+// Registration modes, set with REGISTRATION: nobody can sign up (the
+// default), anybody can, or only people holding an unused invite code.
+const (
+	RegistrationOff    = "off"
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+)
+
+var registrationMode = RegistrationOff
+
+var errInvalidInvite = errors.New("invalid, used or expired invite code")
+
+// validateRegistrationMode returns mode, defaulting to off, if it is one of
+// the modes above.
+func validateRegistrationMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return RegistrationOff, nil
+	case RegistrationOff, RegistrationOpen, RegistrationInvite:
+		return mode, nil
+	}
+	return "", fmt.Errorf("REGISTRATION must be off, open or invite: %q", mode)
+}
+
+// Invite: a single-use code letting someone register. Only its hash is
+// kept; Code is filled in once, in the response to creating it.
+type Invite struct {
+	ID        int        `json:"id"`
+	Hash      string     `json:"-"`
+	Note      string     `json:"note"`
+	CreatedBy *int       `json:"created_by"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	UsedBy    *int       `json:"used_by"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt string     `json:"created_at"`
+	Code      string     `json:"code,omitempty"`
+}
+
+// POST /api/register => { "username", "password", "invite_code" }: sign up
+// as a user with the default categories. Refused while REGISTRATION is off;
+// "invite_code" is required, and used up, while it is invite.
+func (s *Server) registerHandler(w http.ResponseWriter, r *http.Request) {
+	if registrationMode == RegistrationOff {
+		http.Error(w, "Registration is disabled", http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		Username   string `json:"username"`
+		Password   string `json:"password"`
+		InviteCode string `json:"invite_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	body.Username = strings.TrimSpace(body.Username)
+	if body.Username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(body.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if registrationMode == RegistrationInvite && body.InviteCode == "" {
+		http.Error(w, "invite_code is required", http.StatusForbidden)
+		return
+	}
+
+	hashedPass, err := hashPassword(body.Password)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+	u := User{Username: body.Username, Password: hashedPass, Permissions: RoleUser}
+	// The new user is the actor; CreateUser sets u.ID before it is recorded
+	src := auditSource{ActorID: &u.ID, IP: clientIP(r), UserAgent: r.UserAgent()}
+	err = s.store.Tx(func(tx Store) error {
+		var invite Invite
+		if registrationMode == RegistrationInvite {
+			var err error
+			invite, err = tx.GetInvite(hashToken(body.InviteCode))
+			if errors.Is(err, ErrNotFound) {
+				return errInvalidInvite
+			}
+			if err != nil {
+				return err
+			}
+			if invite.UsedBy != nil || (invite.ExpiresAt != nil && time.Now().After(*invite.ExpiresAt)) {
+				return errInvalidInvite
+			}
+		}
+		if err := insertUser(tx, &u, src); err != nil {
+			return err
+		}
+		if registrationMode == RegistrationInvite {
+			if err := tx.UseInvite(invite.ID, u.ID); errors.Is(err, ErrNotFound) {
+				return errInvalidInvite
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errInvalidInvite) {
+		http.Error(w, "Invalid, used or expired invite code", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, ErrConflict) {
+		http.Error(w, "Username is taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error registering user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":          u.ID,
+		"username":    u.Username,
+		"permissions": u.Permissions,
+	})
+}
+
+// GET /api/invites => every invite, newest first (users:read)
+func (s *Server) getInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	invites, err := s.store.ListInvites()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching invites: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(invites)
+}
+
+// POST /api/invites => { "note", "expires_at" }, both optional: create an
+// invite (users:write). Its "code" is in this response and nowhere else.
+func (s *Server) createInviteHandler(w http.ResponseWriter, r *http.Request) {
+	me := callerOf(r)
+	var body struct {
+		Note      string `json:"note"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	invite := Invite{Note: body.Note, CreatedBy: &me.ID}
+	if body.ExpiresAt != "" {
+		t, err := parseDate(body.ExpiresAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid expires_at: %v", err), http.StatusBadRequest)
+			return
+		}
+		invite.ExpiresAt = &t
+	}
+
+	code, err := randomToken(12)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating invite: %v", err), http.StatusInternalServerError)
+		return
+	}
+	invite.Hash = hashToken(code)
+	if err := s.store.CreateInvite(&invite); err != nil {
+		http.Error(w, fmt.Sprintf("Error creating invite: %v", err), http.StatusInternalServerError)
+		return
+	}
+	invite.Code = code
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invite)
+}
+
+// DELETE /api/invites/{id} => revoke an invite (users:write)
+func (s *Server) deleteInviteHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid invite ID", http.StatusBadRequest)
+		return
+	}
+	err = s.store.DeleteInvite(id)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting invite: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Invite deleted successfully"})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidateRegistrationMode(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", RegistrationOff, true},
+		{"off", RegistrationOff, true},
+		{"open", RegistrationOpen, true},
+		{"invite", RegistrationInvite, true},
+		{"Open", "", false},
+		{"closed", "", false},
+	}
+	for _, tc := range tests {
+		got, err := validateRegistrationMode(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Fatalf("validateRegistrationMode(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestInviteStore(t *testing.T) {
+	eachStore(t, testInvites)
+}
+
+func testInvites(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	i := Invite{Hash: hashToken("invite-" + u.Username), Note: "for a friend", CreatedBy: &u.ID, ExpiresAt: &expires}
+	if err := s.CreateInvite(&i); err != nil {
+		t.Fatalf("CreateInvite: %v", err)
+	}
+	defer s.DeleteInvite(i.ID)
+	if i.ID == 0 || i.CreatedAt == "" {
+		t.Fatalf("CreateInvite left ID/CreatedAt unset: %+v", i)
+	}
+	if dup := (Invite{Hash: i.Hash}); !errors.Is(s.CreateInvite(&dup), ErrConflict) {
+		t.Fatalf("CreateInvite with a taken code: want ErrConflict")
+	}
+	got, err := s.GetInvite(i.Hash)
+	if err != nil || got.ID != i.ID || got.Note != i.Note || got.CreatedBy == nil || *got.CreatedBy != u.ID ||
+		got.ExpiresAt == nil || !got.ExpiresAt.Equal(expires) || got.UsedBy != nil {
+		t.Fatalf("GetInvite = %+v, %v; want %+v", got, err, i)
+	}
+	if err := s.UseInvite(i.ID, u.ID); err != nil {
+		t.Fatalf("UseInvite: %v", err)
+	}
+	if err := s.UseInvite(i.ID, u.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("using an invite twice: got %v, want ErrNotFound", err)
+	}
+	invites, err := s.ListInvites()
+	if err != nil {
+		t.Fatalf("ListInvites: %v", err)
+	}
+	if len(invites) == 0 || invites[0].ID != i.ID || invites[0].UsedBy == nil || *invites[0].UsedBy != u.ID || invites[0].UsedAt == nil {
+		t.Fatalf("ListInvites = %+v, want the used invite first", invites)
+	}
+	if err := s.DeleteInvite(i.ID); err != nil {
+		t.Fatalf("DeleteInvite: %v", err)
+	}
+	if err := s.DeleteInvite(i.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleting an invite twice: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --------------------------
+//        Reports
+// --------------------------
+
+// BudgetReportLine: one budget compared against the charges in its current
+// window. Only charges in the budget's currency count as spent; matching
+// charges in other currencies are totalled separately, never added in.
+type BudgetReportLine struct {
+	BudgetID        int         `json:"budget_id"`
+	Name            string      `json:"name"`
+	Category        string      `json:"category"`
+	Period          string      `json:"period"`
+	PeriodStart     string      `json:"period_start"`
+	PeriodEnd       string      `json:"period_end"`
+	Currency        string      `json:"currency"`
+	Budgeted        json.Number `json:"budgeted"`
+	Spent           json.Number `json:"spent"`
+	Remaining       json.Number `json:"remaining"`
+	PercentUsed     float64     `json:"percent_used"`
+	OverBudget      bool        `json:"over_budget"`
+	OtherCurrencies MoneyTotals `json:"other_currencies,omitempty"`
+}
+
+// periodWindow returns the [start, end) window of the given budget period that
+// contains t. Weeks start on Monday. A "one-time" budget covers all time.
+func periodWindow(period string, t time.Time) (time.Time, time.Time, error) {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch strings.ToLower(strings.TrimSpace(period)) {
+	case "daily":
+		return day, day.AddDate(0, 0, 1), nil
+	case "weekly":
+		offset := (int(day.Weekday()) + 6) % 7
+		start := day.AddDate(0, 0, -offset)
+		return start, start.AddDate(0, 0, 7), nil
+	case "monthly", "":
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0), nil
+	case "quarterly":
+		month := time.Month((int(t.Month())-1)/3*3 + 1)
+		start := time.Date(t.Year(), month, 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 3, 0), nil
+	case "yearly", "annually":
+		start := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(1, 0, 0), nil
+	case "one-time", "onetime", "once":
+		return time.Unix(0, 0).UTC(), time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("unknown budget period %q", period)
+}
+
+// reportWindow returns the [from, to) window a report covers: ?from= and
+// ?to= (YYYY-MM-DD or RFC 3339), defaulting to the current period.
+func reportWindow(r *http.Request, period string) (time.Time, time.Time, error) {
+	from, to, _ := periodWindow(period, time.Now())
+	for _, p := range []struct {
+		param string
+		dst   *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := r.URL.Query().Get(p.param); v != "" {
+			t, err := parseDate(v)
+			if err != nil {
+				return time.Time{}, time.Time{}, fmt.Errorf("invalid %s date %q", p.param, v)
+			}
+			*p.dst = t
+		}
+	}
+	return from, to, nil
+}
+
+// GET /api/reports/budget-vs-actual => each of the JWT user's budgets with the
+// amount spent in the budget's current period, counting charges in the
+// budget's category and all its subcategories (every charge, for a budget
+// without a category). Optional ?date=YYYY-MM-DD picks the day used to
+// resolve the period (defaults to today); ?owner=<id> reports on a user who
+// shares with the JWT user.
+func (s *Server) budgetVsActualHandler(w http.ResponseWriter, r *http.Request) {
+	_, userID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	asOf := time.Now()
+	if d := r.URL.Query().Get("date"); d != "" {
+		asOf, err = time.Parse("2006-01-02", d)
+		if err != nil {
+			http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+
+	budgets, err := s.store.ListBudgets(&ListFilter{OwnerID: userID, Sort: "id"})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying budgets: %v", err), http.StatusInternalServerError)
+		return
+	}
+	tree, err := loadCategoryTree(s.store, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	report := []BudgetReportLine{}
+	for _, b := range budgets {
+		start, end, err := periodWindow(b.Period, asOf)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Budget %d: %v", b.ID, err), http.StatusUnprocessableEntity)
+			return
+		}
+
+		var categories []int
+		if b.CategoryID != nil {
+			categories = tree.subtree(*b.CategoryID)
+		}
+		totals, err := sumChargesByCurrency(s.store, userID, categories, start, end)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error summing charges: %v", err), http.StatusInternalServerError)
+			return
+		}
+		spent := Money{Currency: b.Amount.Currency}
+		if t, ok := totals[b.Amount.Currency]; ok {
+			spent = t
+			delete(totals, b.Amount.Currency)
+		}
+		remaining, err := b.Amount.Sub(spent)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		percent, err := spent.PercentOf(b.Amount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		line := BudgetReportLine{
+			BudgetID:    b.ID,
+			Name:        b.Name,
+			Category:    b.Category,
+			Period:      b.Period,
+			PeriodStart: start.Format(time.RFC3339),
+			PeriodEnd:   end.Format(time.RFC3339),
+			Currency:    b.Amount.Currency,
+			Budgeted:    b.Amount.Number(),
+			Spent:       spent.Number(),
+			Remaining:   remaining.Number(),
+			PercentUsed: percent,
+			OverBudget:  remaining.Minor < 0,
+		}
+		if len(totals) > 0 {
+			line.OtherCurrencies = totals
+		}
+		report = append(report, line)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// sumChargesByCurrency totals the owner's spending filed under one of
+// categories (any, when nil) within [start, end), per currency: expenses
+// less refunds, leaving out income and transfers. Split charges count
+// only their lines in those categories.
+func sumChargesByCurrency(store Store, userID int, categories []int, start, end time.Time) (MoneyTotals, error) {
+	charges, err := store.ListCharges(&ListFilter{
+		OwnerID:     userID,
+		From:        &start,
+		To:          &end,
+		CategoryIDs: categories,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return spendingTotals(charges, categories)
+}
+
+// spendingTotals totals the spending of charges filed under one of
+// categories (any, when nil), per currency, counted like
+// sumChargesByCurrency.
+func spendingTotals(charges []Charge, categories []int) (MoneyTotals, error) {
+	in := map[int]bool{}
+	for _, id := range categories {
+		in[id] = true
+	}
+	totals := MoneyTotals{}
+	for _, c := range charges {
+		for _, line := range spendingLines(c) {
+			if categories == nil || (line.CategoryID != nil && in[*line.CategoryID]) {
+				if err := totals.Add(line.Amount); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return totals, nil
+}
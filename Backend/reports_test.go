@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPeriodWindow(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	tests := []struct {
+		period     string
+		at         string
+		start, end string
+	}{
+		{"daily", "2024-05-15", "2024-05-15", "2024-05-16"},
+		{"weekly", "2024-05-15", "2024-05-13", "2024-05-20"}, // a Wednesday
+		{"weekly", "2024-05-19", "2024-05-13", "2024-05-20"}, // a Sunday
+		{"weekly", "2024-05-13", "2024-05-13", "2024-05-20"}, // a Monday
+		{"monthly", "2024-02-29", "2024-02-01", "2024-03-01"},
+		{"", "2024-12-31", "2024-12-01", "2025-01-01"},
+		{" Monthly ", "2024-05-15", "2024-05-01", "2024-06-01"},
+		{"quarterly", "2024-05-15", "2024-04-01", "2024-07-01"},
+		{"quarterly", "2024-12-31", "2024-10-01", "2025-01-01"},
+		{"yearly", "2024-05-15", "2024-01-01", "2025-01-01"},
+		{"annually", "2024-05-15", "2024-01-01", "2025-01-01"},
+		{"one-time", "2024-05-15", "1970-01-01", "9999-12-31"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.period+"/"+tc.at, func(t *testing.T) {
+			start, end, err := periodWindow(tc.period, day(tc.at).Add(15*time.Hour))
+			if err != nil || !start.Equal(day(tc.start)) || !end.Equal(day(tc.end)) {
+				t.Fatalf("periodWindow(%q, %s) = %s, %s, %v; want %s, %s", tc.period, tc.at,
+					start.Format("2006-01-02"), end.Format("2006-01-02"), err, tc.start, tc.end)
+			}
+		})
+	}
+	if _, _, err := periodWindow("fortnightly", time.Now()); err == nil {
+		t.Fatalf("periodWindow of an unknown period: want an error")
+	}
+}
+
+func TestBudgetVsActual(t *testing.T) {
+	eachStore(t, testBudgetVsActual)
+}
+
+// testBudgetVsActual checks the report against budgets with and without
+// spending in other currencies and subcategories.
+func testBudgetVsActual(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	a := at.a
+
+	for _, b := range []map[string]interface{}{
+		{"name": "Food", "amount": 100, "currency": "USD", "category": "Food", "period": "monthly"},
+		{"name": "Travel", "amount": 30, "currency": "USD", "category": "Travel", "period": "monthly"},
+	} {
+		if err := a.expectStatus(http.StatusCreated, "POST", "/api/budgets", b, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []map[string]interface{}{
+		{"name": "Lunch", "amount": json.Number("12.50"), "category": "food"},
+		{"name": "Lunch", "amount": json.Number("7.25"), "category": "Food"},
+		{"name": "Market", "amount": 5, "category": "Food/Groceries"},
+		{"name": "Croissant", "amount": 3, "currency": "EUR", "category": "Food"},
+		{"name": "Train", "amount": 40, "category": "Travel"},
+	} {
+		if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", c, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type line struct {
+		Name            string                 `json:"name"`
+		Spent           json.Number            `json:"spent"`
+		Remaining       json.Number            `json:"remaining"`
+		PercentUsed     float64                `json:"percent_used"`
+		OverBudget      bool                   `json:"over_budget"`
+		OtherCurrencies map[string]json.Number `json:"other_currencies"`
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  []line
+	}{
+		{"this period", "", []line{
+			{Name: "Food", Spent: "24.75", Remaining: "75.25", PercentUsed: 24.75, OtherCurrencies: map[string]json.Number{"EUR": "3.00"}},
+			{Name: "Travel", Spent: "40.00", Remaining: "-10.00", PercentUsed: 133.33, OverBudget: true},
+		}},
+		{"a period without charges", "?date=2000-01-15", []line{
+			{Name: "Food", Spent: "0.00", Remaining: "100.00"},
+			{Name: "Travel", Spent: "0.00", Remaining: "30.00"},
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var report []line
+			if err := a.expectStatus(http.StatusOK, "GET", "/api/reports/budget-vs-actual"+tc.query, nil, &report); err != nil {
+				t.Fatal(err)
+			}
+			if len(report) != len(tc.want) {
+				t.Fatalf("report = %+v, want %d lines", report, len(tc.want))
+			}
+			for i, got := range report {
+				want := tc.want[i]
+				if got.Name != want.Name || got.Spent != want.Spent || got.Remaining != want.Remaining ||
+					got.OverBudget != want.OverBudget || got.OtherCurrencies["EUR"] != want.OtherCurrencies["EUR"] ||
+					got.PercentUsed < want.PercentUsed-0.01 || got.PercentUsed > want.PercentUsed+0.01 {
+					t.Fatalf("line %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+
+	if err := a.expectStatus(http.StatusBadRequest, "GET", "/api/reports/budget-vs-actual?date=May", nil, nil); err != nil {
+		t.Fatalf("an invalid date: %v", err)
+	}
+	owner := "?owner=" + strconv.Itoa(at.alice.ID)
+	if err := at.b.expectStatus(http.StatusForbidden, "GET", "/api/reports/budget-vs-actual"+owner, nil, nil); err != nil {
+		t.Fatalf("a report on a user who doesn't share: %v", err)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --------------------------
+//      Budget Rollover
+// --------------------------
+
+// Rollover policies: what a budget carries from one period into the next.
+// A surplus is what was left unspent, a deficit what was overspent.
+const (
+	RolloverNone    = "none"
+	RolloverSurplus = "surplus"
+	RolloverDeficit = "deficit"
+	RolloverBoth    = "both"
+)
+
+var rolloverPolicies = map[string]bool{RolloverNone: true, RolloverSurplus: true, RolloverDeficit: true, RolloverBoth: true}
+
+// rolloverFields is how Budget carries its rollover amounts over JSON, in
+// the budget's currency. CarriedIn and Available are only ever sent.
+type rolloverFields struct {
+	RolloverCap *json.Number `json:"rollover_cap"`
+	CarriedIn   *json.Number `json:"carried_in,omitempty"`
+	Available   *json.Number `json:"available,omitempty"`
+}
+
+// number returns *m as a JSON number, nil when m is.
+func number(m *Money) *json.Number {
+	if m == nil {
+		return nil
+	}
+	n := m.Number()
+	return &n
+}
+
+func newRolloverFields(b Budget) rolloverFields {
+	return rolloverFields{RolloverCap: number(b.RolloverCap), CarriedIn: number(b.CarriedIn), Available: number(b.Available)}
+}
+
+// validateRollover normalizes b's rollover policy and checks its cap.
+func validateRollover(b *Budget) error {
+	if b.Rollover = strings.ToLower(strings.TrimSpace(b.Rollover)); b.Rollover == "" {
+		b.Rollover = RolloverNone
+	}
+	if !rolloverPolicies[b.Rollover] {
+		return fmt.Errorf("invalid rollover %q (want none, surplus, deficit or both)", b.Rollover)
+	}
+	if b.RolloverCap != nil && b.RolloverCap.Minor <= 0 {
+		return fmt.Errorf("rollover_cap must be positive")
+	}
+	if b.Rollover == RolloverNone {
+		b.RolloverCap = nil
+	}
+	return nil
+}
+
+// BudgetSnapshot: a closed period of a budget as it was computed when the
+// period ended. Allocated is the budget's amount then, CarriedIn what the
+// previous period carried into it and Spent its spending in the budget's
+// currency; CarriedOut is what it carried into the next one under the
+// Rollover policy of the time. Snapshots are kept as computed, so editing
+// old charges leaves them alone until they are recomputed.
+type BudgetSnapshot struct {
+	BudgetID    int       `json:"budget_id"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Allocated   Money     `json:"-"`
+	CarriedIn   Money     `json:"-"`
+	Spent       Money     `json:"-"`
+	CarriedOut  Money     `json:"-"`
+	Rollover    string    `json:"rollover"`
+	ComputedAt  time.Time `json:"computed_at"`
+}
+
+func (sn BudgetSnapshot) MarshalJSON() ([]byte, error) {
+	type plain BudgetSnapshot
+	return json.Marshal(struct {
+		plain
+		Currency   string      `json:"currency"`
+		Allocated  json.Number `json:"allocated"`
+		CarriedIn  json.Number `json:"carried_in"`
+		Spent      json.Number `json:"spent"`
+		CarriedOut json.Number `json:"carried_out"`
+	}{plain(sn), sn.Allocated.Currency, sn.Allocated.Number(), sn.CarriedIn.Number(), sn.Spent.Number(), sn.CarriedOut.Number()})
+}
+
+// carryOut returns what a period that had left over (negative when
+// overspent) carries into the next under b's policy and cap.
+func carryOut(b Budget, left Money) Money {
+	carried := Money{Currency: left.Currency}
+	switch {
+	case left.Minor > 0 && (b.Rollover == RolloverSurplus || b.Rollover == RolloverBoth),
+		left.Minor < 0 && (b.Rollover == RolloverDeficit || b.Rollover == RolloverBoth):
+		carried = left
+	}
+	if b.RolloverCap != nil && carried.Abs().Minor > b.RolloverCap.Minor {
+		carried.Minor = b.RolloverCap.Minor
+		if left.Minor < 0 {
+			carried.Minor = -carried.Minor
+		}
+	}
+	return carried
+}
+
+// budgetSpent is the owner's spending under b in [start, end), in b's
+// currency.
+func budgetSpent(store Store, tree *categoryTree, b Budget, start, end time.Time) (Money, MoneyTotals, error) {
+	var categories []int
+	if b.CategoryID != nil {
+		categories = tree.subtree(*b.CategoryID)
+	}
+	totals, err := sumChargesByCurrency(store, b.UserID, categories, start, end)
+	if err != nil {
+		return Money{}, nil, err
+	}
+	spent := Money{Currency: b.Amount.Currency}
+	if t, ok := totals[b.Amount.Currency]; ok {
+		spent = t
+		delete(totals, b.Amount.Currency)
+	}
+	return spent, totals, nil
+}
+
+// maxBudgetPeriods caps how many ended periods of a budget are worked out
+// at once. When more than that went by without a snapshot, the older ones
+// are skipped and carry nothing into the rest.
+const maxBudgetPeriods = 1000
+
+// budgetPeriod: the [start, end) of one period of a budget.
+type budgetPeriod struct {
+	start, end time.Time
+}
+
+// endedBudgetPeriods works out, without storing them, the snapshots of the
+// periods of b that have ended by now after the last of snapshots (or from
+// the period b was created in), oldest first, at most maxBudgetPeriods of
+// them. Their spending comes from one query. It also returns what the last
+// ended period carries into the current one.
+func endedBudgetPeriods(store Store, tree *categoryTree, b Budget, snapshots []BudgetSnapshot, now time.Time) ([]BudgetSnapshot, Money, error) {
+	carried := Money{Currency: b.Amount.Currency}
+	current, _, err := periodWindow(b.Period, now)
+	if err != nil {
+		return nil, carried, err
+	}
+
+	var start time.Time
+	if n := len(snapshots); n > 0 {
+		last := snapshots[n-1]
+		start = last.PeriodEnd
+		if last.CarriedOut.Currency == b.Amount.Currency {
+			carried = last.CarriedOut
+		}
+	} else {
+		created, err := time.Parse(time.RFC3339Nano, b.CreatedAt)
+		if err != nil {
+			created = now
+		}
+		if start, _, err = periodWindow(b.Period, created); err != nil {
+			return nil, carried, err
+		}
+	}
+
+	var periods []budgetPeriod
+	for start.Before(current) {
+		periodStart, end, err := periodWindow(b.Period, start)
+		if err != nil {
+			return nil, carried, err
+		}
+		periods = append(periods, budgetPeriod{periodStart, end})
+		start = end
+	}
+	if len(periods) == 0 {
+		return nil, carried, nil
+	}
+	if len(periods) > maxBudgetPeriods {
+		periods = periods[len(periods)-maxBudgetPeriods:]
+		carried = Money{Currency: b.Amount.Currency}
+	}
+
+	var categories []int
+	if b.CategoryID != nil {
+		categories = tree.subtree(*b.CategoryID)
+	}
+	from, to := periods[0].start, periods[len(periods)-1].end
+	charges, err := store.ListCharges(&ListFilter{OwnerID: b.UserID, From: &from, To: &to, CategoryIDs: categories})
+	if err != nil {
+		return nil, carried, err
+	}
+	byPeriod := make([][]Charge, len(periods))
+	for _, c := range charges {
+		t, err := parseDate(c.CreatedAt)
+		if err != nil {
+			return nil, carried, fmt.Errorf("charge %d: invalid created_at %q", c.ID, c.CreatedAt)
+		}
+		if i := sort.Search(len(periods), func(i int) bool { return t.Before(periods[i].end) }); i < len(periods) {
+			byPeriod[i] = append(byPeriod[i], c)
+		}
+	}
+
+	ended := make([]BudgetSnapshot, len(periods))
+	for i, p := range periods {
+		totals, err := spendingTotals(byPeriod[i], categories)
+		if err != nil {
+			return nil, carried, err
+		}
+		spent := Money{Currency: b.Amount.Currency}
+		if t, ok := totals[b.Amount.Currency]; ok {
+			spent = t
+		}
+		left := Money{Minor: b.Amount.Minor + carried.Minor - spent.Minor, Currency: b.Amount.Currency}
+		ended[i] = BudgetSnapshot{BudgetID: b.ID, PeriodStart: p.start, PeriodEnd: p.end, Allocated: b.Amount,
+			CarriedIn: carried, Spent: spent, CarriedOut: carryOut(b, left), Rollover: b.Rollover, ComputedAt: now.UTC()}
+		carried = ended[i].CarriedOut
+	}
+	return ended, carried, nil
+}
+
+// closeBudgetPeriods stores the snapshots endedBudgetPeriods works out for
+// b, returning them and what the last closed period carries into the
+// current one. Only writes close periods: updating a budget, recomputing
+// its snapshots and the snapshot worker.
+func closeBudgetPeriods(tx Store, tree *categoryTree, b Budget, now time.Time) ([]BudgetSnapshot, Money, error) {
+	snapshots, err := tx.ListBudgetSnapshots(b.ID)
+	if err != nil {
+		return nil, Money{Currency: b.Amount.Currency}, err
+	}
+	ended, carried, err := endedBudgetPeriods(tx, tree, b, snapshots, now)
+	if err != nil {
+		return nil, carried, err
+	}
+	for _, sn := range ended {
+		if err := tx.PutBudgetSnapshot(sn); err != nil {
+			return nil, carried, err
+		}
+	}
+	return ended, carried, nil
+}
+
+// closeAllBudgetPeriods closes the ended periods of every user's budgets,
+// one transaction per user, and returns how many it closed.
+func closeAllBudgetPeriods(store Store, now time.Time) (int, error) {
+	users, err := store.ListUsers()
+	if err != nil {
+		return 0, err
+	}
+	closed := 0
+	for _, u := range users {
+		err := store.Tx(func(tx Store) error {
+			budgets, err := tx.ListBudgets(&ListFilter{OwnerID: u.ID})
+			if err != nil || len(budgets) == 0 {
+				return err
+			}
+			tree, err := loadCategoryTree(tx, u.ID)
+			if err != nil {
+				return err
+			}
+			for _, b := range budgets {
+				ended, _, err := closeBudgetPeriods(tx, tree, b, now)
+				if err != nil {
+					return fmt.Errorf("budget %d: %v", b.ID, err)
+				}
+				closed += len(ended)
+			}
+			return nil
+		})
+		if err != nil {
+			return closed, fmt.Errorf("user %d: %v", u.ID, err)
+		}
+	}
+	return closed, nil
+}
+
+// snapshotInterval is how often runSnapshotWorker closes budget periods,
+// overridable with BUDGET_SNAPSHOT_INTERVAL.
+var snapshotInterval = time.Hour
+
+// runSnapshotWorker closes ended budget periods every snapshotInterval for
+// the life of the server, so reads never have to.
+func (s *Server) runSnapshotWorker() {
+	for {
+		n, err := closeAllBudgetPeriods(s.store, time.Now())
+		if err != nil {
+			log.Printf("Budget snapshots: %v\n", err)
+		} else if n > 0 {
+			log.Printf("Budget snapshots: closed %d period(s)\n", n)
+		}
+		time.Sleep(snapshotInterval)
+	}
+}
+
+// withRollover fills in what was carried into b's current period and what
+// is available in it: the budget's amount plus what was carried in, less
+// what was spent so far. Periods ended since the last snapshot are worked
+// out but not stored. Budgets of an unknown period are left as they are.
+func withRollover(store Store, tree *categoryTree, b Budget, now time.Time) (Budget, error) {
+	start, end, err := periodWindow(b.Period, now)
+	if err != nil {
+		return b, nil
+	}
+	snapshots, err := store.ListBudgetSnapshots(b.ID)
+	if err != nil {
+		return b, err
+	}
+	_, carried, err := endedBudgetPeriods(store, tree, b, snapshots, now)
+	if err != nil {
+		return b, err
+	}
+	spent, _, err := budgetSpent(store, tree, b, start, end)
+	if err != nil {
+		return b, err
+	}
+	available := Money{Minor: b.Amount.Minor + carried.Minor - spent.Minor, Currency: b.Amount.Currency}
+	b.CarriedIn, b.Available = &carried, &available
+	return b, nil
+}
+
+// budgetID reads the budget ID in the request path.
+func budgetID(r *http.Request) (int, error) {
+	return strconv.Atoi(mux.Vars(r)["id"])
+}
+
+// GET /api/budgets/{id}/snapshots => the closed periods of a budget of the
+// JWT user (or ?owner=<id>, read access), oldest first, followed by any
+// that ended since the last snapshot, worked out but not stored
+func (s *Server) getBudgetSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	id, err := budgetID(r)
+	if err != nil {
+		http.Error(w, "Invalid budget ID", http.StatusBadRequest)
+		return
+	}
+
+	var snapshots []BudgetSnapshot
+	err = s.store.Tx(func(tx Store) error {
+		b, err := tx.GetBudget(id)
+		if err == nil && b.UserID != ownerID {
+			err = ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		tree, err := loadCategoryTree(tx, ownerID)
+		if err != nil {
+			return err
+		}
+		if snapshots, err = tx.ListBudgetSnapshots(id); err != nil {
+			return err
+		}
+		ended, _, err := endedBudgetPeriods(tx, tree, b, snapshots, time.Now())
+		snapshots = append(snapshots, ended...)
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Budget not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying snapshots: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+// POST /api/budgets/{id}/snapshots/recompute => recompute the snapshots of
+// a budget of the JWT user (or ?owner=<id>, write access) from the charges
+// as they are now and the budget's current amount and rollover policy.
+// Optional ?from=YYYY-MM-DD keeps the snapshots of periods that started
+// before it.
+func (s *Server) recomputeBudgetSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	id, err := budgetID(r)
+	if err != nil {
+		http.Error(w, "Invalid budget ID", http.StatusBadRequest)
+		return
+	}
+	var from time.Time
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse("2006-01-02", v); err != nil {
+			http.Error(w, "Invalid from date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var snapshots []BudgetSnapshot
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		b, err := tx.GetBudget(id)
+		if err == nil && b.UserID != ownerID {
+			err = ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		before, err := tx.ListBudgetSnapshots(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteBudgetSnapshots(id, from); err != nil {
+			return err
+		}
+		tree, err := loadCategoryTree(tx, ownerID)
+		if err != nil {
+			return err
+		}
+		if _, _, err := closeBudgetPeriods(tx, tree, b, time.Now()); err != nil {
+			return err
+		}
+		if snapshots, err = tx.ListBudgetSnapshots(id); err != nil {
+			return err
+		}
+		return audit.record(tx, AuditUpdate, "budget", id, ownerID,
+			map[string]interface{}{"snapshots": before}, map[string]interface{}{"snapshots": snapshots})
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Budget not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error recomputing snapshots: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(snapshots)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestValidateRollover(t *testing.T) {
+	positive, zero := mustMoney("25", "EUR"), mustMoney("0", "EUR")
+	tests := []struct {
+		rollover string
+		cap      *Money
+		want     string
+		wantCap  bool
+		ok       bool
+	}{
+		{"", nil, RolloverNone, false, true},
+		{" Both ", &positive, RolloverBoth, true, true},
+		{"surplus", nil, RolloverSurplus, false, true},
+		{"DEFICIT", &positive, RolloverDeficit, true, true},
+		{"none", &positive, RolloverNone, false, true},
+		{"sometimes", nil, "", false, false},
+		{"both", &zero, "", false, false},
+	}
+	for _, tc := range tests {
+		b := Budget{Rollover: tc.rollover, RolloverCap: tc.cap}
+		err := validateRollover(&b)
+		if (err == nil) != tc.ok {
+			t.Fatalf("validateRollover(%q) = %v, want ok %v", tc.rollover, err, tc.ok)
+		}
+		if tc.ok && (b.Rollover != tc.want || (b.RolloverCap != nil) != tc.wantCap) {
+			t.Fatalf("validateRollover(%q) = %q with cap %v, want %q with cap %v", tc.rollover, b.Rollover, b.RolloverCap, tc.want, tc.wantCap)
+		}
+	}
+}
+
+func TestCarryOut(t *testing.T) {
+	limit := mustMoney("50", "EUR")
+	tests := []struct {
+		rollover string
+		cap      *Money
+		left     string
+		want     string
+	}{
+		{RolloverNone, nil, "30", "0.00"},
+		{RolloverNone, nil, "-30", "0.00"},
+		{RolloverSurplus, nil, "30", "30.00"},
+		{RolloverSurplus, nil, "-30", "0.00"},
+		{RolloverDeficit, nil, "30", "0.00"},
+		{RolloverDeficit, nil, "-30", "-30.00"},
+		{RolloverBoth, nil, "30", "30.00"},
+		{RolloverBoth, nil, "-30", "-30.00"},
+		{RolloverBoth, nil, "0", "0.00"},
+		{RolloverBoth, &limit, "50", "50.00"},
+		{RolloverBoth, &limit, "80", "50.00"},
+		{RolloverBoth, &limit, "-80", "-50.00"},
+		{RolloverSurplus, &limit, "-80", "0.00"},
+	}
+	for _, tc := range tests {
+		b := Budget{Rollover: tc.rollover, RolloverCap: tc.cap}
+		got := carryOut(b, mustMoney(tc.left, "EUR"))
+		if got.String() != tc.want || got.Currency != "EUR" {
+			t.Fatalf("carryOut(%s, cap %v, %s) = %s %s, want %s EUR", tc.rollover, tc.cap, tc.left, got, got.Currency, tc.want)
+		}
+	}
+}
+
+func TestBudgetSnapshotJSON(t *testing.T) {
+	month := func(m time.Month) time.Time { return time.Date(2026, m, 1, 0, 0, 0, 0, time.UTC) }
+	sn := BudgetSnapshot{BudgetID: 7, PeriodStart: month(1), PeriodEnd: month(2), Allocated: mustMoney("100", "JPY"), CarriedIn: mustMoney("-5", "JPY"),
+		Spent: mustMoney("120", "JPY"), CarriedOut: mustMoney("-25", "JPY"), Rollover: RolloverDeficit, ComputedAt: month(2)}
+	data, err := json.Marshal(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"budget_id":7,"period_start":"2026-01-01T00:00:00Z","period_end":"2026-02-01T00:00:00Z","rollover":"deficit","computed_at":"2026-02-01T00:00:00Z","currency":"JPY","allocated":100,"carried_in":-5,"spent":120,"carried_out":-25}`
+	if string(data) != want {
+		t.Fatalf("snapshot JSON = %s\nwant %s", data, want)
+	}
+}
+
+func TestBudgetRolloverStore(t *testing.T) {
+	eachStore(t, testBudgetRollover)
+}
+
+func testBudgetRollover(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	limit := mustMoney("50", "EUR")
+	b := Budget{Name: "Eating out", Amount: mustMoney("100", "EUR"), Period: "monthly", Rollover: RolloverBoth, RolloverCap: &limit, UserID: u.ID}
+	if err := s.CreateBudget(&b); err != nil || b.CreatedAt == "" {
+		t.Fatalf("CreateBudget = %+v, %v", b, err)
+	}
+	if got, err := s.GetBudget(b.ID); err != nil || got.Rollover != RolloverBoth || got.RolloverCap == nil || got.RolloverCap.String() != "50.00" || got.CreatedAt != b.CreatedAt {
+		t.Fatalf("GetBudget = %+v, %v; want rollover both capped at 50.00", got, err)
+	}
+
+	// January was closed by hand and carried 30 into February, where 180
+	// was spent: February carries the capped deficit and March the surplus
+	month := func(m time.Month) time.Time { return time.Date(2026, m, 1, 0, 0, 0, 0, time.UTC) }
+	jan := BudgetSnapshot{BudgetID: b.ID, PeriodStart: month(1), PeriodEnd: month(2), Allocated: b.Amount, CarriedIn: mustMoney("0", "EUR"),
+		Spent: mustMoney("75", "EUR"), CarriedOut: mustMoney("30", "EUR"), Rollover: RolloverBoth, ComputedAt: month(2)}
+	if err := s.PutBudgetSnapshot(jan); err != nil {
+		t.Fatalf("PutBudgetSnapshot: %v", err)
+	}
+	c := Charge{Name: "Restaurant", Amount: mustMoney("180", "EUR"), UserID: u.ID, CreatedAt: "2026-02-10T19:00:00Z"}
+	if err := s.CreateCharge(&c); err != nil {
+		t.Fatalf("CreateCharge: %v", err)
+	}
+	tree, err := loadCategoryTree(s, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 4, 15, 0, 0, 0, 0, time.UTC)
+
+	// Reading works the ended periods out without storing them
+	got, err := withRollover(s, tree, b, now)
+	if err != nil || got.CarriedIn == nil || got.CarriedIn.String() != "50.00" {
+		t.Fatalf("withRollover = %+v, %v; want 50.00 carried in", got, err)
+	}
+	if snapshots, err := s.ListBudgetSnapshots(b.ID); err != nil || len(snapshots) != 1 {
+		t.Fatalf("snapshots after a read = %+v, %v; want only January", snapshots, err)
+	}
+
+	if _, carried, err := closeBudgetPeriods(s, tree, b, now); err != nil || carried.String() != "50.00" {
+		t.Fatalf("closing February and March carries %s, %v; want 50.00", carried, err)
+	}
+	snapshots, err := s.ListBudgetSnapshots(b.ID)
+	if err != nil || len(snapshots) != 3 || !snapshots[1].PeriodStart.Equal(month(2)) || snapshots[1].Spent.String() != "180.00" || snapshots[1].CarriedOut.String() != "-50.00" {
+		t.Fatalf("ListBudgetSnapshots = %+v, %v; want January to March", snapshots, err)
+	}
+
+	// Editing an old charge leaves the snapshots alone until recomputed
+	c.Amount = mustMoney("10", "EUR")
+	if err := s.UpdateCharge(c); err != nil {
+		t.Fatalf("UpdateCharge: %v", err)
+	}
+	if _, _, err := closeBudgetPeriods(s, tree, b, now); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots, _ = s.ListBudgetSnapshots(b.ID); len(snapshots) != 3 || snapshots[1].Spent.String() != "180.00" {
+		t.Fatalf("snapshots after editing a charge = %+v; want them unchanged", snapshots)
+	}
+	if err := s.DeleteBudgetSnapshots(b.ID, month(2)); err != nil {
+		t.Fatalf("DeleteBudgetSnapshots: %v", err)
+	}
+	if snapshots, _ = s.ListBudgetSnapshots(b.ID); len(snapshots) != 1 || !snapshots[0].PeriodStart.Equal(month(1)) || snapshots[0].CarriedOut.String() != "30.00" {
+		t.Fatalf("snapshots left after deleting from February = %+v; want January", snapshots)
+	}
+	if _, _, err := closeBudgetPeriods(s, tree, b, now); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots, _ = s.ListBudgetSnapshots(b.ID); len(snapshots) != 3 || snapshots[1].Spent.String() != "10.00" || snapshots[1].CarriedOut.String() != "50.00" {
+		t.Fatalf("recomputed snapshots = %+v; want February at 10.00 spent", snapshots)
+	}
+
+	// A budget untouched for years only has its latest periods worked out,
+	// which the worker stores
+	daily := Budget{Name: "Coffee", Amount: mustMoney("5", "EUR"), Period: "daily", Rollover: RolloverSurplus, UserID: u.ID}
+	if err := s.CreateBudget(&daily); err != nil {
+		t.Fatalf("CreateBudget: %v", err)
+	}
+	later := time.Now().AddDate(3, 0, 0)
+	ended, carried, err := endedBudgetPeriods(s, tree, daily, nil, later)
+	if err != nil || len(ended) != maxBudgetPeriods || ended[0].CarriedIn.Minor != 0 || carried.String() != "5000.00" {
+		t.Fatalf("endedBudgetPeriods = %d periods carrying %s, %v; want %d carrying 5000.00", len(ended), carried, err, maxBudgetPeriods)
+	}
+	if _, err := closeAllBudgetPeriods(s, later); err != nil {
+		t.Fatalf("closeAllBudgetPeriods: %v", err)
+	}
+	if snapshots, err := s.ListBudgetSnapshots(daily.ID); err != nil || len(snapshots) != maxBudgetPeriods {
+		t.Fatalf("daily snapshots after the worker = %d, %v; want %d", len(snapshots), err, maxBudgetPeriods)
+	}
+	if err := s.DeleteBudget(u.ID, daily.ID); err != nil {
+		t.Fatalf("DeleteBudget: %v", err)
+	}
+
+	if err := s.DeleteBudget(u.ID, b.ID); err != nil {
+		t.Fatalf("DeleteBudget: %v", err)
+	}
+	if left, err := s.ListBudgetSnapshots(b.ID); err != nil || len(left) != 0 {
+		t.Fatalf("snapshots of a deleted budget = %+v, %v", left, err)
+	}
+}
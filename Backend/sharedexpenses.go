@@ -0,0 +1,662 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// --------------------------
+//      Shared Expenses
+// --------------------------
+
+// Share modes: how a shared expense is divided among its participants.
+const (
+	ShareEqual   = "equal"
+	SharePercent = "percent"
+	ShareExact   = "exact"
+)
+
+// maxParticipants caps the participants of one shared expense.
+const maxParticipants = 20
+
+// Participant: someone who takes part in a shared expense. The charge's
+// owner paid it; each participant (the owner included, if listed) owes
+// Amount of it, worked out from the charge's share mode. Percent is sent
+// in percent mode and Amount, in the charge's currency, in exact mode.
+type Participant struct {
+	UserID  int      `json:"user_id"`
+	Percent *float64 `json:"percent,omitempty"`
+	Amount  Money    `json:"-"`
+
+	sent json.Number // amount as sent, until checkParticipants reads it
+}
+
+func (p Participant) MarshalJSON() ([]byte, error) {
+	type plain Participant
+	return json.Marshal(struct {
+		plain
+		Amount json.Number `json:"amount"`
+	}{plain(p), p.Amount.Number()})
+}
+
+func (p *Participant) UnmarshalJSON(data []byte) error {
+	type plain Participant
+	aux := struct {
+		*plain
+		Amount json.Number `json:"amount"`
+	}{plain: (*plain)(p)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	p.sent = aux.Amount
+	return nil
+}
+
+// Settlement: money one user paid another to settle what they owed.
+type Settlement struct {
+	ID         int    `json:"id"`
+	FromUserID int    `json:"from_user_id"`
+	ToUserID   int    `json:"to_user_id"`
+	Amount     Money  `json:"-"`
+	Note       string `json:"note"`
+	CreatedAt  string `json:"created_at"`
+}
+
+func (st Settlement) MarshalJSON() ([]byte, error) {
+	type plain Settlement
+	return json.Marshal(struct {
+		plain
+		moneyFields
+	}{plain(st), newMoneyFields(st.Amount)})
+}
+
+func (st *Settlement) UnmarshalJSON(data []byte) error {
+	type plain Settlement
+	aux := struct {
+		*plain
+		moneyFields
+	}{plain: (*plain)(st)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m, err := aux.money()
+	if err != nil {
+		return err
+	}
+	st.Amount = m
+	return nil
+}
+
+// errInvalidParticipants: participants a charge can't be shared with.
+var errInvalidParticipants = errors.New("invalid participants")
+
+// connectedUsers returns the users userID shares with or is shared with.
+func connectedUsers(store Store, userID int) (map[int]bool, error) {
+	shares, err := store.ListShares(userID)
+	if err != nil {
+		return nil, err
+	}
+	connected := map[int]bool{}
+	for _, sh := range shares {
+		if sh.UserID == userID {
+			connected[sh.UserShareID] = true
+		} else {
+			connected[sh.UserID] = true
+		}
+	}
+	return connected, nil
+}
+
+// checkParticipants validates the participants of c, a charge about to be
+// stored, and works out what each owes. Participants are the charge's owner
+// or users connected to them by a share; only expenses can be shared.
+func checkParticipants(store Store, c *Charge) error {
+	if len(c.Participants) == 0 {
+		c.Participants, c.ShareMode = nil, ""
+		return nil
+	}
+	switch c.ShareMode = strings.ToLower(strings.TrimSpace(c.ShareMode)); c.ShareMode {
+	case "":
+		c.ShareMode = ShareEqual
+	case ShareEqual, SharePercent, ShareExact:
+	default:
+		return fmt.Errorf("%w: share_mode must be equal, percent or exact", errInvalidParticipants)
+	}
+	if c.Direction != DirectionExpense {
+		return fmt.Errorf("%w: only expenses can be shared", errInvalidParticipants)
+	}
+	if len(c.Participants) > maxParticipants {
+		return fmt.Errorf("%w: at most %d participants", errInvalidParticipants, maxParticipants)
+	}
+
+	connected, err := connectedUsers(store, c.UserID)
+	if err != nil {
+		return err
+	}
+	seen := map[int]bool{}
+	for _, p := range c.Participants {
+		if seen[p.UserID] {
+			return fmt.Errorf("%w: user %d is listed twice", errInvalidParticipants, p.UserID)
+		}
+		seen[p.UserID] = true
+		if p.UserID != c.UserID && !connected[p.UserID] {
+			return fmt.Errorf("%w: user %d has no share with user %d", errInvalidParticipants, p.UserID, c.UserID)
+		}
+	}
+	return shareAmounts(c)
+}
+
+// shareAmounts works out what each participant of c owes. Amounts that
+// don't divide evenly leave the odd minor units with the first
+// participants.
+func shareAmounts(c *Charge) error {
+	ps := c.Participants
+	total := c.Amount.Minor
+	weights := make([]int64, len(ps)) // parts of 10000 in percent mode
+	switch c.ShareMode {
+	case ShareEqual:
+		for i := range ps {
+			weights[i] = 1
+		}
+	case SharePercent:
+		var sum int64
+		for i, p := range ps {
+			if p.Percent == nil {
+				return fmt.Errorf("%w: user %d needs a percent", errInvalidParticipants, p.UserID)
+			}
+			weights[i] = int64(math.Round(*p.Percent * 100))
+			if weights[i] <= 0 || weights[i] > 10000 {
+				return fmt.Errorf("%w: user %d: percent must be above 0 and at most 100", errInvalidParticipants, p.UserID)
+			}
+			sum += weights[i]
+		}
+		if sum != 10000 {
+			return fmt.Errorf("%w: percents add up to %.2f, not 100", errInvalidParticipants, float64(sum)/100)
+		}
+	case ShareExact:
+		sum := Money{Currency: c.Amount.Currency}
+		for i := range ps {
+			if ps[i].sent != "" {
+				m, err := parseMoney(ps[i].sent.String(), c.Amount.Currency)
+				if err != nil {
+					return fmt.Errorf("%w: user %d: %v", errInvalidParticipants, ps[i].UserID, err)
+				}
+				ps[i].Amount = m
+			}
+			if ps[i].Amount.Minor < 0 || ps[i].Amount.Currency != c.Amount.Currency {
+				return fmt.Errorf("%w: user %d needs an amount of at least 0 in %s", errInvalidParticipants, ps[i].UserID, c.Amount.Currency)
+			}
+			ps[i].Percent, ps[i].sent = nil, ""
+			var err error
+			if sum, err = sum.Add(ps[i].Amount); err != nil {
+				return fmt.Errorf("%w: %v", errInvalidParticipants, err)
+			}
+		}
+		if sum != c.Amount {
+			return fmt.Errorf("%w: the amounts add up to %s, not the charge's %s", errInvalidParticipants, sum, c.Amount)
+		}
+		return nil
+	}
+
+	// total * weight can be past what an int64 holds; the share itself isn't
+	var weightSum, assigned int64
+	for _, w := range weights {
+		weightSum += w
+	}
+	for i := range ps {
+		share := new(big.Int).Mul(big.NewInt(total), big.NewInt(weights[i]))
+		owed := share.Quo(share, big.NewInt(weightSum)).Int64()
+		ps[i].Amount = Money{Minor: owed, Currency: c.Amount.Currency}
+		assigned += owed
+		if c.ShareMode == ShareEqual {
+			ps[i].Percent = nil
+		}
+		ps[i].sent = ""
+	}
+	// Rounding down leaves fewer odd units than there are participants
+	for i := 0; i < len(ps) && assigned < total; i++ {
+		ps[i].Amount.Minor++
+		assigned++
+	}
+	return nil
+}
+
+// owing: the direction of a debt between two users.
+type owing struct{ debtor, creditor int }
+
+// balanceSheet: what users owe each other through shared expenses and
+// settlements, per currency, before netting.
+type balanceSheet map[owing]MoneyTotals
+
+func (b balanceSheet) add(debtor, creditor int, m Money) error {
+	if debtor == creditor {
+		return nil
+	}
+	k := owing{debtor, creditor}
+	if b[k] == nil {
+		b[k] = MoneyTotals{}
+	}
+	return b[k].Add(m)
+}
+
+// addSettlement counts a payment towards what its payer owed.
+func (b balanceSheet) addSettlement(st Settlement) error {
+	return b.add(st.ToUserID, st.FromUserID, st.Amount)
+}
+
+// between returns what other owes userID, net, per currency; negative
+// amounts are what userID owes other.
+func (b balanceSheet) between(userID, other int) (MoneyTotals, error) {
+	net := MoneyTotals{}
+	for _, m := range b[owing{other, userID}] {
+		if err := net.Add(m); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range b[owing{userID, other}] {
+		if err := net.Add(m.Neg()); err != nil {
+			return nil, err
+		}
+	}
+	return net, nil
+}
+
+// loadBalanceSheet collects what ownerID and other users owe each other
+// through shared expenses and settlements, counting only the users in
+// group unless it is nil. Debts between two other users are left out:
+// sharing with both doesn't let ownerID see what they owe each other.
+func loadBalanceSheet(store Store, ownerID int, group map[int]bool) (balanceSheet, error) {
+	charges, err := store.ListSharedCharges(ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying shared expenses: %v", err)
+	}
+	settlements, err := store.ListSettlements(ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying settlements: %v", err)
+	}
+	counts := func(debtor, creditor int) bool {
+		other := debtor
+		if debtor == ownerID {
+			other = creditor
+		} else if creditor != ownerID {
+			return false
+		}
+		return group == nil || group[other]
+	}
+
+	b := balanceSheet{}
+	for _, c := range charges {
+		for _, p := range c.Participants {
+			if !counts(p.UserID, c.UserID) {
+				continue
+			}
+			if err := b.add(p.UserID, c.UserID, p.Amount); err != nil {
+				return nil, fmt.Errorf("Error totaling shared expenses: %w", err)
+			}
+		}
+	}
+	for _, st := range settlements {
+		if !counts(st.ToUserID, st.FromUserID) {
+			continue
+		}
+		if err := b.addSettlement(st); err != nil {
+			return nil, fmt.Errorf("Error totaling settlements: %w", err)
+		}
+	}
+	return b, nil
+}
+
+// Balance: what another user owes the user asking, per currency; negative
+// amounts are owed to them.
+type Balance struct {
+	UserID   int         `json:"user_id"`
+	Username string      `json:"username"`
+	Balance  MoneyTotals `json:"balance"`
+}
+
+// ownerBalances returns the balances of ownerID with every user connected
+// to them or with a balance, by user ID.
+func ownerBalances(store Store, ownerID int) ([]Balance, error) {
+	others, err := connectedUsers(store, ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying shares: %v", err)
+	}
+	b, err := loadBalanceSheet(store, ownerID, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k := range b {
+		others[k.debtor], others[k.creditor] = true, true
+	}
+	delete(others, ownerID)
+
+	balances := []Balance{}
+	for id := range others {
+		u, err := store.GetUser(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		net, err := b.between(ownerID, id)
+		if err != nil {
+			return nil, fmt.Errorf("Error totaling balances: %w", err)
+		}
+		balances = append(balances, Balance{UserID: id, Username: u.Username, Balance: net})
+	}
+	sort.Slice(balances, func(i, j int) bool { return balances[i].UserID < balances[j].UserID })
+	return balances, nil
+}
+
+// GET /api/balances => what each user the JWT user (or ?owner=<id>, read
+// access) shares with owes them through shared expenses, net of
+// settlements, per currency. Negative amounts are owed to that user.
+func (s *Server) getBalancesHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	balances, err := ownerBalances(s.store, ownerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(balances)
+}
+
+// Payment: one step of a settle-up plan.
+type Payment struct {
+	FromUserID int   `json:"from_user_id"`
+	ToUserID   int   `json:"to_user_id"`
+	Amount     Money `json:"-"`
+}
+
+func (p Payment) MarshalJSON() ([]byte, error) {
+	type plain Payment
+	return json.Marshal(struct {
+		plain
+		moneyFields
+	}{plain(p), newMoneyFields(p.Amount)})
+}
+
+// settleUp returns payments that zero every user's net position (positive:
+// owed to them), per currency. Each payment clears the largest debt
+// against the largest credit, so a group of n needs at most n-1 per
+// currency.
+func settleUp(net map[int]MoneyTotals) []Payment {
+	currencies := map[string]bool{}
+	for _, totals := range net {
+		for code := range totals {
+			currencies[code] = true
+		}
+	}
+	codes := make([]string, 0, len(currencies))
+	for code := range currencies {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	type position struct {
+		user  int
+		minor int64
+	}
+	payments := []Payment{}
+	for _, code := range codes {
+		var creditors, debtors []position
+		for user, totals := range net {
+			switch m := totals[code].Minor; {
+			case m > 0:
+				creditors = append(creditors, position{user, m})
+			case m < 0:
+				debtors = append(debtors, position{user, -m})
+			}
+		}
+		largestFirst := func(ps []position) {
+			sort.Slice(ps, func(i, j int) bool {
+				if ps[i].minor != ps[j].minor {
+					return ps[i].minor > ps[j].minor
+				}
+				return ps[i].user < ps[j].user
+			})
+		}
+		for len(creditors) > 0 && len(debtors) > 0 {
+			largestFirst(creditors)
+			largestFirst(debtors)
+			c, d := &creditors[0], &debtors[0]
+			amount := c.minor
+			if d.minor < amount {
+				amount = d.minor
+			}
+			payments = append(payments, Payment{FromUserID: d.user, ToUserID: c.user, Amount: Money{Minor: amount, Currency: code}})
+			c.minor -= amount
+			d.minor -= amount
+			if c.minor == 0 {
+				creditors = creditors[1:]
+			}
+			if d.minor == 0 {
+				debtors = debtors[1:]
+			}
+		}
+	}
+	return payments
+}
+
+// GET /api/balances/settle-up => the fewest payments that settle every
+// debt within a group: the JWT user (or ?owner=<id>, read access) and the
+// users given as ?user_id= (repeat or comma-separate; default everyone
+// they share with). Only what members owe the owner, or the owner owes
+// them, counts; debts between two other members are theirs alone. Also
+// returns each member's net position, positive when they are owed.
+func (s *Server) settleUpHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	connected, err := connectedUsers(s.store, ownerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying shares: %v", err), http.StatusInternalServerError)
+		return
+	}
+	group := map[int]bool{ownerID: true}
+	if values := r.URL.Query()["user_id"]; len(values) > 0 {
+		for _, v := range values {
+			for _, part := range strings.Split(v, ",") {
+				id, err := strconv.Atoi(strings.TrimSpace(part))
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid user_id %q", part), http.StatusBadRequest)
+					return
+				}
+				if id != ownerID && !connected[id] {
+					http.Error(w, fmt.Sprintf("User %d has no share with user %d", id, ownerID), http.StatusBadRequest)
+					return
+				}
+				group[id] = true
+			}
+		}
+	} else {
+		for id := range connected {
+			group[id] = true
+		}
+	}
+
+	b, err := loadBalanceSheet(s.store, ownerID, group)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	net := map[int]MoneyTotals{}
+	for id := range group {
+		net[id] = MoneyTotals{}
+	}
+	for k, totals := range b {
+		for _, m := range totals {
+			if err := net[k.creditor].Add(m); err != nil {
+				http.Error(w, fmt.Sprintf("Error totaling balances: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if err := net[k.debtor].Add(m.Neg()); err != nil {
+				http.Error(w, fmt.Sprintf("Error totaling balances: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	type member struct {
+		UserID int         `json:"user_id"`
+		Net    MoneyTotals `json:"net"`
+	}
+	members := []member{}
+	for id, totals := range net {
+		members = append(members, member{UserID: id, Net: totals})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].UserID < members[j].UserID })
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"members":  members,
+		"payments": settleUp(net),
+	})
+}
+
+// GET /api/settlements => settlements the JWT user (or ?owner=<id>, read
+// access) paid or received, newest first
+func (s *Server) getSettlementsHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	settlements, err := s.store.ListSettlements(ownerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying settlements: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(settlements)
+}
+
+// POST /api/settlements => record that the JWT user (or ?owner=<id>, write
+// access) paid a user they share with. Body:
+// { "to_user_id": 2, "amount": 60, "currency": "EUR", "note": "Dinner" }
+// Without an amount it settles everything they owe that user in the
+// currency.
+func (s *Server) createSettlementHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var st Settlement
+	if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if st.Amount.Minor < 0 {
+		http.Error(w, "amount must be positive", http.StatusBadRequest)
+		return
+	}
+	st.ID = 0
+	st.FromUserID = ownerID
+	st.CreatedAt = ""
+	st.Note = strings.TrimSpace(st.Note)
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		connected, err := connectedUsers(tx, ownerID)
+		if err != nil {
+			return err
+		}
+		if !connected[st.ToUserID] {
+			return fmt.Errorf("%w: user %d has no share with user %d", errInvalidParticipants, st.ToUserID, ownerID)
+		}
+		if st.Amount.Minor == 0 {
+			balances, err := ownerBalances(tx, ownerID)
+			if err != nil {
+				return err
+			}
+			for _, b := range balances {
+				if owed := b.Balance[st.Amount.Currency]; b.UserID == st.ToUserID && owed.Minor < 0 {
+					st.Amount = owed.Neg()
+				}
+			}
+			if st.Amount.Minor == 0 {
+				return fmt.Errorf("%w: nothing owed to user %d", errInvalidParticipants, st.ToUserID)
+			}
+		}
+		if err := tx.CreateSettlement(&st); err != nil {
+			return fmt.Errorf("Error inserting settlement: %v", err)
+		}
+		return audit.record(tx, AuditCreate, "settlement", st.ID, ownerID, nil, st)
+	})
+	if errors.Is(err, errInvalidParticipants) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(st)
+}
+
+// DELETE /api/settlements/{id} => delete a settlement the JWT user (or
+// ?owner=<id>, write access) paid, e.g. one recorded by mistake
+func (s *Server) deleteSettlementHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid settlement ID", http.StatusBadRequest)
+		return
+	}
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, err := tx.GetSettlement(id)
+		if err == nil && before.FromUserID != ownerID {
+			err = ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteSettlement(id); err != nil {
+			return err
+		}
+		return audit.record(tx, AuditDelete, "settlement", id, ownerID, before, nil)
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Settlement not found or not paid by user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting settlement: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Settlement deleted successfully", "owner_id": ownerID})
+}
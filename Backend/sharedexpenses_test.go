@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestShareAmounts(t *testing.T) {
+	tests := []struct {
+		name   string
+		charge string // JSON
+		want   string // what each participant owes, or "" for an error
+	}{
+		{"equal", `{"amount":30.01,"currency":"EUR","share_mode":"equal","participants":[{"user_id":1},{"user_id":2}]}`, "15.01 15.00"},
+		{"equal in thirds", `{"amount":10,"currency":"USD","share_mode":"equal","participants":[{"user_id":1},{"user_id":2},{"user_id":3}]}`, "3.34 3.33 3.33"},
+		{"equal in yen", `{"amount":100,"currency":"JPY","share_mode":"equal","participants":[{"user_id":1},{"user_id":2},{"user_id":3}]}`, "34 33 33"},
+		{"equal ignores percents", `{"amount":10,"currency":"USD","share_mode":"equal","participants":[{"user_id":1,"percent":90},{"user_id":2}]}`, "5.00 5.00"},
+		{"percent", `{"amount":10.01,"currency":"USD","share_mode":"percent","participants":[{"user_id":1,"percent":60},{"user_id":2,"percent":40}]}`, "6.01 4.00"},
+		{"percent with decimals", `{"amount":100,"currency":"USD","share_mode":"percent","participants":[{"user_id":1,"percent":33.33},{"user_id":2,"percent":33.33},{"user_id":3,"percent":33.34}]}`, "33.33 33.33 33.34"},
+		{"percent of the largest amount", `{"amount":"999999999999999.99","currency":"USD","share_mode":"percent","participants":[{"user_id":1,"percent":50},{"user_id":2,"percent":50}]}`, "500000000000000.00 499999999999999.99"},
+		{"equal of the largest amount", `{"amount":"999999999999999","currency":"JPY","share_mode":"equal","participants":[{"user_id":1},{"user_id":2},{"user_id":3}]}`, "333333333333333 333333333333333 333333333333333"},
+		{"percent not adding up", `{"amount":10,"currency":"USD","share_mode":"percent","participants":[{"user_id":1,"percent":60},{"user_id":2,"percent":30}]}`, ""},
+		{"percent missing", `{"amount":10,"currency":"USD","share_mode":"percent","participants":[{"user_id":1,"percent":100},{"user_id":2}]}`, ""},
+		{"percent zero", `{"amount":10,"currency":"USD","share_mode":"percent","participants":[{"user_id":1,"percent":100},{"user_id":2,"percent":0}]}`, ""},
+		{"percent over 100", `{"amount":10,"currency":"USD","share_mode":"percent","participants":[{"user_id":1,"percent":150},{"user_id":2,"percent":-50}]}`, ""},
+		{"exact", `{"amount":10,"currency":"USD","share_mode":"exact","participants":[{"user_id":1,"amount":7.5},{"user_id":2,"amount":2.5}]}`, "7.50 2.50"},
+		{"exact with nothing owed", `{"amount":10,"currency":"USD","share_mode":"exact","participants":[{"user_id":1,"amount":10},{"user_id":2,"amount":0}]}`, "10.00 0.00"},
+		{"exact not adding up", `{"amount":10,"currency":"USD","share_mode":"exact","participants":[{"user_id":1,"amount":7.5},{"user_id":2,"amount":2}]}`, ""},
+		{"exact negative", `{"amount":10,"currency":"USD","share_mode":"exact","participants":[{"user_id":1,"amount":12},{"user_id":2,"amount":-2}]}`, ""},
+		{"exact past the largest amount", `{"amount":10,"currency":"USD","share_mode":"exact","participants":[{"user_id":1,"amount":"999999999999999.99"},{"user_id":2,"amount":"999999999999999.99"}]}`, ""},
+		{"exact too precise", `{"amount":10,"currency":"JPY","share_mode":"exact","participants":[{"user_id":1,"amount":9.5},{"user_id":2,"amount":0.5}]}`, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var c Charge
+			if err := json.Unmarshal([]byte(tc.charge), &c); err != nil {
+				t.Fatal(err)
+			}
+			err := shareAmounts(&c)
+			if tc.want == "" {
+				if !errors.Is(err, errInvalidParticipants) {
+					t.Fatalf("shareAmounts = %v, want errInvalidParticipants", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("shareAmounts: %v", err)
+			}
+			var owed []string
+			for _, p := range c.Participants {
+				if p.Amount.Currency != c.Amount.Currency {
+					t.Fatalf("participant %d owes %s, not %s", p.UserID, p.Amount.Currency, c.Amount.Currency)
+				}
+				owed = append(owed, p.Amount.String())
+			}
+			if got := strings.Join(owed, " "); got != tc.want {
+				t.Fatalf("owed = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBalanceSheet(t *testing.T) {
+	b := balanceSheet{}
+	for _, d := range []struct {
+		debtor, creditor int
+		amount           Money
+	}{
+		{1, 1, mustMoney("10", "EUR")},
+		{2, 1, mustMoney("10", "EUR")},
+		{3, 1, mustMoney("10", "EUR")},
+		{1, 2, mustMoney("4", "EUR")},
+		{1, 2, mustMoney("1", "USD")},
+	} {
+		if err := b.add(d.debtor, d.creditor, d.amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.addSettlement(Settlement{FromUserID: 3, ToUserID: 1, Amount: mustMoney("10", "EUR")}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, other int
+		want        string
+	}{
+		{1, 2, `{"EUR":6.00,"USD":-1.00}`},
+		{2, 1, `{"EUR":-6.00,"USD":1.00}`},
+		{1, 3, `{"EUR":0.00}`},
+		{2, 3, `{}`},
+		{1, 1, `{}`},
+	}
+	for _, tc := range tests {
+		net, err := b.between(tc.user, tc.other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(net)
+		if string(data) != tc.want {
+			t.Fatalf("between(%d, %d) = %s, want %s", tc.user, tc.other, data, tc.want)
+		}
+	}
+}
+
+func TestSettleUp(t *testing.T) {
+	usd := func(s string) MoneyTotals { return MoneyTotals{"USD": mustMoney(s, "USD")} }
+	tests := []struct {
+		name string
+		net  map[int]MoneyTotals
+		want string
+	}{
+		{"nothing owed", map[int]MoneyTotals{1: usd("0"), 2: {}}, ""},
+		{"one debt", map[int]MoneyTotals{1: usd("10"), 2: usd("-10")}, "2>1 10.00 USD"},
+		{"one creditor", map[int]MoneyTotals{1: usd("30"), 2: usd("-20"), 3: usd("-10")}, "2>1 20.00 USD, 3>1 10.00 USD"},
+		{"one debtor", map[int]MoneyTotals{1: usd("15"), 2: usd("5"), 3: usd("-20")}, "3>1 15.00 USD, 3>2 5.00 USD"},
+		{"someone even", map[int]MoneyTotals{1: usd("10"), 2: usd("0"), 3: usd("-10")}, "3>1 10.00 USD"},
+		{"ties by user", map[int]MoneyTotals{1: usd("10"), 2: usd("10"), 3: usd("-10"), 4: usd("-10")}, "3>1 10.00 USD, 4>2 10.00 USD"},
+		{"largest first", map[int]MoneyTotals{1: usd("7"), 2: usd("3"), 3: usd("-4"), 4: usd("-6")}, "4>1 6.00 USD, 3>2 3.00 USD, 3>1 1.00 USD"},
+		{"per currency", map[int]MoneyTotals{
+			1: {"USD": mustMoney("5", "USD"), "EUR": mustMoney("-3", "EUR")},
+			2: {"USD": mustMoney("-5", "USD"), "EUR": mustMoney("3", "EUR")},
+		}, "1>2 3.00 EUR, 2>1 5.00 USD"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			payments := settleUp(tc.net)
+			var got []string
+			left := map[string]int64{} // user/currency => net after paying
+			for user, totals := range tc.net {
+				for code, m := range totals {
+					left[fmt.Sprint(user, code)] = m.Minor
+				}
+			}
+			for _, p := range payments {
+				got = append(got, fmt.Sprintf("%d>%d %s %s", p.FromUserID, p.ToUserID, p.Amount, p.Amount.Currency))
+				left[fmt.Sprint(p.FromUserID, p.Amount.Currency)] += p.Amount.Minor
+				left[fmt.Sprint(p.ToUserID, p.Amount.Currency)] -= p.Amount.Minor
+			}
+			if joined := strings.Join(got, ", "); joined != tc.want {
+				t.Fatalf("settleUp = %s, want %s", joined, tc.want)
+			}
+			for k, minor := range left {
+				if minor != 0 {
+					t.Fatalf("after paying, %s is left with %d", k, minor)
+				}
+			}
+		})
+	}
+}
+
+func TestSharedExpenseStore(t *testing.T) {
+	eachStore(t, testSharedExpenses)
+}
+
+func TestSettleUpAPI(t *testing.T) {
+	eachStore(t, testSettleUpAPI)
+}
+
+// testSettleUpAPI shares expenses among three users through the API and
+// checks the settle-up plans of different groups.
+func testSettleUpAPI(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	alice, bob := at.alice, at.bob
+	carol, c := at.user(RoleUser)
+	for _, u := range []User{bob, carol} {
+		if err := at.a.expectStatus(http.StatusCreated, "POST", "/api/shares", map[string]string{"shareUsername": u.Username, "access": "read"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dinner := map[string]interface{}{"name": "Dinner", "amount": 30, "participants": []map[string]interface{}{
+		{"user_id": alice.ID}, {"user_id": bob.ID}, {"user_id": carol.ID}}}
+	if err := at.a.expectStatus(http.StatusCreated, "POST", "/api/charges", dinner, nil); err != nil {
+		t.Fatal(err)
+	}
+	taxi := map[string]interface{}{"name": "Taxi", "amount": 12, "share_mode": "exact", "participants": []map[string]interface{}{
+		{"user_id": alice.ID, "amount": 12}}}
+	if err := at.b.expectStatus(http.StatusCreated, "POST", "/api/charges", taxi, nil); err != nil {
+		t.Fatal(err)
+	}
+	// bob and carol aren't connected, so can't share expenses until they are
+	snack := map[string]interface{}{"name": "Snack", "amount": 4, "share_mode": "exact", "participants": []map[string]interface{}{
+		{"user_id": bob.ID, "amount": 4}}}
+	if err := c.expectStatus(http.StatusBadRequest, "POST", "/api/charges", snack, nil); err != nil {
+		t.Fatalf("sharing with an unconnected user: %v", err)
+	}
+	if err := c.expectStatus(http.StatusCreated, "POST", "/api/shares", map[string]string{"shareUsername": bob.Username, "access": "read"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.expectStatus(http.StatusCreated, "POST", "/api/charges", snack, nil); err != nil {
+		t.Fatal(err)
+	}
+	dave, _ := at.user(RoleUser)
+
+	// What bob owes carol is between them; alice's plans leave it out
+	names := map[int]string{alice.ID: "alice", bob.ID: "bob", carol.ID: "carol"}
+	tests := []struct {
+		name   string
+		c      *apiClient
+		query  string
+		status int
+		want   string
+	}{
+		{"everyone alice shares with", at.a, "", http.StatusOK, "carol>alice 8.00, carol>bob 2.00"},
+		{"alice and bob", at.a, "?user_id=" + strconv.Itoa(bob.ID), http.StatusOK, "alice>bob 2.00"},
+		{"alice and carol", at.a, "?user_id=" + strconv.Itoa(carol.ID), http.StatusOK, "carol>alice 10.00"},
+		{"everyone bob shares with", at.b, "", http.StatusOK, "alice>carol 2.00, bob>carol 2.00"},
+		{"everyone carol shares with", c, "", http.StatusOK, "bob>alice 4.00, carol>alice 6.00"},
+		{"an unconnected user", at.b, "?user_id=" + strconv.Itoa(dave.ID), http.StatusBadRequest, ""},
+		{"a bad user", at.a, "?user_id=bob", http.StatusBadRequest, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var plan struct {
+				Payments []struct {
+					FromUserID int         `json:"from_user_id"`
+					ToUserID   int         `json:"to_user_id"`
+					Amount     json.Number `json:"amount"`
+				} `json:"payments"`
+			}
+			if err := tc.c.expectStatus(tc.status, "GET", "/api/balances/settle-up"+tc.query, nil, &plan); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range plan.Payments {
+				got = append(got, names[p.FromUserID]+">"+names[p.ToUserID]+" "+string(p.Amount))
+			}
+			sort.Strings(got)
+			if joined := strings.Join(got, ", "); joined != tc.want {
+				t.Fatalf("payments = %s, want %s", joined, tc.want)
+			}
+		})
+	}
+}
+
+func testSharedExpenses(t *testing.T, s Store) {
+	users := make([]User, 3)
+	for i := range users {
+		u, cleanup := testUser(t, s, "secret")
+		defer cleanup()
+		users[i] = u
+	}
+	payer, friend, other := users[0], users[1], users[2]
+
+	pct := 50.0
+	c := Charge{Name: "Dinner", Amount: mustMoney("90", "EUR"), UserID: payer.ID, ShareMode: SharePercent,
+		Participants: []Participant{
+			{UserID: payer.ID, Percent: &pct, Amount: mustMoney("45", "EUR")},
+			{UserID: friend.ID, Amount: mustMoney("30", "EUR")},
+			{UserID: other.ID, Amount: mustMoney("15", "EUR")},
+		}}
+	if err := s.CreateCharge(&c); err != nil {
+		t.Fatalf("CreateCharge: %v", err)
+	}
+	got, err := s.GetCharge(c.ID)
+	if err != nil || got.ShareMode != SharePercent || len(got.Participants) != 3 ||
+		got.Participants[1].UserID != friend.ID || got.Participants[1].Amount.String() != "30.00" ||
+		got.Participants[0].Percent == nil || *got.Participants[0].Percent != 50 {
+		t.Fatalf("GetCharge participants = %q %+v, %v", got.ShareMode, got.Participants, err)
+	}
+	plain := Charge{Name: "Lunch", Amount: mustMoney("10", "EUR"), UserID: friend.ID}
+	if err := s.CreateCharge(&plain); err != nil {
+		t.Fatalf("CreateCharge: %v", err)
+	}
+	for _, u := range users {
+		if shared, err := s.ListSharedCharges(u.ID); err != nil || len(shared) != 1 || shared[0].ID != c.ID {
+			t.Fatalf("ListSharedCharges(%d) = %+v, %v", u.ID, shared, err)
+		}
+	}
+
+	// Deleting a participant's user drops them from the charge
+	if err := s.DeleteUser(other.ID); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if got, err := s.GetCharge(c.ID); err != nil || len(got.Participants) != 2 {
+		t.Fatalf("participants after deleting a user = %+v, %v", got.Participants, err)
+	}
+
+	if err := s.SetChargeParticipants(payer.ID, c.ID, ShareExact, []Participant{
+		{UserID: friend.ID, Amount: mustMoney("90", "EUR")},
+	}); err != nil {
+		t.Fatalf("SetChargeParticipants: %v", err)
+	}
+	if got, err := s.GetCharge(c.ID); err != nil || got.ShareMode != ShareExact || len(got.Participants) != 1 || got.Participants[0].Percent != nil {
+		t.Fatalf("replaced participants = %q %+v, %v", got.ShareMode, got.Participants, err)
+	}
+	if err := s.SetChargeParticipants(friend.ID, c.ID, ShareEqual, nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("SetChargeParticipants for another owner: got %v, want ErrNotFound", err)
+	}
+
+	st := Settlement{FromUserID: friend.ID, ToUserID: payer.ID, Amount: mustMoney("40", "EUR"), Note: "Dinner"}
+	if err := s.CreateSettlement(&st); err != nil || st.ID == 0 || st.CreatedAt == "" {
+		t.Fatalf("CreateSettlement = %+v, %v", st, err)
+	}
+	if got, err := s.GetSettlement(st.ID); err != nil || got.Amount != st.Amount || got.Note != "Dinner" {
+		t.Fatalf("GetSettlement = %+v, %v", got, err)
+	}
+	for _, u := range []User{payer, friend} {
+		if list, err := s.ListSettlements(u.ID); err != nil || len(list) != 1 || list[0].ID != st.ID {
+			t.Fatalf("ListSettlements(%d) = %+v, %v", u.ID, list, err)
+		}
+	}
+	if err := s.DeleteSettlement(st.ID); err != nil {
+		t.Fatalf("DeleteSettlement: %v", err)
+	}
+	if _, err := s.GetSettlement(st.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetSettlement after delete: got %v, want ErrNotFound", err)
+	}
+
+	if err := s.SetChargeParticipants(payer.ID, c.ID, ShareEqual, nil); err != nil {
+		t.Fatalf("SetChargeParticipants(nil): %v", err)
+	}
+	if got, err := s.GetCharge(c.ID); err != nil || got.ShareMode != "" || got.Participants != nil {
+		t.Fatalf("charge after unsharing = %q %+v, %v", got.ShareMode, got.Participants, err)
+	}
+}
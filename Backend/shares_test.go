@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestParseAccessLevel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want AccessLevel
+		ok   bool
+	}{
+		{"read", AccessRead, true},
+		{" Read ", AccessRead, true},
+		{"read-only", AccessRead, true},
+		{"write", AccessWrite, true},
+		{"edit", AccessWrite, true},
+		{"ADMIN", AccessAdmin, true},
+		{"", "", false},
+		{"owner", "", false},
+	}
+	for _, tc := range tests {
+		got, err := parseAccessLevel(tc.in)
+		if got != tc.want || (err == nil) != tc.ok {
+			t.Fatalf("parseAccessLevel(%q) = %q, %v; want %q, ok %v", tc.in, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestAccessLevelAllows(t *testing.T) {
+	levels := []AccessLevel{AccessRead, AccessWrite, AccessAdmin}
+	for i, have := range levels {
+		for j, need := range levels {
+			if got := have.allows(need); got != (i >= j) {
+				t.Fatalf("%s.allows(%s) = %v", have, need, got)
+			}
+		}
+		if have.allows("") || have.allows("owner") {
+			t.Fatalf("%s allows an unknown level", have)
+		}
+	}
+	if AccessLevel("").allows(AccessRead) {
+		t.Fatalf("no access allows reading")
+	}
+}
+
+func TestShareStore(t *testing.T) {
+	eachStore(t, testShares)
+}
+
+func TestShareAccess(t *testing.T) {
+	eachStore(t, testShareAccess)
+}
+
+// testShareAccess checks what each access level lets a grantee do with the
+// owner's data.
+func testShareAccess(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	a, b := at.a, at.b
+	owner := "?owner=" + strconv.Itoa(at.alice.ID)
+	budget := map[string]interface{}{"name": "Food", "amount": 100}
+
+	tests := []struct {
+		access             string // "" for no share
+		read, write, admin int
+	}{
+		{"", http.StatusForbidden, http.StatusForbidden, http.StatusForbidden},
+		{"read", http.StatusOK, http.StatusForbidden, http.StatusForbidden},
+		{"write", http.StatusOK, http.StatusCreated, http.StatusForbidden},
+		{"admin", http.StatusOK, http.StatusCreated, http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run("access "+tc.access, func(t *testing.T) {
+			if tc.access != "" {
+				share := map[string]string{"shareUsername": at.bob.Username, "access": tc.access}
+				if err := a.expectStatus(http.StatusCreated, "POST", "/api/shares", share, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := b.expectStatus(tc.read, "GET", "/api/budgets"+owner, nil, nil); err != nil {
+				t.Fatalf("listing budgets: %v", err)
+			}
+			if err := b.expectStatus(tc.write, "POST", "/api/budgets"+owner, budget, nil); err != nil {
+				t.Fatalf("creating a budget: %v", err)
+			}
+			if err := b.expectStatus(tc.admin, "GET", "/api/shares"+owner, nil, nil); err != nil {
+				t.Fatalf("listing shares: %v", err)
+			}
+		})
+	}
+
+	// Sharing again changed the access of the one share
+	var shares []Share
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/shares", nil, &shares); err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 1 || shares[0].Access != AccessAdmin {
+		t.Fatalf("shares = %+v, want one admin share", shares)
+	}
+	for _, bad := range []map[string]string{
+		{"shareUsername": at.bob.Username, "access": "owner"},
+		{"shareUsername": at.alice.Username, "access": "read"},
+	} {
+		if err := a.expectStatus(http.StatusBadRequest, "POST", "/api/shares", bad, nil); err != nil {
+			t.Fatalf("share %v: %v", bad, err)
+		}
+	}
+	if err := a.expectStatus(http.StatusNotFound, "POST", "/api/shares", map[string]string{"shareUsername": "nobody-" + at.bob.Username, "access": "read"}, nil); err != nil {
+		t.Fatalf("sharing with an unknown user: %v", err)
+	}
+
+	// The grantee may end the share; after that they are shut out again
+	sharePath := "/api/shares/" + strconv.Itoa(shares[0].ID)
+	if err := b.expectStatus(http.StatusOK, "DELETE", sharePath, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.expectStatus(http.StatusForbidden, "GET", "/api/budgets"+owner, nil, nil); err != nil {
+		t.Fatalf("after deleting the share: %v", err)
+	}
+	if _, err := s.GetShare(shares[0].ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetShare after delete: got %v, want ErrNotFound", err)
+	}
+}
+
+func testShares(t *testing.T, s Store) {
+	owner, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+	grantee, cleanupGrantee := testUser(t, s, "secret")
+	defer cleanupGrantee()
+
+	sh := Share{UserID: owner.ID, UserShareID: grantee.ID, Access: AccessRead}
+	if err := s.PutShare(&sh); err != nil {
+		t.Fatalf("PutShare: %v", err)
+	}
+	again := Share{UserID: owner.ID, UserShareID: grantee.ID, Access: AccessWrite}
+	if err := s.PutShare(&again); err != nil || again.ID != sh.ID {
+		t.Fatalf("PutShare of an existing pair = id %d, %v; want id %d", again.ID, err, sh.ID)
+	}
+	if got, err := s.FindShare(owner.ID, grantee.ID); err != nil || got.Access != AccessWrite {
+		t.Fatalf("FindShare = %+v, %v", got, err)
+	}
+	if _, err := s.FindShare(grantee.ID, owner.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("FindShare of the reverse pair: got %v, want ErrNotFound", err)
+	}
+	for _, id := range []int{owner.ID, grantee.ID} {
+		if shares, err := s.ListShares(id); err != nil || len(shares) != 1 {
+			t.Fatalf("ListShares(%d) = %+v, %v", id, shares, err)
+		}
+	}
+	if err := s.DeleteShare(sh.ID); err != nil {
+		t.Fatalf("DeleteShare: %v", err)
+	}
+	if _, err := s.GetShare(sh.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetShare after delete: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// --------------------------
+//       Charge Splits
+// --------------------------
+
+// ChargeSplit: one line of a charge split across categories, e.g. the
+// household supplies on a supermarket receipt. Its amount is in the
+// charge's currency, so only "amount" is sent. Category is the path of the
+// category CategoryID refers to, as for charges.
+type ChargeSplit struct {
+	Amount     Money  `json:"-"`
+	Category   string `json:"category"`
+	CategoryID *int   `json:"category_id"`
+	Note       string `json:"note,omitempty"`
+
+	sent json.Number // amount as sent, until parseSplits reads it
+}
+
+// maxSplits caps the lines of one charge.
+const maxSplits = 50
+
+// errInvalidSplit: split lines that don't make up their charge.
+var errInvalidSplit = errors.New("invalid split")
+
+func (sp ChargeSplit) MarshalJSON() ([]byte, error) {
+	type plain ChargeSplit
+	return json.Marshal(struct {
+		plain
+		Amount json.Number `json:"amount"`
+	}{plain(sp), sp.Amount.Number()})
+}
+
+func (sp *ChargeSplit) UnmarshalJSON(data []byte) error {
+	type plain ChargeSplit
+	aux := struct {
+		*plain
+		Amount json.Number `json:"amount"`
+	}{plain: (*plain)(sp)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	sp.sent = aux.Amount
+	return nil
+}
+
+// parseSplits reads the amounts of c's split lines as sent, in c's currency.
+func parseSplits(c *Charge) error {
+	for i := range c.Splits {
+		m, err := parseMoney(c.Splits[i].sent.String(), c.Amount.Currency)
+		if err != nil {
+			return fmt.Errorf("%w: line %d: %v", errInvalidSplit, i+1, err)
+		}
+		c.Splits[i].Amount = m
+	}
+	return nil
+}
+
+// checkSplits verifies that c's split lines, if any, are positive and add
+// up to its amount. A split charge's own category is cleared: its lines
+// carry the categories.
+func checkSplits(c *Charge) error {
+	if len(c.Splits) == 0 {
+		c.Splits = nil
+		return nil
+	}
+	if len(c.Splits) < 2 || len(c.Splits) > maxSplits {
+		return fmt.Errorf("%w: a split has 2 to %d lines", errInvalidSplit, maxSplits)
+	}
+	total := Money{Currency: c.Amount.Currency}
+	for i, sp := range c.Splits {
+		if sp.Amount.Minor <= 0 {
+			return fmt.Errorf("%w: line %d: amount must be positive", errInvalidSplit, i+1)
+		}
+		var err error
+		if total, err = total.Add(sp.Amount); err != nil {
+			return fmt.Errorf("%w: line %d: %v", errInvalidSplit, i+1, err)
+		}
+	}
+	if total != c.Amount {
+		return fmt.Errorf("%w: the lines add up to %s, not the charge's %s", errInvalidSplit, total, c.Amount)
+	}
+	c.CategoryID, c.Category = nil, ""
+	return nil
+}
+
+// resolveSplitCategories resolves the categories of c's split lines like
+// the charge's own (see categoryTree.resolve).
+func resolveSplitCategories(tx Store, t *categoryTree, c *Charge, src auditSource) error {
+	for i := range c.Splits {
+		sp := &c.Splits[i]
+		var err error
+		if sp.CategoryID, sp.Category, err = t.resolve(tx, sp.CategoryID, sp.Category, src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spendingLine: part of a charge's spending filed under one category.
+type spendingLine struct {
+	CategoryID *int
+	Amount     Money
+}
+
+// spendingLines splits what c adds to spending (see spendingOf) by
+// category: one line per split line, or the whole charge when it isn't
+// split. Income and transfers have none.
+func spendingLines(c Charge) []spendingLine {
+	spent, ok := spendingOf(c)
+	if !ok {
+		return nil
+	}
+	if len(c.Splits) == 0 {
+		return []spendingLine{{CategoryID: c.CategoryID, Amount: spent}}
+	}
+	lines := make([]spendingLine, len(c.Splits))
+	for i, sp := range c.Splits {
+		amount := sp.Amount
+		if c.Direction == DirectionRefund {
+			amount = amount.Neg()
+		}
+		lines[i] = spendingLine{CategoryID: sp.CategoryID, Amount: amount}
+	}
+	return lines
+}
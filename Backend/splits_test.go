@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSplits(t *testing.T) {
+	tests := []struct {
+		body    string
+		amounts string
+		ok      bool
+	}{
+		{`{"amount":10,"currency":"USD","splits":[{"amount":7.5},{"amount":"2.50"}]}`, "7.50 2.50", true},
+		{`{"amount":1000,"currency":"JPY","splits":[{"amount":600},{"amount":400}]}`, "600 400", true},
+		{`{"amount":10,"currency":"JPY","splits":[{"amount":9.5},{"amount":0.5}]}`, "", false},
+		{`{"amount":10,"currency":"USD","splits":[{"amount":5},{}]}`, "5.00 0.00", true},
+	}
+	for _, tc := range tests {
+		var c Charge
+		if err := json.Unmarshal([]byte(tc.body), &c); err != nil {
+			t.Fatal(err)
+		}
+		err := parseSplits(&c)
+		if (err == nil) != tc.ok || (err != nil && !errors.Is(err, errInvalidSplit)) {
+			t.Fatalf("parseSplits(%s) = %v, want ok %v", tc.body, err, tc.ok)
+		}
+		if !tc.ok {
+			continue
+		}
+		var amounts []string
+		for _, sp := range c.Splits {
+			amounts = append(amounts, sp.Amount.String())
+		}
+		if got := strings.Join(amounts, " "); got != tc.amounts {
+			t.Fatalf("parseSplits(%s) amounts = %s, want %s", tc.body, got, tc.amounts)
+		}
+	}
+}
+
+func TestCheckSplits(t *testing.T) {
+	lines := func(amounts ...string) []ChargeSplit {
+		var splits []ChargeSplit
+		for _, a := range amounts {
+			splits = append(splits, ChargeSplit{Amount: mustMoney(a, "USD")})
+		}
+		return splits
+	}
+	tooMany := make([]string, maxSplits+1)
+	for i := range tooMany {
+		tooMany[i] = "1"
+	}
+	tests := []struct {
+		name   string
+		splits []ChargeSplit
+		amount string
+		ok     bool
+	}{
+		{"not split", nil, "10", true},
+		{"empty", []ChargeSplit{}, "10", true},
+		{"two lines", lines("7.50", "2.50"), "10", true},
+		{"one line", lines("10"), "10", false},
+		{"too many lines", lines(tooMany...), "51", false},
+		{"short", lines("7.50", "2"), "10", false},
+		{"over", lines("7.50", "3"), "10", false},
+		{"zero line", lines("10", "0"), "10", false},
+		{"negative line", lines("11", "-1"), "10", false},
+		{"another currency", append(lines("5"), ChargeSplit{Amount: mustMoney("5", "EUR")}), "10", false},
+	}
+	for _, tc := range tests {
+		categoryID := 4
+		c := Charge{Amount: mustMoney(tc.amount, "USD"), Category: "Food", CategoryID: &categoryID, Splits: tc.splits}
+		err := checkSplits(&c)
+		if (err == nil) != tc.ok || (err != nil && !errors.Is(err, errInvalidSplit)) {
+			t.Fatalf("%s: checkSplits = %v, want ok %v", tc.name, err, tc.ok)
+		}
+		split := len(tc.splits) > 0
+		if tc.ok && (split != (c.CategoryID == nil && c.Category == "") || (!split && c.Splits != nil)) {
+			t.Fatalf("%s: after checkSplits = %+v", tc.name, c)
+		}
+	}
+}
+
+func TestSpendingLines(t *testing.T) {
+	food, home := 1, 2
+	splits := []ChargeSplit{{Amount: mustMoney("30", "USD"), CategoryID: &food}, {Amount: mustMoney("10", "USD"), CategoryID: &home}}
+	tests := []struct {
+		name   string
+		charge Charge
+		want   string
+	}{
+		{"an expense", Charge{Direction: DirectionExpense, CategoryID: &food}, "1:40.00"},
+		{"uncategorized", Charge{Direction: DirectionExpense}, "-:40.00"},
+		{"a split expense", Charge{Direction: DirectionExpense, Splits: splits}, "1:30.00 2:10.00"},
+		{"a split refund", Charge{Direction: DirectionRefund, Splits: splits}, "1:-30.00 2:-10.00"},
+		{"income", Charge{Direction: DirectionIncome, Splits: splits}, ""},
+	}
+	for _, tc := range tests {
+		tc.charge.Amount = mustMoney("40", "USD")
+		var got []string
+		for _, line := range spendingLines(tc.charge) {
+			category := "-"
+			if line.CategoryID != nil {
+				category = strconv.Itoa(*line.CategoryID)
+			}
+			got = append(got, category+":"+line.Amount.String())
+		}
+		if joined := strings.Join(got, " "); joined != tc.want {
+			t.Fatalf("spendingLines(%s) = %s, want %s", tc.name, joined, tc.want)
+		}
+	}
+}
+
+func TestChargeSplitStore(t *testing.T) {
+	eachStore(t, testChargeSplits)
+}
+
+func TestSplitCharges(t *testing.T) {
+	eachStore(t, testSplitCharges)
+}
+
+// testSplitCharges creates split charges through the API and checks that
+// the category report counts them per line.
+func testSplitCharges(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	a := at.a
+
+	tests := []struct {
+		name   string
+		charge map[string]interface{}
+		status int
+	}{
+		{"a split", map[string]interface{}{"name": "Supermarket", "amount": 50, "category": "Ignored",
+			"splits": []map[string]interface{}{{"amount": 35, "category": "Food/Groceries"}, {"amount": 15, "category": "Household", "note": "Soap"}}}, http.StatusCreated},
+		{"a split refund", map[string]interface{}{"name": "Returned soap", "amount": 5, "direction": "refund",
+			"splits": []map[string]interface{}{{"amount": 2, "category": "Food/Groceries"}, {"amount": 3, "category": "Household"}}}, http.StatusCreated},
+		{"a plain charge", map[string]interface{}{"name": "Lunch", "amount": 10, "category": "Food"}, http.StatusCreated},
+		{"lines not adding up", map[string]interface{}{"name": "Market", "amount": 50,
+			"splits": []map[string]interface{}{{"amount": 35, "category": "Food"}, {"amount": 5, "category": "Household"}}}, http.StatusBadRequest},
+		{"a single line", map[string]interface{}{"name": "Market", "amount": 50,
+			"splits": []map[string]interface{}{{"amount": 50, "category": "Food"}}}, http.StatusBadRequest},
+		{"a bad category", map[string]interface{}{"name": "Market", "amount": 50,
+			"splits": []map[string]interface{}{{"amount": 25, "category": "Food"}, {"amount": 25, "category": "Food/" + strings.Repeat("x", 101)}}}, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var c Charge
+			if err := a.expectStatus(tc.status, "POST", "/api/charges", tc.charge, &c); err != nil {
+				t.Fatal(err)
+			}
+			if tc.status == http.StatusCreated && tc.charge["splits"] != nil && (c.CategoryID != nil || len(c.Splits) != 2 || c.Splits[0].CategoryID == nil) {
+				t.Fatalf("split charge = %+v", c)
+			}
+		})
+	}
+
+	var report struct {
+		Categories []struct {
+			Path     string                 `json:"path"`
+			Total    map[string]json.Number `json:"total"`
+			RolledUp map[string]json.Number `json:"rolled_up"`
+		} `json:"categories"`
+	}
+	if err := a.expectStatus(http.StatusOK, "GET", "/api/reports/categories", nil, &report); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range report.Categories {
+		got = append(got, c.Path+" "+string(c.Total["USD"])+"/"+string(c.RolledUp["USD"]))
+	}
+	if joined := strings.Join(got, ", "); joined != "Food 10.00/43.00, Food > Groceries 33.00/33.00, Household 12.00/12.00" {
+		t.Fatalf("category report = %s", joined)
+	}
+}
+
+func testChargeSplits(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	cats := map[string]int{}
+	for _, name := range []string{"Groceries", "Household", "Gifts"} {
+		c := Category{Name: name, UserID: u.ID}
+		if err := s.CreateCategory(&c); err != nil {
+			t.Fatalf("CreateCategory: %v", err)
+		}
+		cats[name] = c.ID
+	}
+	line := func(amount, category string) ChargeSplit {
+		id := cats[category]
+		return ChargeSplit{Amount: mustMoney(amount, "USD"), Category: category, CategoryID: &id}
+	}
+	c := Charge{Name: "Supermarket", Amount: mustMoney("60", "USD"), UserID: u.ID, CreatedAt: "2024-05-01T12:00:00Z",
+		Splits: []ChargeSplit{line("40", "Groceries"), line("15", "Household"), line("5", "Gifts")}}
+	if err := s.CreateCharge(&c); err != nil {
+		t.Fatalf("CreateCharge: %v", err)
+	}
+	got, err := s.GetCharge(c.ID)
+	if err != nil || len(got.Splits) != 3 || got.Splits[1].Category != "Household" || got.Splits[1].Amount.String() != "15.00" {
+		t.Fatalf("GetCharge splits = %+v, %v", got.Splits, err)
+	}
+
+	// Lists filtered on a category find charges with a line in it
+	found, err := s.ListCharges(&ListFilter{OwnerID: u.ID, CategoryIDs: []int{cats["Household"]}})
+	if err != nil || len(found) != 1 || found[0].ID != c.ID {
+		t.Fatalf("ListCharges(category=Household) = %+v, %v", found, err)
+	}
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	spent, err := sumChargesByCurrency(s, u.ID, []int{cats["Household"], cats["Gifts"]}, start, start.AddDate(0, 1, 0))
+	if err != nil || spent["USD"].String() != "20.00" {
+		t.Fatalf("Household and Gifts spending = %v, %v; want 20.00", spent, err)
+	}
+
+	household := Category{ID: cats["Household"], Name: "Home", UserID: u.ID}
+	if err := s.UpdateCategory(household); err != nil {
+		t.Fatalf("UpdateCategory: %v", err)
+	}
+	if err := s.DeleteCategory(u.ID, cats["Gifts"]); err != nil {
+		t.Fatalf("DeleteCategory: %v", err)
+	}
+	got, err = s.GetCharge(c.ID)
+	if err != nil || got.Splits[1].Category != "Home" || got.Splits[2].CategoryID != nil || got.Splits[2].Category != "" {
+		t.Fatalf("splits after renaming and deleting categories = %+v, %v", got.Splits, err)
+	}
+
+	if err := s.SetChargeSplits(u.ID, c.ID, []ChargeSplit{line("30", "Groceries"), line("30", "Groceries")}); err != nil {
+		t.Fatalf("SetChargeSplits: %v", err)
+	}
+	if got, err := s.GetCharge(c.ID); err != nil || len(got.Splits) != 2 || got.Splits[0].Amount.String() != "30.00" {
+		t.Fatalf("replaced splits = %+v, %v", got.Splits, err)
+	}
+	if err := s.SetChargeSplits(u.ID, c.ID, nil); err != nil {
+		t.Fatalf("SetChargeSplits(nil): %v", err)
+	}
+	if got, err := s.GetCharge(c.ID); err != nil || len(got.Splits) != 0 {
+		t.Fatalf("splits after removing them = %+v, %v", got.Splits, err)
+	}
+	if err := s.SetChargeSplits(u.ID+1, c.ID, nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("SetChargeSplits for another owner: got %v, want ErrNotFound", err)
+	}
+}
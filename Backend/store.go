@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// --------------------------
+//          Storage
+// --------------------------
+
+// Store is everything the handlers need to persist. postgresStore is the
+// production implementation and memoryStore an in-process one for running
+// the API without a database; store_test.go holds the contract both meet.
+type Store interface {
+	// Tx runs fn against a Store whose changes are all applied, or none are
+	// if fn returns an error. Calling Tx inside fn joins the outer transaction.
+	Tx(fn func(Store) error) error
+
+	// Users. Usernames are unique (ErrConflict).
+	// ListUsers locks the users when run in a transaction.
+	ListUsers() ([]User, error)
+	GetUser(id int) (User, error)
+	GetUserByUsername(username string) (User, error)
+	CreateUser(u *User) error
+	UpdateUser(u User) error
+	// DeleteUser also deletes everything the user owns.
+	DeleteUser(id int) error
+
+	// Access and refresh tokens
+	CreateRefreshToken(t *RefreshToken) error
+	// GetRefreshToken looks a token up by hash. Like GetBudget and GetCharge
+	// it locks the row for the rest of the transaction.
+	GetRefreshToken(hash string) (RefreshToken, error)
+	RevokeRefreshToken(id int) error
+	// RevokeUserTokens revokes every refresh token of the user and every
+	// access token issued to them until now, by moving them on to the next
+	// token generation.
+	RevokeUserTokens(userID int) error
+	// TokenGeneration is the generation new access tokens of the user carry.
+	TokenGeneration(userID int) (int, error)
+	// RevokeAccessToken records a revoked jti until it expires, forgetting
+	// revocations that already have.
+	RevokeAccessToken(jti string, userID int, expires time.Time) error
+	TokenRevocation(userID int, jti string) (TokenRevocation, error)
+
+	// Login throttling, keyed by "user:<username>" or "ip:<address>".
+	// GetLoginThrottle reports ErrNotFound for a key without failures.
+	GetLoginThrottle(key string) (LoginThrottle, error)
+	// RecordLoginFailure counts a failure of key at at and returns its new
+	// state, first forgetting keys whose last failure was before since.
+	RecordLoginFailure(key string, at, since time.Time) (LoginThrottle, error)
+	// ClearLoginThrottle forgets a key's failures, if it has any.
+	ClearLoginThrottle(key string) error
+	// LockLoginThrottle holds key for the rest of the transaction, so that
+	// concurrent logins under it check and count failures one at a time.
+	LockLoginThrottle(key string) error
+	// Login attempts are only ever appended. RecordLoginAttempt sets ID and
+	// CreatedAt; ListLoginAttempts returns them newest first.
+	RecordLoginAttempt(a *LoginAttempt) error
+	ListLoginAttempts(f *LoginAttemptFilter) ([]LoginAttempt, error)
+
+	// Two-factor authentication. GetTwoFactor reports ErrNotFound for a user
+	// without settings, and locks them for the rest of the transaction.
+	GetTwoFactor(userID int) (TwoFactor, error)
+	// PutTwoFactor creates or replaces the user's settings.
+	PutTwoFactor(t TwoFactor) error
+	// Recovery codes are kept by hash. SetRecoveryCodes replaces the user's;
+	// UseRecoveryCode deletes one, reporting ErrNotFound if they don't have it.
+	SetRecoveryCodes(userID int, hashes []string) error
+	UseRecoveryCode(userID int, hash string) error
+	CountRecoveryCodes(userID int) (int, error)
+	// Login challenges, looked up by hash. DeleteLoginChallenge also forgets
+	// expired ones.
+	CreateLoginChallenge(c *LoginChallenge) error
+	GetLoginChallenge(hash string) (LoginChallenge, error)
+	DeleteLoginChallenge(id int) error
+	// Password reset tokens, looked up by hash. CreatePasswordReset also
+	// forgets expired ones; GetPasswordReset locks the one it finds.
+	CreatePasswordReset(pr *PasswordReset) error
+	GetPasswordReset(hash string) (PasswordReset, error)
+	DeletePasswordResets(userID int) error
+	// Invite codes, looked up by hash and listed newest first. UseInvite
+	// reports ErrNotFound if the invite is missing or already used.
+	CreateInvite(i *Invite) error
+	ListInvites() ([]Invite, error)
+	GetInvite(hash string) (Invite, error)
+	UseInvite(id, userID int) error
+	DeleteInvite(id int) error
+
+	// Categories, scoped to their owner. Sibling names are unique regardless
+	// of case (ErrConflict).
+	ListCategories(ownerID int) ([]Category, error)
+	GetCategory(id int) (Category, error)
+	CreateCategory(c *Category) error
+	// UpdateCategory renames or moves a category and rewrites the category
+	// path of the budgets and charges filed under it or its descendants.
+	UpdateCategory(c Category) error
+	// DeleteCategory fails with ErrConflict while the category has children;
+	// budgets and charges filed under it become uncategorized.
+	DeleteCategory(ownerID, id int) error
+
+	// Accounts, scoped to their owner. Names are unique regardless of case
+	// (ErrConflict).
+	ListAccounts(ownerID int) ([]Account, error)
+	// GetAccount locks the account for the rest of the transaction.
+	GetAccount(id int) (Account, error)
+	CreateAccount(a *Account) error
+	UpdateAccount(a Account) error
+	// DeleteAccount fails with ErrConflict while charges are posted to it.
+	DeleteAccount(ownerID, id int) error
+
+	// Budgets, scoped to their owner
+	ListBudgets(f *ListFilter) ([]Budget, error)
+	GetBudget(id int) (Budget, error)
+	// CreateBudget sets ID and CreatedAt.
+	CreateBudget(b *Budget) error
+	UpdateBudget(b Budget) error
+	DeleteBudget(ownerID, id int) error
+
+	// Budget snapshots: one per closed period of a budget, keyed by the
+	// period's start, oldest first. Deleting the budget deletes them.
+	ListBudgetSnapshots(budgetID int) ([]BudgetSnapshot, error)
+	// PutBudgetSnapshot creates or replaces the snapshot of its period.
+	PutBudgetSnapshot(sn BudgetSnapshot) error
+	// DeleteBudgetSnapshots deletes those of periods starting at from or later.
+	DeleteBudgetSnapshots(budgetID int, from time.Time) error
+
+	// Charges, scoped to their owner
+	ListCharges(f *ListFilter) ([]Charge, error)
+	GetCharge(id int) (Charge, error)
+	// CreateCharge sets ID, and CreatedAt when it is empty.
+	CreateCharge(c *Charge) error
+	// UpdateCharge leaves the charge's tags and split lines alone.
+	UpdateCharge(c Charge) error
+	DeleteCharge(ownerID, id int) error
+	// SetChargeSplits replaces the split lines of a charge of the owner.
+	// CreateCharge and PostOccurrence store a new charge's Splits.
+	SetChargeSplits(ownerID, chargeID int, splits []ChargeSplit) error
+	// SetChargeParticipants replaces the share mode and participants of a
+	// charge of the owner. CreateCharge and PostOccurrence store a new
+	// charge's.
+	SetChargeParticipants(ownerID, chargeID int, mode string, participants []Participant) error
+	// ListSharedCharges returns the shared expenses the user paid or takes
+	// part in, oldest first.
+	ListSharedCharges(userID int) ([]Charge, error)
+
+	// Tags on charges, scoped to their owner. CreateCharge and
+	// PostOccurrence store a new charge's Tags; these change them after.
+	ListTags(ownerID int) ([]Tag, error)
+	// TagCharges adds tags to those of chargeIDs the owner has and
+	// UntagCharges removes them. Neither minds tags a charge already has
+	// (or lacks).
+	TagCharges(ownerID int, chargeIDs []int, tags []string) error
+	UntagCharges(ownerID int, chargeIDs []int, tags []string) error
+
+	// Transfers link the two legs of money moved between the owner's
+	// accounts. Stores keep only the link (ID, UserID and the legs' IDs);
+	// each leg's TransferID names its transfer. A charge is a leg of at most
+	// one transfer (ErrConflict), and deleting a leg deletes the link.
+	ListTransfers(ownerID int) ([]Transfer, error)
+	// GetTransfer locks the transfer for the rest of the transaction.
+	GetTransfer(id int) (Transfer, error)
+	CreateTransfer(t *Transfer) error
+	DeleteTransfer(ownerID, id int) error
+
+	// Savings goals, scoped to their owner, by target date. Deleting a
+	// goal deletes its contributions; deleting its account unlinks it.
+	ListGoals(ownerID int) ([]Goal, error)
+	// GetGoal locks the goal for the rest of the transaction.
+	GetGoal(id int) (Goal, error)
+	// CreateGoal sets ID and CreatedAt.
+	CreateGoal(g *Goal) error
+	UpdateGoal(g Goal) error
+	DeleteGoal(ownerID, id int) error
+	// ListContributions returns a goal's contributions, oldest first.
+	ListContributions(goalID int) ([]Contribution, error)
+	// CreateContribution sets ID, and CreatedAt when it is empty.
+	CreateContribution(c *Contribution) error
+	DeleteContribution(goalID, id int) error
+
+	// Envelope budgeting, scoped to the owner. GetEnvelopeMode reports
+	// ErrNotFound while the mode is off, and locks the settings for the
+	// rest of the transaction.
+	GetEnvelopeMode(userID int) (EnvelopeMode, error)
+	// PutEnvelopeMode turns the mode on, setting CreatedAt, or changes it.
+	PutEnvelopeMode(m *EnvelopeMode) error
+	DeleteEnvelopeMode(userID int) error
+	// Envelopes draw on one category each, and a category has at most one
+	// (ErrConflict). Deleting the category leaves its envelope on none.
+	ListEnvelopes(ownerID int) ([]Envelope, error)
+	GetEnvelope(id int) (Envelope, error)
+	// CreateEnvelope sets ID and CreatedAt.
+	CreateEnvelope(e *Envelope) error
+	UpdateEnvelope(e Envelope) error
+	// DeleteEnvelope puts the pool in the envelope's place in its moves.
+	DeleteEnvelope(ownerID, id int) error
+	// ListEnvelopeMoves returns the owner's moves by month, oldest first.
+	ListEnvelopeMoves(ownerID int) ([]EnvelopeMove, error)
+	// CreateEnvelopeMove sets ID and CreatedAt.
+	CreateEnvelopeMove(m *EnvelopeMove) error
+
+	// Recurring charge templates
+	SetRecurrence(chargeID, seq int, next *time.Time) error
+	// LastOccurrence returns when the latest charge posted from a template
+	// was created, or nil if none has been. Deleting that charge doesn't
+	// change it.
+	LastOccurrence(templateID int) (*time.Time, error)
+	// DueTemplates returns up to limit templates due by now, locked for the
+	// transaction and skipping ones another transaction holds.
+	DueTemplates(now time.Time, limit int) ([]RecurringTemplate, error)
+	ListRecurringTemplates(ownerID int) ([]RecurringTemplate, error)
+	// PostOccurrence creates c as the occurrence of its template on date,
+	// reporting false if that occurrence already exists.
+	PostOccurrence(c *Charge, date string) (bool, error)
+
+	// Shares: UserID is the owner, UserShareID the grantee
+	ListShares(userID int) ([]Share, error)
+	GetShare(id int) (Share, error)
+	FindShare(ownerID, granteeID int) (Share, error)
+	// PutShare creates the owner/grantee share or updates its access.
+	PutShare(s *Share) error
+	DeleteShare(id int) error
+
+	// Settlements between users. ListSettlements returns those the user
+	// paid or received, newest first.
+	ListSettlements(userID int) ([]Settlement, error)
+	GetSettlement(id int) (Settlement, error)
+	// CreateSettlement sets ID, and CreatedAt when it is empty.
+	CreateSettlement(st *Settlement) error
+	DeleteSettlement(id int) error
+
+	// Audit log. Events are only ever appended.
+	RecordAudit(e *AuditEvent) error
+	ListAudit(f *AuditFilter) ([]AuditEvent, error)
+}
+
+var (
+	// ErrNotFound: no row matched (or it belongs to someone else).
+	ErrNotFound = errors.New("not found")
+	// ErrConflict: a uniqueness rule was violated.
+	ErrConflict = errors.New("already exists")
+)
+
+// RefreshToken: a stored refresh token. Only its hash is kept.
+type RefreshToken struct {
+	ID        int
+	UserID    int
+	Hash      string
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+// TokenRevocation: what checkTokenRevoked needs to know about a user's tokens.
+type TokenRevocation struct {
+	Generation int  // tokens of earlier generations are revoked
+	JTIRevoked bool // the token itself was revoked at logout
+}
+
+// RecurringTemplate: a recurring charge and the next occurrence it will post.
+type RecurringTemplate struct {
+	Charge
+	Seq int
+}
@@ -0,0 +1,2285 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------------------
+//      In-Memory Store
+// --------------------------
+
+// memoryStore implements Store in process memory, for running the API
+// without PostgreSQL. Transactions hold a single lock and work on a copy
+// of the data that replaces the original when they succeed.
+type memoryStore struct {
+	mu   *sync.Mutex
+	data *memData
+	inTx bool
+}
+
+// memData is everything a memoryStore holds. Its maps are keyed by ID.
+type memData struct {
+	lastID        map[string]int // per table
+	users         map[int]memUser
+	refresh       map[int]RefreshToken
+	revoked       map[string]time.Time // jti => expiry
+	budgets       map[int]Budget
+	charges       map[int]memCharge
+	shares        map[int]Share
+	categories    map[int]Category
+	accounts      map[int]Account
+	transfers     map[int]Transfer
+	settlements   map[int]Settlement
+	goals         map[int]Goal
+	snapshots     map[int][]BudgetSnapshot // by budget ID, oldest first
+	contributions map[int]Contribution
+	envelopeModes map[int]EnvelopeMode // by user ID
+	envelopes     map[int]Envelope
+	envelopeMoves map[int]EnvelopeMove
+	audit         []AuditEvent // in ID order
+	throttles     map[string]LoginThrottle
+	logins        []LoginAttempt    // in ID order
+	twoFactor     map[int]TwoFactor // by user ID
+	recoveryCodes map[int][]string  // hashes by user ID
+	challenges    map[int]LoginChallenge
+	resets        map[int]PasswordReset
+	invites       map[int]Invite
+}
+
+type memUser struct {
+	User
+	TokenGeneration int
+}
+
+type memCharge struct {
+	Charge
+	Seq            int
+	Next           *time.Time
+	Last           *time.Time
+	OccurrenceDate string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{mu: &sync.Mutex{}, data: &memData{
+		lastID:        map[string]int{},
+		users:         map[int]memUser{},
+		refresh:       map[int]RefreshToken{},
+		revoked:       map[string]time.Time{},
+		budgets:       map[int]Budget{},
+		charges:       map[int]memCharge{},
+		shares:        map[int]Share{},
+		categories:    map[int]Category{},
+		accounts:      map[int]Account{},
+		transfers:     map[int]Transfer{},
+		settlements:   map[int]Settlement{},
+		goals:         map[int]Goal{},
+		snapshots:     map[int][]BudgetSnapshot{},
+		contributions: map[int]Contribution{},
+		envelopeModes: map[int]EnvelopeMode{},
+		envelopes:     map[int]Envelope{},
+		envelopeMoves: map[int]EnvelopeMove{},
+		throttles:     map[string]LoginThrottle{},
+		twoFactor:     map[int]TwoFactor{},
+		recoveryCodes: map[int][]string{},
+		challenges:    map[int]LoginChallenge{},
+		resets:        map[int]PasswordReset{},
+		invites:       map[int]Invite{},
+	}}
+}
+
+// clone copies d deeply enough that changing the copy leaves d untouched.
+func (d *memData) clone() *memData {
+	c := &memData{
+		lastID:        make(map[string]int, len(d.lastID)),
+		users:         make(map[int]memUser, len(d.users)),
+		refresh:       make(map[int]RefreshToken, len(d.refresh)),
+		revoked:       make(map[string]time.Time, len(d.revoked)),
+		budgets:       make(map[int]Budget, len(d.budgets)),
+		charges:       make(map[int]memCharge, len(d.charges)),
+		shares:        make(map[int]Share, len(d.shares)),
+		categories:    make(map[int]Category, len(d.categories)),
+		accounts:      make(map[int]Account, len(d.accounts)),
+		transfers:     make(map[int]Transfer, len(d.transfers)),
+		settlements:   make(map[int]Settlement, len(d.settlements)),
+		goals:         make(map[int]Goal, len(d.goals)),
+		snapshots:     make(map[int][]BudgetSnapshot, len(d.snapshots)),
+		contributions: make(map[int]Contribution, len(d.contributions)),
+		envelopeModes: make(map[int]EnvelopeMode, len(d.envelopeModes)),
+		envelopes:     make(map[int]Envelope, len(d.envelopes)),
+		envelopeMoves: make(map[int]EnvelopeMove, len(d.envelopeMoves)),
+		throttles:     make(map[string]LoginThrottle, len(d.throttles)),
+		twoFactor:     make(map[int]TwoFactor, len(d.twoFactor)),
+		recoveryCodes: make(map[int][]string, len(d.recoveryCodes)),
+		challenges:    make(map[int]LoginChallenge, len(d.challenges)),
+		resets:        make(map[int]PasswordReset, len(d.resets)),
+		invites:       make(map[int]Invite, len(d.invites)),
+		// Events and attempts are never changed, so sharing their backing
+		// arrays is safe
+		audit:  d.audit[:len(d.audit):len(d.audit)],
+		logins: d.logins[:len(d.logins):len(d.logins)],
+	}
+	for k, v := range d.throttles {
+		c.throttles[k] = v
+	}
+	for k, v := range d.twoFactor {
+		c.twoFactor[k] = v
+	}
+	for k, v := range d.recoveryCodes {
+		c.recoveryCodes[k] = append([]string{}, v...)
+	}
+	for k, v := range d.challenges {
+		c.challenges[k] = v
+	}
+	for k, v := range d.resets {
+		c.resets[k] = v
+	}
+	for k, v := range d.invites {
+		c.invites[k] = v
+	}
+	for k, v := range d.lastID {
+		c.lastID[k] = v
+	}
+	for k, v := range d.users {
+		c.users[k] = v
+	}
+	for k, v := range d.refresh {
+		c.refresh[k] = v
+	}
+	for k, v := range d.revoked {
+		c.revoked[k] = v
+	}
+	for k, v := range d.budgets {
+		c.budgets[k] = v
+	}
+	for k, v := range d.charges {
+		v.Charge = copyCharge(v.Charge)
+		c.charges[k] = v
+	}
+	for k, v := range d.shares {
+		c.shares[k] = v
+	}
+	for k, v := range d.categories {
+		c.categories[k] = v
+	}
+	for k, v := range d.accounts {
+		c.accounts[k] = v
+	}
+	for k, v := range d.transfers {
+		c.transfers[k] = v
+	}
+	for k, v := range d.settlements {
+		c.settlements[k] = v
+	}
+	for k, v := range d.snapshots {
+		c.snapshots[k] = append([]BudgetSnapshot{}, v...)
+	}
+	for k, v := range d.goals {
+		v.AccountID = copyInt(v.AccountID)
+		c.goals[k] = v
+	}
+	for k, v := range d.contributions {
+		v.UserID = copyInt(v.UserID)
+		c.contributions[k] = v
+	}
+	for k, v := range d.envelopeModes {
+		c.envelopeModes[k] = v
+	}
+	for k, v := range d.envelopes {
+		v.CategoryID = copyInt(v.CategoryID)
+		c.envelopes[k] = v
+	}
+	for k, v := range d.envelopeMoves {
+		v.FromEnvelopeID, v.ToEnvelopeID, v.ActorID = copyInt(v.FromEnvelopeID), copyInt(v.ToEnvelopeID), copyInt(v.ActorID)
+		c.envelopeMoves[k] = v
+	}
+	return c
+}
+
+// copyCharge copies c's pointer fields so callers can't reach stored values.
+func copyCharge(c Charge) Charge {
+	if c.RecurrenceDay != nil {
+		d := *c.RecurrenceDay
+		c.RecurrenceDay = &d
+	}
+	if c.RecurrenceEnd != nil {
+		e := *c.RecurrenceEnd
+		c.RecurrenceEnd = &e
+	}
+	if c.TemplateID != nil {
+		id := *c.TemplateID
+		c.TemplateID = &id
+	}
+	c.CategoryID = copyInt(c.CategoryID)
+	c.AccountID = copyInt(c.AccountID)
+	c.TransferID = copyInt(c.TransferID)
+	c.Tags = append([]string{}, c.Tags...)
+	if c.Splits != nil {
+		splits := make([]ChargeSplit, len(c.Splits))
+		for i, sp := range c.Splits {
+			sp.CategoryID = copyInt(sp.CategoryID)
+			splits[i] = sp
+		}
+		c.Splits = splits
+	}
+	if c.Participants != nil {
+		participants := make([]Participant, len(c.Participants))
+		for i, p := range c.Participants {
+			if p.Percent != nil {
+				pct := *p.Percent
+				p.Percent = &pct
+			}
+			participants[i] = p
+		}
+		c.Participants = participants
+	}
+	return c
+}
+
+// copyInt returns a copy of *p, nil when p is.
+func copyInt(p *int) *int {
+	if p == nil {
+		return nil
+	}
+	i := *p
+	return &i
+}
+
+func (d *memData) nextID(table string) int {
+	d.lastID[table]++
+	return d.lastID[table]
+}
+
+// do runs fn under the store's lock, which a transaction already holds.
+func (s *memoryStore) do(fn func(d *memData) error) error {
+	if !s.inTx {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	return fn(s.data)
+}
+
+func (s *memoryStore) Tx(fn func(Store) error) error {
+	if s.inTx {
+		return fn(s)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	work := s.data.clone()
+	if err := fn(&memoryStore{mu: s.mu, data: work, inTx: true}); err != nil {
+		return err
+	}
+	*s.data = *work
+	return nil
+}
+
+// ---- Users ----
+
+func (s *memoryStore) ListUsers() ([]User, error) {
+	var users []User
+	err := s.do(func(d *memData) error {
+		for _, u := range d.users {
+			users = append(users, u.User)
+		}
+		return nil
+	})
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, err
+}
+
+func (s *memoryStore) GetUser(id int) (User, error) {
+	var u User
+	err := s.do(func(d *memData) error {
+		mu, ok := d.users[id]
+		if !ok {
+			return ErrNotFound
+		}
+		u = mu.User
+		return nil
+	})
+	return u, err
+}
+
+func (s *memoryStore) GetUserByUsername(username string) (User, error) {
+	var u User
+	err := s.do(func(d *memData) error {
+		for _, mu := range d.users {
+			if mu.Username == username {
+				u = mu.User
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	return u, err
+}
+
+func (d *memData) usernameTaken(username string, exceptID int) bool {
+	for _, u := range d.users {
+		if u.Username == username && u.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) CreateUser(u *User) error {
+	return s.do(func(d *memData) error {
+		if d.usernameTaken(u.Username, 0) {
+			return fmt.Errorf("%w: username %q", ErrConflict, u.Username)
+		}
+		u.ID = d.nextID("users")
+		d.users[u.ID] = memUser{User: *u}
+		return nil
+	})
+}
+
+func (s *memoryStore) UpdateUser(u User) error {
+	return s.do(func(d *memData) error {
+		old, ok := d.users[u.ID]
+		if !ok {
+			return ErrNotFound
+		}
+		if d.usernameTaken(u.Username, u.ID) {
+			return fmt.Errorf("%w: username %q", ErrConflict, u.Username)
+		}
+		old.User = u
+		d.users[u.ID] = old
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteUser(id int) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.users[id]; !ok {
+			return ErrNotFound
+		}
+		delete(d.users, id)
+		for k, t := range d.refresh {
+			if t.UserID == id {
+				delete(d.refresh, k)
+			}
+		}
+		delete(d.twoFactor, id)
+		delete(d.recoveryCodes, id)
+		for k, c := range d.challenges {
+			if c.UserID == id {
+				delete(d.challenges, k)
+			}
+		}
+		for k, pr := range d.resets {
+			if pr.UserID == id {
+				delete(d.resets, k)
+			}
+		}
+		for k, b := range d.budgets {
+			if b.UserID == id {
+				delete(d.budgets, k)
+				delete(d.snapshots, k)
+			}
+		}
+		for k, c := range d.charges {
+			if c.UserID == id {
+				d.deleteCharge(k)
+			}
+		}
+		for k, c := range d.charges {
+			if i := c.participant(id); i >= 0 {
+				c.Charge = copyCharge(c.Charge)
+				c.Participants = append(c.Participants[:i], c.Participants[i+1:]...)
+				if len(c.Participants) == 0 {
+					c.ShareMode, c.Participants = "", nil
+				}
+				d.charges[k] = c
+			}
+		}
+		for k, st := range d.settlements {
+			if st.FromUserID == id || st.ToUserID == id {
+				delete(d.settlements, k)
+			}
+		}
+		for k, g := range d.goals {
+			if g.UserID == id {
+				d.deleteGoal(k)
+			}
+		}
+		for k, c := range d.contributions {
+			if c.UserID != nil && *c.UserID == id {
+				c.UserID = nil
+				d.contributions[k] = c
+			}
+		}
+		delete(d.envelopeModes, id)
+		for k, e := range d.envelopes {
+			if e.UserID == id {
+				delete(d.envelopes, k)
+			}
+		}
+		for k, m := range d.envelopeMoves {
+			switch {
+			case m.UserID == id:
+				delete(d.envelopeMoves, k)
+			case m.ActorID != nil && *m.ActorID == id:
+				m.ActorID = nil
+				d.envelopeMoves[k] = m
+			}
+		}
+		for k, sh := range d.shares {
+			if sh.UserID == id || sh.UserShareID == id {
+				delete(d.shares, k)
+			}
+		}
+		for k, c := range d.categories {
+			if c.UserID == id {
+				delete(d.categories, k)
+			}
+		}
+		for k, a := range d.accounts {
+			if a.UserID == id {
+				delete(d.accounts, k)
+			}
+		}
+		return nil
+	})
+}
+
+// ---- Tokens ----
+
+func (s *memoryStore) CreateRefreshToken(t *RefreshToken) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.users[t.UserID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrNotFound, t.UserID)
+		}
+		for _, other := range d.refresh {
+			if other.Hash == t.Hash {
+				return fmt.Errorf("%w: refresh token", ErrConflict)
+			}
+		}
+		t.ID = d.nextID("refresh_tokens")
+		d.refresh[t.ID] = *t
+		return nil
+	})
+}
+
+func (s *memoryStore) GetRefreshToken(hash string) (RefreshToken, error) {
+	var t RefreshToken
+	err := s.do(func(d *memData) error {
+		for _, rt := range d.refresh {
+			if rt.Hash == hash {
+				t = rt
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	return t, err
+}
+
+func (s *memoryStore) RevokeRefreshToken(id int) error {
+	return s.do(func(d *memData) error {
+		if t, ok := d.refresh[id]; ok && t.RevokedAt == nil {
+			now := time.Now()
+			t.RevokedAt = &now
+			d.refresh[id] = t
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) RevokeUserTokens(userID int) error {
+	return s.do(func(d *memData) error {
+		now := time.Now()
+		if u, ok := d.users[userID]; ok {
+			u.TokenGeneration++
+			d.users[userID] = u
+		}
+		for id, t := range d.refresh {
+			if t.UserID == userID && t.RevokedAt == nil {
+				t.RevokedAt = &now
+				d.refresh[id] = t
+			}
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) TokenGeneration(userID int) (int, error) {
+	var gen int
+	err := s.do(func(d *memData) error {
+		u, ok := d.users[userID]
+		if !ok {
+			return ErrNotFound
+		}
+		gen = u.TokenGeneration
+		return nil
+	})
+	return gen, err
+}
+
+func (s *memoryStore) RevokeAccessToken(jti string, userID int, expires time.Time) error {
+	return s.do(func(d *memData) error {
+		now := time.Now()
+		for k, exp := range d.revoked {
+			if exp.Before(now) {
+				delete(d.revoked, k)
+			}
+		}
+		if _, ok := d.revoked[jti]; !ok {
+			d.revoked[jti] = expires
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) TokenRevocation(userID int, jti string) (TokenRevocation, error) {
+	var r TokenRevocation
+	err := s.do(func(d *memData) error {
+		u, ok := d.users[userID]
+		if !ok {
+			return ErrNotFound
+		}
+		r.Generation = u.TokenGeneration
+		_, r.JTIRevoked = d.revoked[jti]
+		return nil
+	})
+	return r, err
+}
+
+// ---- Login throttling ----
+
+func (s *memoryStore) GetLoginThrottle(key string) (LoginThrottle, error) {
+	var t LoginThrottle
+	err := s.do(func(d *memData) error {
+		var ok bool
+		if t, ok = d.throttles[key]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return t, err
+}
+
+func (s *memoryStore) RecordLoginFailure(key string, at, since time.Time) (LoginThrottle, error) {
+	var t LoginThrottle
+	err := s.do(func(d *memData) error {
+		for k, old := range d.throttles {
+			if old.LastFailure.Before(since) {
+				delete(d.throttles, k)
+			}
+		}
+		t = d.throttles[key]
+		t.Key = key
+		t.Failures++
+		t.LastFailure = at
+		d.throttles[key] = t
+		return nil
+	})
+	return t, err
+}
+
+func (s *memoryStore) ClearLoginThrottle(key string) error {
+	return s.do(func(d *memData) error {
+		delete(d.throttles, key)
+		return nil
+	})
+}
+
+// LockLoginThrottle has nothing to do: a transaction holds the whole store.
+func (s *memoryStore) LockLoginThrottle(key string) error {
+	return nil
+}
+
+func (s *memoryStore) RecordLoginAttempt(a *LoginAttempt) error {
+	return s.do(func(d *memData) error {
+		a.ID = d.nextID("login_attempts")
+		a.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		d.logins = append(d.logins, *a)
+		return nil
+	})
+}
+
+func (s *memoryStore) ListLoginAttempts(f *LoginAttemptFilter) ([]LoginAttempt, error) {
+	attempts := []LoginAttempt{}
+	err := s.do(func(d *memData) error {
+		for i := len(d.logins) - 1; i >= 0; i-- {
+			a := d.logins[i]
+			switch {
+			case f.Username != "" && a.Username != f.Username,
+				f.UserID != 0 && (a.UserID == nil || *a.UserID != f.UserID),
+				f.IP != "" && a.IP != f.IP,
+				f.BeforeID != 0 && a.ID >= f.BeforeID:
+				continue
+			}
+			attempts = append(attempts, a)
+			if f.Limit > 0 && len(attempts) == f.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return attempts, err
+}
+
+// ---- Two-factor authentication ----
+
+func (s *memoryStore) GetTwoFactor(userID int) (TwoFactor, error) {
+	var t TwoFactor
+	err := s.do(func(d *memData) error {
+		var ok bool
+		if t, ok = d.twoFactor[userID]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return t, err
+}
+
+func (s *memoryStore) PutTwoFactor(t TwoFactor) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.users[t.UserID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrNotFound, t.UserID)
+		}
+		d.twoFactor[t.UserID] = t
+		return nil
+	})
+}
+
+func (s *memoryStore) SetRecoveryCodes(userID int, hashes []string) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.users[userID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrNotFound, userID)
+		}
+		if len(hashes) == 0 {
+			delete(d.recoveryCodes, userID)
+			return nil
+		}
+		d.recoveryCodes[userID] = append([]string{}, hashes...)
+		return nil
+	})
+}
+
+func (s *memoryStore) UseRecoveryCode(userID int, hash string) error {
+	return s.do(func(d *memData) error {
+		codes := d.recoveryCodes[userID]
+		for i, h := range codes {
+			if h == hash {
+				d.recoveryCodes[userID] = append(codes[:i:i], codes[i+1:]...)
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+func (s *memoryStore) CountRecoveryCodes(userID int) (int, error) {
+	n := 0
+	err := s.do(func(d *memData) error {
+		n = len(d.recoveryCodes[userID])
+		return nil
+	})
+	return n, err
+}
+
+func (s *memoryStore) CreateLoginChallenge(c *LoginChallenge) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.users[c.UserID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrNotFound, c.UserID)
+		}
+		c.ID = d.nextID("login_challenges")
+		d.challenges[c.ID] = *c
+		return nil
+	})
+}
+
+func (s *memoryStore) GetLoginChallenge(hash string) (LoginChallenge, error) {
+	var c LoginChallenge
+	err := s.do(func(d *memData) error {
+		for _, lc := range d.challenges {
+			if lc.Hash == hash {
+				c = lc
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	return c, err
+}
+
+func (s *memoryStore) DeleteLoginChallenge(id int) error {
+	return s.do(func(d *memData) error {
+		_, ok := d.challenges[id]
+		delete(d.challenges, id)
+		now := time.Now()
+		for k, c := range d.challenges {
+			if c.ExpiresAt.Before(now) {
+				delete(d.challenges, k)
+			}
+		}
+		if !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) CreatePasswordReset(pr *PasswordReset) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.users[pr.UserID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrNotFound, pr.UserID)
+		}
+		now := time.Now()
+		for k, r := range d.resets {
+			if r.ExpiresAt.Before(now) {
+				delete(d.resets, k)
+			}
+		}
+		pr.ID = d.nextID("password_resets")
+		d.resets[pr.ID] = *pr
+		return nil
+	})
+}
+
+func (s *memoryStore) GetPasswordReset(hash string) (PasswordReset, error) {
+	var pr PasswordReset
+	err := s.do(func(d *memData) error {
+		for _, r := range d.resets {
+			if r.Hash == hash {
+				pr = r
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	return pr, err
+}
+
+func (s *memoryStore) DeletePasswordResets(userID int) error {
+	return s.do(func(d *memData) error {
+		for k, r := range d.resets {
+			if r.UserID == userID {
+				delete(d.resets, k)
+			}
+		}
+		return nil
+	})
+}
+
+// ---- Invites ----
+
+func (s *memoryStore) CreateInvite(i *Invite) error {
+	return s.do(func(d *memData) error {
+		for _, other := range d.invites {
+			if other.Hash == i.Hash {
+				return fmt.Errorf("%w: invite code", ErrConflict)
+			}
+		}
+		i.ID = d.nextID("invites")
+		i.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		d.invites[i.ID] = *i
+		return nil
+	})
+}
+
+func (s *memoryStore) ListInvites() ([]Invite, error) {
+	var invites []Invite
+	err := s.do(func(d *memData) error {
+		for _, i := range d.invites {
+			invites = append(invites, i)
+		}
+		return nil
+	})
+	sort.Slice(invites, func(a, b int) bool { return invites[a].ID > invites[b].ID })
+	return invites, err
+}
+
+func (s *memoryStore) GetInvite(hash string) (Invite, error) {
+	var i Invite
+	err := s.do(func(d *memData) error {
+		for _, other := range d.invites {
+			if other.Hash == hash {
+				i = other
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	return i, err
+}
+
+func (s *memoryStore) UseInvite(id, userID int) error {
+	return s.do(func(d *memData) error {
+		i, ok := d.invites[id]
+		if !ok || i.UsedBy != nil {
+			return ErrNotFound
+		}
+		now := time.Now().UTC()
+		i.UsedBy, i.UsedAt = &userID, &now
+		d.invites[id] = i
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteInvite(id int) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.invites[id]; !ok {
+			return ErrNotFound
+		}
+		delete(d.invites, id)
+		return nil
+	})
+}
+
+// ---- Lists ----
+
+// compareSortKeys orders two sort keys of the given SQL type like PostgreSQL
+// would (text compares bytewise rather than by collation).
+func compareSortKeys(typ, a, b string) int {
+	switch typ {
+	case "integer":
+		x, _ := strconv.Atoi(a)
+		y, _ := strconv.Atoi(b)
+		return x - y
+	case "numeric":
+		x, _ := new(big.Rat).SetString(a)
+		y, _ := new(big.Rat).SetString(b)
+		if x == nil || y == nil {
+			return strings.Compare(a, b)
+		}
+		return x.Cmp(y)
+	case "timestamptz":
+		x, errX := time.Parse(time.RFC3339Nano, a)
+		y, errY := time.Parse(time.RFC3339Nano, b)
+		if errX != nil || errY != nil {
+			return strings.Compare(a, b)
+		}
+		return x.Compare(y)
+	}
+	return strings.Compare(a, b)
+}
+
+// listRow is what filterList needs to know about a budget or charge.
+type listRow struct {
+	ID       int
+	OwnerID  int
+	Name     string
+	Category string
+	// CategoryID is nil for uncategorized rows
+	CategoryID *int
+	Tags       []string
+	AccountID  *int
+	Direction  string
+	SplitIDs   []int // categories of its split lines
+	Amount     Money
+	CreatedAt  string
+	key        func(field string) string
+}
+
+// filterList returns the indexes of rows matching f, in f's order and
+// limited to f.Limit.
+func filterList(rows []listRow, f *ListFilter, spec listSpec) []int {
+	field := f.Sort
+	if _, ok := spec.Sortable[field]; !ok {
+		field = "id"
+	}
+	typ := spec.Sortable[field].Type
+	desc := f.Order == "desc"
+	cmp := func(a, b listRow) int {
+		c := compareSortKeys(typ, a.key(field), b.key(field))
+		if c == 0 {
+			c = a.ID - b.ID
+		}
+		if desc {
+			c = -c
+		}
+		return c
+	}
+
+	var after *listRow
+	if f.After != nil {
+		v := f.After.Value
+		after = &listRow{ID: f.After.ID, key: func(string) string { return v }}
+	}
+
+	var match []int
+	for i, row := range rows {
+		if row.OwnerID != f.OwnerID {
+			continue
+		}
+		if spec.DateColumn != "" && (f.From != nil || f.To != nil) {
+			t, err := time.Parse(time.RFC3339Nano, row.CreatedAt)
+			if err != nil || (f.From != nil && t.Before(*f.From)) || (f.To != nil && !t.Before(*f.To)) {
+				continue
+			}
+		}
+		if f.CategoryIDs != nil {
+			found := false
+			for _, id := range f.CategoryIDs {
+				found = found || (row.CategoryID != nil && *row.CategoryID == id)
+				for _, split := range row.SplitIDs {
+					found = found || (spec.Split && split == id)
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if len(f.Tags) > 0 && spec.Tagged {
+			n := 0
+			for _, tag := range f.Tags {
+				if containsTag(row.Tags, tag) {
+					n++
+				}
+			}
+			if n == 0 || (!f.AnyTag && n < len(f.Tags)) {
+				continue
+			}
+		}
+		if spec.Accounts && f.AccountID != 0 && (row.AccountID == nil || *row.AccountID != f.AccountID) {
+			continue
+		}
+		if spec.Directed && f.Direction != "" && row.Direction != f.Direction {
+			continue
+		}
+		if f.Currency != "" && row.Amount.Currency != f.Currency {
+			continue
+		}
+		amount := row.Amount.String()
+		if f.MinAmount != nil && compareSortKeys("numeric", amount, f.MinAmount.String()) < 0 {
+			continue
+		}
+		if f.MaxAmount != nil && compareSortKeys("numeric", amount, f.MaxAmount.String()) > 0 {
+			continue
+		}
+		if f.Query != "" && !strings.Contains(strings.ToLower(row.Name), strings.ToLower(f.Query)) {
+			continue
+		}
+		if after != nil && cmp(row, *after) <= 0 {
+			continue
+		}
+		match = append(match, i)
+	}
+
+	sort.Slice(match, func(i, j int) bool { return cmp(rows[match[i]], rows[match[j]]) < 0 })
+	if f.Limit > 0 && len(match) > f.Limit {
+		match = match[:f.Limit]
+	}
+	return match
+}
+
+// ---- Categories ----
+
+func (s *memoryStore) ListCategories(ownerID int) ([]Category, error) {
+	categories := []Category{}
+	err := s.do(func(d *memData) error {
+		for _, c := range d.categories {
+			if c.UserID == ownerID {
+				c.ParentID = copyInt(c.ParentID)
+				categories = append(categories, c)
+			}
+		}
+		return nil
+	})
+	sort.Slice(categories, func(i, j int) bool { return categories[i].ID < categories[j].ID })
+	return categories, err
+}
+
+func (s *memoryStore) GetCategory(id int) (Category, error) {
+	var c Category
+	err := s.do(func(d *memData) error {
+		var ok bool
+		if c, ok = d.categories[id]; !ok {
+			return ErrNotFound
+		}
+		c.ParentID = copyInt(c.ParentID)
+		return nil
+	})
+	return c, err
+}
+
+// checkCategoryName enforces the foreign keys of c and the uniqueness of
+// sibling names.
+func (d *memData) checkCategoryName(c Category) error {
+	if _, ok := d.users[c.UserID]; !ok {
+		return fmt.Errorf("%w: user %d", ErrNotFound, c.UserID)
+	}
+	if err := d.checkCategory(c.ParentID); err != nil {
+		return err
+	}
+	for _, other := range d.categories {
+		sameParent := (other.ParentID == nil && c.ParentID == nil) ||
+			(other.ParentID != nil && c.ParentID != nil && *other.ParentID == *c.ParentID)
+		if other.ID != c.ID && other.UserID == c.UserID && sameParent && strings.EqualFold(other.Name, c.Name) {
+			return fmt.Errorf("%w: category %q", ErrConflict, c.Name)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) CreateCategory(c *Category) error {
+	return s.do(func(d *memData) error {
+		if err := d.checkCategoryName(*c); err != nil {
+			return err
+		}
+		c.ID = d.nextID("categories")
+		stored := *c
+		stored.ParentID, stored.Path = copyInt(c.ParentID), ""
+		d.categories[c.ID] = stored
+		return nil
+	})
+}
+
+func (s *memoryStore) UpdateCategory(c Category) error {
+	return s.do(func(d *memData) error {
+		if old, ok := d.categories[c.ID]; !ok || old.UserID != c.UserID {
+			return ErrNotFound
+		}
+		if err := d.checkCategoryName(c); err != nil {
+			return err
+		}
+		c.ParentID, c.Path = copyInt(c.ParentID), ""
+		d.categories[c.ID] = c
+
+		t := &categoryTree{ownerID: c.UserID, byID: map[int]Category{}, children: map[int][]int{}}
+		for _, other := range d.categories {
+			if other.UserID == c.UserID {
+				t.add(other)
+			}
+		}
+		for id, b := range d.budgets {
+			if b.CategoryID != nil && b.UserID == c.UserID {
+				b.Category = t.path(*b.CategoryID)
+				d.budgets[id] = b
+			}
+		}
+		for id, ch := range d.charges {
+			if ch.UserID != c.UserID {
+				continue
+			}
+			if ch.CategoryID != nil {
+				ch.Category = t.path(*ch.CategoryID)
+			}
+			for i, sp := range ch.Splits {
+				if sp.CategoryID != nil {
+					ch.Splits[i].Category = t.path(*sp.CategoryID)
+				}
+			}
+			d.charges[id] = ch
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteCategory(ownerID, id int) error {
+	return s.do(func(d *memData) error {
+		if c, ok := d.categories[id]; !ok || c.UserID != ownerID {
+			return ErrNotFound
+		}
+		for _, other := range d.categories {
+			if other.ParentID != nil && *other.ParentID == id {
+				return fmt.Errorf("%w: category %d has subcategories", ErrConflict, id)
+			}
+		}
+		delete(d.categories, id)
+		for k, b := range d.budgets {
+			if b.CategoryID != nil && *b.CategoryID == id {
+				b.Category, b.CategoryID = "", nil
+				d.budgets[k] = b
+			}
+		}
+		for k, e := range d.envelopes {
+			if e.CategoryID != nil && *e.CategoryID == id {
+				e.CategoryID = nil
+				d.envelopes[k] = e
+			}
+		}
+		for k, c := range d.charges {
+			if c.CategoryID != nil && *c.CategoryID == id {
+				c.Category, c.CategoryID = "", nil
+			}
+			for i, sp := range c.Splits {
+				if sp.CategoryID != nil && *sp.CategoryID == id {
+					c.Splits[i].Category, c.Splits[i].CategoryID = "", nil
+				}
+			}
+			d.charges[k] = c
+		}
+		return nil
+	})
+}
+
+// ---- Accounts ----
+
+func (s *memoryStore) ListAccounts(ownerID int) ([]Account, error) {
+	accounts := []Account{}
+	err := s.do(func(d *memData) error {
+		for _, a := range d.accounts {
+			if a.UserID == ownerID {
+				accounts = append(accounts, a)
+			}
+		}
+		return nil
+	})
+	sort.Slice(accounts, func(i, j int) bool {
+		a, b := strings.ToLower(accounts[i].Name), strings.ToLower(accounts[j].Name)
+		if a != b {
+			return a < b
+		}
+		return accounts[i].ID < accounts[j].ID
+	})
+	return accounts, err
+}
+
+func (s *memoryStore) GetAccount(id int) (Account, error) {
+	var a Account
+	err := s.do(func(d *memData) error {
+		var ok bool
+		if a, ok = d.accounts[id]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return a, err
+}
+
+// checkAccountName enforces the user foreign key of a and the uniqueness
+// of account names.
+func (d *memData) checkAccountName(a Account) error {
+	if _, ok := d.users[a.UserID]; !ok {
+		return fmt.Errorf("%w: user %d", ErrNotFound, a.UserID)
+	}
+	for _, other := range d.accounts {
+		if other.ID != a.ID && other.UserID == a.UserID && strings.EqualFold(other.Name, a.Name) {
+			return fmt.Errorf("%w: account %q", ErrConflict, a.Name)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) CreateAccount(a *Account) error {
+	return s.do(func(d *memData) error {
+		if err := d.checkAccountName(*a); err != nil {
+			return err
+		}
+		a.ID = d.nextID("accounts")
+		stored := *a
+		stored.Balance = nil
+		d.accounts[a.ID] = stored
+		return nil
+	})
+}
+
+func (s *memoryStore) UpdateAccount(a Account) error {
+	return s.do(func(d *memData) error {
+		if old, ok := d.accounts[a.ID]; !ok || old.UserID != a.UserID {
+			return ErrNotFound
+		}
+		if err := d.checkAccountName(a); err != nil {
+			return err
+		}
+		a.Balance = nil
+		d.accounts[a.ID] = a
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteAccount(ownerID, id int) error {
+	return s.do(func(d *memData) error {
+		if a, ok := d.accounts[id]; !ok || a.UserID != ownerID {
+			return ErrNotFound
+		}
+		for _, c := range d.charges {
+			if c.AccountID != nil && *c.AccountID == id {
+				return fmt.Errorf("%w: account %d has charges", ErrConflict, id)
+			}
+		}
+		delete(d.accounts, id)
+		for k, g := range d.goals {
+			if g.AccountID != nil && *g.AccountID == id {
+				g.AccountID = nil
+				d.goals[k] = g
+			}
+		}
+		return nil
+	})
+}
+
+// checkAccount enforces the accounts foreign key of charges and goals.
+func (d *memData) checkAccount(id *int) error {
+	if id == nil {
+		return nil
+	}
+	if _, ok := d.accounts[*id]; !ok {
+		return fmt.Errorf("%w: account %d", ErrNotFound, *id)
+	}
+	return nil
+}
+
+// ---- Budgets ----
+
+func (s *memoryStore) ListBudgets(f *ListFilter) ([]Budget, error) {
+	budgets := []Budget{}
+	err := s.do(func(d *memData) error {
+		var all []Budget
+		var rows []listRow
+		for _, b := range d.budgets {
+			b := copyBudget(b)
+			all = append(all, b)
+			rows = append(rows, listRow{ID: b.ID, OwnerID: b.UserID, Name: b.Name, Category: b.Category,
+				CategoryID: b.CategoryID, Amount: b.Amount, key: b.sortKey})
+		}
+		for _, i := range filterList(rows, f, budgetListSpec) {
+			budgets = append(budgets, all[i])
+		}
+		return nil
+	})
+	return budgets, err
+}
+
+func (s *memoryStore) GetBudget(id int) (Budget, error) {
+	var b Budget
+	err := s.do(func(d *memData) error {
+		var ok bool
+		if b, ok = d.budgets[id]; !ok {
+			return ErrNotFound
+		}
+		b = copyBudget(b)
+		return nil
+	})
+	return b, err
+}
+
+// checkCategory enforces the categories foreign key of budgets and charges.
+func (d *memData) checkCategory(id *int) error {
+	if id == nil {
+		return nil
+	}
+	if _, ok := d.categories[*id]; !ok {
+		return fmt.Errorf("%w: category %d", ErrNotFound, *id)
+	}
+	return nil
+}
+
+func (s *memoryStore) CreateBudget(b *Budget) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.users[b.UserID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrNotFound, b.UserID)
+		}
+		if err := d.checkCategory(b.CategoryID); err != nil {
+			return err
+		}
+		if b.Rollover == "" {
+			b.Rollover = RolloverNone
+		}
+		b.ID = d.nextID("budgets")
+		b.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		d.budgets[b.ID] = copyBudget(*b)
+		return nil
+	})
+}
+
+func (s *memoryStore) UpdateBudget(b Budget) error {
+	return s.do(func(d *memData) error {
+		old, ok := d.budgets[b.ID]
+		if !ok || old.UserID != b.UserID {
+			return ErrNotFound
+		}
+		if err := d.checkCategory(b.CategoryID); err != nil {
+			return err
+		}
+		if b.Rollover == "" {
+			b.Rollover = RolloverNone
+		}
+		b.CreatedAt = old.CreatedAt
+		d.budgets[b.ID] = copyBudget(b)
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteBudget(ownerID, id int) error {
+	return s.do(func(d *memData) error {
+		if b, ok := d.budgets[id]; !ok || b.UserID != ownerID {
+			return ErrNotFound
+		}
+		delete(d.budgets, id)
+		delete(d.snapshots, id)
+		return nil
+	})
+}
+
+// copyBudget copies b's pointer fields and drops what is only filled in on
+// responses.
+func copyBudget(b Budget) Budget {
+	b.CategoryID = copyInt(b.CategoryID)
+	if b.RolloverCap != nil {
+		limit := *b.RolloverCap
+		b.RolloverCap = &limit
+	}
+	b.CarriedIn, b.Available = nil, nil
+	return b
+}
+
+func (s *memoryStore) ListBudgetSnapshots(budgetID int) ([]BudgetSnapshot, error) {
+	var snapshots []BudgetSnapshot
+	err := s.do(func(d *memData) error {
+		snapshots = append([]BudgetSnapshot{}, d.snapshots[budgetID]...)
+		return nil
+	})
+	return snapshots, err
+}
+
+func (s *memoryStore) PutBudgetSnapshot(sn BudgetSnapshot) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.budgets[sn.BudgetID]; !ok {
+			return fmt.Errorf("%w: budget %d", ErrNotFound, sn.BudgetID)
+		}
+		list := d.snapshots[sn.BudgetID]
+		i := sort.Search(len(list), func(i int) bool { return !list[i].PeriodStart.Before(sn.PeriodStart) })
+		if i < len(list) && list[i].PeriodStart.Equal(sn.PeriodStart) {
+			list[i] = sn
+		} else {
+			list = append(list[:i], append([]BudgetSnapshot{sn}, list[i:]...)...)
+		}
+		d.snapshots[sn.BudgetID] = list
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteBudgetSnapshots(budgetID int, from time.Time) error {
+	return s.do(func(d *memData) error {
+		var kept []BudgetSnapshot
+		for _, sn := range d.snapshots[budgetID] {
+			if sn.PeriodStart.Before(from) {
+				kept = append(kept, sn)
+			}
+		}
+		d.snapshots[budgetID] = kept
+		return nil
+	})
+}
+
+// ---- Charges ----
+
+func (s *memoryStore) ListCharges(f *ListFilter) ([]Charge, error) {
+	charges := []Charge{}
+	err := s.do(func(d *memData) error {
+		var all []Charge
+		var rows []listRow
+		for _, mc := range d.charges {
+			c := mc.Charge
+			all = append(all, c)
+			var splitIDs []int
+			for _, sp := range c.Splits {
+				if sp.CategoryID != nil {
+					splitIDs = append(splitIDs, *sp.CategoryID)
+				}
+			}
+			rows = append(rows, listRow{ID: c.ID, OwnerID: c.UserID, Name: c.Name, Category: c.Category,
+				CategoryID: c.CategoryID, Tags: c.Tags, AccountID: c.AccountID, Direction: c.Direction, SplitIDs: splitIDs,
+				Amount: c.Amount, CreatedAt: c.CreatedAt, key: c.sortKey})
+		}
+		for _, i := range filterList(rows, f, chargeListSpec) {
+			charges = append(charges, copyCharge(all[i]))
+		}
+		return nil
+	})
+	return charges, err
+}
+
+func (s *memoryStore) GetCharge(id int) (Charge, error) {
+	var c Charge
+	err := s.do(func(d *memData) error {
+		mc, ok := d.charges[id]
+		if !ok {
+			return ErrNotFound
+		}
+		c = copyCharge(mc.Charge)
+		return nil
+	})
+	return c, err
+}
+
+// insertCharge stores c as a new charge, defaulting its creation time to now.
+func (d *memData) insertCharge(c *Charge, occurrenceDate string) error {
+	if _, ok := d.users[c.UserID]; !ok {
+		return fmt.Errorf("%w: user %d", ErrNotFound, c.UserID)
+	}
+	if err := d.checkCategory(c.CategoryID); err != nil {
+		return err
+	}
+	if err := d.checkAccount(c.AccountID); err != nil {
+		return err
+	}
+	for _, sp := range c.Splits {
+		if err := d.checkCategory(sp.CategoryID); err != nil {
+			return err
+		}
+	}
+	if err := d.checkParticipants(c.Participants); err != nil {
+		return err
+	}
+	if len(c.Participants) == 0 {
+		c.ShareMode, c.Participants = "", nil
+	}
+	if c.Direction == "" {
+		c.Direction = DirectionExpense
+	}
+	if c.CreatedAt == "" {
+		c.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	} else {
+		t, err := parseDate(c.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("invalid created_at %q", c.CreatedAt)
+		}
+		c.CreatedAt = t.UTC().Format(time.RFC3339Nano)
+	}
+	c.ID = d.nextID("charges")
+	c.TransferID = nil
+	stored := copyCharge(*c)
+	stored.Tags = retag(c.Tags, nil, nil)
+	d.charges[c.ID] = memCharge{Charge: stored, OccurrenceDate: occurrenceDate}
+	return nil
+}
+
+func (s *memoryStore) CreateCharge(c *Charge) error {
+	return s.do(func(d *memData) error {
+		return d.insertCharge(c, "")
+	})
+}
+
+func (s *memoryStore) UpdateCharge(c Charge) error {
+	return s.do(func(d *memData) error {
+		old, ok := d.charges[c.ID]
+		if !ok || old.UserID != c.UserID {
+			return ErrNotFound
+		}
+		if err := d.checkCategory(c.CategoryID); err != nil {
+			return err
+		}
+		if err := d.checkAccount(c.AccountID); err != nil {
+			return err
+		}
+		old.Name, old.Amount, old.Category, old.Periodical = c.Name, c.Amount, c.Category, c.Periodical
+		updated := copyCharge(c)
+		old.CategoryID, old.AccountID = updated.CategoryID, updated.AccountID
+		if old.Direction = c.Direction; old.Direction == "" {
+			old.Direction = DirectionExpense
+		}
+		old.Recurring, old.RecurrenceDay, old.RecurrenceEnd = updated.Recurring, updated.RecurrenceDay, updated.RecurrenceEnd
+		d.charges[c.ID] = old
+		return nil
+	})
+}
+
+// deleteCharge removes a charge and any transfer it is a leg of;
+// occurrences posted from it are kept.
+func (d *memData) deleteCharge(id int) {
+	if c := d.charges[id]; c.TransferID != nil {
+		d.unlinkTransfer(*c.TransferID)
+	}
+	delete(d.charges, id)
+	for k, c := range d.charges {
+		if c.TemplateID != nil && *c.TemplateID == id {
+			c.TemplateID = nil
+			d.charges[k] = c
+		}
+	}
+}
+
+func (s *memoryStore) SetChargeSplits(ownerID, chargeID int, splits []ChargeSplit) error {
+	return s.do(func(d *memData) error {
+		c, ok := d.charges[chargeID]
+		if !ok || c.UserID != ownerID {
+			return ErrNotFound
+		}
+		for _, sp := range splits {
+			if err := d.checkCategory(sp.CategoryID); err != nil {
+				return err
+			}
+		}
+		c.Splits = splits
+		c.Charge = copyCharge(c.Charge)
+		if len(splits) == 0 {
+			c.Splits = nil
+		}
+		d.charges[chargeID] = c
+		return nil
+	})
+}
+
+// checkParticipants fails with ErrNotFound if a participant's user doesn't
+// exist.
+func (d *memData) checkParticipants(participants []Participant) error {
+	for _, p := range participants {
+		if _, ok := d.users[p.UserID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrNotFound, p.UserID)
+		}
+	}
+	return nil
+}
+
+// participant returns the index of userID among c's participants, or -1.
+func (c memCharge) participant(userID int) int {
+	for i, p := range c.Participants {
+		if p.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *memoryStore) SetChargeParticipants(ownerID, chargeID int, mode string, participants []Participant) error {
+	return s.do(func(d *memData) error {
+		c, ok := d.charges[chargeID]
+		if !ok || c.UserID != ownerID {
+			return ErrNotFound
+		}
+		if err := d.checkParticipants(participants); err != nil {
+			return err
+		}
+		c.ShareMode, c.Participants = mode, participants
+		c.Charge = copyCharge(c.Charge)
+		if len(participants) == 0 {
+			c.ShareMode, c.Participants = "", nil
+		}
+		d.charges[chargeID] = c
+		return nil
+	})
+}
+
+func (s *memoryStore) ListSharedCharges(userID int) ([]Charge, error) {
+	charges := []Charge{}
+	err := s.do(func(d *memData) error {
+		for _, c := range d.charges {
+			if len(c.Participants) > 0 && (c.UserID == userID || c.participant(userID) >= 0) {
+				charges = append(charges, copyCharge(c.Charge))
+			}
+		}
+		return nil
+	})
+	sort.Slice(charges, func(i, j int) bool {
+		if charges[i].CreatedAt != charges[j].CreatedAt {
+			return charges[i].CreatedAt < charges[j].CreatedAt
+		}
+		return charges[i].ID < charges[j].ID
+	})
+	return charges, err
+}
+
+func (s *memoryStore) DeleteCharge(ownerID, id int) error {
+	return s.do(func(d *memData) error {
+		if c, ok := d.charges[id]; !ok || c.UserID != ownerID {
+			return ErrNotFound
+		}
+		d.deleteCharge(id)
+		return nil
+	})
+}
+
+// ---- Tags ----
+
+func (s *memoryStore) ListTags(ownerID int) ([]Tag, error) {
+	tags := []Tag{}
+	err := s.do(func(d *memData) error {
+		counts := map[string]int{}
+		for _, c := range d.charges {
+			if c.UserID == ownerID {
+				for _, tag := range c.Tags {
+					counts[tag]++
+				}
+			}
+		}
+		for name, n := range counts {
+			tags = append(tags, Tag{Name: name, Charges: n})
+		}
+		return nil
+	})
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, err
+}
+
+// retagCharges applies add and remove to those of ids the owner has.
+func (d *memData) retagCharges(ownerID int, ids []int, add, remove []string) {
+	for _, id := range ids {
+		if c, ok := d.charges[id]; ok && c.UserID == ownerID {
+			c.Tags = retag(c.Tags, add, remove)
+			d.charges[id] = c
+		}
+	}
+}
+
+func (s *memoryStore) TagCharges(ownerID int, chargeIDs []int, tags []string) error {
+	return s.do(func(d *memData) error {
+		d.retagCharges(ownerID, chargeIDs, tags, nil)
+		return nil
+	})
+}
+
+func (s *memoryStore) UntagCharges(ownerID int, chargeIDs []int, tags []string) error {
+	return s.do(func(d *memData) error {
+		d.retagCharges(ownerID, chargeIDs, nil, tags)
+		return nil
+	})
+}
+
+// ---- Transfers ----
+
+func (s *memoryStore) ListTransfers(ownerID int) ([]Transfer, error) {
+	transfers := []Transfer{}
+	err := s.do(func(d *memData) error {
+		for _, t := range d.transfers {
+			if t.UserID == ownerID {
+				transfers = append(transfers, t)
+			}
+		}
+		return nil
+	})
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].ID > transfers[j].ID })
+	return transfers, err
+}
+
+func (s *memoryStore) GetTransfer(id int) (Transfer, error) {
+	var t Transfer
+	err := s.do(func(d *memData) error {
+		var ok bool
+		if t, ok = d.transfers[id]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return t, err
+}
+
+func (s *memoryStore) CreateTransfer(t *Transfer) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.users[t.UserID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrNotFound, t.UserID)
+		}
+		if t.FromChargeID == t.ToChargeID {
+			return fmt.Errorf("a transfer needs two legs")
+		}
+		for _, id := range []int{t.FromChargeID, t.ToChargeID} {
+			c, ok := d.charges[id]
+			if !ok {
+				return fmt.Errorf("%w: charge %d", ErrNotFound, id)
+			}
+			if c.TransferID != nil {
+				return fmt.Errorf("%w: charge %d is already a transfer leg", ErrConflict, id)
+			}
+		}
+		t.ID = d.nextID("transfers")
+		d.transfers[t.ID] = Transfer{ID: t.ID, UserID: t.UserID, FromChargeID: t.FromChargeID, ToChargeID: t.ToChargeID}
+		for _, id := range []int{t.FromChargeID, t.ToChargeID} {
+			c := d.charges[id]
+			c.TransferID = &t.ID
+			c.Charge = copyCharge(c.Charge)
+			d.charges[id] = c
+		}
+		return nil
+	})
+}
+
+// unlinkTransfer deletes a transfer, leaving its legs as plain charges.
+func (d *memData) unlinkTransfer(id int) {
+	t := d.transfers[id]
+	delete(d.transfers, id)
+	for _, leg := range []int{t.FromChargeID, t.ToChargeID} {
+		if c, ok := d.charges[leg]; ok {
+			c.TransferID = nil
+			d.charges[leg] = c
+		}
+	}
+}
+
+func (s *memoryStore) DeleteTransfer(ownerID, id int) error {
+	return s.do(func(d *memData) error {
+		if t, ok := d.transfers[id]; !ok || t.UserID != ownerID {
+			return ErrNotFound
+		}
+		d.unlinkTransfer(id)
+		return nil
+	})
+}
+
+// ---- Recurring charges ----
+
+func (s *memoryStore) SetRecurrence(chargeID, seq int, next *time.Time) error {
+	return s.do(func(d *memData) error {
+		c, ok := d.charges[chargeID]
+		if !ok {
+			return ErrNotFound
+		}
+		c.Seq, c.Next = seq, next
+		d.charges[chargeID] = c
+		return nil
+	})
+}
+
+func (s *memoryStore) LastOccurrence(templateID int) (*time.Time, error) {
+	var latest *time.Time
+	err := s.do(func(d *memData) error {
+		c, ok := d.charges[templateID]
+		if !ok {
+			return ErrNotFound
+		}
+		latest = c.Last
+		return nil
+	})
+	return latest, err
+}
+
+// templates returns the recurring charges keep selects, by ID.
+func (s *memoryStore) templates(keep func(c memCharge) bool, limit int) ([]RecurringTemplate, error) {
+	var templates []RecurringTemplate
+	err := s.do(func(d *memData) error {
+		for _, c := range d.charges {
+			if c.Recurring && keep(c) {
+				templates = append(templates, RecurringTemplate{Charge: copyCharge(c.Charge), Seq: c.Seq})
+			}
+		}
+		return nil
+	})
+	sort.Slice(templates, func(i, j int) bool { return templates[i].ID < templates[j].ID })
+	if limit > 0 && len(templates) > limit {
+		templates = templates[:limit]
+	}
+	return templates, err
+}
+
+func (s *memoryStore) DueTemplates(now time.Time, limit int) ([]RecurringTemplate, error) {
+	return s.templates(func(c memCharge) bool {
+		return c.Next != nil && !c.Next.After(now)
+	}, limit)
+}
+
+func (s *memoryStore) ListRecurringTemplates(ownerID int) ([]RecurringTemplate, error) {
+	return s.templates(func(c memCharge) bool {
+		return c.UserID == ownerID && c.Next != nil
+	}, 0)
+}
+
+func (s *memoryStore) PostOccurrence(c *Charge, date string) (bool, error) {
+	posted := false
+	err := s.do(func(d *memData) error {
+		for _, other := range d.charges {
+			if other.TemplateID != nil && c.TemplateID != nil && *other.TemplateID == *c.TemplateID && other.OccurrenceDate == date {
+				return nil
+			}
+		}
+		if err := d.insertCharge(c, date); err != nil {
+			return err
+		}
+		posted = true
+		if c.TemplateID == nil {
+			return nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, c.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if template, ok := d.charges[*c.TemplateID]; ok && (template.Last == nil || t.After(*template.Last)) {
+			template.Last = &t
+			d.charges[*c.TemplateID] = template
+		}
+		return nil
+	})
+	return posted && err == nil, err
+}
+
+// ---- Shares ----
+
+func (s *memoryStore) ListShares(userID int) ([]Share, error) {
+	var shares []Share
+	err := s.do(func(d *memData) error {
+		for _, sh := range d.shares {
+			if sh.UserID == userID || sh.UserShareID == userID {
+				shares = append(shares, sh)
+			}
+		}
+		return nil
+	})
+	sort.Slice(shares, func(i, j int) bool { return shares[i].ID < shares[j].ID })
+	return shares, err
+}
+
+func (s *memoryStore) GetShare(id int) (Share, error) {
+	var sh Share
+	err := s.do(func(d *memData) error {
+		var ok bool
+		if sh, ok = d.shares[id]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return sh, err
+}
+
+func (s *memoryStore) FindShare(ownerID, granteeID int) (Share, error) {
+	var found Share
+	err := s.do(func(d *memData) error {
+		for _, sh := range d.shares {
+			if sh.UserID == ownerID && sh.UserShareID == granteeID {
+				found = sh
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	return found, err
+}
+
+func (s *memoryStore) PutShare(sh *Share) error {
+	return s.do(func(d *memData) error {
+		for _, id := range []int{sh.UserID, sh.UserShareID} {
+			if _, ok := d.users[id]; !ok {
+				return fmt.Errorf("%w: user %d", ErrNotFound, id)
+			}
+		}
+		for id, existing := range d.shares {
+			if existing.UserID == sh.UserID && existing.UserShareID == sh.UserShareID {
+				sh.ID = id
+				d.shares[id] = *sh
+				return nil
+			}
+		}
+		sh.ID = d.nextID("shares")
+		d.shares[sh.ID] = *sh
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteShare(id int) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.shares[id]; !ok {
+			return ErrNotFound
+		}
+		delete(d.shares, id)
+		return nil
+	})
+}
+
+// ---- Savings goals ----
+
+func (s *memoryStore) ListGoals(ownerID int) ([]Goal, error) {
+	goals := []Goal{}
+	err := s.do(func(d *memData) error {
+		for _, g := range d.goals {
+			if g.UserID == ownerID {
+				g.AccountID = copyInt(g.AccountID)
+				goals = append(goals, g)
+			}
+		}
+		return nil
+	})
+	sort.Slice(goals, func(i, j int) bool {
+		if goals[i].TargetDate != goals[j].TargetDate {
+			return goals[i].TargetDate < goals[j].TargetDate
+		}
+		return goals[i].ID < goals[j].ID
+	})
+	return goals, err
+}
+
+func (s *memoryStore) GetGoal(id int) (Goal, error) {
+	var g Goal
+	err := s.do(func(d *memData) error {
+		var ok bool
+		if g, ok = d.goals[id]; !ok {
+			return ErrNotFound
+		}
+		g.AccountID = copyInt(g.AccountID)
+		return nil
+	})
+	return g, err
+}
+
+func (s *memoryStore) CreateGoal(g *Goal) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.users[g.UserID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrNotFound, g.UserID)
+		}
+		if err := d.checkAccount(g.AccountID); err != nil {
+			return err
+		}
+		g.ID = d.nextID("goals")
+		g.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		stored := *g
+		stored.AccountID, stored.Progress = copyInt(g.AccountID), nil
+		d.goals[g.ID] = stored
+		return nil
+	})
+}
+
+func (s *memoryStore) UpdateGoal(g Goal) error {
+	return s.do(func(d *memData) error {
+		old, ok := d.goals[g.ID]
+		if !ok || old.UserID != g.UserID {
+			return ErrNotFound
+		}
+		if err := d.checkAccount(g.AccountID); err != nil {
+			return err
+		}
+		old.Name, old.Target, old.TargetDate, old.AccountID = g.Name, g.Target, g.TargetDate, copyInt(g.AccountID)
+		d.goals[g.ID] = old
+		return nil
+	})
+}
+
+// deleteGoal removes a goal and its contributions.
+func (d *memData) deleteGoal(id int) {
+	delete(d.goals, id)
+	for k, c := range d.contributions {
+		if c.GoalID == id {
+			delete(d.contributions, k)
+		}
+	}
+}
+
+func (s *memoryStore) DeleteGoal(ownerID, id int) error {
+	return s.do(func(d *memData) error {
+		if g, ok := d.goals[id]; !ok || g.UserID != ownerID {
+			return ErrNotFound
+		}
+		d.deleteGoal(id)
+		return nil
+	})
+}
+
+func (s *memoryStore) ListContributions(goalID int) ([]Contribution, error) {
+	contributions := []Contribution{}
+	err := s.do(func(d *memData) error {
+		for _, c := range d.contributions {
+			if c.GoalID == goalID {
+				c.UserID = copyInt(c.UserID)
+				contributions = append(contributions, c)
+			}
+		}
+		return nil
+	})
+	sort.Slice(contributions, func(i, j int) bool {
+		if contributions[i].CreatedAt != contributions[j].CreatedAt {
+			return contributions[i].CreatedAt < contributions[j].CreatedAt
+		}
+		return contributions[i].ID < contributions[j].ID
+	})
+	return contributions, err
+}
+
+func (s *memoryStore) CreateContribution(c *Contribution) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.goals[c.GoalID]; !ok {
+			return fmt.Errorf("%w: goal %d", ErrNotFound, c.GoalID)
+		}
+		if c.UserID != nil {
+			if _, ok := d.users[*c.UserID]; !ok {
+				return fmt.Errorf("%w: user %d", ErrNotFound, *c.UserID)
+			}
+		}
+		if c.CreatedAt == "" {
+			c.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+		c.ID = d.nextID("goal_contributions")
+		stored := *c
+		stored.UserID, stored.sent = copyInt(c.UserID), ""
+		d.contributions[c.ID] = stored
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteContribution(goalID, id int) error {
+	return s.do(func(d *memData) error {
+		if c, ok := d.contributions[id]; !ok || c.GoalID != goalID {
+			return ErrNotFound
+		}
+		delete(d.contributions, id)
+		return nil
+	})
+}
+
+// ---- Envelope budgeting ----
+
+func (s *memoryStore) GetEnvelopeMode(userID int) (EnvelopeMode, error) {
+	var m EnvelopeMode
+	err := s.do(func(d *memData) error {
+		var ok bool
+		if m, ok = d.envelopeModes[userID]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return m, err
+}
+
+func (s *memoryStore) PutEnvelopeMode(m *EnvelopeMode) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.users[m.UserID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrNotFound, m.UserID)
+		}
+		if old, ok := d.envelopeModes[m.UserID]; ok {
+			m.CreatedAt = old.CreatedAt
+		} else {
+			m.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+		d.envelopeModes[m.UserID] = *m
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteEnvelopeMode(userID int) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.envelopeModes[userID]; !ok {
+			return ErrNotFound
+		}
+		delete(d.envelopeModes, userID)
+		return nil
+	})
+}
+
+func (s *memoryStore) ListEnvelopes(ownerID int) ([]Envelope, error) {
+	envelopes := []Envelope{}
+	err := s.do(func(d *memData) error {
+		for _, e := range d.envelopes {
+			if e.UserID == ownerID {
+				e.CategoryID = copyInt(e.CategoryID)
+				envelopes = append(envelopes, e)
+			}
+		}
+		return nil
+	})
+	sort.Slice(envelopes, func(i, j int) bool { return envelopes[i].ID < envelopes[j].ID })
+	return envelopes, err
+}
+
+func (s *memoryStore) GetEnvelope(id int) (Envelope, error) {
+	var e Envelope
+	err := s.do(func(d *memData) error {
+		var ok bool
+		if e, ok = d.envelopes[id]; !ok {
+			return ErrNotFound
+		}
+		e.CategoryID = copyInt(e.CategoryID)
+		return nil
+	})
+	return e, err
+}
+
+// checkEnvelope enforces the foreign keys of an envelope and that its
+// category has no other.
+func (d *memData) checkEnvelope(e Envelope) error {
+	if _, ok := d.users[e.UserID]; !ok {
+		return fmt.Errorf("%w: user %d", ErrNotFound, e.UserID)
+	}
+	if e.CategoryID == nil {
+		return nil
+	}
+	if _, ok := d.categories[*e.CategoryID]; !ok {
+		return fmt.Errorf("%w: category %d", ErrNotFound, *e.CategoryID)
+	}
+	for _, other := range d.envelopes {
+		if other.ID != e.ID && other.CategoryID != nil && *other.CategoryID == *e.CategoryID {
+			return fmt.Errorf("%w: category %d has an envelope", ErrConflict, *e.CategoryID)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) CreateEnvelope(e *Envelope) error {
+	return s.do(func(d *memData) error {
+		if err := d.checkEnvelope(*e); err != nil {
+			return err
+		}
+		e.ID = d.nextID("envelopes")
+		e.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		stored := *e
+		stored.Category, stored.CategoryID = "", copyInt(e.CategoryID)
+		d.envelopes[e.ID] = stored
+		return nil
+	})
+}
+
+func (s *memoryStore) UpdateEnvelope(e Envelope) error {
+	return s.do(func(d *memData) error {
+		old, ok := d.envelopes[e.ID]
+		if !ok || old.UserID != e.UserID {
+			return ErrNotFound
+		}
+		if err := d.checkEnvelope(e); err != nil {
+			return err
+		}
+		old.Name, old.CategoryID = e.Name, copyInt(e.CategoryID)
+		d.envelopes[e.ID] = old
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteEnvelope(ownerID, id int) error {
+	return s.do(func(d *memData) error {
+		if e, ok := d.envelopes[id]; !ok || e.UserID != ownerID {
+			return ErrNotFound
+		}
+		delete(d.envelopes, id)
+		for k, m := range d.envelopeMoves {
+			if m.FromEnvelopeID != nil && *m.FromEnvelopeID == id {
+				m.FromEnvelopeID = nil
+			}
+			if m.ToEnvelopeID != nil && *m.ToEnvelopeID == id {
+				m.ToEnvelopeID = nil
+			}
+			d.envelopeMoves[k] = m
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) ListEnvelopeMoves(ownerID int) ([]EnvelopeMove, error) {
+	moves := []EnvelopeMove{}
+	err := s.do(func(d *memData) error {
+		for _, m := range d.envelopeMoves {
+			if m.UserID == ownerID {
+				m.FromEnvelopeID, m.ToEnvelopeID, m.ActorID = copyInt(m.FromEnvelopeID), copyInt(m.ToEnvelopeID), copyInt(m.ActorID)
+				moves = append(moves, m)
+			}
+		}
+		return nil
+	})
+	sort.Slice(moves, func(i, j int) bool {
+		if moves[i].Month != moves[j].Month {
+			return moves[i].Month < moves[j].Month
+		}
+		return moves[i].ID < moves[j].ID
+	})
+	return moves, err
+}
+
+func (s *memoryStore) CreateEnvelopeMove(m *EnvelopeMove) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.users[m.UserID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrNotFound, m.UserID)
+		}
+		for _, id := range []*int{m.FromEnvelopeID, m.ToEnvelopeID} {
+			if id == nil {
+				continue
+			}
+			if _, ok := d.envelopes[*id]; !ok {
+				return fmt.Errorf("%w: envelope %d", ErrNotFound, *id)
+			}
+		}
+		if m.ActorID != nil {
+			if _, ok := d.users[*m.ActorID]; !ok {
+				return fmt.Errorf("%w: user %d", ErrNotFound, *m.ActorID)
+			}
+		}
+		m.ID = d.nextID("envelope_moves")
+		m.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		stored := *m
+		stored.FromEnvelopeID, stored.ToEnvelopeID, stored.ActorID = copyInt(m.FromEnvelopeID), copyInt(m.ToEnvelopeID), copyInt(m.ActorID)
+		stored.sent = ""
+		d.envelopeMoves[m.ID] = stored
+		return nil
+	})
+}
+
+// ---- Settlements ----
+
+func (s *memoryStore) ListSettlements(userID int) ([]Settlement, error) {
+	settlements := []Settlement{}
+	err := s.do(func(d *memData) error {
+		for _, st := range d.settlements {
+			if st.FromUserID == userID || st.ToUserID == userID {
+				settlements = append(settlements, st)
+			}
+		}
+		return nil
+	})
+	sort.Slice(settlements, func(i, j int) bool {
+		if settlements[i].CreatedAt != settlements[j].CreatedAt {
+			return settlements[i].CreatedAt > settlements[j].CreatedAt
+		}
+		return settlements[i].ID > settlements[j].ID
+	})
+	return settlements, err
+}
+
+func (s *memoryStore) GetSettlement(id int) (Settlement, error) {
+	var st Settlement
+	err := s.do(func(d *memData) error {
+		var ok bool
+		if st, ok = d.settlements[id]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return st, err
+}
+
+func (s *memoryStore) CreateSettlement(st *Settlement) error {
+	return s.do(func(d *memData) error {
+		for _, id := range []int{st.FromUserID, st.ToUserID} {
+			if _, ok := d.users[id]; !ok {
+				return fmt.Errorf("%w: user %d", ErrNotFound, id)
+			}
+		}
+		if st.FromUserID == st.ToUserID || st.Amount.Minor <= 0 {
+			return fmt.Errorf("invalid settlement")
+		}
+		if st.CreatedAt == "" {
+			st.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+		st.ID = d.nextID("settlements")
+		d.settlements[st.ID] = *st
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteSettlement(id int) error {
+	return s.do(func(d *memData) error {
+		if _, ok := d.settlements[id]; !ok {
+			return ErrNotFound
+		}
+		delete(d.settlements, id)
+		return nil
+	})
+}
+
+// ---- Audit log ----
+
+func (s *memoryStore) RecordAudit(e *AuditEvent) error {
+	return s.do(func(d *memData) error {
+		e.ID = d.nextID("audit_events")
+		e.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		d.audit = append(d.audit, *e)
+		return nil
+	})
+}
+
+func (s *memoryStore) ListAudit(f *AuditFilter) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	err := s.do(func(d *memData) error {
+		for i := len(d.audit) - 1; i >= 0; i-- {
+			e := d.audit[i]
+			t, _ := time.Parse(time.RFC3339Nano, e.CreatedAt)
+			switch {
+			case f.OwnerID != 0 && e.OwnerID != f.OwnerID,
+				f.ActorID != 0 && (e.ActorID == nil || *e.ActorID != f.ActorID),
+				f.EntityType != "" && e.EntityType != f.EntityType,
+				f.EntityID != 0 && e.EntityID != f.EntityID,
+				f.Action != "" && e.Action != f.Action,
+				f.From != nil && t.Before(*f.From),
+				f.To != nil && !t.Before(*f.To),
+				f.BeforeID != 0 && e.ID >= f.BeforeID:
+				continue
+			}
+			events = append(events, e)
+			if f.Limit > 0 && len(events) == f.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return events, err
+}
@@ -0,0 +1,1725 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// --------------------------
+//     PostgreSQL Store
+// --------------------------
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// postgresStore implements Store on the schema in migrations/.
+type postgresStore struct {
+	db   *sql.DB
+	q    queryer // db, or the transaction in progress
+	inTx bool
+}
+
+func newPostgresStore(db *sql.DB) *postgresStore {
+	return &postgresStore{db: db, q: db}
+}
+
+func (s *postgresStore) Tx(fn func(Store) error) error {
+	if s.inTx {
+		return fn(s)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(&postgresStore{db: s.db, q: tx, inTx: true}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %v", err)
+	}
+	return nil
+}
+
+// pgError maps driver errors onto the Store's sentinel errors.
+func pgError(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505": // unique_violation
+			return fmt.Errorf("%w: %s", ErrConflict, pqErr.Detail)
+		case "23503": // foreign_key_violation
+			return fmt.Errorf("%w: %s", ErrNotFound, pqErr.Detail)
+		}
+	}
+	return err
+}
+
+// affectedOne returns ErrNotFound when an UPDATE or DELETE matched nothing.
+func affectedOne(result sql.Result, err error) error {
+	if err != nil {
+		return pgError(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// forUpdate locks the rows a SELECT returns when run in a transaction.
+func (s *postgresStore) forUpdate() string {
+	if s.inTx {
+		return "FOR UPDATE"
+	}
+	return ""
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// ---- Users ----
+
+const userColumns = `id, username, password, permissions, must_change_password`
+
+func scanUser(row scanner) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Username, &u.Password, &u.Permissions, &u.MustChangePassword)
+	return u, pgError(err)
+}
+
+func (s *postgresStore) ListUsers() ([]User, error) {
+	rows, err := s.q.Query(`SELECT ` + userColumns + ` FROM users ORDER BY id ` + s.forUpdate())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *postgresStore) GetUser(id int) (User, error) {
+	return scanUser(s.q.QueryRow(`SELECT `+userColumns+` FROM users WHERE id=$1`, id))
+}
+
+func (s *postgresStore) GetUserByUsername(username string) (User, error) {
+	return scanUser(s.q.QueryRow(`SELECT `+userColumns+` FROM users WHERE username=$1`, username))
+}
+
+func (s *postgresStore) CreateUser(u *User) error {
+	err := s.q.QueryRow(`
+		INSERT INTO users (username, password, permissions, must_change_password)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, u.Username, u.Password, u.Permissions, u.MustChangePassword).Scan(&u.ID)
+	return pgError(err)
+}
+
+func (s *postgresStore) UpdateUser(u User) error {
+	return affectedOne(s.q.Exec(`
+		UPDATE users
+		SET username=$1, password=$2, permissions=$3, must_change_password=$4
+		WHERE id=$5
+	`, u.Username, u.Password, u.Permissions, u.MustChangePassword, u.ID))
+}
+
+func (s *postgresStore) DeleteUser(id int) error {
+	return affectedOne(s.q.Exec(`DELETE FROM users WHERE id=$1`, id))
+}
+
+// ---- Tokens ----
+
+func (s *postgresStore) CreateRefreshToken(t *RefreshToken) error {
+	err := s.q.QueryRow(`
+		INSERT INTO refresh_tokens (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, t.UserID, t.Hash, t.ExpiresAt).Scan(&t.ID)
+	return pgError(err)
+}
+
+func (s *postgresStore) GetRefreshToken(hash string) (RefreshToken, error) {
+	t := RefreshToken{Hash: hash}
+	var revokedAt sql.NullTime
+	err := s.q.QueryRow(`
+		SELECT id, user_id, expires_at, revoked_at
+		FROM refresh_tokens
+		WHERE token_hash=$1
+		`+s.forUpdate(), hash).Scan(&t.ID, &t.UserID, &t.ExpiresAt, &revokedAt)
+	if err != nil {
+		return t, pgError(err)
+	}
+	if revokedAt.Valid {
+		t.RevokedAt = &revokedAt.Time
+	}
+	return t, nil
+}
+
+func (s *postgresStore) RevokeRefreshToken(id int) error {
+	_, err := s.q.Exec(`
+		UPDATE refresh_tokens
+		SET revoked_at=CURRENT_TIMESTAMP
+		WHERE id=$1 AND revoked_at IS NULL
+	`, id)
+	return err
+}
+
+func (s *postgresStore) RevokeUserTokens(userID int) error {
+	if _, err := s.q.Exec(`UPDATE users SET token_generation=token_generation+1 WHERE id=$1`, userID); err != nil {
+		return fmt.Errorf("revoking access tokens: %v", err)
+	}
+	_, err := s.q.Exec(`
+		UPDATE refresh_tokens
+		SET revoked_at=CURRENT_TIMESTAMP
+		WHERE user_id=$1 AND revoked_at IS NULL
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("revoking refresh tokens: %v", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) TokenGeneration(userID int) (int, error) {
+	var gen int
+	err := s.q.QueryRow(`SELECT token_generation FROM users WHERE id=$1`, userID).Scan(&gen)
+	return gen, pgError(err)
+}
+
+func (s *postgresStore) RevokeAccessToken(jti string, userID int, expires time.Time) error {
+	if _, err := s.q.Exec(`DELETE FROM revoked_tokens WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		return fmt.Errorf("pruning revoked tokens: %v", err)
+	}
+	_, err := s.q.Exec(`
+		INSERT INTO revoked_tokens (jti, user_id, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (jti) DO NOTHING
+	`, jti, userID, expires)
+	return err
+}
+
+func (s *postgresStore) TokenRevocation(userID int, jti string) (TokenRevocation, error) {
+	var r TokenRevocation
+	err := s.q.QueryRow(`
+		SELECT u.token_generation,
+		       EXISTS (SELECT 1 FROM revoked_tokens WHERE jti=$2)
+		FROM users u
+		WHERE u.id=$1
+	`, userID, jti).Scan(&r.Generation, &r.JTIRevoked)
+	return r, pgError(err)
+}
+
+// ---- Login throttling ----
+
+func (s *postgresStore) GetLoginThrottle(key string) (LoginThrottle, error) {
+	t := LoginThrottle{Key: key}
+	err := s.q.QueryRow(`SELECT failures, last_failure_at FROM login_throttles WHERE key=$1`, key).
+		Scan(&t.Failures, &t.LastFailure)
+	return t, pgError(err)
+}
+
+func (s *postgresStore) RecordLoginFailure(key string, at, since time.Time) (LoginThrottle, error) {
+	if _, err := s.q.Exec(`DELETE FROM login_throttles WHERE last_failure_at < $1`, since); err != nil {
+		return LoginThrottle{}, fmt.Errorf("pruning login throttles: %v", err)
+	}
+	t := LoginThrottle{Key: key}
+	err := s.q.QueryRow(`
+		INSERT INTO login_throttles (key, failures, last_failure_at)
+		VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET failures = login_throttles.failures + 1, last_failure_at = EXCLUDED.last_failure_at
+		RETURNING failures, last_failure_at
+	`, key, at).Scan(&t.Failures, &t.LastFailure)
+	return t, pgError(err)
+}
+
+func (s *postgresStore) ClearLoginThrottle(key string) error {
+	_, err := s.q.Exec(`DELETE FROM login_throttles WHERE key=$1`, key)
+	return err
+}
+
+// loginThrottleLockClass namespaces the advisory locks LockLoginThrottle
+// takes, keyed by a hash of the throttle key.
+const loginThrottleLockClass = 7_241_022
+
+func (s *postgresStore) LockLoginThrottle(key string) error {
+	_, err := s.q.Exec(`SELECT pg_advisory_xact_lock($1::int, hashtext($2))`, loginThrottleLockClass, key)
+	return err
+}
+
+func (s *postgresStore) RecordLoginAttempt(a *LoginAttempt) error {
+	err := s.q.QueryRow(`
+		INSERT INTO login_attempts (username, user_id, ip, user_agent, success, reason)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, a.Username, a.UserID, a.IP, a.UserAgent, a.Success, a.Reason).Scan(&a.ID, &a.CreatedAt)
+	return pgError(err)
+}
+
+func (s *postgresStore) ListLoginAttempts(f *LoginAttemptFilter) ([]LoginAttempt, error) {
+	where := []string{"true"}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if f.Username != "" {
+		where = append(where, "username="+arg(f.Username))
+	}
+	if f.UserID != 0 {
+		where = append(where, "user_id="+arg(f.UserID))
+	}
+	if f.IP != "" {
+		where = append(where, "ip="+arg(f.IP))
+	}
+	if f.BeforeID != 0 {
+		where = append(where, "id < "+arg(f.BeforeID))
+	}
+	query := `
+		SELECT id, username, user_id, ip, user_agent, success, reason, created_at
+		FROM login_attempts
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY id DESC`
+	if f.Limit > 0 {
+		query += fmt.Sprintf("\n\t\tLIMIT %d", f.Limit)
+	}
+
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []LoginAttempt{}
+	for rows.Next() {
+		var a LoginAttempt
+		var userID sql.NullInt64
+		if err := rows.Scan(&a.ID, &a.Username, &userID, &a.IP, &a.UserAgent, &a.Success, &a.Reason, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		a.UserID = nullInt(userID)
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// ---- Two-factor authentication ----
+
+func (s *postgresStore) GetTwoFactor(userID int) (TwoFactor, error) {
+	t := TwoFactor{UserID: userID}
+	var confirmedAt sql.NullTime
+	err := s.q.QueryRow(`
+		SELECT required, secret, confirmed_at, last_step FROM two_factor WHERE user_id=$1 `+s.forUpdate(), userID,
+	).Scan(&t.Required, &t.Secret, &confirmedAt, &t.LastStep)
+	if confirmedAt.Valid {
+		t.ConfirmedAt = &confirmedAt.Time
+	}
+	return t, pgError(err)
+}
+
+func (s *postgresStore) PutTwoFactor(t TwoFactor) error {
+	_, err := s.q.Exec(`
+		INSERT INTO two_factor (user_id, required, secret, confirmed_at, last_step)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE
+		SET required = EXCLUDED.required, secret = EXCLUDED.secret,
+		    confirmed_at = EXCLUDED.confirmed_at, last_step = EXCLUDED.last_step
+	`, t.UserID, t.Required, t.Secret, t.ConfirmedAt, t.LastStep)
+	return pgError(err)
+}
+
+func (s *postgresStore) SetRecoveryCodes(userID int, hashes []string) error {
+	if _, err := s.q.Exec(`DELETE FROM recovery_codes WHERE user_id=$1`, userID); err != nil {
+		return err
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	_, err := s.q.Exec(`
+		INSERT INTO recovery_codes (user_id, code_hash)
+		SELECT $1, UNNEST($2::text[])
+	`, userID, pq.Array(hashes))
+	return pgError(err)
+}
+
+func (s *postgresStore) UseRecoveryCode(userID int, hash string) error {
+	return affectedOne(s.q.Exec(`DELETE FROM recovery_codes WHERE user_id=$1 AND code_hash=$2`, userID, hash))
+}
+
+func (s *postgresStore) CountRecoveryCodes(userID int) (int, error) {
+	var n int
+	err := s.q.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id=$1`, userID).Scan(&n)
+	return n, err
+}
+
+func (s *postgresStore) CreateLoginChallenge(c *LoginChallenge) error {
+	err := s.q.QueryRow(`
+		INSERT INTO login_challenges (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, c.UserID, c.Hash, c.ExpiresAt).Scan(&c.ID)
+	return pgError(err)
+}
+
+func (s *postgresStore) GetLoginChallenge(hash string) (LoginChallenge, error) {
+	var c LoginChallenge
+	err := s.q.QueryRow(`
+		SELECT id, user_id, token_hash, expires_at FROM login_challenges WHERE token_hash=$1 `+s.forUpdate(), hash,
+	).Scan(&c.ID, &c.UserID, &c.Hash, &c.ExpiresAt)
+	return c, pgError(err)
+}
+
+func (s *postgresStore) DeleteLoginChallenge(id int) error {
+	if err := affectedOne(s.q.Exec(`DELETE FROM login_challenges WHERE id=$1`, id)); err != nil {
+		return err
+	}
+	if _, err := s.q.Exec(`DELETE FROM login_challenges WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		return fmt.Errorf("pruning login challenges: %v", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) CreatePasswordReset(pr *PasswordReset) error {
+	if _, err := s.q.Exec(`DELETE FROM password_resets WHERE expires_at < CURRENT_TIMESTAMP`); err != nil {
+		return fmt.Errorf("pruning password resets: %v", err)
+	}
+	err := s.q.QueryRow(`
+		INSERT INTO password_resets (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, pr.UserID, pr.Hash, pr.ExpiresAt).Scan(&pr.ID)
+	return pgError(err)
+}
+
+func (s *postgresStore) GetPasswordReset(hash string) (PasswordReset, error) {
+	var pr PasswordReset
+	err := s.q.QueryRow(`
+		SELECT id, user_id, token_hash, expires_at FROM password_resets WHERE token_hash=$1 `+s.forUpdate(), hash,
+	).Scan(&pr.ID, &pr.UserID, &pr.Hash, &pr.ExpiresAt)
+	return pr, pgError(err)
+}
+
+func (s *postgresStore) DeletePasswordResets(userID int) error {
+	_, err := s.q.Exec(`DELETE FROM password_resets WHERE user_id=$1`, userID)
+	return err
+}
+
+// ---- Invites ----
+
+const inviteColumns = `id, code_hash, note, created_by, expires_at, used_by, used_at, created_at`
+
+func scanInvite(row scanner) (Invite, error) {
+	var i Invite
+	var createdBy, usedBy sql.NullInt64
+	var expiresAt, usedAt sql.NullTime
+	err := row.Scan(&i.ID, &i.Hash, &i.Note, &createdBy, &expiresAt, &usedBy, &usedAt, &i.CreatedAt)
+	i.CreatedBy, i.UsedBy = nullInt(createdBy), nullInt(usedBy)
+	if expiresAt.Valid {
+		i.ExpiresAt = &expiresAt.Time
+	}
+	if usedAt.Valid {
+		i.UsedAt = &usedAt.Time
+	}
+	return i, err
+}
+
+func (s *postgresStore) CreateInvite(i *Invite) error {
+	err := s.q.QueryRow(`
+		INSERT INTO invites (code_hash, note, created_by, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, i.Hash, i.Note, i.CreatedBy, i.ExpiresAt).Scan(&i.ID, &i.CreatedAt)
+	return pgError(err)
+}
+
+func (s *postgresStore) ListInvites() ([]Invite, error) {
+	rows, err := s.q.Query(`SELECT ` + inviteColumns + ` FROM invites ORDER BY id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []Invite
+	for rows.Next() {
+		i, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+func (s *postgresStore) GetInvite(hash string) (Invite, error) {
+	i, err := scanInvite(s.q.QueryRow(`SELECT `+inviteColumns+` FROM invites WHERE code_hash=$1 `+s.forUpdate(), hash))
+	return i, pgError(err)
+}
+
+func (s *postgresStore) UseInvite(id, userID int) error {
+	return affectedOne(s.q.Exec(`
+		UPDATE invites SET used_by=$2, used_at=CURRENT_TIMESTAMP WHERE id=$1 AND used_by IS NULL
+	`, id, userID))
+}
+
+func (s *postgresStore) DeleteInvite(id int) error {
+	return affectedOne(s.q.Exec(`DELETE FROM invites WHERE id=$1`, id))
+}
+
+// ---- Lists ----
+
+// int64s converts IDs for pq.Array, which has no []int support.
+func int64s(ids []int) []int64 {
+	converted := make([]int64, len(ids))
+	for i, id := range ids {
+		converted[i] = int64(id)
+	}
+	return converted
+}
+
+// listSQL builds the SELECT of columns from table matching f.
+func listSQL(f *ListFilter, spec listSpec, columns, table string) (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where = append(where, "user_id="+arg(f.OwnerID))
+	if spec.DateColumn != "" {
+		if f.From != nil {
+			where = append(where, spec.DateColumn+" >= "+arg(*f.From))
+		}
+		if f.To != nil {
+			where = append(where, spec.DateColumn+" < "+arg(*f.To))
+		}
+	}
+	if f.CategoryIDs != nil {
+		ids := arg(pq.Array(int64s(f.CategoryIDs)))
+		if spec.Split {
+			where = append(where, "(category_id = ANY("+ids+") OR id IN (SELECT charge_id FROM charge_splits WHERE category_id = ANY("+ids+")))")
+		} else {
+			where = append(where, "category_id = ANY("+ids+")")
+		}
+	}
+	if spec.Tagged && len(f.Tags) > 0 {
+		tagged := `SELECT ct.charge_id FROM charge_tags ct JOIN tags t ON t.id = ct.tag_id
+			WHERE t.user_id=` + arg(f.OwnerID) + ` AND t.name = ANY(` + arg(pq.Array(f.Tags)) + `)`
+		if !f.AnyTag {
+			tagged += ` GROUP BY ct.charge_id HAVING COUNT(*) = ` + arg(len(f.Tags))
+		}
+		where = append(where, "id IN ("+tagged+")")
+	}
+	if spec.Accounts && f.AccountID != 0 {
+		where = append(where, "account_id="+arg(f.AccountID))
+	}
+	if spec.Directed && f.Direction != "" {
+		where = append(where, "direction="+arg(f.Direction))
+	}
+	if f.Currency != "" {
+		where = append(where, "currency="+arg(f.Currency))
+	}
+	if f.MinAmount != nil {
+		where = append(where, "amount >= "+arg(f.MinAmount.String())+"::numeric")
+	}
+	if f.MaxAmount != nil {
+		where = append(where, "amount <= "+arg(f.MaxAmount.String())+"::numeric")
+	}
+	if f.Query != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(f.Query)
+		where = append(where, "name ILIKE "+arg("%"+escaped+"%"))
+	}
+
+	field := spec.field(f)
+	order, cmp := "ASC", ">"
+	if f.Order == "desc" {
+		order, cmp = "DESC", "<"
+	}
+	if f.After != nil {
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s::%s, %s)",
+			field.Expr, cmp, arg(f.After.Value), field.Type, arg(f.After.ID)))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM %s
+		WHERE %s
+		ORDER BY %s %s, id %s`, columns, table, strings.Join(where, " AND "), field.Expr, order, order)
+	if f.Limit > 0 {
+		query += fmt.Sprintf("\n\t\tLIMIT %d", f.Limit)
+	}
+	return query, args
+}
+
+// ---- Categories ----
+
+const categoryColumns = `id, name, parent_id, user_id`
+
+func scanCategory(row scanner) (Category, error) {
+	var c Category
+	var parentID sql.NullInt64
+	err := row.Scan(&c.ID, &c.Name, &parentID, &c.UserID)
+	c.ParentID = nullInt(parentID)
+	return c, pgError(err)
+}
+
+func (s *postgresStore) ListCategories(ownerID int) ([]Category, error) {
+	rows, err := s.q.Query(`SELECT `+categoryColumns+` FROM categories WHERE user_id=$1 ORDER BY id`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []Category{}
+	for rows.Next() {
+		c, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+func (s *postgresStore) GetCategory(id int) (Category, error) {
+	return scanCategory(s.q.QueryRow(`SELECT `+categoryColumns+` FROM categories WHERE id=$1 `+s.forUpdate(), id))
+}
+
+func (s *postgresStore) CreateCategory(c *Category) error {
+	err := s.q.QueryRow(`
+		INSERT INTO categories (name, parent_id, user_id)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, c.Name, c.ParentID, c.UserID).Scan(&c.ID)
+	return pgError(err)
+}
+
+// categoryPathsSQL rewrites the category text of a table's rows filed under
+// the categories of user $1 to their current paths.
+const categoryPathsSQL = `
+	WITH RECURSIVE paths AS (
+		SELECT id, name::text AS path FROM categories WHERE user_id=$1 AND parent_id IS NULL
+		UNION ALL
+		SELECT c.id, p.path || ' > ' || c.name FROM categories c JOIN paths p ON c.parent_id = p.id
+	)
+	UPDATE %s t SET category = paths.path
+	FROM paths
+	WHERE t.category_id = paths.id AND t.category IS DISTINCT FROM paths.path`
+
+func (s *postgresStore) UpdateCategory(c Category) error {
+	err := affectedOne(s.q.Exec(`
+		UPDATE categories
+		SET name=$1, parent_id=$2
+		WHERE id=$3 AND user_id=$4
+	`, c.Name, c.ParentID, c.ID, c.UserID))
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"budgets", "charges", "charge_splits"} {
+		if _, err := s.q.Exec(fmt.Sprintf(categoryPathsSQL, table), c.UserID); err != nil {
+			return fmt.Errorf("renaming %s categories: %v", table, err)
+		}
+	}
+	return nil
+}
+
+func (s *postgresStore) DeleteCategory(ownerID, id int) error {
+	var hasChildren bool
+	if err := s.q.QueryRow(`SELECT EXISTS (SELECT 1 FROM categories WHERE parent_id=$1)`, id).Scan(&hasChildren); err != nil {
+		return err
+	}
+	if hasChildren {
+		return fmt.Errorf("%w: category %d has subcategories", ErrConflict, id)
+	}
+	for _, table := range []string{"budgets", "charges"} {
+		if _, err := s.q.Exec(`UPDATE `+table+` SET category='' WHERE category_id=$1 AND user_id=$2`, id, ownerID); err != nil {
+			return err
+		}
+	}
+	if _, err := s.q.Exec(`UPDATE charge_splits SET category='' WHERE category_id=$1`, id); err != nil {
+		return err
+	}
+	return affectedOne(s.q.Exec(`DELETE FROM categories WHERE id=$1 AND user_id=$2`, id, ownerID))
+}
+
+// ---- Accounts ----
+
+const accountColumns = `id, name, type, currency, opening_balance, user_id`
+
+func scanAccount(row scanner) (Account, error) {
+	var a Account
+	err := row.Scan(&a.ID, &a.Name, &a.Type, &a.OpeningBalance.Currency, &a.OpeningBalance, &a.UserID)
+	return a, pgError(err)
+}
+
+func (s *postgresStore) ListAccounts(ownerID int) ([]Account, error) {
+	rows, err := s.q.Query(`SELECT `+accountColumns+` FROM accounts WHERE user_id=$1 ORDER BY LOWER(name), id`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []Account{}
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+func (s *postgresStore) GetAccount(id int) (Account, error) {
+	return scanAccount(s.q.QueryRow(`SELECT `+accountColumns+` FROM accounts WHERE id=$1 `+s.forUpdate(), id))
+}
+
+func (s *postgresStore) CreateAccount(a *Account) error {
+	err := s.q.QueryRow(`
+		INSERT INTO accounts (name, type, currency, opening_balance, user_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, a.Name, a.Type, a.OpeningBalance.Currency, a.OpeningBalance, a.UserID).Scan(&a.ID)
+	return pgError(err)
+}
+
+func (s *postgresStore) UpdateAccount(a Account) error {
+	return affectedOne(s.q.Exec(`
+		UPDATE accounts
+		SET name=$1, type=$2, currency=$3, opening_balance=$4
+		WHERE id=$5 AND user_id=$6
+	`, a.Name, a.Type, a.OpeningBalance.Currency, a.OpeningBalance, a.ID, a.UserID))
+}
+
+func (s *postgresStore) DeleteAccount(ownerID, id int) error {
+	var posted bool
+	if err := s.q.QueryRow(`SELECT EXISTS (SELECT 1 FROM charges WHERE account_id=$1)`, id).Scan(&posted); err != nil {
+		return err
+	}
+	if posted {
+		return fmt.Errorf("%w: account %d has charges", ErrConflict, id)
+	}
+	return affectedOne(s.q.Exec(`DELETE FROM accounts WHERE id=$1 AND user_id=$2`, id, ownerID))
+}
+
+// ---- Budgets ----
+
+const budgetColumns = `id, name, currency, amount, category, category_id, period, rollover, rollover_cap, user_id, created_at`
+
+// nullInt converts a nullable integer column to *int.
+func nullInt(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	i := int(n.Int64)
+	return &i
+}
+
+func scanBudget(row scanner) (Budget, error) {
+	var b Budget
+	var category, period sql.NullString
+	var categoryID sql.NullInt64
+	var rolloverCap sql.NullString
+	err := row.Scan(&b.ID, &b.Name, &b.Amount.Currency, &b.Amount, &category, &categoryID, &period,
+		&b.Rollover, &rolloverCap, &b.UserID, &b.CreatedAt)
+	b.Category, b.CategoryID, b.Period = category.String, nullInt(categoryID), period.String
+	if err == nil && rolloverCap.Valid {
+		limit, perr := parseMoney(rolloverCap.String, b.Amount.Currency)
+		if perr != nil {
+			return b, fmt.Errorf("scanning rollover cap: %v", perr)
+		}
+		b.RolloverCap = &limit
+	}
+	return b, pgError(err)
+}
+
+func (s *postgresStore) ListBudgets(f *ListFilter) ([]Budget, error) {
+	query, args := listSQL(f, budgetListSpec, budgetColumns, "budgets")
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	budgets := []Budget{}
+	for rows.Next() {
+		b, err := scanBudget(rows)
+		if err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, b)
+	}
+	return budgets, rows.Err()
+}
+
+func (s *postgresStore) GetBudget(id int) (Budget, error) {
+	return scanBudget(s.q.QueryRow(`SELECT `+budgetColumns+` FROM budgets WHERE id=$1 `+s.forUpdate(), id))
+}
+
+func (s *postgresStore) CreateBudget(b *Budget) error {
+	err := s.q.QueryRow(`
+		INSERT INTO budgets (name, amount, currency, category, category_id, period, rollover, rollover_cap, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at
+	`, b.Name, b.Amount, b.Amount.Currency, b.Category, b.CategoryID, b.Period, budgetRollover(b), b.RolloverCap, b.UserID).Scan(&b.ID, &b.CreatedAt)
+	return pgError(err)
+}
+
+func (s *postgresStore) UpdateBudget(b Budget) error {
+	return affectedOne(s.q.Exec(`
+		UPDATE budgets
+		SET name=$1, amount=$2, currency=$3, category=$4, category_id=$5, period=$6, rollover=$7, rollover_cap=$8
+		WHERE id=$9 AND user_id=$10
+	`, b.Name, b.Amount, b.Amount.Currency, b.Category, b.CategoryID, b.Period, budgetRollover(&b), b.RolloverCap, b.ID, b.UserID))
+}
+
+// budgetRollover defaults b's rollover policy to none, as stored.
+func budgetRollover(b *Budget) string {
+	if b.Rollover == "" {
+		b.Rollover = RolloverNone
+	}
+	return b.Rollover
+}
+
+func (s *postgresStore) DeleteBudget(ownerID, id int) error {
+	return affectedOne(s.q.Exec(`DELETE FROM budgets WHERE id=$1 AND user_id=$2`, id, ownerID))
+}
+
+func (s *postgresStore) ListBudgetSnapshots(budgetID int) ([]BudgetSnapshot, error) {
+	rows, err := s.q.Query(`
+		SELECT budget_id, period_start, period_end, currency, allocated, carried_in, spent, carried_out, rollover, computed_at
+		FROM budget_snapshots
+		WHERE budget_id=$1
+		ORDER BY period_start
+	`, budgetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snapshots []BudgetSnapshot
+	for rows.Next() {
+		var sn BudgetSnapshot
+		var currency string
+		if err := rows.Scan(&sn.BudgetID, &sn.PeriodStart, &sn.PeriodEnd, &currency, &sn.Allocated, &sn.CarriedIn,
+			&sn.Spent, &sn.CarriedOut, &sn.Rollover, &sn.ComputedAt); err != nil {
+			return nil, err
+		}
+		sn.Allocated.Currency, sn.CarriedIn.Currency, sn.Spent.Currency, sn.CarriedOut.Currency = currency, currency, currency, currency
+		sn.PeriodStart, sn.PeriodEnd, sn.ComputedAt = sn.PeriodStart.UTC(), sn.PeriodEnd.UTC(), sn.ComputedAt.UTC()
+		snapshots = append(snapshots, sn)
+	}
+	return snapshots, rows.Err()
+}
+
+func (s *postgresStore) PutBudgetSnapshot(sn BudgetSnapshot) error {
+	_, err := s.q.Exec(`
+		INSERT INTO budget_snapshots (budget_id, period_start, period_end, currency, allocated, carried_in, spent, carried_out, rollover, computed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (budget_id, period_start) DO UPDATE
+		SET period_end=EXCLUDED.period_end, currency=EXCLUDED.currency, allocated=EXCLUDED.allocated,
+		    carried_in=EXCLUDED.carried_in, spent=EXCLUDED.spent, carried_out=EXCLUDED.carried_out,
+		    rollover=EXCLUDED.rollover, computed_at=EXCLUDED.computed_at
+	`, sn.BudgetID, sn.PeriodStart, sn.PeriodEnd, sn.Allocated.Currency, sn.Allocated, sn.CarriedIn, sn.Spent, sn.CarriedOut,
+		sn.Rollover, sn.ComputedAt)
+	return pgError(err)
+}
+
+func (s *postgresStore) DeleteBudgetSnapshots(budgetID int, from time.Time) error {
+	_, err := s.q.Exec(`DELETE FROM budget_snapshots WHERE budget_id=$1 AND period_start >= $2`, budgetID, from)
+	return err
+}
+
+// ---- Charges ----
+
+const chargeColumns = `id, name, currency, amount, category, category_id, periodical, user_id, created_at,
+		       recurring, recurrence_day, recurrence_end, template_id, account_id, direction,
+		       (SELECT tr.id FROM transfers tr WHERE charges.id IN (tr.from_charge_id, tr.to_charge_id)) AS transfer_id,
+		       (SELECT json_agg(json_build_object('amount', sp.amount, 'category', sp.category,
+		                                          'category_id', sp.category_id, 'note', sp.note) ORDER BY sp.position)
+		        FROM charge_splits sp WHERE sp.charge_id = charges.id) AS splits,
+		       share_mode,
+		       (SELECT json_agg(json_build_object('user_id', cp.user_id, 'percent', cp.percent, 'amount', cp.amount) ORDER BY cp.position)
+		        FROM charge_participants cp WHERE cp.charge_id = charges.id) AS participants,
+		       ARRAY(SELECT t.name FROM charge_tags ct JOIN tags t ON t.id = ct.tag_id
+		             WHERE ct.charge_id = charges.id ORDER BY t.name) AS tags`
+
+func scanCharge(row scanner, extra ...interface{}) (Charge, error) {
+	var c Charge
+	var periodical sql.NullString
+	var categoryID, day, templateID, accountID, transferID sql.NullInt64
+	var end sql.NullTime
+	var splits, participants []byte
+	var shareMode sql.NullString
+	dest := []interface{}{&c.ID, &c.Name, &c.Amount.Currency, &c.Amount, &c.Category, &categoryID, &periodical, &c.UserID, &c.CreatedAt,
+		&c.Recurring, &day, &end, &templateID, &accountID, &c.Direction, &transferID, &splits, &shareMode, &participants, pq.Array(&c.Tags)}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return c, pgError(err)
+	}
+	c.Periodical = periodical.String
+	c.CategoryID, c.RecurrenceDay, c.TemplateID = nullInt(categoryID), nullInt(day), nullInt(templateID)
+	c.AccountID, c.TransferID = nullInt(accountID), nullInt(transferID)
+	splitLines, err := scanSplits(splits, c.Amount.Currency)
+	if err != nil {
+		return c, err
+	}
+	c.Splits = splitLines
+	if c.Participants, err = scanParticipants(participants, c.Amount.Currency); err != nil {
+		return c, err
+	}
+	if c.Participants != nil {
+		c.ShareMode = shareMode.String
+	}
+	if end.Valid {
+		e := end.Time.Format("2006-01-02")
+		c.RecurrenceEnd = &e
+	}
+	return c, nil
+}
+
+func (s *postgresStore) ListCharges(f *ListFilter) ([]Charge, error) {
+	query, args := listSQL(f, chargeListSpec, chargeColumns, "charges")
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	charges := []Charge{}
+	for rows.Next() {
+		c, err := scanCharge(rows)
+		if err != nil {
+			return nil, err
+		}
+		charges = append(charges, c)
+	}
+	return charges, rows.Err()
+}
+
+func (s *postgresStore) GetCharge(id int) (Charge, error) {
+	return scanCharge(s.q.QueryRow(`SELECT `+chargeColumns+` FROM charges WHERE id=$1 `+s.forUpdate(), id))
+}
+
+// scanSplits decodes the JSON array of a charge's split lines, NULL when
+// it has none.
+func scanSplits(data []byte, currency string) ([]ChargeSplit, error) {
+	if data == nil {
+		return nil, nil
+	}
+	var rows []struct {
+		Amount     json.Number `json:"amount"`
+		Category   string      `json:"category"`
+		CategoryID *int        `json:"category_id"`
+		Note       string      `json:"note"`
+	}
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, fmt.Errorf("scanning splits: %v", err)
+	}
+	splits := make([]ChargeSplit, len(rows))
+	for i, r := range rows {
+		m, err := parseMoney(r.Amount.String(), currency)
+		if err != nil {
+			return nil, fmt.Errorf("scanning splits: %v", err)
+		}
+		splits[i] = ChargeSplit{Amount: m, Category: r.Category, CategoryID: r.CategoryID, Note: r.Note}
+	}
+	return splits, nil
+}
+
+// insertSplits stores the split lines of a charge, in order.
+func (s *postgresStore) insertSplits(chargeID int, splits []ChargeSplit) error {
+	for i, sp := range splits {
+		_, err := s.q.Exec(`
+			INSERT INTO charge_splits (charge_id, position, amount, category, category_id, note)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, chargeID, i, sp.Amount, sp.Category, sp.CategoryID, sp.Note)
+		if err != nil {
+			return pgError(err)
+		}
+	}
+	return nil
+}
+
+func (s *postgresStore) SetChargeSplits(ownerID, chargeID int, splits []ChargeSplit) error {
+	var owned bool
+	err := s.q.QueryRow(`SELECT EXISTS (SELECT 1 FROM charges WHERE id=$1 AND user_id=$2)`, chargeID, ownerID).Scan(&owned)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return ErrNotFound
+	}
+	if _, err := s.q.Exec(`DELETE FROM charge_splits WHERE charge_id=$1`, chargeID); err != nil {
+		return err
+	}
+	return s.insertSplits(chargeID, splits)
+}
+
+// scanParticipants decodes the JSON array of a shared expense's
+// participants, NULL when it has none.
+func scanParticipants(data []byte, currency string) ([]Participant, error) {
+	if data == nil {
+		return nil, nil
+	}
+	var rows []struct {
+		UserID  int         `json:"user_id"`
+		Percent *float64    `json:"percent"`
+		Amount  json.Number `json:"amount"`
+	}
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, fmt.Errorf("scanning participants: %v", err)
+	}
+	participants := make([]Participant, len(rows))
+	for i, r := range rows {
+		m, err := parseMoney(r.Amount.String(), currency)
+		if err != nil {
+			return nil, fmt.Errorf("scanning participants: %v", err)
+		}
+		participants[i] = Participant{UserID: r.UserID, Percent: r.Percent, Amount: m}
+	}
+	return participants, nil
+}
+
+// insertParticipants stores the share mode and participants of a charge,
+// in order.
+func (s *postgresStore) insertParticipants(chargeID int, mode string, participants []Participant) error {
+	if len(participants) == 0 {
+		mode = ""
+	}
+	if _, err := s.q.Exec(`UPDATE charges SET share_mode=NULLIF($1, '') WHERE id=$2`, mode, chargeID); err != nil {
+		return pgError(err)
+	}
+	for i, p := range participants {
+		_, err := s.q.Exec(`
+			INSERT INTO charge_participants (charge_id, user_id, position, percent, amount)
+			VALUES ($1, $2, $3, $4, $5)
+		`, chargeID, p.UserID, i, p.Percent, p.Amount)
+		if err != nil {
+			return pgError(err)
+		}
+	}
+	return nil
+}
+
+func (s *postgresStore) SetChargeParticipants(ownerID, chargeID int, mode string, participants []Participant) error {
+	var owned bool
+	err := s.q.QueryRow(`SELECT EXISTS (SELECT 1 FROM charges WHERE id=$1 AND user_id=$2)`, chargeID, ownerID).Scan(&owned)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return ErrNotFound
+	}
+	if _, err := s.q.Exec(`DELETE FROM charge_participants WHERE charge_id=$1`, chargeID); err != nil {
+		return err
+	}
+	return s.insertParticipants(chargeID, mode, participants)
+}
+
+func (s *postgresStore) ListSharedCharges(userID int) ([]Charge, error) {
+	rows, err := s.q.Query(`
+		SELECT `+chargeColumns+`
+		FROM charges
+		WHERE EXISTS (SELECT 1 FROM charge_participants cp
+		              WHERE cp.charge_id = charges.id AND (charges.user_id=$1 OR cp.user_id=$1))
+		ORDER BY created_at, id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	charges := []Charge{}
+	for rows.Next() {
+		c, err := scanCharge(rows)
+		if err != nil {
+			return nil, err
+		}
+		charges = append(charges, c)
+	}
+	return charges, rows.Err()
+}
+
+// chargeDirection defaults c's direction to an expense, as stored.
+func chargeDirection(c *Charge) string {
+	if c.Direction == "" {
+		c.Direction = DirectionExpense
+	}
+	return c.Direction
+}
+
+// nullableTime passes "" to SQL as NULL.
+func nullableTime(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (s *postgresStore) CreateCharge(c *Charge) error {
+	err := s.q.QueryRow(`
+		INSERT INTO charges (name, amount, currency, category, category_id, periodical, user_id,
+		                     recurring, recurrence_day, recurrence_end, template_id, account_id, direction, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, COALESCE($14::timestamptz, CURRENT_TIMESTAMP))
+		RETURNING id, created_at
+	`, c.Name, c.Amount, c.Amount.Currency, c.Category, c.CategoryID, c.Periodical, c.UserID,
+		c.Recurring, c.RecurrenceDay, c.RecurrenceEnd, c.TemplateID, c.AccountID, chargeDirection(c), nullableTime(c.CreatedAt)).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		return pgError(err)
+	}
+	if err := s.insertSplits(c.ID, c.Splits); err != nil {
+		return err
+	}
+	if err := s.insertParticipants(c.ID, c.ShareMode, c.Participants); err != nil {
+		return err
+	}
+	return s.TagCharges(c.UserID, []int{c.ID}, c.Tags)
+}
+
+func (s *postgresStore) UpdateCharge(c Charge) error {
+	return affectedOne(s.q.Exec(`
+		UPDATE charges
+		SET name=$1, amount=$2, currency=$3, category=$4, category_id=$5, periodical=$6,
+		    recurring=$7, recurrence_day=$8, recurrence_end=$9, account_id=$10, direction=$11
+		WHERE id=$12 AND user_id=$13
+	`, c.Name, c.Amount, c.Amount.Currency, c.Category, c.CategoryID, c.Periodical,
+		c.Recurring, c.RecurrenceDay, c.RecurrenceEnd, c.AccountID, chargeDirection(&c), c.ID, c.UserID))
+}
+
+func (s *postgresStore) DeleteCharge(ownerID, id int) error {
+	return affectedOne(s.q.Exec(`DELETE FROM charges WHERE id=$1 AND user_id=$2`, id, ownerID))
+}
+
+// ---- Tags ----
+
+func (s *postgresStore) ListTags(ownerID int) ([]Tag, error) {
+	rows, err := s.q.Query(`
+		SELECT t.name, COUNT(*)
+		FROM tags t
+		JOIN charge_tags ct ON ct.tag_id = t.id
+		WHERE t.user_id=$1
+		GROUP BY t.name
+		ORDER BY t.name
+	`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.Name, &t.Charges); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+func (s *postgresStore) TagCharges(ownerID int, chargeIDs []int, tags []string) error {
+	if len(chargeIDs) == 0 || len(tags) == 0 {
+		return nil
+	}
+	if _, err := s.q.Exec(`
+		INSERT INTO tags (user_id, name)
+		SELECT $1, unnest($2::text[])
+		ON CONFLICT (user_id, name) DO NOTHING
+	`, ownerID, pq.Array(tags)); err != nil {
+		return pgError(err)
+	}
+	_, err := s.q.Exec(`
+		INSERT INTO charge_tags (charge_id, tag_id)
+		SELECT c.id, t.id
+		FROM charges c
+		JOIN tags t ON t.user_id = c.user_id
+		WHERE c.user_id=$1 AND c.id = ANY($2) AND t.name = ANY($3)
+		ON CONFLICT DO NOTHING
+	`, ownerID, pq.Array(int64s(chargeIDs)), pq.Array(tags))
+	return pgError(err)
+}
+
+func (s *postgresStore) UntagCharges(ownerID int, chargeIDs []int, tags []string) error {
+	if len(chargeIDs) == 0 || len(tags) == 0 {
+		return nil
+	}
+	_, err := s.q.Exec(`
+		DELETE FROM charge_tags ct
+		USING tags t
+		WHERE ct.tag_id = t.id AND t.user_id=$1 AND ct.charge_id = ANY($2) AND t.name = ANY($3)
+	`, ownerID, pq.Array(int64s(chargeIDs)), pq.Array(tags))
+	return pgError(err)
+}
+
+// ---- Transfers ----
+
+const transferColumns = `id, user_id, from_charge_id, to_charge_id`
+
+func scanTransfer(row scanner) (Transfer, error) {
+	var t Transfer
+	err := row.Scan(&t.ID, &t.UserID, &t.FromChargeID, &t.ToChargeID)
+	return t, pgError(err)
+}
+
+func (s *postgresStore) ListTransfers(ownerID int) ([]Transfer, error) {
+	rows, err := s.q.Query(`SELECT `+transferColumns+` FROM transfers WHERE user_id=$1 ORDER BY id DESC`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []Transfer{}
+	for rows.Next() {
+		t, err := scanTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
+
+func (s *postgresStore) GetTransfer(id int) (Transfer, error) {
+	return scanTransfer(s.q.QueryRow(`SELECT `+transferColumns+` FROM transfers WHERE id=$1 `+s.forUpdate(), id))
+}
+
+func (s *postgresStore) CreateTransfer(t *Transfer) error {
+	var linked bool
+	err := s.q.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM transfers WHERE from_charge_id IN ($1, $2) OR to_charge_id IN ($1, $2))
+	`, t.FromChargeID, t.ToChargeID).Scan(&linked)
+	if err != nil {
+		return err
+	}
+	if linked {
+		return fmt.Errorf("%w: charge %d or %d is already a transfer leg", ErrConflict, t.FromChargeID, t.ToChargeID)
+	}
+	err = s.q.QueryRow(`
+		INSERT INTO transfers (user_id, from_charge_id, to_charge_id)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, t.UserID, t.FromChargeID, t.ToChargeID).Scan(&t.ID)
+	return pgError(err)
+}
+
+func (s *postgresStore) DeleteTransfer(ownerID, id int) error {
+	return affectedOne(s.q.Exec(`DELETE FROM transfers WHERE id=$1 AND user_id=$2`, id, ownerID))
+}
+
+// ---- Savings goals ----
+
+const goalColumns = `id, name, currency, target_amount, target_date, account_id, user_id, created_at`
+
+func scanGoal(row scanner) (Goal, error) {
+	var g Goal
+	var target time.Time
+	var accountID sql.NullInt64
+	err := row.Scan(&g.ID, &g.Name, &g.Target.Currency, &g.Target, &target, &accountID, &g.UserID, &g.CreatedAt)
+	g.TargetDate, g.AccountID = target.Format("2006-01-02"), nullInt(accountID)
+	return g, pgError(err)
+}
+
+func (s *postgresStore) ListGoals(ownerID int) ([]Goal, error) {
+	rows, err := s.q.Query(`SELECT `+goalColumns+` FROM goals WHERE user_id=$1 ORDER BY target_date, id`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	goals := []Goal{}
+	for rows.Next() {
+		g, err := scanGoal(rows)
+		if err != nil {
+			return nil, err
+		}
+		goals = append(goals, g)
+	}
+	return goals, rows.Err()
+}
+
+func (s *postgresStore) GetGoal(id int) (Goal, error) {
+	return scanGoal(s.q.QueryRow(`SELECT `+goalColumns+` FROM goals WHERE id=$1 `+s.forUpdate(), id))
+}
+
+func (s *postgresStore) CreateGoal(g *Goal) error {
+	err := s.q.QueryRow(`
+		INSERT INTO goals (name, currency, target_amount, target_date, account_id, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, g.Name, g.Target.Currency, g.Target, g.TargetDate, g.AccountID, g.UserID).Scan(&g.ID, &g.CreatedAt)
+	return pgError(err)
+}
+
+func (s *postgresStore) UpdateGoal(g Goal) error {
+	return affectedOne(s.q.Exec(`
+		UPDATE goals
+		SET name=$1, currency=$2, target_amount=$3, target_date=$4, account_id=$5
+		WHERE id=$6 AND user_id=$7
+	`, g.Name, g.Target.Currency, g.Target, g.TargetDate, g.AccountID, g.ID, g.UserID))
+}
+
+func (s *postgresStore) DeleteGoal(ownerID, id int) error {
+	return affectedOne(s.q.Exec(`DELETE FROM goals WHERE id=$1 AND user_id=$2`, id, ownerID))
+}
+
+func (s *postgresStore) ListContributions(goalID int) ([]Contribution, error) {
+	rows, err := s.q.Query(`
+		SELECT c.id, c.goal_id, c.user_id, g.currency, c.amount, c.note, c.created_at
+		FROM goal_contributions c
+		JOIN goals g ON g.id = c.goal_id
+		WHERE c.goal_id=$1
+		ORDER BY c.created_at, c.id
+	`, goalID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contributions := []Contribution{}
+	for rows.Next() {
+		var c Contribution
+		var userID sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.GoalID, &userID, &c.Amount.Currency, &c.Amount, &c.Note, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		c.UserID = nullInt(userID)
+		contributions = append(contributions, c)
+	}
+	return contributions, rows.Err()
+}
+
+func (s *postgresStore) CreateContribution(c *Contribution) error {
+	err := s.q.QueryRow(`
+		INSERT INTO goal_contributions (goal_id, user_id, amount, note, created_at)
+		VALUES ($1, $2, $3, $4, COALESCE($5::timestamptz, CURRENT_TIMESTAMP))
+		RETURNING id, created_at
+	`, c.GoalID, c.UserID, c.Amount, c.Note, nullableTime(c.CreatedAt)).Scan(&c.ID, &c.CreatedAt)
+	return pgError(err)
+}
+
+func (s *postgresStore) DeleteContribution(goalID, id int) error {
+	return affectedOne(s.q.Exec(`DELETE FROM goal_contributions WHERE id=$1 AND goal_id=$2`, id, goalID))
+}
+
+// ---- Envelope budgeting ----
+
+func (s *postgresStore) GetEnvelopeMode(userID int) (EnvelopeMode, error) {
+	var m EnvelopeMode
+	var start time.Time
+	err := s.q.QueryRow(`
+		SELECT user_id, currency, start_month, created_at FROM envelope_modes WHERE user_id=$1 `+s.forUpdate(), userID,
+	).Scan(&m.UserID, &m.Currency, &start, &m.CreatedAt)
+	m.StartMonth = start.Format("2006-01")
+	return m, pgError(err)
+}
+
+func (s *postgresStore) PutEnvelopeMode(m *EnvelopeMode) error {
+	err := s.q.QueryRow(`
+		INSERT INTO envelope_modes (user_id, currency, start_month)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET currency = EXCLUDED.currency, start_month = EXCLUDED.start_month
+		RETURNING created_at
+	`, m.UserID, m.Currency, m.StartMonth+"-01").Scan(&m.CreatedAt)
+	return pgError(err)
+}
+
+func (s *postgresStore) DeleteEnvelopeMode(userID int) error {
+	return affectedOne(s.q.Exec(`DELETE FROM envelope_modes WHERE user_id=$1`, userID))
+}
+
+const envelopeColumns = `id, name, category_id, user_id, created_at`
+
+func scanEnvelope(row scanner) (Envelope, error) {
+	var e Envelope
+	var categoryID sql.NullInt64
+	err := row.Scan(&e.ID, &e.Name, &categoryID, &e.UserID, &e.CreatedAt)
+	e.CategoryID = nullInt(categoryID)
+	return e, pgError(err)
+}
+
+func (s *postgresStore) ListEnvelopes(ownerID int) ([]Envelope, error) {
+	rows, err := s.q.Query(`SELECT `+envelopeColumns+` FROM envelopes WHERE user_id=$1 ORDER BY id`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	envelopes := []Envelope{}
+	for rows.Next() {
+		e, err := scanEnvelope(rows)
+		if err != nil {
+			return nil, err
+		}
+		envelopes = append(envelopes, e)
+	}
+	return envelopes, rows.Err()
+}
+
+func (s *postgresStore) GetEnvelope(id int) (Envelope, error) {
+	return scanEnvelope(s.q.QueryRow(`SELECT `+envelopeColumns+` FROM envelopes WHERE id=$1`, id))
+}
+
+func (s *postgresStore) CreateEnvelope(e *Envelope) error {
+	err := s.q.QueryRow(`
+		INSERT INTO envelopes (name, category_id, user_id)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, e.Name, e.CategoryID, e.UserID).Scan(&e.ID, &e.CreatedAt)
+	return pgError(err)
+}
+
+func (s *postgresStore) UpdateEnvelope(e Envelope) error {
+	return affectedOne(s.q.Exec(`UPDATE envelopes SET name=$1, category_id=$2 WHERE id=$3 AND user_id=$4`, e.Name, e.CategoryID, e.ID, e.UserID))
+}
+
+func (s *postgresStore) DeleteEnvelope(ownerID, id int) error {
+	return affectedOne(s.q.Exec(`DELETE FROM envelopes WHERE id=$1 AND user_id=$2`, id, ownerID))
+}
+
+func (s *postgresStore) ListEnvelopeMoves(ownerID int) ([]EnvelopeMove, error) {
+	rows, err := s.q.Query(`
+		SELECT id, user_id, month, from_envelope_id, to_envelope_id, currency, amount, note, actor_id, created_at
+		FROM envelope_moves
+		WHERE user_id=$1
+		ORDER BY month, id
+	`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	moves := []EnvelopeMove{}
+	for rows.Next() {
+		var m EnvelopeMove
+		var month time.Time
+		var from, to, actor sql.NullInt64
+		if err := rows.Scan(&m.ID, &m.UserID, &month, &from, &to, &m.Amount.Currency, &m.Amount, &m.Note, &actor, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		m.Month = month.Format("2006-01")
+		m.FromEnvelopeID, m.ToEnvelopeID, m.ActorID = nullInt(from), nullInt(to), nullInt(actor)
+		moves = append(moves, m)
+	}
+	return moves, rows.Err()
+}
+
+func (s *postgresStore) CreateEnvelopeMove(m *EnvelopeMove) error {
+	err := s.q.QueryRow(`
+		INSERT INTO envelope_moves (user_id, month, from_envelope_id, to_envelope_id, currency, amount, note, actor_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at
+	`, m.UserID, m.Month+"-01", m.FromEnvelopeID, m.ToEnvelopeID, m.Amount.Currency, m.Amount, m.Note, m.ActorID).Scan(&m.ID, &m.CreatedAt)
+	return pgError(err)
+}
+
+// ---- Recurring charges ----
+
+func (s *postgresStore) SetRecurrence(chargeID, seq int, next *time.Time) error {
+	return affectedOne(s.q.Exec(`UPDATE charges SET recurrence_seq=$1, recurrence_next=$2 WHERE id=$3`, seq, next, chargeID))
+}
+
+func (s *postgresStore) LastOccurrence(templateID int) (*time.Time, error) {
+	var latest sql.NullTime
+	if err := s.q.QueryRow(`SELECT recurrence_last FROM charges WHERE id=$1`, templateID).Scan(&latest); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if !latest.Valid {
+		return nil, nil
+	}
+	return &latest.Time, nil
+}
+
+func (s *postgresStore) queryTemplates(query string, args ...interface{}) ([]RecurringTemplate, error) {
+	rows, err := s.q.Query(`SELECT `+chargeColumns+`, recurrence_seq FROM charges `+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []RecurringTemplate
+	for rows.Next() {
+		var t RecurringTemplate
+		t.Charge, err = scanCharge(rows, &t.Seq)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+func (s *postgresStore) DueTemplates(now time.Time, limit int) ([]RecurringTemplate, error) {
+	return s.queryTemplates(`
+		WHERE recurring AND recurrence_next <= $1
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`, now, limit)
+}
+
+func (s *postgresStore) ListRecurringTemplates(ownerID int) ([]RecurringTemplate, error) {
+	return s.queryTemplates(`
+		WHERE recurring AND user_id=$1 AND recurrence_next IS NOT NULL
+		ORDER BY id
+	`, ownerID)
+}
+
+func (s *postgresStore) PostOccurrence(c *Charge, date string) (bool, error) {
+	err := s.q.QueryRow(`
+		INSERT INTO charges (name, amount, currency, category, category_id, periodical, user_id, created_at, template_id, occurrence_date,
+		                     account_id, direction)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (template_id, occurrence_date) DO NOTHING
+		RETURNING id, created_at
+	`, c.Name, c.Amount, c.Amount.Currency, c.Category, c.CategoryID, c.Periodical, c.UserID, c.CreatedAt, c.TemplateID, date,
+		c.AccountID, chargeDirection(c)).Scan(&c.ID, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := s.insertSplits(c.ID, c.Splits); err != nil {
+		return false, err
+	}
+	if err := s.insertParticipants(c.ID, c.ShareMode, c.Participants); err != nil {
+		return false, err
+	}
+	if _, err := s.q.Exec(`
+		UPDATE charges SET recurrence_last = GREATEST(recurrence_last, $1) WHERE id=$2
+	`, c.CreatedAt, c.TemplateID); err != nil {
+		return false, err
+	}
+	return true, s.TagCharges(c.UserID, []int{c.ID}, c.Tags)
+}
+
+// ---- Shares ----
+
+const shareColumns = `id, user_id, user_share_id, access`
+
+func scanShare(row scanner) (Share, error) {
+	var sh Share
+	err := row.Scan(&sh.ID, &sh.UserID, &sh.UserShareID, &sh.Access)
+	return sh, pgError(err)
+}
+
+func (s *postgresStore) ListShares(userID int) ([]Share, error) {
+	rows, err := s.q.Query(`
+		SELECT `+shareColumns+`
+		FROM shares
+		WHERE user_id=$1 OR user_share_id=$1
+		ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shares []Share
+	for rows.Next() {
+		sh, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, sh)
+	}
+	return shares, rows.Err()
+}
+
+func (s *postgresStore) GetShare(id int) (Share, error) {
+	return scanShare(s.q.QueryRow(`SELECT `+shareColumns+` FROM shares WHERE id=$1`, id))
+}
+
+func (s *postgresStore) FindShare(ownerID, granteeID int) (Share, error) {
+	return scanShare(s.q.QueryRow(`
+		SELECT `+shareColumns+`
+		FROM shares
+		WHERE user_id=$1 AND user_share_id=$2
+	`, ownerID, granteeID))
+}
+
+func (s *postgresStore) PutShare(sh *Share) error {
+	err := s.q.QueryRow(`
+		INSERT INTO shares (user_id, user_share_id, access)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, user_share_id) DO UPDATE SET access=EXCLUDED.access
+		RETURNING id
+	`, sh.UserID, sh.UserShareID, sh.Access).Scan(&sh.ID)
+	return pgError(err)
+}
+
+func (s *postgresStore) DeleteShare(id int) error {
+	return affectedOne(s.q.Exec(`DELETE FROM shares WHERE id=$1`, id))
+}
+
+// ---- Settlements ----
+
+const settlementColumns = `id, from_user_id, to_user_id, currency, amount, note, created_at`
+
+func scanSettlement(row scanner) (Settlement, error) {
+	var st Settlement
+	err := row.Scan(&st.ID, &st.FromUserID, &st.ToUserID, &st.Amount.Currency, &st.Amount, &st.Note, &st.CreatedAt)
+	return st, pgError(err)
+}
+
+func (s *postgresStore) ListSettlements(userID int) ([]Settlement, error) {
+	rows, err := s.q.Query(`
+		SELECT `+settlementColumns+`
+		FROM settlements
+		WHERE from_user_id=$1 OR to_user_id=$1
+		ORDER BY created_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settlements := []Settlement{}
+	for rows.Next() {
+		st, err := scanSettlement(rows)
+		if err != nil {
+			return nil, err
+		}
+		settlements = append(settlements, st)
+	}
+	return settlements, rows.Err()
+}
+
+func (s *postgresStore) GetSettlement(id int) (Settlement, error) {
+	return scanSettlement(s.q.QueryRow(`SELECT `+settlementColumns+` FROM settlements WHERE id=$1 `+s.forUpdate(), id))
+}
+
+func (s *postgresStore) CreateSettlement(st *Settlement) error {
+	err := s.q.QueryRow(`
+		INSERT INTO settlements (from_user_id, to_user_id, currency, amount, note, created_at)
+		VALUES ($1, $2, $3, $4, $5, COALESCE($6::timestamptz, CURRENT_TIMESTAMP))
+		RETURNING id, created_at
+	`, st.FromUserID, st.ToUserID, st.Amount.Currency, st.Amount, st.Note, nullableTime(st.CreatedAt)).Scan(&st.ID, &st.CreatedAt)
+	return pgError(err)
+}
+
+func (s *postgresStore) DeleteSettlement(id int) error {
+	return affectedOne(s.q.Exec(`DELETE FROM settlements WHERE id=$1`, id))
+}
+
+// ---- Audit log ----
+
+// nullableJSON passes a JSON null snapshot to SQL as NULL.
+func nullableJSON(raw []byte) interface{} {
+	if raw == nil || string(raw) == "null" {
+		return nil
+	}
+	return string(raw)
+}
+
+func (s *postgresStore) RecordAudit(e *AuditEvent) error {
+	err := s.q.QueryRow(`
+		INSERT INTO audit_events (actor_id, owner_id, action, entity_type, entity_id, before, after, ip, user_agent)
+		VALUES ($1, $2, $3, $4, $5, $6::jsonb, $7::jsonb, $8, $9)
+		RETURNING id, created_at
+	`, e.ActorID, e.OwnerID, e.Action, e.EntityType, e.EntityID,
+		nullableJSON(e.Before), nullableJSON(e.After), e.IP, e.UserAgent).Scan(&e.ID, &e.CreatedAt)
+	return pgError(err)
+}
+
+func (s *postgresStore) ListAudit(f *AuditFilter) ([]AuditEvent, error) {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	where = append(where, "true")
+	if f.OwnerID != 0 {
+		where = append(where, "owner_id="+arg(f.OwnerID))
+	}
+	if f.ActorID != 0 {
+		where = append(where, "actor_id="+arg(f.ActorID))
+	}
+	if f.EntityType != "" {
+		where = append(where, "entity_type="+arg(f.EntityType))
+	}
+	if f.EntityID != 0 {
+		where = append(where, "entity_id="+arg(f.EntityID))
+	}
+	if f.Action != "" {
+		where = append(where, "action="+arg(f.Action))
+	}
+	if f.From != nil {
+		where = append(where, "created_at >= "+arg(*f.From))
+	}
+	if f.To != nil {
+		where = append(where, "created_at < "+arg(*f.To))
+	}
+	if f.BeforeID != 0 {
+		where = append(where, "id < "+arg(f.BeforeID))
+	}
+	query := `
+		SELECT id, actor_id, owner_id, action, entity_type, entity_id, before, after, created_at,
+		       COALESCE(ip, ''), COALESCE(user_agent, '')
+		FROM audit_events
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY id DESC`
+	if f.Limit > 0 {
+		query += fmt.Sprintf("\n\t\tLIMIT %d", f.Limit)
+	}
+
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		var actorID sql.NullInt64
+		var before, after []byte
+		err := rows.Scan(&e.ID, &actorID, &e.OwnerID, &e.Action, &e.EntityType, &e.EntityID,
+			&before, &after, &e.CreatedAt, &e.IP, &e.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+		if actorID.Valid {
+			id := int(actorID.Int64)
+			e.ActorID = &id
+		}
+		e.Before, e.After = json.RawMessage("null"), json.RawMessage("null")
+		if before != nil {
+			e.Before = before
+		}
+		if after != nil {
+			e.After = after
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// --------------------------
+//   Store Conformance Suite
+// --------------------------
+
+// The store tests are the contract every Store implementation meets. They
+// run against a fresh in-memory store and, when TEST_POSTGRES_URI is set,
+// against that PostgreSQL database, which they migrate and write to. Point
+// it at a throwaway database: tests delete the users they create, but audit
+// events and login attempts can't be deleted, and TestMigrationRoundTrip
+// reverts every migration before applying them again.
+
+func TestMain(m *testing.M) {
+	jwtSecret = []byte("test-secret")
+	os.Exit(m.Run())
+}
+
+var (
+	pgOnce  sync.Once
+	pgDB    *sql.DB
+	pgStore Store
+	pgErr   error
+)
+
+// testPostgres returns the store on TEST_POSTGRES_URI, skipping the test
+// without one.
+func testPostgres(t *testing.T) Store {
+	uri := os.Getenv("TEST_POSTGRES_URI")
+	if uri == "" {
+		t.Skip("TEST_POSTGRES_URI not set")
+	}
+	pgOnce.Do(func() {
+		db, err := sql.Open("postgres", uri)
+		if err == nil {
+			err = db.Ping()
+		}
+		if err == nil {
+			_, err = migrateUp(db, 0)
+		}
+		pgDB, pgStore, pgErr = db, newPostgresStore(db), err
+	})
+	if pgErr != nil {
+		t.Fatalf("TEST_POSTGRES_URI: %v", pgErr)
+	}
+	return pgStore
+}
+
+// eachStore runs test against a fresh in-memory store and against the
+// PostgreSQL test database, if there is one.
+func eachStore(t *testing.T, test func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) { test(t, newMemoryStore()) })
+	t.Run("postgres", func(t *testing.T) { test(t, testPostgres(t)) })
+}
+
+var storeTests = []struct {
+	name string
+	run  func(t *testing.T, s Store)
+}{
+	{"users", testUsers},
+	{"budgets", testBudgets},
+	{"transactions", testTransactions},
+}
+
+func TestStore(t *testing.T) {
+	eachStore(t, func(t *testing.T, s Store) {
+		for _, tc := range storeTests {
+			t.Run(tc.name, func(t *testing.T) { tc.run(t, s) })
+		}
+	})
+}
+
+var testSeq int64
+
+// testUser creates a uniquely named user for a test; the returned func
+// deletes it again.
+func testUser(t *testing.T, s Store, password string) (User, func()) {
+	t.Helper()
+	n := atomic.AddInt64(&testSeq, 1)
+	u := User{
+		Username:    fmt.Sprintf("test-%d-%d", time.Now().UnixNano(), n),
+		Password:    password,
+		Permissions: "user",
+	}
+	if err := s.CreateUser(&u); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return u, func() { s.DeleteUser(u.ID) }
+}
+
+func mustMoney(s, currency string) Money {
+	m, err := parseMoney(s, currency)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func testUsers(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	if u.ID == 0 {
+		t.Fatalf("CreateUser did not set an ID")
+	}
+	dup := User{Username: u.Username, Password: "x", Permissions: "user"}
+	if err := s.CreateUser(&dup); !errors.Is(err, ErrConflict) {
+		t.Fatalf("duplicate username: got %v, want ErrConflict", err)
+	}
+
+	got, err := s.GetUserByUsername(u.Username)
+	if err != nil || got != u {
+		t.Fatalf("GetUserByUsername = %+v, %v; want %+v", got, err, u)
+	}
+	u.Permissions = "admin"
+	if err := s.UpdateUser(u); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	if got, err = s.GetUser(u.ID); err != nil || got.Permissions != "admin" {
+		t.Fatalf("GetUser after update = %+v, %v", got, err)
+	}
+	users, err := s.ListUsers()
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	found := false
+	for _, lu := range users {
+		found = found || lu.ID == u.ID
+	}
+	if !found {
+		t.Fatalf("ListUsers is missing user %d", u.ID)
+	}
+
+	b := Budget{Name: "cascade", Amount: mustMoney("1", "USD"), UserID: u.ID}
+	if err := s.CreateBudget(&b); err != nil {
+		t.Fatalf("CreateBudget: %v", err)
+	}
+	if err := s.DeleteUser(u.ID); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := s.GetUser(u.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetUser after delete: got %v, want ErrNotFound", err)
+	}
+	if budgets, _ := s.ListBudgets(&ListFilter{OwnerID: u.ID}); len(budgets) != 0 {
+		t.Fatalf("deleting a user left %d budget(s)", len(budgets))
+	}
+	if err := s.DeleteUser(u.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleting a missing user: got %v, want ErrNotFound", err)
+	}
+}
+
+func testBudgets(t *testing.T, s Store) {
+	owner, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+	other, cleanupOther := testUser(t, s, "secret")
+	defer cleanupOther()
+
+	b := Budget{Name: "Groceries", Amount: mustMoney("250.00", "EUR"), Category: "Food", Period: "monthly", UserID: owner.ID}
+	if err := s.CreateBudget(&b); err != nil {
+		t.Fatalf("CreateBudget: %v", err)
+	}
+	b.Name = "Food"
+	b.Amount = mustMoney("300", "EUR")
+	if err := s.UpdateBudget(b); err != nil {
+		t.Fatalf("UpdateBudget: %v", err)
+	}
+	stolen := b
+	stolen.UserID = other.ID
+	if err := s.UpdateBudget(stolen); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("updating another user's budget: got %v, want ErrNotFound", err)
+	}
+
+	budgets, err := s.ListBudgets(&ListFilter{OwnerID: owner.ID})
+	if err != nil || len(budgets) != 1 || budgets[0] != b {
+		t.Fatalf("ListBudgets = %+v, %v; want [%+v]", budgets, err, b)
+	}
+	if budgets, _ := s.ListBudgets(&ListFilter{OwnerID: other.ID}); len(budgets) != 0 {
+		t.Fatalf("ListBudgets leaked %d budget(s) to another user", len(budgets))
+	}
+
+	if err := s.DeleteBudget(other.ID, b.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleting another user's budget: got %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteBudget(owner.ID, b.ID); err != nil {
+		t.Fatalf("DeleteBudget: %v", err)
+	}
+}
+
+func testTransactions(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	rollback := errors.New("roll back")
+	err := s.Tx(func(tx Store) error {
+		b := Budget{Name: "uncommitted", Amount: mustMoney("1", "USD"), UserID: u.ID}
+		if err := tx.CreateBudget(&b); err != nil {
+			return err
+		}
+		if budgets, _ := tx.ListBudgets(&ListFilter{OwnerID: u.ID}); len(budgets) != 1 {
+			return fmt.Errorf("a transaction can't see its own budget")
+		}
+		return rollback
+	})
+	if err != rollback {
+		t.Fatalf("Tx returned %v, want the callback's error", err)
+	}
+	if budgets, _ := s.ListBudgets(&ListFilter{OwnerID: u.ID}); len(budgets) != 0 {
+		t.Fatalf("rolled back budget was kept")
+	}
+
+	err = s.Tx(func(tx Store) error {
+		b := Budget{Name: "committed", Amount: mustMoney("1", "USD"), UserID: u.ID}
+		return tx.CreateBudget(&b)
+	})
+	if err != nil {
+		t.Fatalf("Tx: %v", err)
+	}
+	if budgets, _ := s.ListBudgets(&ListFilter{OwnerID: u.ID}); len(budgets) != 1 {
+		t.Fatalf("committed budget is missing")
+	}
+}
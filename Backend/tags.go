@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// --------------------------
+//           Tags
+// --------------------------
+
+// Tag: a label on some of a user's charges, e.g. vacation-2026 or
+// reimbursable, independent of their category. Charges counts the charges
+// carrying it; a tag no charge carries any more is not listed.
+type Tag struct {
+	Name    string `json:"name"`
+	Charges int    `json:"charges"`
+}
+
+const maxTagLength = 50
+
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N}._:-]*$`)
+
+// errInvalidTag: a tag name that normalizeTags rejects.
+var errInvalidTag = errors.New("invalid tag")
+
+// normalizeTags lower-cases and validates tags, returning them sorted and
+// without duplicates. A tag is up to 50 letters, digits and . _ : - and
+// starts with a letter or digit.
+func normalizeTags(tags []string) ([]string, error) {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if utf8.RuneCountInString(tag) > maxTagLength || !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("%w %q: use up to %d letters, digits, '.', '_', ':' or '-'", errInvalidTag, tag, maxTagLength)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// retag returns tags with add added and remove removed, sorted.
+func retag(tags, add, remove []string) []string {
+	set := map[string]bool{}
+	for _, tag := range tags {
+		set[tag] = true
+	}
+	for _, tag := range add {
+		set[tag] = true
+	}
+	for _, tag := range remove {
+		delete(set, tag)
+	}
+	result := []string{}
+	for tag := range set {
+		result = append(result, tag)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// retagCharges adds and removes tags on the owner's charges, auditing each
+// charge whose tags change, and returns how many did.
+func retagCharges(tx Store, src auditSource, ownerID int, charges []Charge, add, remove []string) (int, error) {
+	var ids []int
+	var before, after []Charge
+	for _, c := range charges {
+		tags := retag(c.Tags, add, remove)
+		if sameTags(tags, c.Tags) {
+			continue
+		}
+		ids = append(ids, c.ID)
+		before = append(before, c)
+		c.Tags = tags
+		after = append(after, c)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	if len(add) > 0 {
+		if err := tx.TagCharges(ownerID, ids, add); err != nil {
+			return 0, fmt.Errorf("Error tagging charges: %v", err)
+		}
+	}
+	if len(remove) > 0 {
+		if err := tx.UntagCharges(ownerID, ids, remove); err != nil {
+			return 0, fmt.Errorf("Error untagging charges: %v", err)
+		}
+	}
+	for i := range ids {
+		if err := src.record(tx, AuditUpdate, "charge", ids[i], ownerID, before[i], after[i]); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// replaceChargeTags makes tags the tags of charge c, which the caller
+// audits along with the rest of its update.
+func replaceChargeTags(tx Store, ownerID int, c Charge, tags []string) error {
+	var add, remove []string
+	for _, tag := range tags {
+		if !containsTag(c.Tags, tag) {
+			add = append(add, tag)
+		}
+	}
+	for _, tag := range c.Tags {
+		if !containsTag(tags, tag) {
+			remove = append(remove, tag)
+		}
+	}
+	if len(add) > 0 {
+		if err := tx.TagCharges(ownerID, []int{c.ID}, add); err != nil {
+			return fmt.Errorf("Error tagging charge: %v", err)
+		}
+	}
+	if len(remove) > 0 {
+		if err := tx.UntagCharges(ownerID, []int{c.ID}, remove); err != nil {
+			return fmt.Errorf("Error untagging charge: %v", err)
+		}
+	}
+	return nil
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// GET /api/tags => the tags on the JWT user's charges (or ?owner=<id>, read
+// access) with how many charges carry each, by name
+func (s *Server) getTagsHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	tags, err := s.store.ListTags(ownerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying tags: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tags)
+}
+
+// changeChargeTags adds and removes tags on one charge of the owner and
+// responds with the charge.
+func (s *Server) changeChargeTags(w http.ResponseWriter, r *http.Request, add, remove []string) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	chargeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid charge ID", http.StatusBadRequest)
+		return
+	}
+
+	var c Charge
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, err := tx.GetCharge(chargeID)
+		if err == nil && before.UserID != ownerID {
+			err = ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := retagCharges(tx, audit, ownerID, []Charge{before}, add, remove); err != nil {
+			return err
+		}
+		c = before
+		c.Tags = retag(before.Tags, add, remove)
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Charge not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(c)
+}
+
+// POST /api/charges/{id}/tags => add tags to a charge of the JWT user (or
+// ?owner=<id>, write access). Body: { "tags": ["vacation-2026", "reimbursable"] }
+func (s *Server) addChargeTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	tags, err := normalizeTags(body.Tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.changeChargeTags(w, r, tags, nil)
+}
+
+// DELETE /api/charges/{id}/tags/{tag} => remove a tag from a charge of the
+// JWT user (or ?owner=<id>, write access)
+func (s *Server) removeChargeTagHandler(w http.ResponseWriter, r *http.Request) {
+	tags, err := normalizeTags([]string{mux.Vars(r)["tag"]})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.changeChargeTags(w, r, nil, tags)
+}
+
+// POST /api/charges/tags => add and remove tags on every charge of the JWT
+// user (or ?owner=<id>, write access) matching the query's filters, which
+// are those of GET /api/charges minus paging. Body:
+// { "add": ["tax-deductible"], "remove": ["todo"] }
+func (s *Server) bulkTagChargesHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	f, err := parseListQuery(r.URL.Query(), chargeListSpec, ownerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Limit, f.After = 0, nil
+
+	var body struct {
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	add, err := normalizeTags(body.Add)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	remove, err := normalizeTags(body.Remove)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		http.Error(w, "Nothing to add or remove", http.StatusBadRequest)
+		return
+	}
+	for _, tag := range add {
+		for _, other := range remove {
+			if tag == other {
+				http.Error(w, fmt.Sprintf("Tag %q is both added and removed", tag), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	matched, changed := 0, 0
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		if err := expandCategoryFilter(tx, f); err != nil {
+			return err
+		}
+		charges, err := tx.ListCharges(f)
+		if err != nil {
+			return fmt.Errorf("Error querying charges: %v", err)
+		}
+		matched = len(charges)
+		changed, err = retagCharges(tx, audit, ownerID, charges, add, remove)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"matched": matched, "changed": changed, "owner_id": ownerID})
+}
+
+// TagTotal: what was spent on charges carrying one tag in a window.
+type TagTotal struct {
+	Tag     string      `json:"tag"`
+	Charges int         `json:"charges"`
+	Total   MoneyTotals `json:"total"`
+}
+
+// GET /api/reports/tags => spending per tag of the JWT user (or
+// ?owner=<id>, read access) between ?from= and ?to= (YYYY-MM-DD or RFC 3339,
+// to exclusive; default the current month), counted like the category
+// report. A charge with several tags counts towards each, so the totals
+// overlap. Untagged charges are totalled separately.
+func (s *Server) tagTotalsHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	from, to, err := reportWindow(r, "monthly")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	charges, err := s.store.ListCharges(&ListFilter{OwnerID: ownerID, From: &from, To: &to})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying charges: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	byTag := map[string]*TagTotal{}
+	untagged := MoneyTotals{}
+	for _, c := range charges {
+		spent, ok := spendingOf(c)
+		if !ok {
+			continue
+		}
+		if len(c.Tags) == 0 {
+			if err := untagged.Add(spent); err != nil {
+				http.Error(w, fmt.Sprintf("Error totaling charges: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		for _, tag := range c.Tags {
+			if byTag[tag] == nil {
+				byTag[tag] = &TagTotal{Tag: tag, Total: MoneyTotals{}}
+			}
+			byTag[tag].Charges++
+			if err := byTag[tag].Total.Add(spent); err != nil {
+				http.Error(w, fmt.Sprintf("Error totaling charges: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	lines := []TagTotal{}
+	for _, t := range byTag {
+		lines = append(lines, *t)
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Tag < lines[j].Tag })
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":     from.Format(time.RFC3339),
+		"to":       to.Format(time.RFC3339),
+		"tags":     lines,
+		"untagged": untagged,
+	})
+}
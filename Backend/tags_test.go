@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []string
+		ok   bool
+	}{
+		{nil, []string{}, true},
+		{[]string{"Vacation-2026", " reimbursable ", "vacation-2026"}, []string{"reimbursable", "vacation-2026"}, true},
+		{[]string{"tax:2025", "a.b_c", "9lives"}, []string{"9lives", "a.b_c", "tax:2025"}, true},
+		{[]string{"Café"}, []string{"café"}, true},
+		{[]string{strings.Repeat("ü", maxTagLength)}, []string{strings.Repeat("ü", maxTagLength)}, true},
+		{[]string{strings.Repeat("a", maxTagLength+1)}, nil, false},
+		{[]string{""}, nil, false},
+		{[]string{"-todo"}, nil, false},
+		{[]string{"two words"}, nil, false},
+		{[]string{"ok", "not/ok"}, nil, false},
+	}
+	for _, tc := range tests {
+		got, err := normalizeTags(tc.in)
+		if !reflect.DeepEqual(got, tc.want) || (err == nil) != tc.ok || (err != nil && !errors.Is(err, errInvalidTag)) {
+			t.Fatalf("normalizeTags(%q) = %q, %v; want %q, ok %v", tc.in, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestRetag(t *testing.T) {
+	tests := []struct {
+		tags, add, remove []string
+		want              []string
+	}{
+		{nil, nil, nil, []string{}},
+		{[]string{"b"}, []string{"a"}, nil, []string{"a", "b"}},
+		{[]string{"a", "b"}, []string{"b"}, []string{"a"}, []string{"b"}},
+		{[]string{"a"}, nil, []string{"z"}, []string{"a"}},
+		{[]string{"a"}, []string{"c"}, []string{"a"}, []string{"c"}},
+	}
+	for _, tc := range tests {
+		got := retag(tc.tags, tc.add, tc.remove)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("retag(%q, +%q, -%q) = %q, want %q", tc.tags, tc.add, tc.remove, got, tc.want)
+		}
+		if sameTags(got, tc.tags) != reflect.DeepEqual(got, append([]string{}, tc.tags...)) {
+			t.Fatalf("sameTags(%q, %q) = %v", got, tc.tags, sameTags(got, tc.tags))
+		}
+	}
+}
+
+func TestTagStore(t *testing.T) {
+	eachStore(t, testTags)
+}
+
+func TestBulkTagging(t *testing.T) {
+	eachStore(t, testBulkTagging)
+}
+
+// testBulkTagging adds and removes tags on filtered charges through the API.
+func testBulkTagging(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	a := at.a
+	for _, c := range []map[string]interface{}{
+		{"name": "Hotel", "amount": 120, "category": "Travel", "tags": []string{"Todo"}},
+		{"name": "Train", "amount": 40, "category": "Travel"},
+		{"name": "Lunch", "amount": 12, "category": "Food", "tags": []string{"todo"}},
+	} {
+		if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", c, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type result struct {
+		Matched int `json:"matched"`
+		Changed int `json:"changed"`
+	}
+	tests := []struct {
+		name   string
+		query  string
+		body   map[string][]string
+		status int
+		want   result
+		tags   string // GET /api/tags afterwards, name:charges
+	}{
+		{"add to a category", "?category=travel", map[string][]string{"add": {"Trip-2026"}}, http.StatusOK, result{2, 2}, "todo:2 trip-2026:2"},
+		{"again changes nothing", "?category=travel", map[string][]string{"add": {"trip-2026"}}, http.StatusOK, result{2, 0}, "todo:2 trip-2026:2"},
+		{"swap on tagged charges", "?tag=todo", map[string][]string{"add": {"done"}, "remove": {"todo"}}, http.StatusOK, result{2, 2}, "done:2 trip-2026:2"},
+		{"by name", "?q=train", map[string][]string{"remove": {"trip-2026"}}, http.StatusOK, result{1, 1}, "done:2 trip-2026:1"},
+		{"nothing to do", "", map[string][]string{}, http.StatusBadRequest, result{}, ""},
+		{"added and removed", "", map[string][]string{"add": {"x"}, "remove": {"X"}}, http.StatusBadRequest, result{}, ""},
+		{"an invalid tag", "", map[string][]string{"add": {"no spaces"}}, http.StatusBadRequest, result{}, ""},
+		{"an invalid filter", "?direction=sideways", map[string][]string{"add": {"x"}}, http.StatusBadRequest, result{}, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got result
+			if err := a.expectStatus(tc.status, "POST", "/api/charges/tags"+tc.query, tc.body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			if got != tc.want {
+				t.Fatalf("result = %+v, want %+v", got, tc.want)
+			}
+			var tags []Tag
+			if err := a.expectStatus(http.StatusOK, "GET", "/api/tags", nil, &tags); err != nil {
+				t.Fatal(err)
+			}
+			var counts []string
+			for _, tag := range tags {
+				counts = append(counts, tag.Name+":"+strconv.Itoa(tag.Charges))
+			}
+			if joined := strings.Join(counts, " "); joined != tc.tags {
+				t.Fatalf("tags = %s, want %s", joined, tc.tags)
+			}
+		})
+	}
+	if err := at.b.expectStatus(http.StatusForbidden, "POST", "/api/charges/tags?owner="+strconv.Itoa(at.alice.ID),
+		map[string][]string{"add": {"x"}}, nil); err != nil {
+		t.Fatalf("tagging another user's charges: %v", err)
+	}
+}
+
+func testTags(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+	other, cleanupOther := testUser(t, s, "secret")
+	defer cleanupOther()
+
+	var ids []int
+	for _, c := range []Charge{
+		{Name: "Hotel", Tags: []string{"vacation", "reimbursable"}, UserID: u.ID},
+		{Name: "Taxi", Tags: []string{"reimbursable"}, UserID: u.ID},
+		{Name: "Snacks", UserID: u.ID},
+		{Name: "Theirs", Tags: []string{"vacation"}, UserID: other.ID},
+	} {
+		c.Amount = mustMoney("10", "USD")
+		if err := s.CreateCharge(&c); err != nil {
+			t.Fatalf("CreateCharge: %v", err)
+		}
+		ids = append(ids, c.ID)
+	}
+	got, err := s.GetCharge(ids[0])
+	if err != nil || strings.Join(got.Tags, ",") != "reimbursable,vacation" {
+		t.Fatalf("GetCharge tags = %q, %v; want sorted reimbursable,vacation", got.Tags, err)
+	}
+
+	// Tagging skips other owners' charges and tags a charge already has
+	if err := s.TagCharges(u.ID, []int{ids[1], ids[2], ids[3]}, []string{"work", "reimbursable"}); err != nil {
+		t.Fatalf("TagCharges: %v", err)
+	}
+	if err := s.UntagCharges(u.ID, []int{ids[0], ids[3]}, []string{"vacation"}); err != nil {
+		t.Fatalf("UntagCharges: %v", err)
+	}
+	theirs, err := s.GetCharge(ids[3])
+	if err != nil || strings.Join(theirs.Tags, ",") != "vacation" {
+		t.Fatalf("another owner's charge was retagged: %q, %v", theirs.Tags, err)
+	}
+
+	got.Name = "Hotel stay"
+	if err := s.UpdateCharge(got); err != nil {
+		t.Fatalf("UpdateCharge: %v", err)
+	}
+	tags, err := s.ListTags(u.ID)
+	if err != nil {
+		t.Fatalf("ListTags: %v", err)
+	}
+	if fmt.Sprint(tags) != "[{reimbursable 3} {work 2}]" {
+		t.Fatalf("ListTags = %v, want reimbursable on 3 and work on 2", tags)
+	}
+
+	names := func(tags []string, any bool) (string, error) {
+		charges, err := s.ListCharges(&ListFilter{OwnerID: u.ID, Tags: tags, AnyTag: any, Sort: "id", Order: "asc"})
+		out := ""
+		for _, c := range charges {
+			out += c.Name + ";"
+		}
+		return out, err
+	}
+	for _, tc := range []struct {
+		tags []string
+		any  bool
+		want string
+	}{
+		{[]string{"reimbursable"}, false, "Hotel stay;Taxi;Snacks;"},
+		{[]string{"reimbursable", "work"}, false, "Taxi;Snacks;"},
+		{[]string{"vacation", "work"}, true, "Taxi;Snacks;"},
+		{[]string{"vacation"}, false, ""},
+	} {
+		got, err := names(tc.tags, tc.any)
+		if err != nil {
+			t.Fatalf("ListCharges(tags=%v): %v", tc.tags, err)
+		}
+		if got != tc.want {
+			t.Fatalf("ListCharges(tags=%v, any=%v) = %q, want %q", tc.tags, tc.any, got, tc.want)
+		}
+	}
+}
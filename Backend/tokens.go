@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// --------------------------
+//   Refresh Tokens + Logout
+// --------------------------
+
+// Token lifetimes, overridable with ACCESS_TOKEN_TTL / REFRESH_TOKEN_TTL.
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// errRefreshExpired: a refresh token presented after its expiry
+var errRefreshExpired = errors.New("refresh token expired")
+
+// tokenPair is returned by login and refresh.
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// durationFromEnv reads a time.ParseDuration value such as "15m" from the
+// environment, falling back to def when unset.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("%s must be a positive duration like 15m: %q", name, v)
+	}
+	return d
+}
+
+// intFromEnv reads a positive integer from the environment, falling back to
+// def when unset.
+func intFromEnv(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Fatalf("%s must be a positive integer: %q", name, v)
+	}
+	return n
+}
+
+// randomToken returns n random bytes encoded as unpadded base64url.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("random token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is how refresh tokens are stored and looked up.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRefreshToken stores a new refresh token for userID and returns the
+// plaintext, which is only ever handed to the client.
+func issueRefreshToken(store Store, userID int) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = store.CreateRefreshToken(&RefreshToken{
+		UserID:    userID,
+		Hash:      hashToken(token),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	})
+	if err != nil {
+		return "", fmt.Errorf("storing refresh token: %v", err)
+	}
+	return token, nil
+}
+
+// issueTokenPair creates an access token and a refresh token for userID.
+func issueTokenPair(store Store, userID int) (tokenPair, error) {
+	gen, err := store.TokenGeneration(userID)
+	if err != nil {
+		return tokenPair{}, fmt.Errorf("reading token generation: %v", err)
+	}
+	access, err := generateJWT(userID, gen)
+	if err != nil {
+		return tokenPair{}, err
+	}
+	refresh, err := issueRefreshToken(store, userID)
+	if err != nil {
+		return tokenPair{}, err
+	}
+	return tokenPair{
+		Token:        access,
+		RefreshToken: refresh,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// checkTokenRevoked rejects access tokens whose user no longer exists, whose
+// jti was revoked at logout, or that are from a token generation before the
+// user's tokens were last revoked wholesale (logout everywhere, password
+// change, admin update).
+func checkTokenRevoked(store Store, t *accessToken) error {
+	rev, err := store.TokenRevocation(t.UserID, t.ID)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("user no longer exists")
+	}
+	if err != nil {
+		return fmt.Errorf("checking token revocation: %v", err)
+	}
+	if rev.JTIRevoked {
+		return fmt.Errorf("token revoked")
+	}
+	if t.Generation < rev.Generation {
+		return fmt.Errorf("token revoked")
+	}
+	return nil
+}
+
+// POST /api/token/refresh => exchange a refresh token for a new token pair.
+// The presented refresh token is revoked (rotation); presenting an already
+// revoked one is treated as theft and revokes all of the user's tokens.
+func (s *Server) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var pair tokenPair
+	reused := 0
+	err := s.store.Tx(func(tx Store) error {
+		t, err := tx.GetRefreshToken(hashToken(body.RefreshToken))
+		if err != nil {
+			return err
+		}
+		if t.RevokedAt != nil {
+			reused = t.UserID
+			return tx.RevokeUserTokens(t.UserID)
+		}
+		if time.Now().After(t.ExpiresAt) {
+			return errRefreshExpired
+		}
+		if err := tx.RevokeRefreshToken(t.ID); err != nil {
+			return fmt.Errorf("rotating refresh token: %v", err)
+		}
+		pair, err = issueTokenPair(tx, t.UserID)
+		return err
+	})
+	switch {
+	case reused != 0:
+		log.Printf("Revoked refresh token reused for user %d; all sessions revoked\n", reused)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	case errors.Is(err, errRefreshExpired):
+		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Error refreshing token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(pair)
+}
+
+// POST /api/logout => revoke the presented access token. The optional body
+// { "refresh_token": "...", "all": true } also revokes that refresh token, or
+// every token the user holds.
+func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := s.parseAccessToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+		All          bool   `json:"all"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	err = s.store.Tx(func(tx Store) error {
+		if err := tx.RevokeAccessToken(t.ID, t.UserID, t.Expires); err != nil {
+			return err
+		}
+		if body.All {
+			return tx.RevokeUserTokens(t.UserID)
+		}
+		if body.RefreshToken != "" {
+			// Only the caller's own refresh tokens can be revoked this way
+			rt, err := tx.GetRefreshToken(hashToken(body.RefreshToken))
+			if errors.Is(err, ErrNotFound) || (err == nil && rt.UserID != t.UserID) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return tx.RevokeRefreshToken(rt.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully"})
+}
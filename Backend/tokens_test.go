@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRandomToken(t *testing.T) {
+	seen := map[string]bool{}
+	for _, n := range []int{12, 16, 32} {
+		token, err := randomToken(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Unpadded base64url: 4 characters per 3 bytes, rounded up
+		if want := (n*8 + 5) / 6; len(token) != want || strings.ContainsAny(token, "+/=") || seen[token] {
+			t.Fatalf("randomToken(%d) = %q, want %d fresh base64url characters", n, token, want)
+		}
+		seen[token] = true
+	}
+	if hashToken("a") != hashToken("a") || hashToken("a") == hashToken("b") || len(hashToken("a")) != 64 {
+		t.Fatalf("hashToken isn't a SHA-256 hex digest of its input")
+	}
+}
+
+func TestDurationFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", time.Minute},
+		{"15m", 15 * time.Minute},
+		{"36h", 36 * time.Hour},
+		{"90s", 90 * time.Second},
+	}
+	for _, tc := range tests {
+		t.Setenv("TEST_TTL", tc.value)
+		if got := durationFromEnv("TEST_TTL", time.Minute); got != tc.want {
+			t.Fatalf("durationFromEnv with %q = %s, want %s", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestTokenStore(t *testing.T) {
+	eachStore(t, testTokens)
+}
+
+func TestSessions(t *testing.T) {
+	eachStore(t, testSessions)
+}
+
+// testSessions checks refresh token rotation and logout.
+func testSessions(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	u := at.alice
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, c *apiClient, refresh string)
+	}{
+		{"refresh rotates", func(t *testing.T, c *apiClient, refresh string) {
+			var pair tokenPair
+			if err := c.expectStatus(http.StatusOK, "POST", "/api/token/refresh", map[string]string{"refresh_token": refresh}, &pair); err != nil {
+				t.Fatal(err)
+			}
+			if pair.Token == "" || pair.RefreshToken == "" || pair.RefreshToken == refresh || pair.ExpiresIn != int(accessTokenTTL.Seconds()) {
+				t.Fatalf("refreshed pair = %+v", pair)
+			}
+			rotated := &apiClient{base: c.base, token: pair.Token}
+			if err := rotated.expectStatus(http.StatusOK, "GET", "/api/budgets", nil, nil); err != nil {
+				t.Fatalf("refreshed access token: %v", err)
+			}
+			// Reuse looks like theft, so it ends every session
+			if err := c.expectStatus(http.StatusUnauthorized, "POST", "/api/token/refresh", map[string]string{"refresh_token": refresh}, nil); err != nil {
+				t.Fatalf("reusing a rotated refresh token: %v", err)
+			}
+			if err := rotated.expectStatus(http.StatusUnauthorized, "GET", "/api/budgets", nil, nil); err != nil {
+				t.Fatalf("after refresh token reuse: %v", err)
+			}
+			if err := c.expectStatus(http.StatusUnauthorized, "POST", "/api/token/refresh", map[string]string{"refresh_token": pair.RefreshToken}, nil); err != nil {
+				t.Fatalf("refresh token issued before the reuse: %v", err)
+			}
+		}},
+		{"logout ends only this session", func(t *testing.T, c *apiClient, refresh string) {
+			other := at.client()
+			if _, err := other.login(u.Username, "pw"); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.expectStatus(http.StatusOK, "POST", "/api/logout", nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.expectStatus(http.StatusUnauthorized, "GET", "/api/budgets", nil, nil); err != nil {
+				t.Fatalf("after logout: %v", err)
+			}
+			if err := other.expectStatus(http.StatusOK, "GET", "/api/budgets", nil, nil); err != nil {
+				t.Fatalf("another session after logout: %v", err)
+			}
+			if err := c.expectStatus(http.StatusOK, "POST", "/api/token/refresh", map[string]string{"refresh_token": refresh}, nil); err != nil {
+				t.Fatalf("refresh token kept at logout: %v", err)
+			}
+		}},
+		{"logout with the refresh token", func(t *testing.T, c *apiClient, refresh string) {
+			if err := c.expectStatus(http.StatusOK, "POST", "/api/logout", map[string]string{"refresh_token": refresh}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.expectStatus(http.StatusUnauthorized, "POST", "/api/token/refresh", map[string]string{"refresh_token": refresh}, nil); err != nil {
+				t.Fatalf("refresh token revoked at logout: %v", err)
+			}
+		}},
+		{"bad refresh tokens", func(t *testing.T, c *apiClient, refresh string) {
+			if err := c.expectStatus(http.StatusBadRequest, "POST", "/api/token/refresh", map[string]string{}, nil); err != nil {
+				t.Fatalf("no refresh token: %v", err)
+			}
+			if err := c.expectStatus(http.StatusUnauthorized, "POST", "/api/token/refresh", map[string]string{"refresh_token": "x" + refresh}, nil); err != nil {
+				t.Fatalf("unknown refresh token: %v", err)
+			}
+			expired := "expired-" + refresh
+			rt := RefreshToken{UserID: u.ID, Hash: hashToken(expired), ExpiresAt: time.Now().Add(-time.Minute)}
+			if err := s.CreateRefreshToken(&rt); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.expectStatus(http.StatusUnauthorized, "POST", "/api/token/refresh", map[string]string{"refresh_token": expired}, nil); err != nil {
+				t.Fatalf("expired refresh token: %v", err)
+			}
+			if err := c.expectStatus(http.StatusOK, "GET", "/api/budgets", nil, nil); err != nil {
+				t.Fatalf("session after presenting an expired refresh token: %v", err)
+			}
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := at.client()
+			refresh, err := c.login(u.Username, "pw")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.run(t, c, refresh)
+		})
+	}
+}
+
+func TestTokenRevocation(t *testing.T) {
+	eachStore(t, testTokenRevocation)
+}
+
+// testTokenRevocation checks that revoking a user's tokens ends the sessions
+// they had, but not ones they start right after, in the same second.
+func testTokenRevocation(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	u := at.alice
+
+	tests := []struct {
+		name   string
+		revoke func(t *testing.T, c *apiClient, refresh string)
+	}{
+		{"logout everywhere", func(t *testing.T, c *apiClient, refresh string) {
+			if err := c.expectStatus(http.StatusOK, "POST", "/api/logout", map[string]bool{"all": true}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"refresh token reuse", func(t *testing.T, c *apiClient, refresh string) {
+			body := map[string]string{"refresh_token": refresh}
+			rotated := &apiClient{base: c.base}
+			if err := rotated.expectStatus(http.StatusOK, "POST", "/api/token/refresh", body, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := rotated.expectStatus(http.StatusUnauthorized, "POST", "/api/token/refresh", body, nil); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"store revocation", func(t *testing.T, c *apiClient, refresh string) {
+			if err := s.RevokeUserTokens(u.ID); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			old := at.client()
+			refresh, err := old.login(u.Username, "pw")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.revoke(t, old, refresh)
+			if err := old.expectStatus(http.StatusUnauthorized, "GET", "/api/budgets", nil, nil); err != nil {
+				t.Fatalf("revoked session: %v", err)
+			}
+			again := at.client()
+			if _, err := again.login(u.Username, "pw"); err != nil {
+				t.Fatal(err)
+			}
+			if err := again.expectStatus(http.StatusOK, "GET", "/api/budgets", nil, nil); err != nil {
+				t.Fatalf("login right after revoking: %v", err)
+			}
+		})
+	}
+}
+
+func testTokens(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	hash := hashToken(strconv.FormatInt(time.Now().UnixNano(), 10))
+	rt := RefreshToken{UserID: u.ID, Hash: hash, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := s.CreateRefreshToken(&rt); err != nil {
+		t.Fatalf("CreateRefreshToken: %v", err)
+	}
+	got, err := s.GetRefreshToken(hash)
+	if err != nil || got.ID != rt.ID || got.UserID != u.ID || got.RevokedAt != nil {
+		t.Fatalf("GetRefreshToken = %+v, %v", got, err)
+	}
+	if _, err := s.GetRefreshToken(hashToken("missing")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unknown refresh token: got %v, want ErrNotFound", err)
+	}
+	if err := s.RevokeRefreshToken(rt.ID); err != nil {
+		t.Fatalf("RevokeRefreshToken: %v", err)
+	}
+	if got, _ = s.GetRefreshToken(hash); got.RevokedAt == nil {
+		t.Fatalf("refresh token not revoked")
+	}
+
+	rev, err := s.TokenRevocation(u.ID, "jti-"+u.Username)
+	if err != nil || rev.JTIRevoked || rev.Generation != 0 {
+		t.Fatalf("TokenRevocation before revoking = %+v, %v", rev, err)
+	}
+	if err := s.RevokeAccessToken("jti-"+u.Username, u.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RevokeAccessToken: %v", err)
+	}
+	if err := s.RevokeUserTokens(u.ID); err != nil {
+		t.Fatalf("RevokeUserTokens: %v", err)
+	}
+	if rev, err = s.TokenRevocation(u.ID, "jti-"+u.Username); err != nil || !rev.JTIRevoked || rev.Generation != 1 {
+		t.Fatalf("TokenRevocation after revoking = %+v, %v", rev, err)
+	}
+	if gen, err := s.TokenGeneration(u.ID); err != nil || gen != 1 {
+		t.Fatalf("TokenGeneration = %d, %v; want 1", gen, err)
+	}
+	if _, err := s.TokenGeneration(-1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("TokenGeneration of a missing user: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.TokenRevocation(-1, "x"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("TokenRevocation of a missing user: got %v, want ErrNotFound", err)
+	}
+}
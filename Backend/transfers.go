@@ -0,0 +1,515 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// --------------------------
+//         Transfers
+// --------------------------
+
+// Transfer: money moved from one of a user's accounts to another, e.g.
+// into savings or to pay off a credit card. It is posted as two linked
+// charges, its legs: an expense leaving FromAccountID and income arriving
+// in ToAccountID, so both balances move while neither leg counts as
+// spending or income. Stores keep only the link; the rest is read off the
+// legs (see transferOf).
+type Transfer struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	Amount        Money  `json:"-"`
+	FromAccountID int    `json:"from_account_id"`
+	ToAccountID   int    `json:"to_account_id"`
+	FromChargeID  int    `json:"from_charge_id"`
+	ToChargeID    int    `json:"to_charge_id"`
+	UserID        int    `json:"user_id"`
+	CreatedAt     string `json:"created_at"`
+}
+
+func (t Transfer) MarshalJSON() ([]byte, error) {
+	type plain Transfer
+	return json.Marshal(struct {
+		plain
+		moneyFields
+	}{plain(t), newMoneyFields(t.Amount)})
+}
+
+func (t *Transfer) UnmarshalJSON(data []byte) error {
+	type plain Transfer
+	aux := struct {
+		*plain
+		moneyFields
+	}{plain: (*plain)(t)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m, err := aux.money()
+	if err != nil {
+		return err
+	}
+	t.Amount = m
+	return nil
+}
+
+var (
+	// errTransferLeg: a charge that is part of a transfer was to be changed
+	// on its own.
+	errTransferLeg = errors.New("transfer leg")
+	// errInvalidTransfer: two charges that can't be linked as a transfer.
+	errInvalidTransfer = errors.New("invalid transfer")
+)
+
+// checkNotTransferLeg refuses changes to c on its own when it is a leg of
+// a transfer; the transfer is changed as a unit instead.
+func checkNotTransferLeg(c Charge) error {
+	if c.TransferID != nil {
+		return fmt.Errorf("%w: charge %d is part of transfer %d; change the transfer instead", errTransferLeg, c.ID, *c.TransferID)
+	}
+	return nil
+}
+
+// validateTransfer trims t's name, defaulting it, and checks its amount,
+// accounts and date.
+func validateTransfer(t *Transfer) error {
+	if t.Name = strings.TrimSpace(t.Name); t.Name == "" {
+		t.Name = "Transfer"
+	}
+	if t.Amount.Minor <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+	if t.FromAccountID == 0 || t.ToAccountID == 0 {
+		return fmt.Errorf("from_account_id and to_account_id are required")
+	}
+	if t.FromAccountID == t.ToAccountID {
+		return fmt.Errorf("a transfer needs two different accounts")
+	}
+	if t.CreatedAt != "" {
+		if _, err := parseDate(t.CreatedAt); err != nil {
+			return fmt.Errorf("invalid created_at %q", t.CreatedAt)
+		}
+	}
+	return nil
+}
+
+// applyTo sets the fields of leg that t determines: the name, amount and
+// the account it is posted to.
+func (t Transfer) applyTo(leg Charge, accountID int) Charge {
+	leg.Name, leg.Amount, leg.AccountID = t.Name, t.Amount, &accountID
+	return leg
+}
+
+// legs returns the charges a new transfer t posts.
+func (t Transfer) legs() (from, to Charge) {
+	from = t.applyTo(Charge{Direction: DirectionExpense, UserID: t.UserID, CreatedAt: t.CreatedAt}, t.FromAccountID)
+	to = t.applyTo(Charge{Direction: DirectionIncome, UserID: t.UserID, CreatedAt: t.CreatedAt}, t.ToAccountID)
+	return from, to
+}
+
+// transferOf fills in link (a transfer as stored) from its legs.
+func transferOf(link Transfer, from, to Charge) Transfer {
+	t := link
+	t.Name, t.Amount, t.CreatedAt = from.Name, from.Amount, from.CreatedAt
+	t.FromChargeID, t.ToChargeID = from.ID, to.ID
+	if from.AccountID != nil {
+		t.FromAccountID = *from.AccountID
+	}
+	if to.AccountID != nil {
+		t.ToAccountID = *to.AccountID
+	}
+	return t
+}
+
+// loadTransfer returns transfer id of ownerID, filled in, with its legs.
+func loadTransfer(store Store, id, ownerID int) (Transfer, Charge, Charge, error) {
+	link, err := store.GetTransfer(id)
+	if err == nil && link.UserID != ownerID {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return Transfer{}, Charge{}, Charge{}, err
+	}
+	from, err := store.GetCharge(link.FromChargeID)
+	if err != nil {
+		return Transfer{}, Charge{}, Charge{}, fmt.Errorf("loading transfer %d: %v", id, err)
+	}
+	to, err := store.GetCharge(link.ToChargeID)
+	if err != nil {
+		return Transfer{}, Charge{}, Charge{}, fmt.Errorf("loading transfer %d: %v", id, err)
+	}
+	return transferOf(link, from, to), from, to, nil
+}
+
+// transferID parses the transfer ID in the request path.
+func transferID(r *http.Request) (int, error) {
+	return strconv.Atoi(mux.Vars(r)["id"])
+}
+
+// GET /api/transfers => the JWT user's transfers (or ?owner=<id>, read
+// access), newest first
+func (s *Server) getTransfersHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	links, err := s.store.ListTransfers(ownerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying transfers: %v", err), http.StatusInternalServerError)
+		return
+	}
+	transfers := make([]Transfer, 0, len(links))
+	for _, link := range links {
+		t, _, _, err := loadTransfer(s.store, link.ID, ownerID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying transfers: %v", err), http.StatusInternalServerError)
+			return
+		}
+		transfers = append(transfers, t)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(transfers)
+}
+
+// GET /api/transfers/{id} => one transfer of the JWT user (or ?owner=<id>,
+// read access)
+func (s *Server) getTransferHandler(w http.ResponseWriter, r *http.Request) {
+	_, ownerID, status, err := s.resolveOwner(w, r, AccessRead)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	id, err := transferID(r)
+	if err != nil {
+		http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
+		return
+	}
+	t, _, _, err := loadTransfer(s.store, id, ownerID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Transfer not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying transfer: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(t)
+}
+
+// POST /api/transfers => move money between two accounts of the JWT user
+// (or ?owner=<id>, write access), both in the transfer's currency, dated
+// created_at (default now). Body:
+// { "from_account_id": 1, "to_account_id": 2, "amount": 250, "currency": "EUR", "name": "Savings" }
+func (s *Server) createTransferHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var t Transfer
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validateTransfer(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.ID = 0
+	t.UserID = ownerID
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		from, to := t.legs()
+		for _, leg := range []*Charge{&from, &to} {
+			if err := checkChargeAccount(tx, *leg); err != nil {
+				return err
+			}
+			if err := tx.CreateCharge(leg); err != nil {
+				return fmt.Errorf("inserting charge: %w", err)
+			}
+		}
+		t.FromChargeID, t.ToChargeID = from.ID, to.ID
+		if err := tx.CreateTransfer(&t); err != nil {
+			return fmt.Errorf("inserting transfer: %w", err)
+		}
+		for _, leg := range []Charge{from, to} {
+			leg.TransferID = &t.ID
+			if err := audit.record(tx, AuditCreate, "charge", leg.ID, ownerID, nil, leg); err != nil {
+				return err
+			}
+		}
+		t = transferOf(t, from, to)
+		return audit.record(tx, AuditCreate, "transfer", t.ID, ownerID, nil, t)
+	})
+	if errors.Is(err, errInvalidAccount) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating transfer: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// PUT /api/transfers/{id} => change the name, amount or accounts of a
+// transfer of the JWT user (or ?owner=<id>, write access); both legs
+// change together. Body as for POST; created_at is ignored.
+func (s *Server) updateTransferHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	id, err := transferID(r)
+	if err != nil {
+		http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
+		return
+	}
+	var t Transfer
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	t.CreatedAt = ""
+	if err := validateTransfer(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, from, to, err := loadTransfer(tx, id, ownerID)
+		if err != nil {
+			return err
+		}
+		legs := [][2]Charge{
+			{from, t.applyTo(from, t.FromAccountID)},
+			{to, t.applyTo(to, t.ToAccountID)},
+		}
+		for _, leg := range legs {
+			if err := checkChargeAccount(tx, leg[1]); err != nil {
+				return err
+			}
+			if err := tx.UpdateCharge(leg[1]); err != nil {
+				return err
+			}
+			if err := audit.record(tx, AuditUpdate, "charge", leg[1].ID, ownerID, leg[0], leg[1]); err != nil {
+				return err
+			}
+		}
+		t = transferOf(before, legs[0][1], legs[1][1])
+		return audit.record(tx, AuditUpdate, "transfer", id, ownerID, before, t)
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Transfer not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errInvalidAccount) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating transfer: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(t)
+}
+
+// DELETE /api/transfers/{id} => delete a transfer of the JWT user (or
+// ?owner=<id>, write access) and both its legs. With ?keep_charges=true
+// only the link goes, leaving the legs as ordinary charges.
+func (s *Server) deleteTransferHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	id, err := transferID(r)
+	if err != nil {
+		http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
+		return
+	}
+	keepCharges := r.URL.Query().Get("keep_charges") == "true"
+
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		before, from, to, err := loadTransfer(tx, id, ownerID)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteTransfer(ownerID, id); err != nil {
+			return err
+		}
+		for _, leg := range []Charge{from, to} {
+			after := leg
+			after.TransferID = nil
+			if !keepCharges {
+				if err := tx.DeleteCharge(ownerID, leg.ID); err != nil {
+					return err
+				}
+				err = audit.record(tx, AuditDelete, "charge", leg.ID, ownerID, leg, nil)
+			} else {
+				err = audit.record(tx, AuditUpdate, "charge", leg.ID, ownerID, leg, after)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return audit.record(tx, AuditDelete, "transfer", id, ownerID, before, nil)
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Transfer not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting transfer: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Transfer deleted successfully", "owner_id": ownerID})
+}
+
+// checkTransferLegs verifies that from and to, two charges of the same
+// owner, can be linked as a transfer.
+func checkTransferLegs(from, to Charge) error {
+	for _, c := range []Charge{from, to} {
+		if err := checkNotTransferLeg(c); err != nil {
+			return err
+		}
+		if c.AccountID == nil {
+			return fmt.Errorf("%w: charge %d isn't posted to an account", errInvalidTransfer, c.ID)
+		}
+		if c.Recurring {
+			return fmt.Errorf("%w: charge %d is a recurring charge", errInvalidTransfer, c.ID)
+		}
+		if len(c.Participants) > 0 {
+			return fmt.Errorf("%w: charge %d is a shared expense", errInvalidTransfer, c.ID)
+		}
+		// A transfer's amount changes both legs, which would leave splits behind
+		if len(c.Splits) > 0 {
+			return fmt.Errorf("%w: charge %d is split", errInvalidTransfer, c.ID)
+		}
+	}
+	if *from.AccountID == *to.AccountID {
+		return fmt.Errorf("%w: both charges are posted to account %d", errInvalidTransfer, *from.AccountID)
+	}
+	if from.Amount != to.Amount {
+		return fmt.Errorf("%w: the charges' amounts differ (%s %s and %s %s)", errInvalidTransfer,
+			from.Amount, from.Amount.Currency, to.Amount, to.Amount.Currency)
+	}
+	if from.Direction != DirectionExpense {
+		return fmt.Errorf("%w: charge %d, the money leaving, must be an expense", errInvalidTransfer, from.ID)
+	}
+	if to.Direction == DirectionExpense {
+		return fmt.Errorf("%w: charge %d, the money arriving, must be income or a refund", errInvalidTransfer, to.ID)
+	}
+	return nil
+}
+
+// POST /api/transfers/link => mark two existing charges of the JWT user (or
+// ?owner=<id>, write access), e.g. both sides of a card payment imported
+// from two bank exports, as a transfer. Body:
+// { "from_charge_id": 10, "to_charge_id": 42, "name": "Card payment" }
+// from_charge_id is the expense leaving one account and to_charge_id the
+// income or refund of the same amount arriving in another; the latter
+// becomes income. The charges keep their dates, and their names unless
+// name is given.
+func (s *Server) linkTransferHandler(w http.ResponseWriter, r *http.Request) {
+	callerID, ownerID, status, err := s.resolveOwner(w, r, AccessWrite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var body struct {
+		FromChargeID int    `json:"from_charge_id"`
+		ToChargeID   int    `json:"to_charge_id"`
+		Name         string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if body.FromChargeID == body.ToChargeID {
+		http.Error(w, "from_charge_id and to_charge_id must be two different charges", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+
+	var t Transfer
+	audit := requestAudit(r, callerID)
+	err = s.store.Tx(func(tx Store) error {
+		var legs [2][2]Charge // before, after
+		for i, id := range []int{body.FromChargeID, body.ToChargeID} {
+			c, err := tx.GetCharge(id)
+			if err == nil && c.UserID != ownerID {
+				err = ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+			legs[i] = [2]Charge{c, c}
+		}
+		if err := checkTransferLegs(legs[0][0], legs[1][0]); err != nil {
+			return err
+		}
+		legs[1][1].Direction = DirectionIncome
+		if name != "" {
+			legs[0][1].Name, legs[1][1].Name = name, name
+		}
+
+		t = Transfer{UserID: ownerID, FromChargeID: body.FromChargeID, ToChargeID: body.ToChargeID}
+		if err := tx.CreateTransfer(&t); err != nil {
+			return fmt.Errorf("Error inserting transfer: %v", err)
+		}
+		for _, leg := range legs {
+			if err := tx.UpdateCharge(leg[1]); err != nil {
+				return err
+			}
+			leg[1].TransferID = &t.ID
+			if err := audit.record(tx, AuditUpdate, "charge", leg[1].ID, ownerID, leg[0], leg[1]); err != nil {
+				return err
+			}
+		}
+		t = transferOf(t, legs[0][1], legs[1][1])
+		return audit.record(tx, AuditCreate, "transfer", t.ID, ownerID, nil, t)
+	})
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Charge not found or not owned by user", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errInvalidTransfer) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errTransferLeg) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
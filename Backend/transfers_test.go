@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestValidateTransfer(t *testing.T) {
+	tests := []struct {
+		name     string
+		transfer Transfer
+		wantName string
+		ok       bool
+	}{
+		{"defaults the name", Transfer{Name: "  ", Amount: mustMoney("10", "USD"), FromAccountID: 1, ToAccountID: 2}, "Transfer", true},
+		{"keeps a name and date", Transfer{Name: " Savings ", Amount: mustMoney("10", "USD"), FromAccountID: 1, ToAccountID: 2, CreatedAt: "2024-05-01"}, "Savings", true},
+		{"zero amount", Transfer{Amount: mustMoney("0", "USD"), FromAccountID: 1, ToAccountID: 2}, "", false},
+		{"negative amount", Transfer{Amount: mustMoney("-10", "USD"), FromAccountID: 1, ToAccountID: 2}, "", false},
+		{"no from account", Transfer{Amount: mustMoney("10", "USD"), ToAccountID: 2}, "", false},
+		{"one account", Transfer{Amount: mustMoney("10", "USD"), FromAccountID: 2, ToAccountID: 2}, "", false},
+		{"bad date", Transfer{Amount: mustMoney("10", "USD"), FromAccountID: 1, ToAccountID: 2, CreatedAt: "May"}, "", false},
+	}
+	for _, tc := range tests {
+		tr := tc.transfer
+		err := validateTransfer(&tr)
+		if (err == nil) != tc.ok || (tc.ok && tr.Name != tc.wantName) {
+			t.Fatalf("%s: validateTransfer = %q, %v", tc.name, tr.Name, err)
+		}
+	}
+}
+
+func TestTransferLegs(t *testing.T) {
+	tr := Transfer{ID: 9, Name: "Savings", Amount: mustMoney("250", "EUR"), FromAccountID: 1, ToAccountID: 2, UserID: 5, CreatedAt: "2024-05-01"}
+	from, to := tr.legs()
+	if from.Direction != DirectionExpense || to.Direction != DirectionIncome || *from.AccountID != 1 || *to.AccountID != 2 ||
+		from.Amount != tr.Amount || to.Amount != tr.Amount || from.UserID != 5 || to.CreatedAt != tr.CreatedAt {
+		t.Fatalf("legs = %+v, %+v", from, to)
+	}
+	from.ID, to.ID = 20, 21
+	got := transferOf(Transfer{ID: 9, UserID: 5, FromChargeID: 20, ToChargeID: 21}, from, to)
+	want := tr
+	want.FromChargeID, want.ToChargeID = 20, 21
+	if got != want {
+		t.Fatalf("transferOf(legs) = %+v, want %+v", got, want)
+	}
+}
+
+func TestCheckTransferLegs(t *testing.T) {
+	account := func(id int) *int { return &id }
+	transferID := 3
+	leg := func(direction string, accountID *int) Charge {
+		return Charge{ID: 1, Direction: direction, Amount: mustMoney("40", "USD"), AccountID: accountID}
+	}
+	tests := []struct {
+		name     string
+		from, to Charge
+		err      error
+	}{
+		{"expense to income", leg(DirectionExpense, account(1)), leg(DirectionIncome, account(2)), nil},
+		{"expense to refund", leg(DirectionExpense, account(1)), leg(DirectionRefund, account(2)), nil},
+		{"already a leg", func() Charge { c := leg(DirectionExpense, account(1)); c.TransferID = &transferID; return c }(), leg(DirectionIncome, account(2)), errTransferLeg},
+		{"no account", leg(DirectionExpense, nil), leg(DirectionIncome, account(2)), errInvalidTransfer},
+		{"one account", leg(DirectionExpense, account(1)), leg(DirectionIncome, account(1)), errInvalidTransfer},
+		{"recurring", leg(DirectionExpense, account(1)), func() Charge { c := leg(DirectionIncome, account(2)); c.Recurring = true; return c }(), errInvalidTransfer},
+		{"shared", func() Charge {
+			c := leg(DirectionExpense, account(1))
+			c.Participants = []Participant{{UserID: 2}}
+			return c
+		}(), leg(DirectionIncome, account(2)), errInvalidTransfer},
+		{"split", leg(DirectionExpense, account(1)), func() Charge {
+			c := leg(DirectionIncome, account(2))
+			c.Splits = []ChargeSplit{{Amount: mustMoney("40", "USD")}}
+			return c
+		}(), errInvalidTransfer},
+		{"amounts differ", leg(DirectionExpense, account(1)), func() Charge { c := leg(DirectionIncome, account(2)); c.Amount = mustMoney("40", "EUR"); return c }(), errInvalidTransfer},
+		{"income leaving", leg(DirectionIncome, account(1)), leg(DirectionIncome, account(2)), errInvalidTransfer},
+		{"expense arriving", leg(DirectionExpense, account(1)), leg(DirectionExpense, account(2)), errInvalidTransfer},
+	}
+	for _, tc := range tests {
+		if err := checkTransferLegs(tc.from, tc.to); !errors.Is(err, tc.err) || (tc.err == nil) != (err == nil) {
+			t.Fatalf("%s: checkTransferLegs = %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestTransferStore(t *testing.T) {
+	eachStore(t, testTransfers)
+}
+
+func TestTransferAPI(t *testing.T) {
+	eachStore(t, testTransferAPI)
+}
+
+// testTransferAPI moves money between accounts through the API and checks
+// that balances move and that the legs only change as a unit.
+func testTransferAPI(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	a := at.a
+	var accounts [3]Account
+	for i, body := range []map[string]interface{}{
+		{"name": "Checking", "type": "checking", "opening_balance": 500, "currency": "USD"},
+		{"name": "Savings", "type": "savings", "opening_balance": 0, "currency": "USD"},
+		{"name": "Euros", "type": "cash", "opening_balance": 0, "currency": "EUR"},
+	} {
+		if err := a.expectStatus(http.StatusCreated, "POST", "/api/accounts", body, &accounts[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checking, savings, euros := accounts[0].ID, accounts[1].ID, accounts[2].ID
+	balance := func(id int) string {
+		var got struct {
+			Balance json.Number `json:"balance"`
+		}
+		if err := a.expectStatus(http.StatusOK, "GET", "/api/accounts/"+strconv.Itoa(id), nil, &got); err != nil {
+			t.Fatal(err)
+		}
+		return string(got.Balance)
+	}
+
+	tests := []struct {
+		name             string
+		body             map[string]interface{}
+		status           int
+		checking, saving string
+	}{
+		{"a transfer", map[string]interface{}{"amount": 200, "from_account_id": checking, "to_account_id": savings}, http.StatusCreated, "300.00", "200.00"},
+		{"back again", map[string]interface{}{"amount": 50, "from_account_id": savings, "to_account_id": checking}, http.StatusCreated, "350.00", "150.00"},
+		{"one account", map[string]interface{}{"amount": 50, "from_account_id": savings, "to_account_id": savings}, http.StatusBadRequest, "350.00", "150.00"},
+		{"another currency", map[string]interface{}{"amount": 50, "from_account_id": checking, "to_account_id": euros}, http.StatusBadRequest, "350.00", "150.00"},
+		{"nothing", map[string]interface{}{"amount": 0, "from_account_id": checking, "to_account_id": savings}, http.StatusBadRequest, "350.00", "150.00"},
+	}
+	var first Transfer
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var tr Transfer
+			if err := a.expectStatus(tc.status, "POST", "/api/transfers", tc.body, &tr); err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				first = tr
+			}
+			if got := balance(checking) + " " + balance(savings); got != tc.checking+" "+tc.saving {
+				t.Fatalf("balances = %s, want %s %s", got, tc.checking, tc.saving)
+			}
+		})
+	}
+
+	// A leg can't be edited on its own; the transfer changes as a unit
+	legPath := "/api/charges/" + strconv.Itoa(first.FromChargeID)
+	if err := a.expectStatus(http.StatusConflict, "DELETE", legPath, nil, nil); err != nil {
+		t.Fatalf("deleting a transfer leg: %v", err)
+	}
+	if err := a.expectStatus(http.StatusOK, "DELETE", "/api/transfers/"+strconv.Itoa(first.ID), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := balance(checking) + " " + balance(savings); got != "550.00 -50.00" {
+		t.Fatalf("balances after deleting the transfer = %s", got)
+	}
+
+	// Two charges imported separately link up as a transfer
+	var out, in Charge
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", map[string]interface{}{"name": "Card payment", "amount": 75, "account_id": checking}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/charges", map[string]interface{}{"name": "Payment received", "amount": 75, "direction": "refund", "account_id": savings}, &in); err != nil {
+		t.Fatal(err)
+	}
+	link := map[string]interface{}{"from_charge_id": out.ID, "to_charge_id": in.ID, "name": "Card payment"}
+	if err := at.b.expectStatus(http.StatusNotFound, "POST", "/api/transfers/link", link, nil); err != nil {
+		t.Fatalf("linking another user's charges: %v", err)
+	}
+	if err := a.expectStatus(http.StatusBadRequest, "POST", "/api/transfers/link", map[string]interface{}{"from_charge_id": in.ID, "to_charge_id": out.ID}, nil); err != nil {
+		t.Fatalf("linking the wrong way round: %v", err)
+	}
+	var linked Transfer
+	if err := a.expectStatus(http.StatusCreated, "POST", "/api/transfers/link", link, &linked); err != nil {
+		t.Fatal(err)
+	}
+	if linked.FromAccountID != checking || linked.ToAccountID != savings || linked.Amount.String() != "75.00" || linked.Name != "Card payment" {
+		t.Fatalf("linked transfer = %+v", linked)
+	}
+	if err := a.expectStatus(http.StatusConflict, "POST", "/api/transfers/link", link, nil); err != nil {
+		t.Fatalf("linking the legs of a transfer again: %v", err)
+	}
+}
+
+func testTransfers(t *testing.T, s Store) {
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	var legs []Charge
+	for i, name := range []string{"Checking", "Savings"} {
+		a := Account{Name: name, Type: "checking", OpeningBalance: mustMoney("0", "USD"), UserID: u.ID}
+		if err := s.CreateAccount(&a); err != nil {
+			t.Fatalf("CreateAccount: %v", err)
+		}
+		c := Charge{Name: "To savings", Amount: mustMoney("100", "USD"), Direction: []string{DirectionExpense, DirectionIncome}[i],
+			AccountID: &a.ID, UserID: u.ID, CreatedAt: "2024-05-01T12:00:00Z"}
+		if err := s.CreateCharge(&c); err != nil {
+			t.Fatalf("CreateCharge: %v", err)
+		}
+		legs = append(legs, c)
+	}
+
+	tr := Transfer{UserID: u.ID, FromChargeID: legs[0].ID, ToChargeID: legs[1].ID}
+	if err := s.CreateTransfer(&tr); err != nil {
+		t.Fatalf("CreateTransfer: %v", err)
+	}
+	if got, err := s.GetTransfer(tr.ID); err != nil || got != tr {
+		t.Fatalf("GetTransfer = %+v, %v; want %+v", got, err, tr)
+	}
+	for _, leg := range legs {
+		if got, err := s.GetCharge(leg.ID); err != nil || got.TransferID == nil || *got.TransferID != tr.ID {
+			t.Fatalf("leg %d has transfer %v, %v; want %d", leg.ID, got.TransferID, err, tr.ID)
+		}
+	}
+	if list, err := s.ListTransfers(u.ID); err != nil || len(list) != 1 || list[0] != tr {
+		t.Fatalf("ListTransfers = %+v, %v", list, err)
+	}
+	again := Transfer{UserID: u.ID, FromChargeID: legs[1].ID, ToChargeID: legs[0].ID}
+	if err := s.CreateTransfer(&again); !errors.Is(err, ErrConflict) {
+		t.Fatalf("linking a leg twice: got %v, want ErrConflict", err)
+	}
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	if spent, err := sumChargesByCurrency(s, u.ID, nil, start, start.AddDate(0, 1, 0)); err != nil || len(spent) != 0 {
+		t.Fatalf("spending = %v, %v; want none for a transfer", spent, err)
+	}
+
+	if err := s.DeleteTransfer(u.ID, tr.ID); err != nil {
+		t.Fatalf("DeleteTransfer: %v", err)
+	}
+	if got, err := s.GetCharge(legs[0].ID); err != nil || got.TransferID != nil {
+		t.Fatalf("unlinked leg has transfer %v, %v", got.TransferID, err)
+	}
+
+	// Deleting a leg deletes the link
+	if err := s.CreateTransfer(&tr); err != nil {
+		t.Fatalf("CreateTransfer: %v", err)
+	}
+	if err := s.DeleteCharge(u.ID, legs[0].ID); err != nil {
+		t.Fatalf("DeleteCharge: %v", err)
+	}
+	if _, err := s.GetTransfer(tr.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("transfer after deleting a leg: got %v, want ErrNotFound", err)
+	}
+	if got, err := s.GetCharge(legs[1].ID); err != nil || got.TransferID != nil {
+		t.Fatalf("remaining leg has transfer %v, %v", got.TransferID, err)
+	}
+}
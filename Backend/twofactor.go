@@ -0,0 +1,698 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------
+//  Two-Factor Authentication
+// --------------------------
+
+// TOTP parameters: the RFC 6238 defaults, which authenticator apps assume.
+const (
+	totpIssuer = "Budgify"
+	totpPeriod = 30 // seconds per step
+	totpDigits = 6
+	totpSkew   = 1 // steps either side of now a code still counts for, for clock drift
+
+	recoveryCodeCount = 10
+)
+
+// loginChallengeTTL: how long the password step of a two-factor login
+// lasts, overridable with LOGIN_CHALLENGE_TTL.
+var loginChallengeTTL = 5 * time.Minute
+
+var (
+	errInvalidCode       = errors.New("invalid code")
+	errInvalidChallenge  = errors.New("invalid or expired challenge token")
+	errTwoFactorEnabled  = errors.New("two-factor authentication is already enabled; disable it first")
+	errTwoFactorOff      = errors.New("two-factor authentication is not enabled")
+	errNoEnrollment      = errors.New("no two-factor enrollment to confirm; start one with POST /api/2fa/enroll")
+	errTwoFactorRequired = errors.New("two-factor authentication is required for this account")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactor: a user's two-factor settings. Secret is "" until they enroll
+// and ConfirmedAt nil until they verify a first code.
+type TwoFactor struct {
+	UserID      int
+	Required    bool   // an admin requires the user to log in with a second factor
+	Secret      string // base32, as authenticator apps take it
+	ConfirmedAt *time.Time
+	LastStep    int64 // latest step a code was used for; each code works once
+}
+
+// TwoFactorState: what there is to say about TwoFactor short of the
+// secret, as the audit log keeps it.
+type TwoFactorState struct {
+	Enabled  bool `json:"enabled"`
+	Pending  bool `json:"pending"` // enrolled, waiting for a first code
+	Required bool `json:"required"`
+}
+
+// TwoFactorStatus: a user's two-factor state and how many recovery codes
+// they have left.
+type TwoFactorStatus struct {
+	TwoFactorState
+	RecoveryCodesLeft int `json:"recovery_codes_left"`
+}
+
+// TOTPEnrollment: a new secret, and the otpauth:// URI to show as a QR code.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// LoginChallenge: a password step of a two-factor login, waiting for the
+// second. Only its hash is kept.
+type LoginChallenge struct {
+	ID        int
+	UserID    int
+	Hash      string
+	ExpiresAt time.Time
+}
+
+func (t TwoFactor) enabled() bool { return t.ConfirmedAt != nil }
+
+func (t TwoFactor) state() TwoFactorState {
+	return TwoFactorState{Enabled: t.enabled(), Pending: t.Secret != "" && !t.enabled(), Required: t.Required}
+}
+
+// twoFactor returns the user's settings, all off if they have none.
+func twoFactor(store Store, userID int) (TwoFactor, error) {
+	t, err := store.GetTwoFactor(userID)
+	if errors.Is(err, ErrNotFound) {
+		return TwoFactor{UserID: userID}, nil
+	}
+	return t, err
+}
+
+// ---- TOTP ----
+
+// newTOTPSecret returns a random 160-bit secret.
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("random secret: %v", err)
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpURI is what authenticator apps read from a QR code.
+func totpURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(totpDigits))
+	v.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + v.Encode()
+}
+
+// totpCode is the code of a step: HOTP (RFC 4226) of the step number.
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%uint32(math.Pow10(totpDigits)))
+}
+
+// verifyTOTP returns the step code is the code of at now, give or take
+// totpSkew steps, as long as that step comes after last.
+func verifyTOTP(secret, code string, now time.Time, last int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if secret == "" || err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > last && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// ---- Recovery codes ----
+
+// newRecoveryCodes replaces the user's recovery codes with fresh ones,
+// formatted like "abcde-fghij", and returns them. Only their hashes are kept.
+func newRecoveryCodes(store Store, userID int) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("random recovery code: %v", err)
+		}
+		c := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = c[:5] + "-" + c[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	if err := store.SetRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode is how recovery codes are stored and looked up,
+// regardless of case, dashes and spaces.
+func hashRecoveryCode(code string) string {
+	return hashToken(strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code)))
+}
+
+// ---- Verifying a second factor ----
+
+// secondFactor: a TOTP code, or a recovery code instead.
+type secondFactor struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// verify checks f against t at now and uses it up: the step of a TOTP code
+// is stored as t.LastStep, and a recovery code is deleted. Recovery codes
+// only work once two-factor authentication is enabled.
+func (f secondFactor) verify(store Store, t *TwoFactor, now time.Time) (bool, error) {
+	if f.Code != "" {
+		step, ok := verifyTOTP(t.Secret, f.Code, now, t.LastStep)
+		if !ok {
+			return false, nil
+		}
+		t.LastStep = step
+		return true, store.PutTwoFactor(*t)
+	}
+	if f.RecoveryCode != "" && t.enabled() {
+		err := store.UseRecoveryCode(t.UserID, hashRecoveryCode(f.RecoveryCode))
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return false, nil
+}
+
+// withSecondFactor checks f against the user's settings in a transaction
+// and, if it passes, runs fn in the same one. A wrong code counts as a
+// failed login of username from the client's IP, so codes can't be guessed
+// any faster than passwords, and fails with errInvalidCode; while those
+// logins are throttled it fails with a *throttledError. The throttles stay
+// locked from the check until the failure is counted.
+func (s *Server) withSecondFactor(r *http.Request, username string, userID int, f secondFactor, fn func(tx Store, t *TwoFactor) error) error {
+	ip := clientIP(r)
+	invalid := false
+	err := s.store.Tx(func(tx Store) error {
+		retryAt, err := lockLoginRetryAt(tx, username, ip)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if now.Before(retryAt) {
+			return &throttledError{retryAt}
+		}
+		t, err := twoFactor(tx, userID)
+		if err != nil {
+			return err
+		}
+		ok, err := f.verify(tx, &t, now)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			invalid = true
+			return recordLoginFailure(tx, username, ip, now)
+		}
+		return fn(tx, &t)
+	})
+	if err == nil && invalid {
+		return errInvalidCode
+	}
+	return err
+}
+
+// writeTwoFactorError answers the errors two-factor handlers share,
+// reporting whether err was one of them.
+func writeTwoFactorError(w http.ResponseWriter, err error) bool {
+	var throttled *throttledError
+	switch {
+	case errors.As(err, &throttled):
+		writeThrottled(w, throttled.retryAt)
+	case errors.Is(err, errInvalidCode):
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+	case errors.Is(err, errInvalidChallenge):
+		http.Error(w, "Invalid or expired challenge token", http.StatusUnauthorized)
+	case errors.Is(err, errTwoFactorEnabled), errors.Is(err, errTwoFactorOff),
+		errors.Is(err, errNoEnrollment), errors.Is(err, errTwoFactorRequired):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		return false
+	}
+	return true
+}
+
+// ---- Changing the settings ----
+
+// enrollTwoFactor gives t a new secret, to be confirmed with a first code.
+func enrollTwoFactor(tx Store, audit auditSource, username string, t *TwoFactor) (TOTPEnrollment, error) {
+	if t.enabled() {
+		return TOTPEnrollment{}, errTwoFactorEnabled
+	}
+	before := t.state()
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	t.Secret, t.LastStep = secret, 0
+	if err := tx.PutTwoFactor(*t); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if err := audit.record(tx, AuditUpdate, "two_factor", t.UserID, t.UserID, before, t.state()); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	return TOTPEnrollment{Secret: secret, URI: totpURI(username, secret)}, nil
+}
+
+// confirmTwoFactor enables t, whose first code was just verified, and
+// returns its recovery codes.
+func confirmTwoFactor(tx Store, audit auditSource, t *TwoFactor) ([]string, error) {
+	before := t.state()
+	now := time.Now()
+	t.ConfirmedAt = &now
+	if err := tx.PutTwoFactor(*t); err != nil {
+		return nil, err
+	}
+	codes, err := newRecoveryCodes(tx, t.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, audit.record(tx, AuditUpdate, "two_factor", t.UserID, t.UserID, before, t.state())
+}
+
+// resetTwoFactor drops t's secret and recovery codes, leaving Required be.
+func resetTwoFactor(tx Store, audit auditSource, t *TwoFactor) error {
+	before := t.state()
+	t.Secret, t.ConfirmedAt, t.LastStep = "", nil, 0
+	if err := tx.PutTwoFactor(*t); err != nil {
+		return err
+	}
+	if err := tx.SetRecoveryCodes(t.UserID, nil); err != nil {
+		return err
+	}
+	return audit.record(tx, AuditUpdate, "two_factor", t.UserID, t.UserID, before, t.state())
+}
+
+// ---- Logging in ----
+
+// issueLoginChallenge stores a challenge for userID and returns the
+// plaintext token, which is only ever handed to the client.
+func issueLoginChallenge(store Store, userID int) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = store.CreateLoginChallenge(&LoginChallenge{
+		UserID:    userID,
+		Hash:      hashToken(token),
+		ExpiresAt: time.Now().Add(loginChallengeTTL),
+	})
+	if err != nil {
+		return "", fmt.Errorf("storing login challenge: %v", err)
+	}
+	return token, nil
+}
+
+// loginChallenge looks a challenge token up, failing with
+// errInvalidChallenge for unknown and expired ones.
+func loginChallenge(store Store, token string) (LoginChallenge, error) {
+	c, err := store.GetLoginChallenge(hashToken(token))
+	if errors.Is(err, ErrNotFound) || (err == nil && time.Now().After(c.ExpiresAt)) {
+		return c, errInvalidChallenge
+	}
+	return c, err
+}
+
+// challengedUser returns the user a challenge token was issued to.
+func (s *Server) challengedUser(token string) (LoginChallenge, User, error) {
+	c, err := loginChallenge(s.store, token)
+	if err != nil {
+		return c, User{}, err
+	}
+	u, err := s.store.GetUser(c.UserID)
+	if errors.Is(err, ErrNotFound) {
+		err = errInvalidChallenge
+	}
+	return c, u, err
+}
+
+// POST /api/login/2fa => a token pair for { "challenge_token", "code" } (or
+// "recovery_code" instead of "code"), the second step of logging in with
+// two-factor authentication. Wrong codes count as failed logins. Users
+// finishing the enrollment their account requires get their recovery codes
+// as "recovery_codes" too.
+func (s *Server) login2FAHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ChallengeToken string `json:"challenge_token"`
+		secondFactor
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ChallengeToken == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	c, u, err := s.challengedUser(body.ChallengeToken)
+	if err != nil {
+		if !writeTwoFactorError(w, err) {
+			http.Error(w, fmt.Sprintf("Error checking challenge: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+	t, err := twoFactor(s.store, u.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching two-factor settings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if t.Secret == "" {
+		http.Error(w, "Two-factor authentication is required; enroll first with POST /api/login/2fa/enroll", http.StatusConflict)
+		return
+	}
+
+	attempt := LoginAttempt{Username: u.Username, UserID: &u.ID, IP: clientIP(r), UserAgent: r.UserAgent()}
+	var pair tokenPair
+	var codes []string
+	err = s.withSecondFactor(r, u.Username, u.ID, body.secondFactor, func(tx Store, t *TwoFactor) error {
+		// A challenge is exchanged once
+		if err := tx.DeleteLoginChallenge(c.ID); errors.Is(err, ErrNotFound) {
+			return errInvalidChallenge
+		} else if err != nil {
+			return err
+		}
+		if !t.enabled() {
+			var err error
+			if codes, err = confirmTwoFactor(tx, requestAudit(r, u.ID), t); err != nil {
+				return err
+			}
+		}
+		var err error
+		pair, err = finishLogin(tx, &attempt)
+		return err
+	})
+	var throttled *throttledError
+	switch {
+	case errors.Is(err, errInvalidCode):
+		attempt.Reason = LoginInvalidCode
+	case errors.As(err, &throttled):
+		attempt.Reason = LoginThrottled
+	}
+	if attempt.Reason != "" {
+		if err := s.store.RecordLoginAttempt(&attempt); err != nil {
+			http.Error(w, fmt.Sprintf("Error recording login attempt: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err != nil {
+		if !writeTwoFactorError(w, err) {
+			http.Error(w, fmt.Sprintf("Error logging in: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	resp := loginResponse(pair, u)
+	if codes != nil {
+		resp["recovery_codes"] = codes
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// POST /api/login/2fa/enroll => a TOTPEnrollment for { "challenge_token" }
+// of a user whose account requires two-factor authentication they don't
+// have yet. They finish logging in by sending a code of the new secret to
+// POST /api/login/2fa.
+func (s *Server) login2FAEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ChallengeToken string `json:"challenge_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ChallengeToken == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	_, u, err := s.challengedUser(body.ChallengeToken)
+	var enrollment TOTPEnrollment
+	if err == nil {
+		err = s.store.Tx(func(tx Store) error {
+			t, err := twoFactor(tx, u.ID)
+			if err != nil {
+				return err
+			}
+			enrollment, err = enrollTwoFactor(tx, requestAudit(r, u.ID), u.Username, &t)
+			return err
+		})
+	}
+	if err != nil {
+		if !writeTwoFactorError(w, err) {
+			http.Error(w, fmt.Sprintf("Error enrolling: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+// ---- The caller's own settings ----
+
+// writeTwoFactorStatus answers with the user's TwoFactorStatus.
+func (s *Server) writeTwoFactorStatus(w http.ResponseWriter, userID int) {
+	t, err := twoFactor(s.store, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching two-factor settings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	left, err := s.store.CountRecoveryCodes(userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error counting recovery codes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TwoFactorStatus{TwoFactorState: t.state(), RecoveryCodesLeft: left})
+}
+
+// GET /api/2fa => the JWT user's TwoFactorStatus
+func (s *Server) getTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeTwoFactorStatus(w, callerOf(r).ID)
+}
+
+// POST /api/2fa/enroll => a new TOTPEnrollment for the JWT user, replacing
+// one they haven't confirmed yet; 409 while two-factor authentication is on
+func (s *Server) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	me := callerOf(r)
+	var enrollment TOTPEnrollment
+	err := s.store.Tx(func(tx Store) error {
+		t, err := twoFactor(tx, me.ID)
+		if err != nil {
+			return err
+		}
+		enrollment, err = enrollTwoFactor(tx, requestAudit(r, me.ID), me.Username, &t)
+		return err
+	})
+	if err != nil {
+		if !writeTwoFactorError(w, err) {
+			http.Error(w, fmt.Sprintf("Error enrolling: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+// checkedTwoFactorHandler decodes a secondFactor, checks the JWT user's
+// settings with precheck, and runs fn with withSecondFactor.
+func (s *Server) checkedTwoFactorHandler(w http.ResponseWriter, r *http.Request, precheck func(t TwoFactor) error, fn func(tx Store, t *TwoFactor) error) bool {
+	me := callerOf(r)
+	var f secondFactor
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return false
+	}
+	t, err := twoFactor(s.store, me.ID)
+	if err == nil {
+		if err = precheck(t); err == nil {
+			err = s.withSecondFactor(r, me.Username, me.ID, f, fn)
+		}
+	}
+	if err != nil {
+		if !writeTwoFactorError(w, err) {
+			http.Error(w, fmt.Sprintf("Error updating two-factor settings: %v", err), http.StatusInternalServerError)
+		}
+		return false
+	}
+	return true
+}
+
+// POST /api/2fa/confirm => turn two-factor authentication on for the JWT
+// user with { "code" } of the secret they enrolled, returning their
+// recovery codes, which are shown only this once
+func (s *Server) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	audit := requestAudit(r, callerOf(r).ID)
+	var codes []string
+	ok := s.checkedTwoFactorHandler(w, r, func(t TwoFactor) error {
+		switch {
+		case t.enabled():
+			return errTwoFactorEnabled
+		case t.Secret == "":
+			return errNoEnrollment
+		}
+		return nil
+	}, func(tx Store, t *TwoFactor) error {
+		var err error
+		codes, err = confirmTwoFactor(tx, audit, t)
+		return err
+	})
+	if !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// POST /api/2fa/recovery-codes => replace the JWT user's recovery codes,
+// given { "code" } or { "recovery_code" }
+func (s *Server) recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	var codes []string
+	ok := s.checkedTwoFactorHandler(w, r, func(t TwoFactor) error {
+		if !t.enabled() {
+			return errTwoFactorOff
+		}
+		return nil
+	}, func(tx Store, t *TwoFactor) error {
+		var err error
+		codes, err = newRecoveryCodes(tx, t.UserID)
+		return err
+	})
+	if !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// DELETE /api/2fa => turn two-factor authentication off for the JWT user,
+// given { "code" } or { "recovery_code" }; 409 while an admin requires it
+func (s *Server) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	audit := requestAudit(r, callerOf(r).ID)
+	ok := s.checkedTwoFactorHandler(w, r, func(t TwoFactor) error {
+		switch {
+		case !t.enabled():
+			return errTwoFactorOff
+		case t.Required:
+			return errTwoFactorRequired
+		}
+		return nil
+	}, func(tx Store, t *TwoFactor) error {
+		return resetTwoFactor(tx, audit, t)
+	})
+	if !ok {
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// ---- Admin ----
+
+// GET /api/users/{id}/2fa => the user's TwoFactorStatus (users:read)
+func (s *Server) getUserTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	u, status, err := s.userOfPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	s.writeTwoFactorStatus(w, u.ID)
+}
+
+// PUT /api/users/{id}/2fa => { "required": true } makes the user log in
+// with a second factor, enrolling at their next login if they have to
+// (users:write). Meant for admin accounts, though any can be.
+func (s *Server) putUserTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := s.getUserIDFromToken(r)
+	u, status, err := s.userOfPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	var body struct {
+		Required *bool `json:"required"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Required == nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	err = s.store.Tx(func(tx Store) error {
+		t, err := twoFactor(tx, u.ID)
+		if err != nil {
+			return err
+		}
+		before := t.state()
+		t.Required = *body.Required
+		if err := tx.PutTwoFactor(t); err != nil {
+			return err
+		}
+		return requestAudit(r, adminID).record(tx, AuditUpdate, "two_factor", u.ID, u.ID, before, t.state())
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error updating two-factor settings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	s.writeTwoFactorStatus(w, u.ID)
+}
+
+// DELETE /api/users/{id}/2fa => drop the user's secret and recovery codes,
+// say when they lost their device (users:write). If two-factor
+// authentication is required of them, they enroll again at their next login.
+func (s *Server) deleteUserTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := s.getUserIDFromToken(r)
+	u, status, err := s.userOfPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	err = s.store.Tx(func(tx Store) error {
+		t, err := twoFactor(tx, u.ID)
+		if err != nil {
+			return err
+		}
+		return resetTwoFactor(tx, requestAudit(r, adminID), &t)
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error resetting two-factor settings: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication reset"})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 6238 appendix B, cut to six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range tests {
+		if got := totpCode(key, tc.unix/totpPeriod); got != tc.want {
+			t.Fatalf("totpCode at %d = %s, want %s", tc.unix, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		last   int64
+		want   int64
+		ok     bool
+	}{
+		{"the current code", rfc6238Secret, "050471", 0, step, true},
+		{"with spaces", rfc6238Secret, "050 471", 0, step, true},
+		{"the previous step's code", rfc6238Secret, "081804", 0, step - 1, true},
+		{"a code already used", rfc6238Secret, "050471", step, 0, false},
+		{"an older code after a newer one", rfc6238Secret, "081804", step, 0, false},
+		{"a wrong code", rfc6238Secret, "123456", 0, 0, false},
+		{"a code from another time", rfc6238Secret, "287082", 0, 0, false},
+		{"no secret", "", "050471", 0, 0, false},
+		{"an invalid secret", "not base32!", "050471", 0, 0, false},
+	}
+	for _, tc := range tests {
+		got, ok := verifyTOTP(tc.secret, tc.code, now, tc.last)
+		if ok != tc.ok || got != tc.want {
+			t.Fatalf("%s: verifyTOTP = %d, %v; want %d, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	// The next step's code counts too, for clock drift, but not the one after
+	key, _ := totpEncoding.DecodeString(rfc6238Secret)
+	for _, tc := range []struct {
+		step int64
+		ok   bool
+	}{{step + totpSkew, true}, {step + totpSkew + 1, false}, {step - totpSkew - 1, false}} {
+		if _, ok := verifyTOTP(rfc6238Secret, totpCode(key, tc.step), now, 0); ok != tc.ok {
+			t.Fatalf("verifyTOTP of step %+d = %v, want %v", tc.step-step, ok, tc.ok)
+		}
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := hashRecoveryCode("abcde-fghij")
+	tests := []struct {
+		code string
+		same bool
+	}{
+		{"abcde-fghij", true},
+		{"ABCDE-FGHIJ", true},
+		{"abcdefghij", true},
+		{" abcde fghij ", true},
+		{"abcde-fghik", false},
+		{"abcde", false},
+	}
+	for _, tc := range tests {
+		if got := hashRecoveryCode(tc.code) == want; got != tc.same {
+			t.Fatalf("hashRecoveryCode(%q) matches abcde-fghij = %v, want %v", tc.code, got, tc.same)
+		}
+	}
+}
+
+func TestTwoFactorState(t *testing.T) {
+	confirmed := time.Now()
+	tests := []struct {
+		t    TwoFactor
+		want TwoFactorState
+	}{
+		{TwoFactor{}, TwoFactorState{}},
+		{TwoFactor{Required: true}, TwoFactorState{Required: true}},
+		{TwoFactor{Secret: rfc6238Secret}, TwoFactorState{Pending: true}},
+		{TwoFactor{Secret: rfc6238Secret, ConfirmedAt: &confirmed}, TwoFactorState{Enabled: true}},
+	}
+	for _, tc := range tests {
+		if got := tc.t.state(); got != tc.want {
+			t.Fatalf("state of %+v = %+v, want %+v", tc.t, got, tc.want)
+		}
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	got := totpURI("alice smith", "JBSWY3DPEHPK3PXP")
+	want := "otpauth://totp/" + totpIssuer + ":alice%20smith?algorithm=SHA1&digits=6&issuer=" + totpIssuer + "&period=30&secret=JBSWY3DPEHPK3PXP"
+	if got != want {
+		t.Fatalf("totpURI = %s, want %s", got, want)
+	}
+}
+
+func TestTwoFactorStore(t *testing.T) {
+	eachStore(t, testTwoFactor)
+}
+
+func TestConcurrentSecondFactorFailures(t *testing.T) {
+	eachStore(t, testConcurrentSecondFactorFailures)
+}
+
+// testConcurrentSecondFactorFailures checks that wrong codes sent at once
+// are throttled like wrong passwords are.
+func testConcurrentSecondFactorFailures(t *testing.T, s Store) {
+	at := newAPITest(t, s)
+	u := at.alice
+	defer s.ClearLoginThrottle(userLoginKey(u.Username))
+	defer s.ClearLoginThrottle(ipLoginKey("127.0.0.1"))
+	confirmed := time.Now()
+	if err := s.PutTwoFactor(TwoFactor{UserID: u.ID, Secret: "JBSWY3DPEHPK3PXP", ConfirmedAt: &confirmed}); err != nil {
+		t.Fatal(err)
+	}
+
+	var challenge struct {
+		ChallengeToken string `json:"challenge_token"`
+	}
+	c := at.client()
+	if err := c.expectStatus(http.StatusOK, "POST", "/api/login", map[string]string{"username": u.Username, "password": "pw"}, &challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := userLoginLimit.LockoutAt * 2
+	statuses := make([]int, attempts)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := map[string]string{"challenge_token": challenge.ChallengeToken, "code": "not a code"}
+			statuses[i], _ = c.call("POST", "/api/login/2fa", body, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	counts := map[int]int{}
+	for _, status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusUnauthorized] != userLoginLimit.BackoffAfter || counts[http.StatusTooManyRequests] != attempts-userLoginLimit.BackoffAfter {
+		t.Fatalf("%d concurrent wrong codes got statuses %v; want %d 401s, the rest 429s",
+			attempts, counts, userLoginLimit.BackoffAfter)
+	}
+}
+
+func testTwoFactor(t *testing.T, s Store) {
+	// RFC 6238's SHA-1 test vector at T=59s, cut to six digits
+	if code := totpCode([]byte("12345678901234567890"), 59/totpPeriod); code != "287082" {
+		t.Fatalf("totpCode = %s, want 287082", code)
+	}
+
+	u, cleanup := testUser(t, s, "secret")
+	defer cleanup()
+
+	if _, err := s.GetTwoFactor(u.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetTwoFactor before any settings: got %v, want ErrNotFound", err)
+	}
+	if err := s.PutTwoFactor(TwoFactor{UserID: -1}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("PutTwoFactor of a missing user: got %v, want ErrNotFound", err)
+	}
+	confirmed := time.Now().Truncate(time.Second)
+	tf := TwoFactor{UserID: u.ID, Secret: "JBSWY3DPEHPK3PXP", ConfirmedAt: &confirmed, LastStep: 42}
+	for _, required := range []bool{false, true} {
+		tf.Required = required
+		if err := s.PutTwoFactor(tf); err != nil {
+			t.Fatalf("PutTwoFactor: %v", err)
+		}
+		got, err := s.GetTwoFactor(u.ID)
+		if err != nil || got.Required != required || got.Secret != tf.Secret || got.LastStep != 42 ||
+			got.ConfirmedAt == nil || !got.ConfirmedAt.Equal(confirmed) {
+			t.Fatalf("GetTwoFactor = %+v, %v; want %+v", got, err, tf)
+		}
+	}
+
+	hashes := []string{hashRecoveryCode("aaaaa-aaaaa"), hashRecoveryCode("bbbbb-bbbbb"), hashRecoveryCode("ccccc-ccccc")}
+	if err := s.SetRecoveryCodes(u.ID, hashes); err != nil {
+		t.Fatalf("SetRecoveryCodes: %v", err)
+	}
+	if err := s.UseRecoveryCode(u.ID, hashRecoveryCode("BBBBB BBBBB")); err != nil {
+		t.Fatalf("UseRecoveryCode: %v", err)
+	}
+	if err := s.UseRecoveryCode(u.ID, hashes[1]); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("using a recovery code twice: got %v, want ErrNotFound", err)
+	}
+	if n, err := s.CountRecoveryCodes(u.ID); err != nil || n != 2 {
+		t.Fatalf("CountRecoveryCodes = %d, %v; want 2", n, err)
+	}
+	if err := s.SetRecoveryCodes(u.ID, nil); err != nil {
+		t.Fatalf("SetRecoveryCodes(nil): %v", err)
+	}
+	if n, err := s.CountRecoveryCodes(u.ID); err != nil || n != 0 {
+		t.Fatalf("CountRecoveryCodes after clearing = %d, %v; want 0", n, err)
+	}
+
+	hash := hashToken("challenge-" + u.Username)
+	c := LoginChallenge{UserID: u.ID, Hash: hash, ExpiresAt: time.Now().Add(time.Minute)}
+	expired := LoginChallenge{UserID: u.ID, Hash: hashToken("expired-" + u.Username), ExpiresAt: time.Now().Add(-time.Minute)}
+	for _, lc := range []*LoginChallenge{&c, &expired} {
+		if err := s.CreateLoginChallenge(lc); err != nil {
+			t.Fatalf("CreateLoginChallenge: %v", err)
+		}
+	}
+	if got, err := s.GetLoginChallenge(hash); err != nil || got.ID != c.ID || got.UserID != u.ID || !got.ExpiresAt.After(time.Now()) {
+		t.Fatalf("GetLoginChallenge = %+v, %v", got, err)
+	}
+	if err := s.DeleteLoginChallenge(c.ID); err != nil {
+		t.Fatalf("DeleteLoginChallenge: %v", err)
+	}
+	if err := s.DeleteLoginChallenge(c.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleting a login challenge twice: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetLoginChallenge(expired.Hash); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expired login challenge: got %v, want it forgotten", err)
+	}
+
+	// Deleting the user deletes their settings
+	if err := s.SetRecoveryCodes(u.ID, hashes); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if _, err := s.GetTwoFactor(u.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetTwoFactor of a deleted user: got %v, want ErrNotFound", err)
+	}
+	if n, err := s.CountRecoveryCodes(u.ID); err != nil || n != 0 {
+		t.Fatalf("CountRecoveryCodes of a deleted user = %d, %v; want 0", n, err)
+	}
+}
@@ -237,12 +237,12 @@ function BudgetsPage({ token }) {
   useEffect(() => {
     const fetchBudgets = async () => {
       try {
-        const response = await fetch('http://localhost:8080/api/budgets', {
+        const response = await fetch('http://localhost:8080/api/budgets?limit=500', {
           headers: { 'Authorization': `Bearer ${token}` },
         });
         if (response.ok) {
           const data = await response.json();
-          setBudgets(data || []);
+          setBudgets((data && data.items) || []);
         } else {
           setError('Failed to fetch budgets');
         }
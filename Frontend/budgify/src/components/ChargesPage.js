@@ -7,12 +7,12 @@ function ChargesPage({ token }) {
   useEffect(() => {
     const fetchCharges = async () => {
       try {
-        const response = await fetch('http://localhost:8080/api/charges', {
+        const response = await fetch('http://localhost:8080/api/charges?limit=500', {
           headers: { 'Authorization': `Bearer ${token}` },
         });
         if (response.ok) {
           const data = await response.json();
-          setCharges(data);
+          setCharges(data.items || []);
         } else {
           setError('Failed to fetch charges');
         }